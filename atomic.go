@@ -0,0 +1,106 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+// GetOrMap returns the Go value mapped by key, if any, and otherwise maps key
+// to goValue and returns it, under a single acquisition of the lock; loaded
+// reports whether the value was already mapped.  It mirrors
+// sync.Map.LoadOrStore, so that concurrent callbacks racing to map the same
+// C pointer agree on one value, rather than replacing each other's.  It
+// panics under the same conditions as MapPair.
+func (mapper *Mapper) GetOrMap(key Key, goValue interface{}) (actual interface{}, loaded bool) {
+	mapper.checkPair(key)
+	cur, loaded := mapper.load(key)
+	if loaded {
+		return cur.goValue(), true
+	}
+
+	if err := mapper.admit(nil); err != nil {
+		panic(err)
+	}
+	e := entry{value: mapper.stored(goValue)}
+	mapper.sized(&e)
+	mapper.mux.Lock()
+	if cur, loaded = mapper.loadLocked(key); !loaded {
+		mapper.mapLocked(key, e)
+	}
+	mapper.mux.Unlock()
+	if loaded {
+		mapper.refund(nil)
+		return cur.goValue(), true
+	}
+	mapper.checkRetained()
+	return e.goValue(), false
+}
+
+// Swap maps key to goValue, returning the Go value it replaces, if any, under
+// a single acquisition of the lock, so that the state of a C object can be
+// replaced, as when reconfiguring a stream, without a window in which it is
+// unmapped.  As for MapPair, the functions registered by OnDelete for the
+// replaced mapping run before Swap returns, and Swap panics under the same
+// conditions.
+func (mapper *Mapper) Swap(key Key, goValue interface{}) (old interface{}, existed bool) {
+	mapper.checkPair(key)
+	if err := mapper.admit(nil); err != nil {
+		panic(err)
+	}
+	prev, existed := mapper.mapEntry(key, entry{value: mapper.stored(goValue)})
+	if !existed {
+		return nil, false
+	}
+	return prev.goValue(), true
+}
+
+// CompareAndSwap maps key to newValue if it is mapped to a Go value equal to
+// old, replacing the mapping as Swap does, and reports whether it did, under
+// a single acquisition of the lock.  State machines driven by C callbacks can
+// then update their state only if it has not changed since it was read.  As
+// for sync.Map.CompareAndSwap, old must be of a comparable type.  As it only
+// replaces a mapping, it is not limited by a RateLimit.
+func (mapper *Mapper) CompareAndSwap(key Key, old, newValue interface{}) bool {
+	mapper.checkPair(key)
+	cur, ok := mapper.load(key)
+	if !ok || cur.goValue() != old {
+		return false
+	}
+
+	e := entry{value: mapper.stored(newValue)}
+	mapper.sized(&e)
+	mapper.mux.Lock()
+	// The key may have been deleted, or mapped again, meanwhile.
+	if cur, ok = mapper.loadLocked(key); ok && cur.goValue() == old {
+		cur, ok = mapper.mapLocked(key, e)
+	} else {
+		ok = false
+	}
+	mapper.mux.Unlock()
+	if ok {
+		cur.close()
+		mapper.checkRetained()
+	}
+	return ok
+}
+
+// CompareAndDelete deletes the mapping of key if it is mapped to a Go value
+// equal to old, and reports whether it did, under a single acquisition of
+// the lock.  Teardown code can then delete only the mapping it believes is
+// live, and not one made by a racing registration of the same key.  As for
+// sync.Map.CompareAndDelete, old must be of a comparable type.
+func (mapper *Mapper) CompareAndDelete(key Key, old interface{}) bool {
+	key = mapper.canonical(key)
+	mapper.mux.Lock()
+	e, ok := mapper.loadLocked(key)
+	if ok && e.goValue() == old {
+		e, ok = mapper.deleteLocked(key)
+	} else {
+		ok = false
+	}
+	mapper.mux.Unlock()
+	if ok {
+		mapper.checkOwner(key, e)
+		e.close()
+	}
+	return ok
+}
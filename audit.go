@@ -0,0 +1,104 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "time"
+
+// maxAudit limits the operations remembered by the audit ring.
+const maxAudit = 256
+
+// AuditOp is the kind of operation recorded by the audit ring; see Audit.
+type AuditOp int
+
+const (
+	// AuditMapped records that a key was mapped.
+	AuditMapped AuditOp = iota + 1
+
+	// AuditReplaced records that the mapping of a key was replaced.
+	AuditReplaced
+
+	// AuditDeleted records that the mapping of a key was deleted.
+	AuditDeleted
+
+	// AuditCleared records that the Mapper was cleared.
+	AuditCleared
+)
+
+// String returns the name of the operation.
+func (op AuditOp) String() string {
+	switch op {
+	case AuditMapped:
+		return "mapped"
+	case AuditReplaced:
+		return "replaced"
+	case AuditDeleted:
+		return "deleted"
+	case AuditCleared:
+		return "cleared"
+	}
+	return "unknown"
+}
+
+// AuditRecord is an operation on a Mapper recorded by the audit ring.
+type AuditRecord struct {
+	Op AuditOp
+
+	// Key is the key mapped or deleted, and Type the type of its value, as
+	// formatted by the %T verb.  Both are zero for AuditCleared.
+	Key  Key
+	Type string
+
+	// Time is when the operation was made, by the goroutine Goroutine.
+	Time      time.Time
+	Goroutine uint64
+}
+
+// auditRing holds the most recent operations on a Mapper, in debug mode.
+type auditRing struct {
+	records []AuditRecord
+
+	// next is the index in records of the next record, once it is full.
+	next int
+}
+
+// Audit returns the most recent map and delete operations on the mapper,
+// oldest first, as recorded in debug mode by the audit ring.  It lets the
+// history of a key be reconstructed after the fact, such as when a C
+// callback finds its handle unmapped.  It returns nil when the audit ring is
+// not enabled.
+func (mapper *Mapper) Audit() []AuditRecord {
+	mapper.mux.RLock()
+	defer mapper.mux.RUnlock()
+	r := mapper.auditLog
+	if r == nil {
+		return nil
+	}
+	records := make([]AuditRecord, 0, len(r.records))
+	records = append(records, r.records[r.next:]...)
+	return append(records, r.records[:r.next]...)
+}
+
+// audit records an operation on the mapping of key to e in the audit ring,
+// in debug mode.  The caller must hold the write lock.
+func (mapper *Mapper) audit(op AuditOp, key Key, e entry) {
+	if !debug.has(debugAudit) {
+		return
+	}
+	rec := AuditRecord{Op: op, Time: time.Now(), Goroutine: goid()}
+	if op != AuditCleared {
+		rec.Key, rec.Type = key, typeName(e.valueType())
+	}
+	r := mapper.auditLog
+	if r == nil {
+		r = &auditRing{}
+		mapper.auditLog = r
+	}
+	if len(r.records) < maxAudit {
+		r.records = append(r.records, rec)
+		return
+	}
+	r.records[r.next] = rec
+	r.next = (r.next + 1) % maxAudit
+}
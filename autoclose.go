@@ -0,0 +1,110 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"io"
+	"log"
+	"reflect"
+)
+
+// WithAutoClose tears down each mapped value once its mapping is deleted,
+// cleared, or replaced by another value, so that deleting a handle cannot
+// leak the resource it wraps.  teardown is called without any Mapper lock
+// held, after the functions registered by OnDelete; if nil, values that
+// implement io.Closer are closed.  Errors returned by teardown are passed to
+// onError, or logged using the log package if onError is nil.
+func WithAutoClose(teardown func(goValue interface{}) error, onError func(key Key, err error)) Option {
+	if teardown == nil {
+		teardown = closeValue
+	}
+	if onError == nil {
+		onError = func(key Key, err error) {
+			log.Printf("mapper: closing key 0x%x: %v", key.v, err)
+		}
+	}
+	return func(mapper *Mapper) {
+		mapper.teardown = teardown
+		mapper.teardownError = onError
+	}
+}
+
+// MapValueWithFinalizer is like MapValue, but calls finalize with the mapped
+// value once the mapping is removed: by Delete, Clear, Close, DeleteAfter, or
+// mapping the key again.  finalize is called once, without any Mapper lock
+// held, after the functions registered by OnDelete, and in place of the
+// teardown of WithAutoClose.  Keeping the teardown of a value with its
+// mapping means that every deletion path cleans up, not just those that
+// remember to.
+func (mapper *Mapper) MapValueWithFinalizer(goValue interface{}, finalize func(goValue interface{})) Key {
+	e := entry{value: mapper.stored(goValue)}
+	if finalize != nil {
+		c := &closer{finalize: finalize}
+		e.writableExtra().closer = c
+		e.release = c.release(e)
+	}
+	key, err := mapper.mapCounting(e)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// closeValue closes goValue if it is an io.Closer.
+func closeValue(goValue interface{}) error {
+	if c, ok := goValue.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// closer tears down the value of an entry once it is removed: using the
+// teardown of the Mapper mapping it by key, unless key has since been mapped
+// to the same value, or using finalize, if set.  Txn.Move points the closer
+// at the Mapper and key that the entry moves to.
+type closer struct {
+	mapper   *Mapper
+	key      Key
+	finalize func(goValue interface{})
+}
+
+// autoClose sets the release function of the entry e, mapped by key, to tear
+// down its value.
+func (mapper *Mapper) autoClose(key Key, e *entry) {
+	c := &closer{mapper: mapper, key: key}
+	e.writableExtra().closer = c
+	e.release = c.release(*e)
+}
+
+// release returns a release function for the entry e that closes its value.
+func (c *closer) release(e entry) func() {
+	return func() {
+		c.close(e.goValue())
+	}
+}
+
+func (c *closer) close(goValue interface{}) {
+	if c.finalize != nil {
+		c.finalize(goValue)
+		return
+	}
+	mapper := c.mapper
+	if mapper.teardown == nil {
+		return
+	}
+	cur, ok := mapper.load(c.key)
+	if ok && sameValue(cur.goValue(), goValue) {
+		return
+	}
+	if err := mapper.teardown(goValue); err != nil {
+		mapper.teardownError(c.key, err)
+	}
+}
+
+// sameValue reports whether a and b are the same comparable value.
+func sameValue(a, b interface{}) bool {
+	typ := reflect.TypeOf(a)
+	return typ != nil && typ == reflect.TypeOf(b) && typ.Comparable() && a == b
+}
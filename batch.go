@@ -0,0 +1,117 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// MapPtrPairs is like MapPtrPair, but maps each of the cgo pointers ptrs[i]
+// to values[i] under a single lock, returning their keys.  This suits C calls
+// that return arrays of objects, such as device lists, each of which needs a
+// Go wrapper at once.  It panics, without mapping anything, if the slices
+// differ in length, or if any pointer cannot be mapped by MapPtrPair.
+func (mapper *Mapper) MapPtrPairs(ptrs []unsafe.Pointer, values []interface{}) []Key {
+	if len(ptrs) != len(values) {
+		panic(fmt.Errorf("got %d pointers and %d values", len(ptrs), len(values)))
+	}
+	keys := make([]Key, len(ptrs))
+	for i, ptr := range ptrs {
+		keys[i] = mapper.ptrKey(ptr)
+	}
+	mapper.mapAll(keys, values)
+	return keys
+}
+
+// MapAll is like MapPair, but maps each of keys[i] to values[i] under a
+// single lock.  Wrapping a C object that registers dozens of callbacks then
+// pays for one lock acquisition, not one per callback.  It panics, without
+// mapping anything, if the slices differ in length, or if any key cannot be
+// mapped by MapPair.
+func (mapper *Mapper) MapAll(keys []Key, values []interface{}) {
+	if len(keys) != len(values) {
+		panic(fmt.Errorf("got %d keys and %d values", len(keys), len(values)))
+	}
+	mapper.mapAll(keys, values)
+}
+
+// mapAll implements MapAll for slices of equal length.
+func (mapper *Mapper) mapAll(keys []Key, values []interface{}) {
+	entries := make([]entry, len(keys))
+	for i, key := range keys {
+		mapper.checkPair(key)
+		entries[i].value = mapper.stored(values[i])
+		mapper.sized(&entries[i])
+	}
+	if err := mapper.admitN(len(keys)); err != nil {
+		panic(err)
+	}
+
+	var closing []entry
+	mapper.mux.Lock()
+	for i, key := range keys {
+		if old, replaced := mapper.mapLocked(key, entries[i]); replaced && old.release != nil {
+			closing = append(closing, old)
+		}
+	}
+	mapper.mux.Unlock()
+
+	for _, e := range closing {
+		e.close()
+	}
+	mapper.checkRetained()
+}
+
+// GetAll is like Get, but returns the values mapped by keys, looking them up
+// under a single lock.  As for Get, it panics if any key is not mapped, and
+// the function set by OnMiss does not supply its value.
+func (mapper *Mapper) GetAll(keys []Key) []interface{} {
+	values := make([]interface{}, len(keys))
+	entries := make([]entry, len(keys))
+	found := make([]bool, len(keys))
+	mapper.mux.RLock()
+	for i, key := range keys {
+		entries[i], found[i] = mapper.loadLocked(mapper.canonical(key))
+	}
+	mapper.mux.RUnlock()
+
+	for i, key := range keys {
+		e := entries[i]
+		if found[i] && e.uses != nil {
+			found[i] = mapper.use(mapper.canonical(key), e)
+		}
+		if !found[i] {
+			// Get reports the miss, or consults OnMiss.
+			values[i] = mapper.Get(key)
+			continue
+		}
+		if debug.has(debugStacks) {
+			e.diag().got()
+		}
+		values[i] = e.goValue()
+	}
+	return values
+}
+
+// DeleteAll is like Delete, but deletes the mappings of keys under a single
+// lock.  Keys that are not mapped are ignored.  Functions registered by
+// OnDelete are called in the order of keys, without any Mapper lock held.
+func (mapper *Mapper) DeleteAll(keys []Key) {
+	var deleted []mapping
+	mapper.mux.Lock()
+	for _, key := range keys {
+		key = mapper.canonical(key)
+		if e, ok := mapper.deleteLocked(key); ok {
+			deleted = append(deleted, mapping{key, e})
+		}
+	}
+	mapper.mux.Unlock()
+
+	for _, m := range deleted {
+		mapper.checkOwner(m.key, m.e)
+		m.e.close()
+	}
+}
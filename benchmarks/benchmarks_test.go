@@ -0,0 +1,188 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package benchmarks
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime/cgo"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.jpap.org/mapper"
+)
+
+// store is the common interface of the implementations under test.
+type store interface {
+	Map(v interface{}) uintptr
+	Get(h uintptr) interface{}
+	Delete(h uintptr)
+}
+
+type mapperStore struct{ m *mapper.Mapper }
+
+func (s mapperStore) Map(v interface{}) uintptr { return s.m.MapValue(v).Handle() }
+func (s mapperStore) Get(h uintptr) interface{} { return s.m.GetHandle(h) }
+func (s mapperStore) Delete(h uintptr)          { s.m.DeleteHandle(h) }
+
+type cgoHandleStore struct{}
+
+func (cgoHandleStore) Map(v interface{}) uintptr { return uintptr(cgo.NewHandle(v)) }
+func (cgoHandleStore) Get(h uintptr) interface{} { return cgo.Handle(h).Value() }
+func (cgoHandleStore) Delete(h uintptr)          { cgo.Handle(h).Delete() }
+
+type syncMapStore struct {
+	m    sync.Map
+	next uintptr
+}
+
+func (s *syncMapStore) Map(v interface{}) uintptr {
+	h := atomic.AddUintptr(&s.next, 1)
+	s.m.Store(h, v)
+	return h
+}
+
+func (s *syncMapStore) Get(h uintptr) interface{} {
+	v, _ := s.m.Load(h)
+	return v
+}
+
+func (s *syncMapStore) Delete(h uintptr) { s.m.Delete(h) }
+
+var stores = []struct {
+	name string
+	new  func() store
+}{
+	{"Mapper", func() store { return mapperStore{mapper.New()} }},
+	{"MapperPartitioned", func() store { return mapperStore{mapper.New(mapper.WithTypePartitions())} }},
+	{"MapperCompact", func() store { return mapperStore{mapper.New(mapper.WithCompactHandles())} }},
+	{"MapperSharded", func() store { return mapperStore{mapper.New(mapper.WithShards(16))} }},
+	{"MapperReadMostly", func() store { return mapperStore{mapper.New(mapper.WithReadMostly())} }},
+	{"MapperCopyOnWrite", func() store { return mapperStore{mapper.New(mapper.WithCopyOnWrite())} }},
+	{"MapperSlotTable", func() store { return mapperStore{mapper.New(mapper.WithSlotTable())} }},
+	{"CgoHandle", func() store { return cgoHandleStore{} }},
+	{"SyncMap", func() store { return &syncMapStore{} }},
+}
+
+// liveKeys is the number of mappings held while benchmarking lookups; it is
+// within the limit of WithCompactHandles.
+const liveKeys = 1024
+
+// populate maps liveKeys values in s, returning their handles, and a function
+// that deletes them.
+func populate(s store) ([]uintptr, func()) {
+	handles := make([]uintptr, liveKeys)
+	for i := range handles {
+		handles[i] = s.Map(i)
+	}
+	return handles, func() {
+		for _, h := range handles {
+			s.Delete(h)
+		}
+	}
+}
+
+func BenchmarkMapDelete(b *testing.B) {
+	for _, st := range stores {
+		b.Run(st.name, func(b *testing.B) {
+			s := st.new()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s.Delete(s.Map(1))
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, st := range stores {
+		b.Run(st.name, func(b *testing.B) {
+			s := st.new()
+			handles, cleanup := populate(s)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Intn(len(handles))
+				for pb.Next() {
+					s.Get(handles[i%len(handles)])
+					i++
+				}
+			})
+			b.StopTimer()
+			cleanup()
+		})
+	}
+}
+
+// BenchmarkMixed performs lookups, and pairs of map and delete operations,
+// in the given proportion, over a live set of liveKeys mappings.
+func BenchmarkMixed(b *testing.B) {
+	for _, reads := range []int{50, 90, 99} {
+		for _, st := range stores {
+			b.Run(fmt.Sprintf("reads=%d%%/%s", reads, st.name), func(b *testing.B) {
+				benchmarkMixed(b, st.new(), reads)
+			})
+		}
+	}
+}
+
+func benchmarkMixed(b *testing.B, s store, reads int) {
+	handles, cleanup := populate(s)
+	defer cleanup()
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		var local []time.Duration
+		for pb.Next() {
+			start := time.Now()
+			if r.Intn(100) < reads {
+				s.Get(handles[r.Intn(len(handles))])
+			} else {
+				s.Delete(s.Map(1))
+			}
+			local = append(local, time.Since(start))
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if n := len(latencies); n > 0 {
+		b.ReportMetric(float64(latencies[n/2].Nanoseconds()), "p50-ns")
+		b.ReportMetric(float64(latencies[n*99/100].Nanoseconds()), "p99-ns")
+	}
+}
+
+// sample is a small struct, as might be mapped for each buffer of audio.
+type sample struct{ left, right int16 }
+
+// BenchmarkMapDeleteStruct compares boxed storage with MapperOf for a small
+// struct.
+func BenchmarkMapDeleteStruct(b *testing.B) {
+	b.Run("Mapper", func(b *testing.B) {
+		m := mapper.New()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m.Delete(m.MapValue(sample{int16(i), 0}))
+		}
+	})
+	b.Run("MapperOf", func(b *testing.B) {
+		var m mapper.MapperOf[sample]
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m.Delete(m.MapValue(sample{int16(i), 0}))
+		}
+	})
+}
@@ -0,0 +1,14 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package benchmarks compares the throughput and latency of mapper.Mapper
+// configurations with runtime/cgo.Handle and a sync.Map, across read/write
+// mixes.  It contains only benchmarks:
+//
+//	go test -run=NONE -bench=. -cpu=1,4,16 go.jpap.org/mapper/benchmarks
+//
+// The -cpu flag sets the number of goroutines used by the parallel
+// benchmarks.  The Mixed benchmarks also report the 50th and 99th percentile
+// latency of a single operation.
+package benchmarks // go.jpap.org/mapper/benchmarks
@@ -0,0 +1,105 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Borrow is like Get, but defers the teardown of the mapping until release
+// is called.  Delete, Clear, or mapping the key again still removes the
+// mapping at once, so that later retrievals miss, but the functions
+// registered by OnDelete, the teardown of WithAutoClose, and the destroy
+// function of ClearFunc only run once every borrow of the mapping is
+// released.  A C callback can borrow the value it uses, so that a
+// concurrent Delete cannot tear down the value while the callback runs.
+//
+// Borrow panics if key is not mapped.  release must be called once the value
+// is no longer used; calling it again has no effect.
+func (mapper *Mapper) Borrow(key Key) (goValue interface{}, release func()) {
+	key = mapper.canonical(key)
+	mapper.mux.RLock()
+	e, ok := mapper.loadLocked(key)
+	if ok && e.borrow() != nil {
+		e.borrow().acquire()
+	}
+	mapper.mux.RUnlock()
+	if ok && e.borrow() == nil {
+		// The entry is borrowed for the first time.
+		mapper.mux.Lock()
+		e, ok = mapper.loadLocked(key)
+		if ok {
+			if e.borrow() == nil {
+				e.writableExtra().borrow = new(borrow)
+				mapper.m.store(key, e)
+			}
+			e.borrow().acquire()
+		}
+		mapper.mux.Unlock()
+	}
+	if !ok {
+		panic(mapper.missError(key))
+	}
+	if debug.has(debugStacks) {
+		e.diag().got()
+	}
+	return e.goValue(), e.borrow().releaser()
+}
+
+// borrow counts the borrows of an entry.
+type borrow struct {
+	mux sync.Mutex
+	n   int
+
+	// pending are run once the last borrow is released.
+	pending []func()
+}
+
+// acquire borrows the entry.
+func (b *borrow) acquire() {
+	b.mux.Lock()
+	b.n++
+	b.mux.Unlock()
+}
+
+// releaser returns a function releasing a borrow once.
+func (b *borrow) releaser() func() {
+	var released int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&released, 0, 1) {
+			b.release()
+		}
+	}
+}
+
+// release releases a borrow, running the pending functions if it is the last.
+func (b *borrow) release() {
+	b.mux.Lock()
+	b.n--
+	var pending []func()
+	if b.n == 0 {
+		pending, b.pending = b.pending, nil
+	}
+	b.mux.Unlock()
+	for _, fn := range pending {
+		fn()
+	}
+}
+
+// after calls fn once the entry, which has been removed, is not borrowed: at
+// once if it is not, or on the release of its last borrow.  b may be nil.
+func (b *borrow) after(fn func()) {
+	if b != nil {
+		b.mux.Lock()
+		if b.n > 0 {
+			b.pending = append(b.pending, fn)
+			b.mux.Unlock()
+			return
+		}
+		b.mux.Unlock()
+	}
+	fn()
+}
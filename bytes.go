@@ -0,0 +1,31 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "unsafe"
+
+// MapBytes maps the byte slice b to a new Key, and returns a pointer to its
+// contents that C may retain, for example, for an asynchronous write, until
+// the mapping is deleted.  Get on the returned key returns b.
+//
+// When built with Go 1.21 or later, b is pinned in place using a
+// runtime.Pinner, and is unpinned when the mapping is deleted or cleared.
+// Otherwise, the contents of b are copied into C memory obtained from malloc,
+// or into Go memory when built without cgo, which is freed when the mapping is
+// deleted or cleared; writes by C into the copy are not reflected in b.
+// BytesPinned reports which is in effect.
+//
+// The returned pointer is nil if b is empty.
+func (mapper *Mapper) MapBytes(b []byte) (ptr unsafe.Pointer, key Key) {
+	ptr, release := bytesPtr(b)
+	key, err := mapper.mapCounting(entry{value: b, release: release})
+	if err != nil {
+		if release != nil {
+			release()
+		}
+		panic(err)
+	}
+	return ptr, key
+}
@@ -0,0 +1,26 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.21 && cgo
+// +build !go1.21,cgo
+
+package mapper
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import "unsafe"
+
+// BytesPinned reports whether MapBytes pins byte slices in place, rather than
+// copying them into C memory.
+const BytesPinned = false
+
+func bytesPtr(b []byte) (ptr unsafe.Pointer, release func()) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	ptr = C.CBytes(b)
+	return ptr, func() { C.free(ptr) }
+}
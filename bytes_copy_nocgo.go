@@ -0,0 +1,25 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.21 && !cgo
+// +build !go1.21,!cgo
+
+package mapper
+
+import "unsafe"
+
+// BytesPinned reports whether MapBytes pins byte slices in place, rather than
+// copying them into C memory.
+const BytesPinned = false
+
+// Without cgo, there is no C to retain the pointer, and the copy is made in Go
+// memory, kept alive by release.
+func bytesPtr(b []byte) (ptr unsafe.Pointer, release func()) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return unsafe.Pointer(&c[0]), func() { c = nil }
+}
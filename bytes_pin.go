@@ -0,0 +1,26 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package mapper
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// BytesPinned reports whether MapBytes pins byte slices in place, rather than
+// copying them into C memory.
+const BytesPinned = true
+
+func bytesPtr(b []byte) (ptr unsafe.Pointer, release func()) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var pinner runtime.Pinner
+	pinner.Pin(&b[0])
+	return unsafe.Pointer(&b[0]), pinner.Unpin
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cancel provides cancellation tokens that C code can poll for
+// cooperative cancellation.
+//
+// A Token is mapped in the Mapper Target, by default the global mapper.G, and
+// is cancelled when its context is done.  C code polls it by passing its
+// handle to mapper_token_cancelled, declared in cancel.h in this package's
+// directory:
+//
+//	tok := cancel.NewToken(ctx)
+//	defer tok.Close()
+//	C.long_operation(C.uintptr_t(tok.Handle()))
+package cancel // go.jpap.org/mapper/cancel
+
+/*
+#include "cancel.h"
+*/
+import "C"
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/internal/bridge"
+)
+
+// Target is the Mapper in which new Tokens are mapped.  mapper_token_cancelled
+// retrieves each Token from the Mapper it was mapped in, even once Target is
+// changed.  Target is not safe to change concurrently with NewToken.
+var Target = &mapper.G
+
+// Token is a mapped cancellation flag.
+type Token struct {
+	m         *mapper.Mapper
+	key       mapper.Key
+	cancelled uint32 // atomic
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewToken returns a new Token, mapped in Target, that is cancelled once ctx
+// is done.
+func NewToken(ctx context.Context) *Token {
+	tok := &Token{m: Target, closed: make(chan struct{})}
+	tok.key = bridge.Map(tok.m, tok)
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				tok.Cancel()
+			case <-tok.closed:
+			}
+		}()
+	}
+	return tok
+}
+
+// Handle returns the handle to pass to C.
+func (tok *Token) Handle() uintptr {
+	return tok.key.Handle()
+}
+
+// Cancel cancels the token, regardless of its context.
+func (tok *Token) Cancel() {
+	atomic.StoreUint32(&tok.cancelled, 1)
+}
+
+// Cancelled reports whether the token has been cancelled.
+func (tok *Token) Cancelled() bool {
+	return atomic.LoadUint32(&tok.cancelled) != 0
+}
+
+// Close cancels the token, and deletes its mapping.  Polls by C made with its
+// handle thereafter report that it is cancelled.
+func (tok *Token) Close() error {
+	tok.closeOnce.Do(func() {
+		tok.Cancel()
+		bridge.Delete(tok.m, tok.key)
+		close(tok.closed)
+	})
+	return nil
+}
+
+//export mapper_token_cancelled
+func mapper_token_cancelled(handle C.uintptr_t) C.int {
+	v, ok := bridge.Lookup(uintptr(handle))
+	if !ok || v.(*Token).Cancelled() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,14 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#ifndef GO_JPAP_ORG_MAPPER_CANCEL_H
+#define GO_JPAP_ORG_MAPPER_CANCEL_H
+
+#include <stdint.h>
+
+// mapper_token_cancelled returns non-zero if the cancellation token with the
+// given handle has been cancelled, or closed.
+extern int mapper_token_cancelled(uintptr_t handle);
+
+#endif // GO_JPAP_ORG_MAPPER_CANCEL_H
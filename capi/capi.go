@@ -0,0 +1,62 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package capi exports a small C API over a mapper.Mapper, for Go code built
+// as a c-shared or c-archive library that is embedded in a C host.
+//
+// The host can use the API to validate and release the handles it holds,
+// giving symmetric lifetime management across the language boundary.  Import
+// this package for its side effects from the library's main package:
+//
+//	import _ "go.jpap.org/mapper/capi"
+//
+// The C declarations are in the mapper.h file in this package's directory;
+// the header generated by "go build -buildmode=c-shared" only covers the main
+// package, so the host should include mapper.h instead.
+package capi // go.jpap.org/mapper/capi
+
+/*
+#include "mapper.h"
+*/
+import "C"
+import (
+	"go.jpap.org/mapper"
+)
+
+// Target is the Mapper served by the exported C API.  It must be set before
+// the C host makes any calls, and is not safe to change concurrently.
+var Target = &mapper.G
+
+//export mapper_get
+func mapper_get(handle C.uintptr_t) C.int {
+	// Has does not consume a use of a key mapped by MapValueUses.
+	if Target.HasHandle(uintptr(handle)) {
+		return 1
+	}
+	return 0
+}
+
+//export mapper_delete
+func mapper_delete(handle C.uintptr_t) C.int {
+	if _, ok := Target.Pop(mapper.KeyFromHandle(uintptr(handle))); !ok {
+		return 0
+	}
+	return 1
+}
+
+//export mapper_freed
+func mapper_freed(ptr C.uintptr_t) C.int {
+	if Target.FreedHandle(uintptr(ptr)) {
+		return 1
+	}
+	return 0
+}
+
+//export mapper_stats
+func mapper_stats(stats *C.mapper_stats_t) {
+	s := Target.Stats()
+	stats.live = C.int64_t(s.Live)
+	stats.mapped = C.uint64_t(s.Mapped)
+	stats.deleted = C.uint64_t(s.Deleted)
+}
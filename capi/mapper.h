@@ -0,0 +1,36 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// C API exported by go.jpap.org/mapper/capi, for use by a C host embedding a
+// Go c-shared or c-archive library.
+
+#ifndef GO_JPAP_ORG_MAPPER_H
+#define GO_JPAP_ORG_MAPPER_H
+
+#include <stdint.h>
+
+typedef struct {
+	int64_t live;
+	uint64_t mapped;
+	uint64_t deleted;
+} mapper_stats_t;
+
+// mapper_get returns 1 if the handle is mapped, or 0 otherwise, without
+// consuming a use of a handle with limited uses.
+extern int mapper_get(uintptr_t handle);
+
+// mapper_delete deletes the mapping for the handle, returning 1 if the handle
+// was mapped, or 0 otherwise.
+extern int mapper_delete(uintptr_t handle);
+
+// mapper_freed tells the mapper that the pointer has been freed by C,
+// deleting its mapping, and returning 1 if it was mapped, or 0 otherwise.
+// Call it from the shim that frees or destroys wrapped C objects; a later Get
+// of the pointer in Go reports a use after free.
+extern int mapper_freed(uintptr_t ptr);
+
+// mapper_stats fills the given struct with the mapper's statistics.
+extern void mapper_stats(mapper_stats_t *stats);
+
+#endif // GO_JPAP_ORG_MAPPER_H
@@ -0,0 +1,185 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package chanbridge delivers events from C callbacks into a Go channel.
+//
+// A Bridge maps a buffered channel in the Mapper Target, by default the global
+// mapper.G.  C code, usually a streaming callback producing log lines,
+// samples, or progress ticks, passes the bridge's handle to mapper_chan_send
+// or mapper_chan_send_value, declared in chanbridge.h in this package's
+// directory, and Go code receives the events from the channel returned by
+// Events.
+package chanbridge // go.jpap.org/mapper/chanbridge
+
+/*
+#include "chanbridge.h"
+*/
+import "C"
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/internal/bridge"
+)
+
+// Target is the Mapper in which new Bridges are mapped.  The exported C
+// functions retrieve each Bridge from the Mapper it was mapped in, even once
+// Target is changed.  Target is not safe to change concurrently with New.
+var Target = &mapper.G
+
+// Event is a value sent by C.
+type Event struct {
+	// Data is a copy of the bytes sent by mapper_chan_send.
+	Data []byte
+
+	// Value is the integer sent by mapper_chan_send_value.
+	Value int64
+}
+
+// Overflow is the policy applied when C sends an event to a full channel.
+type Overflow int
+
+const (
+	// Block waits until there is room in the channel, or the bridge is
+	// closed.  This stalls the C thread making the call.
+	Block Overflow = iota
+
+	// DropNewest drops the event being sent.
+	DropNewest
+
+	// DropOldest drops the oldest event in the channel to make room.  It
+	// requires a buffered channel.
+	DropOldest
+)
+
+// Bridge is a channel that C can send events into.
+type Bridge struct {
+	m         *mapper.Mapper
+	key       mapper.Key
+	ch        chan Event
+	overflow  Overflow
+	quit      chan struct{}
+	closeOnce sync.Once
+	dropped   uint64 // atomic
+
+	// mu is held for reading while sending, and for writing while closing,
+	// so that ch is never sent to after it is closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New returns a new Bridge, whose channel has the given buffer size, and
+// which applies the overflow policy when the channel is full.  New panics if
+// overflow is DropOldest and size is zero, as an unbuffered channel holds no
+// event to drop.
+func New(size int, overflow Overflow) *Bridge {
+	if overflow == DropOldest && size == 0 {
+		panic(errors.New("chanbridge: DropOldest requires a buffered channel"))
+	}
+	b := &Bridge{
+		m:        Target,
+		ch:       make(chan Event, size),
+		overflow: overflow,
+		quit:     make(chan struct{}),
+	}
+	b.key = bridge.Map(b.m, b)
+	return b
+}
+
+// Handle returns the handle to pass to C.
+func (b *Bridge) Handle() uintptr {
+	return b.key.Handle()
+}
+
+// Events returns the channel of events sent by C.  It is closed by Close.
+func (b *Bridge) Events() <-chan Event {
+	return b.ch
+}
+
+// Dropped returns the number of events dropped by the overflow policy.
+func (b *Bridge) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// Close deletes the bridge's mapping, and closes its channel once any sends
+// in progress have finished.  Later sends by C return -1.
+func (b *Bridge) Close() error {
+	bridge.Delete(b.m, b.key)
+	b.closeOnce.Do(func() {
+		// Blocked senders return once quit is closed.
+		close(b.quit)
+		b.mu.Lock()
+		b.closed = true
+		close(b.ch)
+		b.mu.Unlock()
+	})
+	return nil
+}
+
+// Send enqueues ev as if sent from C, returning the same results as
+// mapper_chan_send.
+func (b *Bridge) Send(ev Event) int {
+	select {
+	case <-b.quit:
+		return -1
+	default:
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return -1
+	}
+
+	select {
+	case b.ch <- ev:
+		return 1
+	default:
+	}
+	switch b.overflow {
+	case DropNewest:
+		atomic.AddUint64(&b.dropped, 1)
+		return 0
+	case DropOldest:
+		for {
+			select {
+			case <-b.ch:
+				atomic.AddUint64(&b.dropped, 1)
+			default:
+			}
+			select {
+			case b.ch <- ev:
+				return 1
+			default:
+			}
+		}
+	default:
+		select {
+		case b.ch <- ev:
+			return 1
+		case <-b.quit:
+			return -1
+		}
+	}
+}
+
+func send(handle C.uintptr_t, ev Event) C.int {
+	v, ok := bridge.Lookup(uintptr(handle))
+	if !ok {
+		return -1
+	}
+	return C.int(v.(*Bridge).Send(ev))
+}
+
+//export mapper_chan_send
+func mapper_chan_send(handle C.uintptr_t, data unsafe.Pointer, len C.size_t) C.int {
+	return send(handle, Event{Data: C.GoBytes(data, C.int(len))})
+}
+
+//export mapper_chan_send_value
+func mapper_chan_send_value(handle C.uintptr_t, value C.int64_t) C.int {
+	return send(handle, Event{Value: int64(value)})
+}
@@ -0,0 +1,19 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#ifndef GO_JPAP_ORG_MAPPER_CHANBRIDGE_H
+#define GO_JPAP_ORG_MAPPER_CHANBRIDGE_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+// mapper_chan_send enqueues a copy of the len bytes at data on the bridge with
+// the given handle.  It returns 1 if the event was enqueued, 0 if it was
+// dropped by the bridge's overflow policy, or -1 if the bridge is closed.
+extern int mapper_chan_send(uintptr_t handle, void *data, size_t len);
+
+// mapper_chan_send_value is like mapper_chan_send, but enqueues an integer.
+extern int mapper_chan_send_value(uintptr_t handle, int64_t value);
+
+#endif // GO_JPAP_ORG_MAPPER_CHANBRIDGE_H
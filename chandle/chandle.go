@@ -0,0 +1,73 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package chandle converts handles between mapper Keys and the C integer and
+// pointer types of cgo, with checks, so that code need not sprinkle manual
+// casts that occasionally go through unsafe.Pointer, and trip the garbage
+// collector's pointer checks.
+//
+// Pass handles to C as a C.uintptr_t, or another C integer type wide enough
+// to hold them:
+//
+//	C.start(chandle.CHandle[C.uintptr_t](key))
+//
+// and convert them to the void* user pointer of a C API in C, using
+// mapper_handle_ptr, declared in chandle.h in this package's directory.
+// Callbacks should likewise declare the user pointer as a C.uintptr_t,
+// converting from void* in C using mapper_ptr_handle:
+//
+//	//export onEvent
+//	func onEvent(user C.uintptr_t) {
+//		v := mapper.G.Get(chandle.Key(user))
+//	}
+//
+// Where a callback must take a *C.void, use KeyFromPointer, which never
+// dereferences it.
+package chandle // go.jpap.org/mapper/chandle
+
+/*
+#include "chandle.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+// Word is the set of C integer types that can carry a handle, such as
+// C.uintptr_t, C.ulong, or C.uint for handles limited to 32 bits.
+type Word interface {
+	~uint | ~uint32 | ~uint64 | ~uintptr
+}
+
+// CHandle returns the handle of key as the C integer type T.  It panics if
+// the handle does not fit in T: a 32-bit field can only carry the handles of
+// a Mapper created using mapper.With32BitHandles.
+func CHandle[T Word](key mapper.Key) T {
+	h := key.Handle()
+	if t := T(h); uintptr(t) != h {
+		panic(fmt.Errorf("handle 0x%x does not fit in %d bits", h, 8*unsafe.Sizeof(t)))
+	}
+	return T(h)
+}
+
+// Key returns the key with the handle h, received from C as an integer of
+// type T.  It panics if h does not fit in a uintptr, as a 64-bit value
+// received on a 32-bit platform may not.
+func Key[T Word](h T) mapper.Key {
+	if uint64(uintptr(h)) != uint64(h) {
+		panic(fmt.Errorf("handle 0x%x does not fit in a uintptr", uint64(h)))
+	}
+	return mapper.KeyFromHandle(uintptr(h))
+}
+
+// KeyFromPointer returns the key with the handle p, received from C as a
+// pointer, such as a *C.void.  The pointer is never dereferenced, but
+// holding a handle that is not a valid address in a Go pointer can still
+// crash the garbage collector: prefer receiving a C.uintptr_t.
+func KeyFromPointer[P ~*E, E any](p P) mapper.Key {
+	return mapper.KeyFromHandle(uintptr(unsafe.Pointer(p)))
+}
@@ -0,0 +1,23 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#ifndef GO_JPAP_ORG_MAPPER_CHANDLE_H
+#define GO_JPAP_ORG_MAPPER_CHANDLE_H
+
+#include <stdint.h>
+
+// mapper_handle_ptr converts a handle passed from Go as a uintptr_t to the
+// void* user pointer expected by a C API.  The conversion must be done in C:
+// Go code must never convert a handle to unsafe.Pointer.
+static inline void *mapper_handle_ptr(uintptr_t handle) {
+	return (void *)handle;
+}
+
+// mapper_ptr_handle converts a void* user pointer received from a C API to a
+// handle, to pass to Go as a uintptr_t.
+static inline uintptr_t mapper_ptr_handle(void *ptr) {
+	return (uintptr_t)ptr;
+}
+
+#endif // GO_JPAP_ORG_MAPPER_CHANDLE_H
@@ -0,0 +1,195 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command mapperbench drives a configurable workload against a
+// mapper.Mapper, and reports throughput, latency percentiles, and allocation
+// rates, so that Mapper options can be compared on the target hardware.
+//
+// Usage:
+//
+//	mapperbench [flags]
+//
+// The workload holds a set of live mappings, of the size given by -keys.
+// Each goroutine repeatedly either looks up a random key in the set, or, with
+// the probability given by -writes, writes to a random key in the set.  A
+// write deletes the key and maps a new one in its place with the probability
+// given by -churn; otherwise it replaces the value of the existing mapping
+// using MapPair.
+//
+// The flags are:
+//
+//	-goroutines n
+//		number of goroutines (default GOMAXPROCS)
+//	-duration d
+//		length of the run (default 5s)
+//	-keys n
+//		number of live mappings (default 1024)
+//	-writes p
+//		percentage of operations that are writes (default 10)
+//	-churn p
+//		percentage of writes that delete and remap their key (default 50)
+//	-compact, -partitioned, -32bit, -reserved n
+//		create the Mapper with WithCompactHandles, WithTypePartitions,
+//		With32BitHandles, and WithReservedBits(n), respectively
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.jpap.org/mapper"
+)
+
+// sampleEvery is the interval between operations whose latency is recorded.
+const sampleEvery = 16
+
+var (
+	goroutines  = flag.Int("goroutines", runtime.GOMAXPROCS(0), "number of `goroutines`")
+	duration    = flag.Duration("duration", 5*time.Second, "length of the run")
+	keys        = flag.Int("keys", 1024, "number of live mappings")
+	writes      = flag.Int("writes", 10, "percentage of operations that are writes")
+	churn       = flag.Int("churn", 50, "percentage of writes that delete and remap their key")
+	compact     = flag.Bool("compact", false, "use WithCompactHandles")
+	partitioned = flag.Bool("partitioned", false, "use WithTypePartitions")
+	bits32      = flag.Bool("32bit", false, "use With32BitHandles")
+	reserved    = flag.Uint("reserved", 0, "use WithReservedBits(`n`)")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: mapperbench [flags]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 || *goroutines < 1 || *keys < 1 ||
+		*writes < 0 || *writes > 100 || *churn < 0 || *churn > 100 {
+		usage()
+	}
+
+	var opts []mapper.Option
+	if *compact {
+		opts = append(opts, mapper.WithCompactHandles())
+	}
+	if *partitioned {
+		opts = append(opts, mapper.WithTypePartitions())
+	}
+	if *bits32 {
+		opts = append(opts, mapper.With32BitHandles())
+	}
+	if *reserved != 0 {
+		opts = append(opts, mapper.WithReservedBits(*reserved))
+	}
+	m := mapper.New(opts...)
+
+	// The live set holds handles, which are swapped atomically on churn.
+	// Writers to a slot are serialized, so that MapPair never maps a key that
+	// has been churned.
+	type slot struct {
+		mu     sync.Mutex
+		handle uintptr
+	}
+	set := make([]slot, *keys)
+	for i := range set {
+		key, err := m.TryMapValue(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mapperbench: mapping %d keys: %v\n", *keys, err)
+			os.Exit(1)
+		}
+		set[i].handle = key.Handle()
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	var (
+		stop    int32
+		ops     uint64
+		misses  uint64
+		mu      sync.Mutex
+		samples []time.Duration
+		wg      sync.WaitGroup
+	)
+	start := time.Now()
+	for g := 0; g < *goroutines; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			var n, miss uint64
+			var local []time.Duration
+			for atomic.LoadInt32(&stop) == 0 {
+				i := r.Intn(len(set))
+				sl := &set[i]
+				t := time.Now()
+				switch {
+				case r.Intn(100) >= *writes:
+					if _, ok := m.Lookup(mapper.KeyFromHandle(atomic.LoadUintptr(&sl.handle))); !ok {
+						// The key was churned between loading and lookup.
+						miss++
+					}
+				case r.Intn(100) < *churn:
+					sl.mu.Lock()
+					key := m.MapValue(i)
+					m.DeleteHandle(sl.handle)
+					atomic.StoreUintptr(&sl.handle, key.Handle())
+					sl.mu.Unlock()
+				default:
+					sl.mu.Lock()
+					m.MapPair(mapper.KeyFromHandle(sl.handle), i)
+					sl.mu.Unlock()
+				}
+				if n%sampleEvery == 0 {
+					local = append(local, time.Since(t))
+				}
+				n++
+			}
+			atomic.AddUint64(&ops, n)
+			atomic.AddUint64(&misses, miss)
+			mu.Lock()
+			samples = append(samples, local...)
+			mu.Unlock()
+		}(int64(g) + 1)
+	}
+	time.Sleep(*duration)
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	percentile := func(p float64) time.Duration {
+		if len(samples) == 0 {
+			return 0
+		}
+		return samples[int(p*float64(len(samples)-1))]
+	}
+
+	fmt.Printf("goroutines %d, keys %d, writes %d%%, churn %d%%, %v\n",
+		*goroutines, *keys, *writes, *churn, elapsed.Round(time.Millisecond))
+	fmt.Printf("ops        %d (%.0f/s), %d lookups raced with churn\n",
+		ops, float64(ops)/elapsed.Seconds(), misses)
+	fmt.Printf("latency    p50 %v, p90 %v, p99 %v, p99.9 %v, max %v\n",
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(0.999), percentile(1))
+	if ops > 0 {
+		// The samples themselves account for a small part of the allocations.
+		mallocs := after.Mallocs - before.Mallocs
+		bytes := after.TotalAlloc - before.TotalAlloc
+		fmt.Printf("allocs     %.2f/op, %.1f B/op, %.1f MB/s\n",
+			float64(mallocs)/float64(ops), float64(bytes)/float64(ops),
+			float64(bytes)/elapsed.Seconds()/1e6)
+	}
+	fmt.Printf("gc         %d cycles, %v pause\n",
+		after.NumGC-before.NumGC, time.Duration(after.PauseTotalNs-before.PauseTotalNs))
+}
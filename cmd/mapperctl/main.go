@@ -0,0 +1,205 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command mapperctl inspects the live mappings of a mapper.Mapper, so that
+// handle leaks can be triaged without writing Go.
+//
+// Usage:
+//
+//	mapperctl handles source
+//	mapperctl types source
+//	mapperctl oldest [-n count] source
+//	mapperctl diff before after
+//
+// A source is either the URL of a running program's debug endpoint (see
+// package go.jpap.org/mapper/mapperhttp), such as
+// http://localhost:6060/debug/mapper, or a file written by (*Mapper).Dump.
+//
+// The handles command lists every live handle with its type and age; types
+// counts the live handles of each type; oldest lists the oldest handles; and
+// diff reports the handles added, removed, changed, and retained between two
+// sources.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.jpap.org/mapper"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage:
+	mapperctl handles source
+	mapperctl types source
+	mapperctl oldest [-n count] source
+	mapperctl diff before after
+`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	var err error
+	switch cmd {
+	case "handles":
+		err = runHandles(w, args)
+	case "types":
+		err = runTypes(w, args)
+	case "oldest":
+		err = runOldest(w, args)
+	case "diff":
+		err = runDiff(w, args)
+	default:
+		usage()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mapperctl:", err)
+		os.Exit(1)
+	}
+}
+
+// load reads a snapshot from a URL or a dump file.
+func load(source string) (*mapper.Snapshot, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %s", source, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	s, err := mapper.ReadDump(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return s, nil
+}
+
+func loadOne(args []string) (*mapper.Snapshot, error) {
+	if len(args) != 1 {
+		usage()
+	}
+	return load(args[0])
+}
+
+func printEntries(w io.Writer, s *mapper.Snapshot, entries []mapper.SnapshotEntry) {
+	fmt.Fprintln(w, "HANDLE\tTYPE\tAGE")
+	for _, e := range entries {
+		fmt.Fprintf(w, "0x%x\t%s\t%s\n", e.Handle, e.Type, e.Age(s).Round(time.Millisecond))
+	}
+}
+
+func runHandles(w io.Writer, args []string) error {
+	s, err := loadOne(args)
+	if err != nil {
+		return err
+	}
+	printEntries(w, s, s.Entries)
+	return nil
+}
+
+func runTypes(w io.Writer, args []string) error {
+	s, err := loadOne(args)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, e := range s.Entries {
+		counts[e.Type]++
+	}
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if counts[types[i]] != counts[types[j]] {
+			return counts[types[i]] > counts[types[j]]
+		}
+		return types[i] < types[j]
+	})
+
+	fmt.Fprintln(w, "COUNT\tTYPE")
+	for _, t := range types {
+		fmt.Fprintf(w, "%d\t%s\n", counts[t], t)
+	}
+	return nil
+}
+
+func runOldest(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("oldest", flag.ExitOnError)
+	n := fs.Int("n", 10, "number of entries to list")
+	fs.Parse(args)
+	if *n < 0 {
+		return fmt.Errorf("oldest: negative count: %d", *n)
+	}
+
+	s, err := loadOne(fs.Args())
+	if err != nil {
+		return err
+	}
+	entries := append([]mapper.SnapshotEntry(nil), s.Entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	if len(entries) > *n {
+		entries = entries[:*n]
+	}
+	printEntries(w, s, entries)
+	return nil
+}
+
+func runDiff(w io.Writer, args []string) error {
+	if len(args) != 2 {
+		usage()
+	}
+	before, err := load(args[0])
+	if err != nil {
+		return err
+	}
+	after, err := load(args[1])
+	if err != nil {
+		return err
+	}
+
+	d := mapper.Diff(before, after)
+	fmt.Fprintln(w, "\tHANDLE\tTYPE\tAGE")
+	list := func(op string, s *mapper.Snapshot, entries []mapper.SnapshotEntry) {
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t0x%x\t%s\t%s\n", op, e.Handle, e.Type, e.Age(s).Round(time.Millisecond))
+		}
+	}
+	list("-", d.Before, d.Removed)
+	list("+", d.After, d.Added)
+	list("~", d.After, d.Changed)
+	list("=", d.After, d.Retained)
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/tabwriter"
+)
+
+const beforeDump = `{"time":"2021-01-01T00:00:10Z","entries":[
+{"handle":2,"type":"string","created":"2021-01-01T00:00:08Z","seq":3},
+{"handle":4,"type":"*main.conn","created":"2021-01-01T00:00:01Z","seq":1},
+{"handle":6,"type":"string","created":"2021-01-01T00:00:05Z","seq":2}]}
+`
+
+// Between the dumps, handle 2 is replaced, handle 6 deleted and mapped again,
+// and handle 8 mapped.
+const afterDump = `{"time":"2021-01-01T00:00:20Z","entries":[
+{"handle":2,"type":"int","created":"2021-01-01T00:00:12Z","seq":3},
+{"handle":4,"type":"*main.conn","created":"2021-01-01T00:00:01Z","seq":1},
+{"handle":6,"type":"string","created":"2021-01-01T00:00:15Z","seq":4},
+{"handle":8,"type":"int","created":"2021-01-01T00:00:18Z","seq":5}]}
+`
+
+var ctlTests = []struct {
+	name string
+	run  func(w io.Writer, args []string) error
+	args []string
+	out  string
+	err  string
+}{
+	{
+		name: "handles",
+		run:  runHandles,
+		args: []string{"before"},
+		out: `HANDLE  TYPE        AGE
+0x2     string      2s
+0x4     *main.conn  9s
+0x6     string      5s
+`,
+	},
+	{
+		name: "types",
+		run:  runTypes,
+		args: []string{"before"},
+		out: `COUNT  TYPE
+2      string
+1      *main.conn
+`,
+	},
+	{
+		name: "oldest",
+		run:  runOldest,
+		args: []string{"-n", "2", "before"},
+		out: `HANDLE  TYPE        AGE
+0x4     *main.conn  9s
+0x6     string      5s
+`,
+	},
+	{
+		name: "oldest all",
+		run:  runOldest,
+		args: []string{"-n", "10", "before"},
+		out: `HANDLE  TYPE        AGE
+0x4     *main.conn  9s
+0x6     string      5s
+0x2     string      2s
+`,
+	},
+	{
+		name: "oldest none",
+		run:  runOldest,
+		args: []string{"-n", "0", "before"},
+		out: `HANDLE  TYPE  AGE
+`,
+	},
+	{
+		name: "oldest negative",
+		run:  runOldest,
+		args: []string{"-n", "-1", "before"},
+		err:  "oldest: negative count: -1",
+	},
+	{
+		name: "diff",
+		run:  runDiff,
+		args: []string{"before", "after"},
+		out: `   HANDLE  TYPE        AGE
+-  0x6     string      5s
++  0x6     string      5s
++  0x8     int         2s
+~  0x2     int         8s
+=  0x4     *main.conn  19s
+`,
+	},
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	dumps := map[string]string{"before": beforeDump, "after": afterDump}
+	for name, dump := range dumps {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(dump), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range ctlTests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string(nil), tt.args...)
+			for i, arg := range args {
+				if _, ok := dumps[arg]; ok {
+					args[i] = filepath.Join(dir, arg)
+				}
+			}
+
+			var out strings.Builder
+			w := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+			err := tt.run(w, args)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Flush()
+			if out.String() != tt.out {
+				t.Errorf("got:\n%s\nwant:\n%s", out.String(), tt.out)
+			}
+		})
+	}
+}
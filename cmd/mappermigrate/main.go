@@ -0,0 +1,128 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command mappermigrate rewrites Go source that uses github.com/mattn/go-pointer
+// or runtime/cgo.Handle to use go.jpap.org/mapper instead.
+//
+// Usage:
+//
+//	mappermigrate [-w] path ...
+//
+// Each path is a Go source file, or a directory whose Go files are rewritten.
+// Without -w, the rewritten source is written to standard output.  With -w,
+// files are rewritten in place.
+//
+// The following rewrites are made, using the global mapper.G:
+//
+//	pointer.Save(v)       mapper.G.MapValue(v).Handle()
+//	pointer.Restore(p)    mapper.G.GetPtr(p)
+//	pointer.Unref(p)      mapper.G.DeleteHandle(uintptr(p))
+//	cgo.NewHandle(v)      mapper.G.MapValue(v)
+//	cgo.Handle(h)         mapper.KeyFromHandle(uintptr(h))
+//	h.Value()             mapper.G.Get(h)
+//	h.Delete()            mapper.G.Delete(h)
+//	cgo.Handle (type)     mapper.Key
+//
+// Handles are passed to cgo calls as C.uintptr_t rather than unsafe.Pointer;
+// see (mapper.Key).Handle for why.  Arguments to cgo calls are converted
+// accordingly, and a note is printed for each C function whose prototype must
+// then be changed (or wrapped) to accept a uintptr_t.
+//
+// The Go files of a directory are type-checked together, and expressions are
+// recognized as holding a handle by their type, or by the call that
+// initialized the variable they use, whatever its name.  A handle from
+// pointer.Save that is held as an unsafe.Pointer, such as in a field or a
+// result of that type, cannot become a uintptr, and go-pointer is then left
+// alone.  Any remaining references to the old packages are reported, and must
+// be migrated by hand.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var write = flag.Bool("w", false, "write result to source file instead of stdout")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: mappermigrate [-w] path ...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, path := range flag.Args() {
+		files, err := goFiles(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		if err := migrateFiles(files); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func goFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(path, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// migrateFiles migrates the files, of one directory, together.
+func migrateFiles(filenames []string) error {
+	files := make([]source, len(filenames))
+	for i, filename := range filenames {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		files[i] = source{filename, src}
+	}
+	results, err := migrate(files)
+	if err != nil {
+		return err
+	}
+	for i, res := range results {
+		for _, note := range res.notes {
+			fmt.Fprintln(os.Stderr, note)
+		}
+		if !*write {
+			if _, err := os.Stdout.Write(res.src); err != nil {
+				return err
+			}
+			continue
+		}
+		if bytes.Equal(files[i].src, res.src) {
+			continue
+		}
+		if err := ioutil.WriteFile(files[i].filename, res.src, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,585 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	goPointerPath = "github.com/mattn/go-pointer"
+	cgoPath       = "runtime/cgo"
+	mapperPath    = "go.jpap.org/mapper"
+)
+
+// source is a Go source file to migrate.
+type source struct {
+	filename string
+	src      []byte
+}
+
+type result struct {
+	src   []byte
+	notes []string
+}
+
+// handles records what holds a handle in the files of a package.
+type handles struct {
+	info *types.Info
+
+	// handleVars are the variables holding a go-pointer unsafe.Pointer,
+	// which become a uintptr handle, and saves are the calls to pointer.Save
+	// whose result is stored in them, or passed directly to C.  keyVars are
+	// the variables initialized with a cgo.Handle whose type is unknown, such
+	// as one converted from a C.uintptr_t; the others are recognized by type.
+	handleVars, keyVars map[types.Object]bool
+	saves               map[*ast.CallExpr]bool
+
+	// keepPointer is set when the result of a pointer.Save is held where a
+	// uintptr cannot take the place of its unsafe.Pointer.  As handles from
+	// both packages cannot be mixed, go-pointer is then left alone.
+	keepPointer bool
+}
+
+type rewriter struct {
+	*handles
+	fset *token.FileSet
+
+	// Local names of the imported packages; empty when not imported.
+	pointerName, cgoName, mapperName string
+
+	changed bool
+	notes   []string
+}
+
+// migrate rewrites the Go source files of a package, which are type-checked
+// together so that handles are recognized across files.
+func migrate(files []source) ([]*result, error) {
+	fset := token.NewFileSet()
+	parsed := make([]*ast.File, len(files))
+	for i, file := range files {
+		f, err := parser.ParseFile(fset, file.filename, file.src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = f
+	}
+
+	h := &handles{
+		info:       typeCheck(fset, parsed),
+		handleVars: make(map[types.Object]bool),
+		keyVars:    make(map[types.Object]bool),
+		saves:      make(map[*ast.CallExpr]bool),
+	}
+	h.collectVars(parsed)
+
+	results := make([]*result, len(files))
+	for i, f := range parsed {
+		res, err := h.rewriteFile(fset, f, files[i].src)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = res
+	}
+	return results, nil
+}
+
+// typeCheck type-checks the files, which may belong to more than one package,
+// such as a package and its external tests.  The files use cgo, and packages
+// that are not imported, so errors are ignored; the types that matter, of
+// runtime/cgo, are still known.
+func typeCheck(fset *token.FileSet, files []*ast.File) *types.Info {
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{
+		Importer:    stdImporter{importer.ForCompiler(fset, "source", nil)},
+		FakeImportC: true,
+		Error:       func(error) {},
+	}
+	var names []string
+	pkgs := make(map[string][]*ast.File)
+	for _, f := range files {
+		if pkgs[f.Name.Name] == nil {
+			names = append(names, f.Name.Name)
+		}
+		pkgs[f.Name.Name] = append(pkgs[f.Name.Name], f)
+	}
+	for _, name := range names {
+		conf.Check(name, fset, pkgs[name], info)
+	}
+	return info
+}
+
+// stdImporter imports only packages of the standard library, from source.
+type stdImporter struct {
+	types.Importer
+}
+
+func (imp stdImporter) Import(path string) (*types.Package, error) {
+	if elem, _, _ := strings.Cut(path, "/"); strings.Contains(elem, ".") {
+		return nil, fmt.Errorf("%s is not imported", path)
+	}
+	return imp.Importer.Import(path)
+}
+
+// rewriteFile rewrites the file f, parsed from src.
+func (h *handles) rewriteFile(fset *token.FileSet, f *ast.File, src []byte) (*result, error) {
+	r := &rewriter{
+		handles:     h,
+		fset:        fset,
+		pointerName: importName(f, goPointerPath, "pointer"),
+		cgoName:     importName(f, cgoPath, "cgo"),
+	}
+	if r.pointerName == "" && r.cgoName == "" {
+		return &result{src: src}, nil
+	}
+	r.mapperName = importName(f, mapperPath, "mapper")
+	addMapper := r.mapperName == ""
+	if addMapper {
+		r.mapperName = "mapper"
+	}
+
+	rewriteNode(f, r.rewrite)
+	for _, imp := range []struct{ path, name string }{
+		{goPointerPath, r.pointerName},
+		{cgoPath, r.cgoName},
+	} {
+		if imp.name == "" {
+			continue
+		}
+		if refs := r.references(f, imp.path); len(refs) > 0 {
+			for _, ref := range refs {
+				r.notef(ref.Pos(), "manual migration needed for %s.%s", imp.name, ref.Sel.Name)
+			}
+			continue
+		}
+		if addMapper {
+			// Take the place of the old import, keeping the grouping of imports.
+			replaceImport(f, imp.path, mapperPath)
+			addMapper = false
+		} else {
+			deleteImport(f, imp.path)
+		}
+	}
+	if !r.changed {
+		return &result{src: src, notes: r.notes}, nil
+	}
+	if addMapper {
+		addImport(f, mapperPath)
+	}
+	ast.SortImports(fset, f)
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return &result{src: buf.Bytes(), notes: r.notes}, nil
+}
+
+func (r *rewriter) notef(pos token.Pos, format string, args ...interface{}) {
+	r.notes = append(r.notes, fmt.Sprintf("%s: %s", r.fset.Position(pos), fmt.Sprintf(format, args...)))
+}
+
+// collectVars records the variables that hold a handle from either package.
+// A variable initialized by pointer.Save holds a handle only when declared
+// without a type, and used only where a uintptr can take the place of its
+// unsafe.Pointer: passed to C or go-pointer, or assigned another handle.
+func (h *handles) collectVars(files []*ast.File) {
+	var all []*ast.CallExpr
+	inits := make(map[types.Object][]*ast.CallExpr)
+	safe := make(map[*ast.Ident]bool)
+	classify := func(id *ast.Ident, value ast.Expr, typed bool) {
+		obj := h.objectOf(id)
+		switch {
+		case h.isPointerCall(value, "Save"):
+			if !typed && h.info.Defs[id] != nil {
+				h.handleVars[obj] = true
+			}
+			inits[obj] = append(inits[obj], value.(*ast.CallExpr))
+			safe[id] = true
+		case h.isCgoCall(value, "NewHandle"), h.isCgoCall(value, "Handle"):
+			h.keyVars[obj] = true
+		}
+	}
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				if len(n.Lhs) == len(n.Rhs) {
+					for i, lhs := range n.Lhs {
+						if id, ok := lhs.(*ast.Ident); ok {
+							classify(id, n.Rhs[i], false)
+						}
+					}
+				}
+			case *ast.ValueSpec:
+				for i, id := range n.Names {
+					if i < len(n.Values) {
+						classify(id, n.Values[i], n.Type != nil)
+					}
+				}
+			case *ast.CallExpr:
+				if h.isPointerCall(n, "Save") {
+					all = append(all, n)
+				}
+				toC := h.isCSel(n.Fun)
+				if toC || h.isPointerCall(n, "Restore") || h.isPointerCall(n, "Unref") {
+					for _, arg := range n.Args {
+						if id, ok := arg.(*ast.Ident); ok {
+							safe[id] = true
+						} else if toC && h.isPointerCall(arg, "Save") {
+							h.saves[arg.(*ast.CallExpr)] = true
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	for id, obj := range h.info.Uses {
+		if h.handleVars[obj] && !safe[id] {
+			delete(h.handleVars, obj)
+		}
+	}
+	for obj := range h.handleVars {
+		for _, call := range inits[obj] {
+			h.saves[call] = true
+		}
+	}
+	for _, call := range all {
+		if !h.saves[call] {
+			h.keepPointer = true
+		}
+	}
+}
+
+// rewrite returns the replacement for e, or e itself if it is unchanged.
+func (r *rewriter) rewrite(e ast.Expr) ast.Expr {
+	switch e := e.(type) {
+	case *ast.CallExpr:
+		return r.rewriteCall(e)
+	case *ast.SelectorExpr:
+		if r.isPkgSel(e, cgoPath, "Handle") {
+			r.changed = true
+			return r.sel(ast.NewIdent(r.mapperName), "Key")
+		}
+	}
+	return e
+}
+
+func (r *rewriter) rewriteCall(call *ast.CallExpr) ast.Expr {
+	if len(call.Args) == 1 {
+		arg := call.Args[0]
+		switch {
+		case r.isPointerCall(call, "Save"):
+			if r.keepPointer {
+				break
+			}
+			r.changed = true
+			return r.call(r.sel(r.mapperCall("MapValue", arg), "Handle"))
+		case r.isPointerCall(call, "Restore"):
+			if r.keepPointer {
+				break
+			}
+			r.changed = true
+			if r.isHandleExpr(arg) {
+				return r.mapperCall("GetHandle", arg)
+			}
+			return r.mapperCall("GetPtr", arg)
+		case r.isPointerCall(call, "Unref"):
+			if r.keepPointer {
+				break
+			}
+			r.changed = true
+			if r.isHandleExpr(arg) {
+				return r.mapperCall("DeleteHandle", arg)
+			}
+			return r.mapperCall("DeleteHandle", r.call(ast.NewIdent("uintptr"), arg))
+		case r.isCgoCall(call, "NewHandle"):
+			r.changed = true
+			return r.mapperCall("MapValue", arg)
+		case r.isCgoCall(call, "Handle"):
+			r.changed = true
+			keyFromHandle := r.sel(ast.NewIdent(r.mapperName), "KeyFromHandle")
+			return r.call(keyFromHandle, r.call(ast.NewIdent("uintptr"), arg))
+		case r.isPkgSel(call.Fun, "C", "uintptr_t") && r.isKeyExpr(arg):
+			r.changed = true
+			call.Args[0] = r.call(r.sel(arg, "Handle"))
+			return call
+		case r.isConversion(call, types.Typ[types.Uintptr]) && r.isKeyExpr(arg):
+			r.changed = true
+			return r.call(r.sel(arg, "Handle"))
+		}
+	}
+
+	if sel, ok := call.Fun.(*ast.SelectorExpr); ok && len(call.Args) == 0 && r.isKeyExpr(sel.X) {
+		switch sel.Sel.Name {
+		case "Value":
+			r.changed = true
+			return r.mapperCall("Get", sel.X)
+		case "Delete":
+			r.changed = true
+			return r.mapperCall("Delete", sel.X)
+		}
+	}
+
+	// A handle that was an unsafe.Pointer is now a uintptr, and is passed to C
+	// as a C.uintptr_t.
+	if sel, ok := call.Fun.(*ast.SelectorExpr); ok && r.isCSel(sel) && sel.Sel.Name != "uintptr_t" {
+		for i, arg := range call.Args {
+			if r.isHandleExpr(arg) {
+				r.changed = true
+				call.Args[i] = r.call(r.sel(ast.NewIdent("C"), "uintptr_t"), arg)
+				r.notef(arg.Pos(), "C.%s now receives a uintptr_t handle; change its prototype or wrap it", sel.Sel.Name)
+			}
+		}
+	}
+	return call
+}
+
+// isHandleExpr reports whether e was a go-pointer unsafe.Pointer that becomes
+// a uintptr handle.
+func (h *handles) isHandleExpr(e ast.Expr) bool {
+	if h.keepPointer {
+		return false
+	}
+	if call, ok := e.(*ast.CallExpr); ok {
+		return h.saves[call]
+	}
+	return h.handleVars[h.objectOf(e)]
+}
+
+// isKeyExpr reports whether e was a cgo.Handle.
+func (h *handles) isKeyExpr(e ast.Expr) bool {
+	if t, ok := h.info.TypeOf(e).(*types.Named); ok {
+		obj := t.Obj()
+		if obj.Pkg() != nil && obj.Pkg().Path() == cgoPath && obj.Name() == "Handle" {
+			return true
+		}
+	}
+	return h.keyVars[h.objectOf(e)] || h.isCgoCall(e, "NewHandle") || h.isCgoCall(e, "Handle")
+}
+
+// objectOf returns the variable or field denoted by e, or nil.
+func (h *handles) objectOf(e ast.Expr) types.Object {
+	switch e := e.(type) {
+	case *ast.Ident:
+		return h.info.ObjectOf(e)
+	case *ast.SelectorExpr:
+		return h.info.ObjectOf(e.Sel)
+	case *ast.ParenExpr:
+		return h.objectOf(e.X)
+	}
+	return nil
+}
+
+// isConversion reports whether call converts to the type t.
+func (h *handles) isConversion(call *ast.CallExpr, t types.Type) bool {
+	tv, ok := h.info.Types[call.Fun]
+	return ok && tv.IsType() && types.Identical(tv.Type, t)
+}
+
+func (h *handles) isPointerCall(e ast.Expr, name string) bool {
+	call, ok := e.(*ast.CallExpr)
+	return ok && h.isPkgSel(call.Fun, goPointerPath, name)
+}
+
+func (h *handles) isCgoCall(e ast.Expr, name string) bool {
+	call, ok := e.(*ast.CallExpr)
+	return ok && h.isPkgSel(call.Fun, cgoPath, name)
+}
+
+// isCSel reports whether e selects a name from cgo's "C".
+func (h *handles) isCSel(e ast.Expr) bool {
+	sel, ok := e.(*ast.SelectorExpr)
+	return ok && h.isPkgSel(sel, "C", sel.Sel.Name)
+}
+
+// isPkgSel reports whether e selects name from the package imported with
+// path, rather than from a variable that shadows its name.
+func (h *handles) isPkgSel(e ast.Expr, path, name string) bool {
+	sel, ok := e.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != name {
+		return false
+	}
+	id, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	pkg, ok := h.info.Uses[id].(*types.PkgName)
+	return ok && pkg.Imported().Path() == path
+}
+
+func (r *rewriter) sel(x ast.Expr, name string) *ast.SelectorExpr {
+	return &ast.SelectorExpr{X: x, Sel: ast.NewIdent(name)}
+}
+
+func (r *rewriter) call(fun ast.Expr, args ...ast.Expr) *ast.CallExpr {
+	return &ast.CallExpr{Fun: fun, Args: args}
+}
+
+// mapperCall returns a call to the named method on the global mapper.G.
+func (r *rewriter) mapperCall(method string, args ...ast.Expr) *ast.CallExpr {
+	g := r.sel(ast.NewIdent(r.mapperName), "G")
+	return r.call(r.sel(g, method), args...)
+}
+
+// references returns the remaining selector expressions on the package
+// imported with path.
+func (r *rewriter) references(f *ast.File, path string) []*ast.SelectorExpr {
+	var refs []*ast.SelectorExpr
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok && r.isPkgSel(sel, path, sel.Sel.Name) {
+			refs = append(refs, sel)
+		}
+		return true
+	})
+	return refs
+}
+
+// importName returns the local name of the package imported with path, or
+// the empty string if it is not imported, or is a dot or blank import.
+func importName(f *ast.File, path, defaultName string) string {
+	for _, imp := range f.Imports {
+		if p, _ := strconv.Unquote(imp.Path.Value); p != path {
+			continue
+		}
+		if imp.Name == nil {
+			return defaultName
+		}
+		if imp.Name.Name == "_" || imp.Name.Name == "." {
+			return ""
+		}
+		return imp.Name.Name
+	}
+	return ""
+}
+
+func replaceImport(f *ast.File, oldPath, newPath string) {
+	for _, imp := range f.Imports {
+		if p, _ := strconv.Unquote(imp.Path.Value); p == oldPath {
+			imp.Name = nil
+			imp.Path.Value = strconv.Quote(newPath)
+		}
+	}
+}
+
+func deleteImport(f *ast.File, path string) {
+	for i := 0; i < len(f.Decls); i++ {
+		decl, ok := f.Decls[i].(*ast.GenDecl)
+		if !ok || decl.Tok != token.IMPORT {
+			continue
+		}
+		specs := decl.Specs[:0]
+		for _, spec := range decl.Specs {
+			if p, _ := strconv.Unquote(spec.(*ast.ImportSpec).Path.Value); p != path {
+				specs = append(specs, spec)
+			}
+		}
+		decl.Specs = specs
+		if len(specs) == 0 {
+			f.Decls = append(f.Decls[:i], f.Decls[i+1:]...)
+			i--
+		}
+	}
+	imports := f.Imports[:0]
+	for _, imp := range f.Imports {
+		if p, _ := strconv.Unquote(imp.Path.Value); p != path {
+			imports = append(imports, imp)
+		}
+	}
+	f.Imports = imports
+}
+
+// addImport adds path to the first import declaration that is not the cgo
+// "C" import, or to a new declaration after the last import.
+func addImport(f *ast.File, path string) {
+	spec := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(path)}}
+	f.Imports = append(f.Imports, spec)
+
+	last := -1
+	for i, decl := range f.Decls {
+		decl, ok := decl.(*ast.GenDecl)
+		if !ok || decl.Tok != token.IMPORT {
+			continue
+		}
+		last = i
+		if len(decl.Specs) == 1 && decl.Specs[0].(*ast.ImportSpec).Path.Value == `"C"` {
+			continue
+		}
+		spec.Path.ValuePos = decl.Specs[len(decl.Specs)-1].End()
+		if !decl.Lparen.IsValid() {
+			decl.Lparen = decl.Specs[0].Pos()
+		}
+		decl.Specs = append(decl.Specs, spec)
+		return
+	}
+
+	decl := &ast.GenDecl{Tok: token.IMPORT, Specs: []ast.Spec{spec}}
+	if last >= 0 {
+		decl.TokPos = f.Decls[last].End()
+		spec.Path.ValuePos = decl.TokPos
+	}
+	f.Decls = append(f.Decls[:last+1], append([]ast.Decl{decl}, f.Decls[last+1:]...)...)
+}
+
+var nodeType = reflect.TypeOf((*ast.Node)(nil)).Elem()
+
+// rewriteNode walks the tree rooted at n, replacing each expression e with
+// fn(e) before descending into the replacement.  Replacements that cannot be
+// stored in the parent's field, such as a non-identifier in place of an
+// *ast.Ident, are ignored.
+func rewriteNode(n ast.Node, fn func(ast.Expr) ast.Expr) {
+	walkFields(reflect.ValueOf(n), fn)
+}
+
+func walkFields(v reflect.Value, fn func(ast.Expr) ast.Expr) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	s := v.Elem()
+	for i := 0; i < s.NumField(); i++ {
+		field := s.Field(i)
+		switch field.Kind() {
+		case reflect.Slice:
+			for j := 0; j < field.Len(); j++ {
+				visitField(field.Index(j), fn)
+			}
+		case reflect.Ptr, reflect.Interface:
+			visitField(field, fn)
+		}
+	}
+}
+
+func visitField(field reflect.Value, fn func(ast.Expr) ast.Expr) {
+	if field.IsNil() || !field.Type().Implements(nodeType) {
+		return
+	}
+	if e, ok := field.Interface().(ast.Expr); ok {
+		if repl := fn(e); repl != e {
+			if v := reflect.ValueOf(repl); v.Type().AssignableTo(field.Type()) {
+				field.Set(v)
+			}
+		}
+	}
+	walkFields(field, fn)
+}
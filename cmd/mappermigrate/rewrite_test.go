@@ -0,0 +1,329 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var migrateTests = []struct {
+	name  string
+	in    string
+	out   string
+	notes int
+}{
+	{
+		name: "go-pointer",
+		in: `package p
+
+// #include "p.h"
+import "C"
+import (
+	"unsafe"
+
+	pointer "github.com/mattn/go-pointer"
+)
+
+func register(v interface{}) {
+	C.register(pointer.Save(v))
+}
+
+func registerVar(v interface{}) unsafe.Pointer {
+	p := pointer.Save(v)
+	C.register(p)
+	return unsafe.Pointer(nil)
+}
+
+//export callback
+func callback(user unsafe.Pointer) {
+	v := pointer.Restore(user)
+	_ = v
+	pointer.Unref(user)
+}
+`,
+		out: `package p
+
+// #include "p.h"
+import "C"
+import (
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+func register(v interface{}) {
+	C.register(C.uintptr_t(mapper.G.MapValue(v).Handle()))
+}
+
+func registerVar(v interface{}) unsafe.Pointer {
+	p := mapper.G.MapValue(v).Handle()
+	C.register(C.uintptr_t(p))
+	return unsafe.Pointer(nil)
+}
+
+//export callback
+func callback(user unsafe.Pointer) {
+	v := mapper.G.GetPtr(user)
+	_ = v
+	mapper.G.DeleteHandle(uintptr(user))
+}
+`,
+		notes: 2,
+	},
+	{
+		name: "cgo.Handle",
+		in: `package p
+
+// #include "p.h"
+import "C"
+import "runtime/cgo"
+
+type obj struct {
+	h cgo.Handle
+}
+
+func register(v interface{}) *obj {
+	h := cgo.NewHandle(v)
+	C.register(C.uintptr_t(h))
+	return &obj{h: h}
+}
+
+func (o *obj) close() {
+	o.h.Delete()
+}
+
+//export callback
+func callback(user C.uintptr_t) {
+	h := cgo.Handle(user)
+	_ = h.Value()
+}
+`,
+		out: `package p
+
+// #include "p.h"
+import "C"
+import "go.jpap.org/mapper"
+
+type obj struct {
+	h mapper.Key
+}
+
+func register(v interface{}) *obj {
+	h := mapper.G.MapValue(v)
+	C.register(C.uintptr_t(h.Handle()))
+	return &obj{h: h}
+}
+
+func (o *obj) close() {
+	mapper.G.Delete(o.h)
+}
+
+//export callback
+func callback(user C.uintptr_t) {
+	h := mapper.KeyFromHandle(uintptr(user))
+	_ = mapper.G.Get(h)
+}
+`,
+	},
+	{
+		name: "unrelated",
+		in: `package p
+
+import "fmt"
+
+func f() { fmt.Println() }
+`,
+		out: `package p
+
+import "fmt"
+
+func f() { fmt.Println() }
+`,
+	},
+	{
+		name: "remaining",
+		in: `package p
+
+import "runtime/cgo"
+
+var h = cgo.NewHandle(1)
+
+type H = cgo.Incomplete
+`,
+		out: `package p
+
+import (
+	"go.jpap.org/mapper"
+	"runtime/cgo"
+)
+
+var h = mapper.G.MapValue(1)
+
+type H = cgo.Incomplete
+`,
+		notes: 1,
+	},
+	{
+		name: "shadowed",
+		in: `package p
+
+import "runtime/cgo"
+
+type registry struct{}
+
+func (registry) NewHandle(v interface{}) int { return 0 }
+
+func register(v interface{}) cgo.Handle {
+	{
+		cgo := registry{}
+		cgo.NewHandle(v)
+	}
+	return cgo.NewHandle(v)
+}
+`,
+		out: `package p
+
+import "go.jpap.org/mapper"
+
+type registry struct{}
+
+func (registry) NewHandle(v interface{}) int { return 0 }
+
+func register(v interface{}) mapper.Key {
+	{
+		cgo := registry{}
+		cgo.NewHandle(v)
+	}
+	return mapper.G.MapValue(v)
+}
+`,
+	},
+	{
+		name: "same name",
+		in: `package p
+
+// #include "p.h"
+import "C"
+import (
+	"runtime/cgo"
+	"unsafe"
+
+	pointer "github.com/mattn/go-pointer"
+)
+
+type conn struct{ h int }
+
+func (conn) Delete() {}
+
+func register(v interface{}) {
+	h := cgo.NewHandle(v)
+	C.register(C.uintptr_t(h))
+	p := pointer.Save(v)
+	C.register_ptr(p)
+}
+
+func close(c conn, buf []byte) {
+	h := c
+	h.Delete()
+	C.free_conn(C.uintptr_t(c.h))
+	p := unsafe.Pointer(&buf[0])
+	C.register_ptr(p)
+}
+`,
+		out: `package p
+
+// #include "p.h"
+import "C"
+import (
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+type conn struct{ h int }
+
+func (conn) Delete() {}
+
+func register(v interface{}) {
+	h := mapper.G.MapValue(v)
+	C.register(C.uintptr_t(h.Handle()))
+	p := mapper.G.MapValue(v).Handle()
+	C.register_ptr(C.uintptr_t(p))
+}
+
+func close(c conn, buf []byte) {
+	h := c
+	h.Delete()
+	C.free_conn(C.uintptr_t(c.h))
+	p := unsafe.Pointer(&buf[0])
+	C.register_ptr(p)
+}
+`,
+		notes: 1,
+	},
+	{
+		name: "unsafe.Pointer",
+		in: `package p
+
+import (
+	"unsafe"
+
+	pointer "github.com/mattn/go-pointer"
+)
+
+type obj struct {
+	user unsafe.Pointer
+}
+
+func newObj(v interface{}) *obj {
+	return &obj{user: pointer.Save(v)}
+}
+
+func (o *obj) value() interface{} {
+	return pointer.Restore(o.user)
+}
+`,
+		out: `package p
+
+import (
+	"unsafe"
+
+	pointer "github.com/mattn/go-pointer"
+)
+
+type obj struct {
+	user unsafe.Pointer
+}
+
+func newObj(v interface{}) *obj {
+	return &obj{user: pointer.Save(v)}
+}
+
+func (o *obj) value() interface{} {
+	return pointer.Restore(o.user)
+}
+`,
+		notes: 2,
+	},
+}
+
+func TestMigrate(t *testing.T) {
+	for _, tt := range migrateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := migrate([]source{{"p.go", []byte(tt.in)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := results[0]
+			if got := string(res.src); got != tt.out {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.out)
+			}
+			if len(res.notes) != tt.notes {
+				t.Errorf("got %d notes, want %d:\n%s", len(res.notes), tt.notes, strings.Join(res.notes, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package completion waits in Go for an asynchronous C operation to complete.
+//
+// Start the C operation with a Completion's handle as its user pointer, and
+// have its completion callback call mapper_complete, declared in completion.h
+// in this package's directory, with the handle, a status, and an optional
+// payload handle:
+//
+//	c := completion.New()
+//	C.start_operation(C.uintptr_t(c.Handle()))
+//	res, err := c.Wait(ctx)
+package completion // go.jpap.org/mapper/completion
+
+/*
+#include "completion.h"
+*/
+import "C"
+import (
+	"context"
+	"sync"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/internal/bridge"
+)
+
+// Target is the Mapper in which new Completions are mapped, by default the
+// global mapper.G.  mapper_complete retrieves each Completion from the Mapper
+// it was mapped in, even once Target is changed.  Target is not safe to change
+// concurrently with New.
+var Target = &mapper.G
+
+// Result is the outcome of a completed operation.
+type Result struct {
+	// Status is as reported by C.
+	Status int
+
+	// Payload is the key of the optional payload handle, which is zero if
+	// no payload was given.
+	Payload mapper.Key
+}
+
+// Completion is a pending asynchronous operation.
+type Completion struct {
+	m    *mapper.Mapper
+	key  mapper.Key
+	done chan struct{}
+	once sync.Once
+	res  Result
+}
+
+// New returns a new Completion, mapped in Target.
+func New() *Completion {
+	c := &Completion{m: Target, done: make(chan struct{})}
+	c.key = bridge.Map(c.m, c)
+	return c
+}
+
+// Handle returns the handle to pass to C, which is later given to
+// mapper_complete.
+func (c *Completion) Handle() uintptr {
+	return c.key.Handle()
+}
+
+// Complete resolves the completion from Go, as mapper_complete does from C.
+// Only the first call has any effect.
+func (c *Completion) Complete(status int, payload mapper.Key) {
+	c.once.Do(func() {
+		bridge.Delete(c.m, c.key)
+		c.res = Result{Status: status, Payload: payload}
+		close(c.done)
+	})
+}
+
+// Done returns a channel that is closed when the completion is resolved.
+func (c *Completion) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait waits for the completion to be resolved, returning its result.  If ctx
+// is done first, Wait abandons the completion, so that a later call to
+// mapper_complete has no effect, and returns the context's error.
+func (c *Completion) Wait(ctx context.Context) (Result, error) {
+	select {
+	case <-c.done:
+		return c.res, nil
+	case <-ctx.Done():
+		c.Abandon()
+		// The completion may have won the race.
+		select {
+		case <-c.done:
+			return c.res, nil
+		default:
+			return Result{}, ctx.Err()
+		}
+	}
+}
+
+// Abandon deletes the completion's mapping, so that a later call to
+// mapper_complete has no effect.
+func (c *Completion) Abandon() {
+	bridge.Delete(c.m, c.key)
+}
+
+//export mapper_complete
+func mapper_complete(handle C.uintptr_t, status C.int, payload C.uintptr_t) {
+	// An abandoned completion is no longer mapped.
+	v, ok := bridge.Lookup(uintptr(handle))
+	if !ok {
+		return
+	}
+	var key mapper.Key
+	if payload != 0 {
+		key = mapper.KeyFromHandle(uintptr(payload))
+	}
+	v.(*Completion).Complete(int(status), key)
+}
@@ -0,0 +1,15 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#ifndef GO_JPAP_ORG_MAPPER_COMPLETION_H
+#define GO_JPAP_ORG_MAPPER_COMPLETION_H
+
+#include <stdint.h>
+
+// mapper_complete resolves the completion with the given handle, with a
+// status and an optional payload handle (or zero).  It may be called from any
+// thread, and only the first call for a completion has any effect.
+extern void mapper_complete(uintptr_t handle, int status, uintptr_t payload);
+
+#endif // GO_JPAP_ORG_MAPPER_COMPLETION_H
@@ -0,0 +1,23 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "context"
+
+// contextKey is the key of the Mapper carried by a context.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries mapper, so that
+// request-scoped code and middleware can find the Mapper to use without a
+// global variable.  It does not tie the lifetime of any mapping to ctx.
+func NewContext(ctx context.Context, mapper *Mapper) context.Context {
+	return context.WithValue(ctx, contextKey{}, mapper)
+}
+
+// FromContext returns the Mapper carried by ctx, and false if there is none.
+func FromContext(ctx context.Context) (*Mapper, bool) {
+	mapper, ok := ctx.Value(contextKey{}).(*Mapper)
+	return mapper, ok
+}
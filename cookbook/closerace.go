@@ -0,0 +1,66 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookbook
+
+/*
+#include <stdint.h>
+
+// A C "socket" library that may deliver one last event after it has been
+// told to close, as happens when an event is already queued.
+
+extern void recipeSocketEvent(uintptr_t handle, int event);
+
+static uintptr_t pending;
+
+static void socket_open(uintptr_t handle) {
+	pending = handle;
+}
+
+static void socket_deliver(int event) {
+	recipeSocketEvent(pending, event);
+}
+*/
+import "C"
+import (
+	"fmt"
+
+	"go.jpap.org/mapper"
+)
+
+// socket is the Go state of a C socket.
+type socket struct {
+	key    mapper.Key
+	events int
+}
+
+// CallbackAfterClose closes a Go object while C may still call back with its
+// handle.  The callback uses Lookup, rather than Get, and drops events for
+// handles that are no longer mapped, instead of panicking.
+//
+// Use a Mapper that does not recycle keys, such as the global G, so that a
+// stale handle cannot resolve to a newer mapping.
+func CallbackAfterClose() {
+	s := &socket{}
+	s.key = mapper.G.MapValue(s)
+	C.socket_open(C.uintptr_t(s.key.Handle()))
+
+	C.socket_deliver(1)
+	mapper.G.Delete(s.key) // Close the Go side.
+	C.socket_deliver(2)    // The C side delivers a queued event.
+
+	fmt.Printf("socket handled %d event(s)\n", s.events)
+}
+
+//export recipeSocketEvent
+func recipeSocketEvent(handle C.uintptr_t, event C.int) {
+	v, ok := mapper.G.Lookup(mapper.KeyFromHandle(uintptr(handle)))
+	if !ok {
+		fmt.Printf("event %d after close: dropped\n", event)
+		return
+	}
+	s := v.(*socket)
+	s.events++
+	fmt.Printf("event %d\n", event)
+}
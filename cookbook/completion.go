@@ -0,0 +1,60 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookbook
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../completion
+#cgo LDFLAGS: -lpthread
+#include <pthread.h>
+#include <stdlib.h>
+#include <unistd.h>
+#include "completion.h"
+
+// A C "download" that completes on a thread of its own, reporting its status
+// to a callback.  Here, the callback is mapper_complete itself.
+
+static void *download(void *arg) {
+	usleep(1000);
+	mapper_complete((uintptr_t)arg, 200, 0);
+	return NULL;
+}
+
+static int start_download(uintptr_t handle) {
+	pthread_t thread;
+	if (pthread_create(&thread, NULL, download, (void *)handle) != 0) {
+		return -1;
+	}
+	return pthread_detach(thread);
+}
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.jpap.org/mapper/completion"
+)
+
+// Completion starts an asynchronous C operation, passing the handle of a
+// completion.Completion as its user pointer, and waits for it in Go, with a
+// timeout.  The Completion deletes its mapping once completed, or abandoned.
+func Completion() {
+	c := completion.New()
+	if C.start_download(C.uintptr_t(c.Handle())) != 0 {
+		c.Abandon()
+		fmt.Println("download failed to start")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := c.Wait(ctx)
+	if err != nil {
+		fmt.Println("download:", err)
+		return
+	}
+	fmt.Println("download completed with status", res.Status)
+}
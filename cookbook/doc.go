@@ -0,0 +1,22 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cookbook is a collection of small, runnable recipes for the cgo
+// callback patterns the mapper supports.  Each recipe simulates a C library
+// in its cgo preamble, and drives it from Go; the examples in the package's
+// tests run every recipe, checking its output.
+//
+// Read the source of each recipe alongside its documentation:
+//
+//   - RefCon: a C API that stores an opaque user pointer ("refCon") with an
+//     object, and passes it to callbacks.
+//   - Completion: waiting in Go for an asynchronous C operation, completed
+//     on another thread.
+//   - ProgressCancel: progress reporting from a long-running C loop, which
+//     Go cancels using a context.
+//   - CallbackAfterClose: a C library that calls back after the Go side has
+//     closed its object, which must be tolerated, not crash.
+//   - ProxyPointer: a C API without a user pointer, whose callbacks receive
+//     only the C object, which is itself the key.
+package cookbook // go.jpap.org/mapper/cookbook
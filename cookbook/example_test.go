@@ -0,0 +1,45 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookbook_test
+
+import "go.jpap.org/mapper/cookbook"
+
+func ExampleRefCon() {
+	cookbook.RefCon()
+	// Output:
+	// heartbeat: tick 1
+	// heartbeat: tick 2
+	// heartbeat: tick 3
+	// heartbeat ticked 3 times
+}
+
+func ExampleCompletion() {
+	cookbook.Completion()
+	// Output:
+	// download completed with status 200
+}
+
+func ExampleProgressCancel() {
+	cookbook.ProgressCancel()
+	// Output:
+	// encoded 1/10
+	// encoded 2/10
+	// encoded 3/10
+	// encoder stopped after 3 frames
+}
+
+func ExampleCallbackAfterClose() {
+	cookbook.CallbackAfterClose()
+	// Output:
+	// event 1
+	// event 2 after close: dropped
+	// socket handled 1 event(s)
+}
+
+func ExampleProxyPointer() {
+	cookbook.ProxyPointer()
+	// Output:
+	// clicked OK
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookbook
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../progress
+#include "progress.h"
+
+// A C "encoder" that reports its progress after each frame, and stops early
+// when asked to.
+
+static int encode(uintptr_t handle, int frames) {
+	for (int i = 1; i <= frames; i++) {
+		if (mapper_progress(handle, i, frames)) {
+			return i;
+		}
+	}
+	return frames;
+}
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+
+	"go.jpap.org/mapper/progress"
+)
+
+// ProgressCancel runs a C loop that reports its progress to Go, passing the
+// handle of a progress.Progress.  Go cancels the loop using the Progress'
+// token, which C sees as the callback's return value.  Cancelling the
+// Progress' context has the same effect, once the token observes it.
+func ProgressCancel() {
+	var p *progress.Progress
+	p = progress.New(context.Background(), func(current, total int64) {
+		fmt.Printf("encoded %d/%d\n", current, total)
+		if current == 3 {
+			p.Token().Cancel()
+		}
+	})
+	defer p.Close()
+
+	n := C.encode(C.uintptr_t(p.Handle()), 10)
+	fmt.Printf("encoder stopped after %d frames\n", n)
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookbook
+
+/*
+#include <stdlib.h>
+
+// A C "widget" library whose callbacks receive only the widget, without a
+// user pointer.
+
+typedef struct widget widget_t;
+typedef void (*widget_fn)(widget_t *w);
+
+struct widget {
+	widget_fn on_click;
+};
+
+extern void recipeWidgetClicked(widget_t *w);
+
+static widget_t *widget_new(void) {
+	widget_t *w = malloc(sizeof(widget_t));
+	w->on_click = recipeWidgetClicked;
+	return w;
+}
+
+static void widget_click(widget_t *w) {
+	w->on_click(w);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+// button is the Go state of a C widget.
+type button struct {
+	label string
+}
+
+// ProxyPointer maps the pointer of a C object, allocated by C, directly to
+// its Go state using MapPtrPair.  The callback, which receives only the C
+// object, uses the object's pointer as the key.
+func ProxyPointer() {
+	w := C.widget_new()
+	mapper.G.MapPtrPair(unsafe.Pointer(w), &button{label: "OK"})
+
+	C.widget_click(w)
+
+	// Delete the mapping before freeing the C object, whose address malloc
+	// may reuse.
+	mapper.G.DeletePtr(unsafe.Pointer(w))
+	C.free(unsafe.Pointer(w))
+}
+
+//export recipeWidgetClicked
+func recipeWidgetClicked(w *C.widget_t) {
+	b := mapper.G.GetPtr(unsafe.Pointer(w)).(*button)
+	fmt.Printf("clicked %s\n", b.label)
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookbook
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// A C "timer" library, which stores a refCon with each timer, and passes it
+// to the timer's callback.
+
+typedef void (*timer_fn)(void *refcon, int tick);
+
+typedef struct {
+	timer_fn fn;
+	void *refcon;
+} timer_t_;
+
+static timer_t_ *timer_create_(timer_fn fn, void *refcon) {
+	timer_t_ *t = malloc(sizeof(timer_t_));
+	t->fn = fn;
+	t->refcon = refcon;
+	return t;
+}
+
+static void timer_fire(timer_t_ *t, int ticks) {
+	for (int i = 1; i <= ticks; i++) {
+		t->fn(t->refcon, i);
+	}
+}
+
+static void timer_destroy(timer_t_ *t) {
+	free(t);
+}
+
+extern void recipeTimerCallback(void *refcon, int tick);
+
+// The handle crosses from Go as a uintptr_t, and is converted to void* in C.
+static timer_t_ *new_timer(uintptr_t handle) {
+	return timer_create_(recipeTimerCallback, (void *)handle);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+// timer is the Go state of a C timer.
+type timer struct {
+	name  string
+	ticks int
+}
+
+// RefCon maps a Go value to a new key, and registers the key's handle as the
+// refCon of a C timer.  The callback exchanges the refCon for the Go value.
+// The mapping is deleted once the C timer, which holds the refCon, is
+// destroyed.
+func RefCon() {
+	t := &timer{name: "heartbeat"}
+	key := mapper.G.MapValue(t)
+
+	ct := C.new_timer(C.uintptr_t(key.Handle()))
+	C.timer_fire(ct, 3)
+	C.timer_destroy(ct)
+
+	mapper.G.Delete(key)
+	fmt.Printf("%s ticked %d times\n", t.name, t.ticks)
+}
+
+//export recipeTimerCallback
+func recipeTimerCallback(refcon unsafe.Pointer, tick C.int) {
+	t := mapper.G.GetPtr(refcon).(*timer)
+	t.ticks++
+	fmt.Printf("%s: tick %d\n", t.name, tick)
+}
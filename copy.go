@@ -0,0 +1,174 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// copyMode selects the copy of each value stored by a Mapper.
+type copyMode int
+
+const (
+	copyNone copyMode = iota
+	copyShallow
+	copyDeep
+)
+
+// stored returns the value to store for goValue, according to the mapper's
+// copy mode.
+func (mapper *Mapper) stored(goValue interface{}) interface{} {
+	if mapper.copyMode == copyNone || goValue == nil {
+		return goValue
+	}
+	v := reflect.ValueOf(goValue)
+	if mapper.copyMode == copyShallow {
+		return shallowCopy(v).Interface()
+	}
+	c := deepCopier{seen: make(map[seenKey]reflect.Value)}
+	return c.copy(v).Interface()
+}
+
+// shallowCopy copies the target of a pointer, or the elements of a slice or
+// map, one level deep.
+func shallowCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(v.Elem())
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), iter.Value())
+		}
+		return c
+	}
+	return v
+}
+
+// seenKey identifies a pointer, slice, or map already copied.
+type seenKey struct {
+	typ reflect.Type
+	ptr uintptr
+}
+
+// deepCopier copies everything reachable from a value.
+type deepCopier struct {
+	seen map[seenKey]reflect.Value
+}
+
+// copy returns a deep copy of v.
+func (c *deepCopier) copy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		key := seenKey{v.Type(), v.Pointer()}
+		if v.Kind() == reflect.Slice {
+			// Slices of different lengths may share an array.
+			key.ptr += uintptr(v.Len()) << 1
+		}
+		if cp, ok := c.seen[key]; ok {
+			return cp
+		}
+		return c.copyRef(v, key)
+	case reflect.Struct, reflect.Array, reflect.Interface:
+		if !v.CanAddr() {
+			// Make the fields of v addressable, so that unexported fields
+			// can be read.
+			a := reflect.New(v.Type()).Elem()
+			a.Set(v)
+			v = a
+		}
+		cp := reflect.New(v.Type()).Elem()
+		c.copyInto(cp, v)
+		return cp
+	}
+	return v
+}
+
+// copyRef copies the pointer, slice, or map v, recording the copy as seen
+// before copying what it refers to, so that cycles terminate.
+func (c *deepCopier) copyRef(v reflect.Value, key seenKey) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		cp := reflect.New(v.Type().Elem())
+		c.seen[key] = cp
+		c.copyInto(cp.Elem(), v.Elem())
+		return cp
+	case reflect.Slice:
+		cp := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		c.seen[key] = cp
+		for i := 0; i < v.Len(); i++ {
+			c.copyInto(cp.Index(i), v.Index(i))
+		}
+		return cp
+	default: // reflect.Map
+		cp := reflect.MakeMapWithSize(v.Type(), v.Len())
+		c.seen[key] = cp
+		iter := v.MapRange()
+		for iter.Next() {
+			cp.SetMapIndex(c.copy(iter.Key()), c.copy(iter.Value()))
+		}
+		return cp
+	}
+}
+
+// copyInto stores a deep copy of src in the settable dst.  If src was read
+// from an unexported field, it must be addressable.
+func (c *deepCopier) copyInto(dst, src reflect.Value) {
+	src = readable(src)
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			c.copyInto(settable(dst.Field(i)), src.Field(i))
+		}
+	case reflect.Array:
+		for i := 0; i < src.Len(); i++ {
+			c.copyInto(dst.Index(i), src.Index(i))
+		}
+	case reflect.Interface:
+		if !src.IsNil() {
+			dst.Set(c.copy(src.Elem()))
+		}
+	default:
+		dst.Set(c.copy(src))
+	}
+}
+
+// settable returns an addressable field, which may be unexported, as a
+// settable value.
+func settable(v reflect.Value) reflect.Value {
+	if v.CanSet() {
+		return v
+	}
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+}
+
+// readable returns v, which may have been read from an unexported field, as
+// a value that may be stored elsewhere.
+func readable(v reflect.Value) reflect.Value {
+	if v.CanInterface() {
+		return v
+	}
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "sync/atomic"
+
+// WithCopyOnWrite keeps the mappings in an immutable map, which is copied,
+// and atomically swapped, by each change.  Get, Lookup, and their variants
+// then retrieve values without taking any lock, or writing to shared memory,
+// so that latency-sensitive C callbacks never wait on a writer.
+//
+// Mapping and deleting copy all mappings, and so suit Mappers whose mappings
+// change rarely, and number no more than a few thousand.  Unlike
+// WithCopyOnMap, it does not copy the mapped values.
+func WithCopyOnWrite() Option {
+	return func(mapper *Mapper) {
+		mapper.newStorage = func(capacity int) storage {
+			return newCOWStorage(capacity)
+		}
+		mapper.lockFree = true
+	}
+}
+
+// cowStorage is the storage of a Mapper created using WithCopyOnWrite.  As
+// the Mapper's write lock is held while it is modified, there is only one
+// writer at a time.
+type cowStorage struct {
+	// v holds the current *keyMap, which is never modified.
+	v atomic.Value
+
+	// capacity is the number of entries the map is allocated to hold.
+	capacity int
+}
+
+func newCOWStorage(capacity int) *cowStorage {
+	s := &cowStorage{capacity: capacity}
+	s.v.Store(&keyMap{})
+	return s
+}
+
+// current returns the current map.
+func (s *cowStorage) current() *keyMap {
+	return s.v.Load().(*keyMap)
+}
+
+// copied returns a copy of the current map, with room for one more entry.
+func (s *cowStorage) copied() *keyMap {
+	cur := s.current()
+	n := len(cur.m) + 1
+	if n < s.capacity {
+		n = s.capacity
+	}
+	m := cur.copied(n)
+	return &m
+}
+
+func (s *cowStorage) load(key Key) (e entry, ok bool) {
+	return s.current().load(key)
+}
+
+func (s *cowStorage) store(key Key, e entry) {
+	m := s.copied()
+	m.store(key, e, 0)
+	s.v.Store(m)
+}
+
+func (s *cowStorage) delete(key Key) {
+	if _, ok := s.current().load(key); !ok {
+		return
+	}
+	m := s.copied()
+	m.delete(key)
+	s.v.Store(m)
+}
+
+func (s *cowStorage) len() int {
+	return s.current().len()
+}
+
+func (s *cowStorage) each(fn func(key Key, e entry) bool) {
+	s.current().each(fn)
+}
+
+func (s *cowStorage) clear() {
+	s.v.Store(&keyMap{})
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// COwned bundles a C object with the Go value mapped to it, and the function
+// that destroys the C object, so that both sides are torn down together, in
+// the right order, by Close.
+type COwned[T any] struct {
+	// Ptr is the C object.
+	Ptr unsafe.Pointer
+
+	// Value is the Go value mapped to Ptr.
+	Value T
+
+	mapper  *Mapper
+	key     Key
+	destroy func(unsafe.Pointer)
+	once    sync.Once
+}
+
+// NewCOwned maps value against the C object ptr, as MapPtrPair does, and
+// returns a COwned that destroys the C object using destroy when closed.  If
+// mapper is nil, the global mapper G is used.
+func NewCOwned[T any](mapper *Mapper, ptr unsafe.Pointer, value T, destroy func(unsafe.Pointer)) *COwned[T] {
+	if mapper == nil {
+		mapper = &G
+	}
+	return &COwned[T]{
+		Ptr:     ptr,
+		Value:   value,
+		mapper:  mapper,
+		key:     mapper.MapPtrPair(ptr, value),
+		destroy: destroy,
+	}
+}
+
+// Key returns the key of the mapping between the C object and the Go value.
+func (o *COwned[T]) Key() Key {
+	return o.key
+}
+
+// Close destroys the C object, and then deletes the mapping.  The mapping
+// outlives the C object so that callbacks made by C during its destruction
+// can still resolve the Go value.  Close may be called more than once, and
+// always returns nil.
+func (o *COwned[T]) Close() error {
+	o.once.Do(func() {
+		if o.destroy != nil {
+			o.destroy(o.Ptr)
+		}
+		o.mapper.Delete(o.key)
+	})
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cstring interns Go strings as C strings, whose lifetime is tied to
+// a mapping in a mapper.Mapper.
+//
+// Wrappers that repeatedly pass the same identifiers to C otherwise either
+// leak the strings returned by C.CString, or allocate and free them on every
+// call.  A Cache allocates each string once per mapping, and frees it when
+// the mapping is deleted or cleared.
+package cstring // go.jpap.org/mapper/cstring
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+// Cache interns C strings for mappings of a Mapper.  The zero value is ready
+// to use, with the global mapper.G.
+type Cache struct {
+	// Mapper holds the mappings that own the strings; if nil, mapper.G is
+	// used.
+	Mapper *mapper.Mapper
+
+	mu   sync.Mutex
+	strs map[mapper.Key]map[string]unsafe.Pointer
+}
+
+func (c *Cache) mapper() *mapper.Mapper {
+	if c.Mapper == nil {
+		return &mapper.G
+	}
+	return c.Mapper
+}
+
+// CString returns a NUL-terminated C copy of s, owned by the mapping for key.
+// Repeated calls with the same key and string return the same pointer, which
+// remains valid until the mapping is deleted or cleared.  The result is an
+// unsafe.Pointer because C types are not shared between Go packages; convert
+// it using (*C.char)(p).
+//
+// CString panics if key is not mapped.
+func (c *Cache) CString(key mapper.Key, s string) unsafe.Pointer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	strs, ok := c.strs[key]
+	if ok {
+		if p, ok := strs[s]; ok {
+			return p
+		}
+	} else {
+		if !c.mapper().OnDelete(key, func() { c.release(key) }) {
+			panic(fmt.Errorf("key not mapped: 0x%x", key.Handle()))
+		}
+		strs = make(map[string]unsafe.Pointer)
+		if c.strs == nil {
+			c.strs = make(map[mapper.Key]map[string]unsafe.Pointer)
+		}
+		c.strs[key] = strs
+	}
+
+	p := unsafe.Pointer(C.CString(s))
+	strs[s] = p
+	return p
+}
+
+// Len returns the number of C strings held for key.
+func (c *Cache) Len(key mapper.Key) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.strs[key])
+}
+
+// release frees the strings owned by a deleted mapping.
+func (c *Cache) release(key mapper.Key) {
+	c.mu.Lock()
+	strs := c.strs[key]
+	delete(c.strs, key)
+	c.mu.Unlock()
+
+	for _, p := range strs {
+		C.free(p)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cstring_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/cstring"
+)
+
+// goString copies a NUL-terminated C string.
+func goString(p unsafe.Pointer) string {
+	var b []byte
+	for ; *(*byte)(p) != 0; p = unsafe.Pointer(uintptr(p) + 1) {
+		b = append(b, *(*byte)(p))
+	}
+	return string(b)
+}
+
+func TestCache(t *testing.T) {
+	m := mapper.New()
+	c := cstring.Cache{Mapper: m}
+	key := m.MapValue("object")
+
+	p := c.CString(key, "name")
+	if goString(p) != "name" {
+		t.Fatalf("got %q", goString(p))
+	}
+	if c.CString(key, "name") != p {
+		t.Fatal("string not interned")
+	}
+	c.CString(key, "other")
+	if n := c.Len(key); n != 2 {
+		t.Fatalf("got %d strings, want 2", n)
+	}
+
+	m.Delete(key)
+	if n := c.Len(key); n != 0 {
+		t.Fatalf("got %d strings after delete, want 0", n)
+	}
+
+	key = m.MapValue("object")
+	c.CString(key, "name")
+	m.Clear()
+	if n := c.Len(key); n != 0 {
+		t.Fatalf("got %d strings after clear, want 0", n)
+	}
+}
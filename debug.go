@@ -0,0 +1,124 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// debugFlags select the diagnostics of debug mode.
+type debugFlags uint8
+
+const (
+	// debugValidate checks the types of values against their namespaces,
+	// and explains missing keys.
+	debugValidate debugFlags = 1 << iota
+
+	// debugStacks records the goroutine and stack creating each mapping,
+	// and its retrievals.
+	debugStacks
+
+	// debugTombstones remembers recently deleted keys.
+	debugTombstones
+
+	// debugAudit records recent map and delete operations in a ring.
+	debugAudit
+
+	debugAll = debugValidate | debugStacks | debugTombstones | debugAudit
+)
+
+// debug enables diagnostics that are too costly to leave on in production.
+// All are enabled by building with the "mapperdebug" tag:
+//
+//	go build -tags mapperdebug
+//
+// or, without rebuilding, by setting the GOMAPPER_DEBUG environment variable
+// when the program starts, to 1 or all, or to a comma-separated list of
+// validate, stacks, tombstones, and audit:
+//
+//	GOMAPPER_DEBUG=stacks,tombstones ./program
+var debug debugFlags
+
+// has reports whether the diagnostics f are enabled.
+func (d debugFlags) has(f debugFlags) bool {
+	return d&f != 0
+}
+
+func init() {
+	if v := os.Getenv("GOMAPPER_DEBUG"); v != "" {
+		debug |= parseDebug(v)
+	}
+}
+
+// parseDebug parses the value of GOMAPPER_DEBUG, logging unknown names.
+func parseDebug(v string) debugFlags {
+	var d debugFlags
+	for _, name := range strings.Split(v, ",") {
+		switch strings.TrimSpace(name) {
+		case "1", "all":
+			d |= debugAll
+		case "0", "":
+		case "validate":
+			d |= debugValidate
+		case "stacks":
+			d |= debugStacks
+		case "tombstones":
+			d |= debugTombstones
+		case "audit":
+			d |= debugAudit
+		default:
+			log.Printf("mapper: unknown GOMAPPER_DEBUG diagnostics %q", name)
+		}
+	}
+	return d
+}
+
+// missError returns the error used to panic when key is not mapped.  In debug
+// mode, it explains the likely cause, where it can.
+func (mapper *Mapper) missError(key Key) error {
+	if t, ok := mapper.freedAt(mapper.canonical(key)); ok {
+		return fmt.Errorf("use after free: key 0x%x was freed by C %v ago", key.v, time.Since(t))
+	}
+	if err := mapper.versionError(key); err != nil {
+		return err
+	}
+	if err := mapper.idError(key); err != nil {
+		return err
+	}
+	if err := mapper.generationError(key); err != nil {
+		return err
+	}
+	if debug.has(debugValidate) {
+		if hint := mapper.truncationHint(key); hint != "" {
+			return fmt.Errorf("key not mapped: 0x%x; %s", key.v, hint)
+		}
+	}
+	return fmt.Errorf("key not mapped: 0x%x", key.v)
+}
+
+// truncationHint checks whether key is a live key truncated to 32 bits, as
+// happens when a C API stores the handle in a 32-bit field.
+func (mapper *Mapper) truncationHint(key Key) string {
+	if unsafe.Sizeof(key.v) <= 4 || key.domain != 0 {
+		return ""
+	}
+	var hint string
+	mapper.mux.RLock()
+	mapper.eachLocked(func(k Key, _ entry) bool {
+		if k.domain == 0 && uint32(k.v) == uint32(key.v) {
+			hint = fmt.Sprintf("it matches the live key 0x%x truncated to 32 bits: "+
+				"a C API may be storing the handle in a 32-bit field (see With32BitHandles)", k.v)
+			return false
+		}
+		return true
+	})
+	mapper.mux.RUnlock()
+	return hint
+}
@@ -0,0 +1,12 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build mapperdebug
+// +build mapperdebug
+
+package mapper
+
+func init() {
+	debug = debugAll
+}
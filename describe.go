@@ -0,0 +1,220 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyInfo describes what a Mapper knows about a key, as reported by Info.
+type KeyInfo struct {
+	// Handle is the handle of the key.
+	Handle uintptr
+
+	// Mapped reports whether the key is mapped.
+	Mapped bool
+
+	// Type, Namespace, Created, Goroutine, and Size are as for
+	// SnapshotEntry.  They describe the live mapping, or in debug mode, the
+	// last deleted mapping of an unmapped key.
+	Type      string
+	Namespace string
+	Created   time.Time
+	Goroutine uint64
+	Size      int64
+
+	// Uses is the number of uses remaining of a mapping made by
+	// MapValueUses, and zero for other mappings.
+	Uses int64
+
+	// LastGet is when the mapping was last retrieved by Get, Lookup, or
+	// their variants.  It is only recorded in debug mode.
+	LastGet time.Time
+
+	// Stack is the stack of the goroutine that created the mapping.  It is
+	// only recorded in debug mode.
+	Stack string
+
+	// Callers are the most recent retrievals of the mapping by Go code
+	// called back from C, most recent first.  They are only recorded in
+	// debug mode.
+	Callers []Caller
+
+	// Deleted is when the key was last deleted, if it is not mapped.  It is
+	// only recorded in debug mode, for the most recent deletions.
+	Deleted time.Time
+}
+
+// Info returns what the mapper knows about key.  Much of it is only recorded
+// in debug mode.
+func (mapper *Mapper) Info(key Key) KeyInfo {
+	key = mapper.canonical(key)
+	info := KeyInfo{Handle: key.v}
+	var se SnapshotEntry
+	var diag *diagnostics
+	mapper.mux.RLock()
+	if e, ok := mapper.loadLocked(key); ok {
+		info.Mapped = true
+		se, diag = snapshotEntry(key, e), e.diag()
+		if e.uses != nil {
+			if n := atomic.LoadInt64(e.uses); n > 0 {
+				info.Uses = n
+			}
+		}
+	} else if t, ok := mapper.tombstones[key]; ok {
+		se, diag = t.SnapshotEntry, t.diag
+		info.Deleted = t.deleted
+	}
+	mapper.mux.RUnlock()
+
+	info.Type = se.Type
+	info.Namespace = se.Namespace
+	info.Created = se.Created
+	info.Goroutine = se.Goroutine
+	info.Size = se.Size
+	info.Callers = se.Callers
+	if diag != nil {
+		if t := atomic.LoadInt64(&diag.lastGet); t != 0 {
+			info.LastGet = time.Unix(0, t)
+		}
+		info.Stack = formatStack(diag.stack)
+	}
+	return info
+}
+
+// Describe returns a description of what the mapper knows about key, as
+// reported by Info, for bug reports and logs.
+func (mapper *Mapper) Describe(key Key) string {
+	return mapper.Info(key).String()
+}
+
+// String formats the KeyInfo over several lines.
+func (info KeyInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "key 0x%x: ", info.Handle)
+	switch {
+	case info.Mapped:
+		b.WriteString("mapped")
+	case !info.Deleted.IsZero():
+		fmt.Fprintf(&b, "not mapped; deleted %v ago", time.Since(info.Deleted).Round(time.Microsecond))
+	default:
+		b.WriteString("not mapped")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\n\ttype: %s", info.Type)
+	if info.Namespace != "" {
+		fmt.Fprintf(&b, "\n\tnamespace: %s", info.Namespace)
+	}
+	fmt.Fprintf(&b, "\n\tcreated: %v (%v ago)", info.Created.Format(time.RFC3339Nano),
+		time.Since(info.Created).Round(time.Microsecond))
+	if info.Goroutine != 0 {
+		fmt.Fprintf(&b, "\n\tgoroutine: %d", info.Goroutine)
+	}
+	if info.Size != 0 {
+		fmt.Fprintf(&b, "\n\tsize: %d bytes", info.Size)
+	}
+	if info.Uses != 0 {
+		fmt.Fprintf(&b, "\n\tuses remaining: %d", info.Uses)
+	}
+	if !info.LastGet.IsZero() {
+		fmt.Fprintf(&b, "\n\tlast get: %v ago", time.Since(info.LastGet).Round(time.Microsecond))
+	}
+	for _, c := range info.Callers {
+		thread := "Go"
+		if c.Foreign {
+			thread = "foreign"
+		}
+		fmt.Fprintf(&b, "\n\tgot from C on %s thread %d, %v ago", thread, c.Thread,
+			time.Since(c.Time).Round(time.Microsecond))
+	}
+	if info.Stack != "" {
+		fmt.Fprintf(&b, "\n\tcreated at:\n%s", info.Stack)
+	}
+	return b.String()
+}
+
+// diagnostics are the details of an entry recorded in debug mode.
+type diagnostics struct {
+	// goid is the goroutine that created the entry.
+	goid uint64
+
+	// stack is the stack that created the entry.
+	stack []uintptr
+
+	// lastGet is when the entry was last retrieved, in nanoseconds since the
+	// Unix epoch; accessed atomically.
+	lastGet int64
+
+	// callers are the most recent retrievals by C callbacks, oldest first;
+	// protected by mux.
+	mux     sync.Mutex
+	callers []Caller
+}
+
+// newDiagnostics returns the diagnostics of an entry created by the caller.
+func newDiagnostics() *diagnostics {
+	pc := make([]uintptr, 32)
+	return &diagnostics{goid: goid(), stack: pc[:runtime.Callers(2, pc)]}
+}
+
+// got records the retrieval of the entry holding d, which may be nil, and
+// the C caller making the retrieval, if any.
+func (d *diagnostics) got() {
+	if d == nil {
+		return
+	}
+	atomic.StoreInt64(&d.lastGet, time.Now().UnixNano())
+	if c, ok := cCaller(); ok {
+		d.called(c)
+	}
+}
+
+// formatStack formats the stack pc, omitting the frames of this package.
+func formatStack(pc []uintptr) string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(pc)
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, "go.jpap.org/mapper.") {
+			fmt.Fprintf(&b, "\t\t%s\n\t\t\t%s:%d\n", f.Function, f.File, f.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// maxTombstones limits the deleted keys remembered in debug mode.
+const maxTombstones = 1024
+
+// tombstone records a deleted entry, in debug mode.
+type tombstone struct {
+	SnapshotEntry
+	diag    *diagnostics
+	deleted time.Time
+}
+
+// bury records the deletion of the mapping of key to e, in debug mode,
+// forgetting the oldest deletion once maxTombstones are recorded.  The caller
+// must hold the write lock.
+func (mapper *Mapper) bury(key Key, e entry) {
+	if mapper.tombstones == nil {
+		mapper.tombstones = make(map[Key]tombstone)
+	}
+	if _, ok := mapper.tombstones[key]; !ok {
+		if len(mapper.buried) == maxTombstones {
+			delete(mapper.tombstones, mapper.buried[0])
+			mapper.buried = mapper.buried[1:]
+		}
+		mapper.buried = append(mapper.buried, key)
+	}
+	mapper.tombstones[key] = tombstone{snapshotEntry(key, e), e.diag(), time.Now()}
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package destructor provides a destructor trampoline for C registration
+// APIs that call a destructor with their user data once the registration is
+// released, so that the C library itself deletes the mapping of the user
+// data.
+//
+// Map a value in the Mapper Target, by default the global mapper.G, using Map,
+// and pass its handle as the user data, with mapper_destroy, declared in
+// destructor.h in this package's directory, as the destructor:
+//
+//	static int create_function(sqlite3 *db, const char *name, uintptr_t handle) {
+//		return sqlite3_create_function_v2(db, name, 1, SQLITE_UTF8,
+//			(void *)handle, goFunc, NULL, NULL, mapper_destroy);
+//	}
+//
+//	key := destructor.Map(fn, nil)
+//	C.create_function(db, cname, C.uintptr_t(key.Handle()))
+package destructor // go.jpap.org/mapper/destructor
+
+/*
+#include "destructor.h"
+*/
+import "C"
+import (
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/internal/bridge"
+)
+
+// Target is the Mapper in which Map maps values.  mapper_destroy deletes each
+// value from the Mapper it was mapped in, even once Target is changed.  Target
+// is not safe to change concurrently with Map.
+var Target = &mapper.G
+
+// Map maps value in Target, returning the key whose handle is passed to C as
+// user data, with mapper_destroy as its destructor.  teardown, if not nil, is
+// called with value once C destroys the registration, or the mapping is
+// otherwise deleted.
+func Map(value interface{}, teardown func(value interface{})) mapper.Key {
+	m := Target
+	key := bridge.Map(m, value)
+	if teardown != nil {
+		m.OnDelete(key, func() { teardown(value) })
+	}
+	return key
+}
+
+//export mapper_destroy
+func mapper_destroy(user unsafe.Pointer) {
+	if !bridge.DeleteHandle(uintptr(user)) {
+		// Report the miss as the Mapper would.
+		Target.DeletePtr(user)
+	}
+}
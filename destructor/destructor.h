@@ -0,0 +1,15 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#ifndef GO_JPAP_ORG_MAPPER_DESTRUCTOR_H
+#define GO_JPAP_ORG_MAPPER_DESTRUCTOR_H
+
+// mapper_destroy deletes the mapping of the handle passed as user data,
+// running its Go teardown.  Pass it as the destructor of a registration whose
+// user data is a handle, such as the xDestroy of
+// sqlite3_create_function_v2, or a GDestroyNotify.  It may be called from
+// any thread.
+extern void mapper_destroy(void *user);
+
+#endif // GO_JPAP_ORG_MAPPER_DESTRUCTOR_H
@@ -0,0 +1,155 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dispatch runs callbacks resolved through a mapper.Mapper on a
+// designated goroutine, rather than inline on the C thread making the call.
+//
+// Many C libraries invoke callbacks from their own internal threads.  Running
+// arbitrary Go code inline on those threads can lead to ordering and
+// re-entrancy bugs, because callbacks from different threads interleave, and
+// may call back into the library.  A Dispatcher instead queues each callback,
+// together with the Go value resolved from its handle, to be run in order by
+// a single goroutine:
+//
+//	d := dispatch.New(64, dispatch.Block)
+//	go d.Run(ctx)
+//
+//	//export onEvent
+//	func onEvent(handle C.uintptr_t, code C.int) {
+//		d.Dispatch(&mapper.G, mapper.KeyFromHandle(uintptr(handle)), func(v interface{}) {
+//			v.(*Widget).handle(int(code))
+//		})
+//	}
+package dispatch // go.jpap.org/mapper/dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.jpap.org/mapper"
+)
+
+// Backpressure is the policy applied when a callback is dispatched to a full
+// queue.
+type Backpressure int
+
+const (
+	// Block waits until there is room in the queue, stalling the C thread.
+	Block Backpressure = iota
+
+	// Reject drops the callback, and Dispatch returns ErrQueueFull.
+	Reject
+)
+
+var (
+	// ErrQueueFull is returned by Dispatch when a Reject dispatcher's queue
+	// is full.
+	ErrQueueFull = errors.New("dispatch: queue full")
+
+	// ErrStopped is returned when the dispatcher's Run has returned.
+	ErrStopped = errors.New("dispatch: dispatcher stopped")
+)
+
+// Dispatcher queues callbacks to run on the goroutine calling Run.
+type Dispatcher struct {
+	queue   chan func()
+	policy  Backpressure
+	stopped chan struct{}
+}
+
+// New returns a new Dispatcher with a queue of the given size, applying the
+// backpressure policy when the queue is full.
+func New(size int, policy Backpressure) *Dispatcher {
+	return &Dispatcher{
+		queue:   make(chan func(), size),
+		policy:  policy,
+		stopped: make(chan struct{}),
+	}
+}
+
+// Run runs queued callbacks in order until ctx is done, and must be called
+// exactly once, from the designated goroutine.  Callbacks still queued when
+// Run returns are discarded.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	defer close(d.stopped)
+	for {
+		select {
+		case fn := <-d.queue:
+			fn()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Dispatch resolves key in m, and queues fn to be called with the resolved
+// value on the dispatcher's goroutine.  It returns an error, without queuing
+// fn, if key is not mapped, the queue is full under the Reject policy, or the
+// dispatcher has stopped.
+func (d *Dispatcher) Dispatch(m *mapper.Mapper, key mapper.Key, fn func(goValue interface{})) error {
+	goValue, ok := m.Lookup(key)
+	if !ok {
+		return fmt.Errorf("dispatch: key not mapped: 0x%x", key.Handle())
+	}
+	return d.enqueue(func() { fn(goValue) }, d.policy)
+}
+
+// Call is like Dispatch, but waits for fn to return, regardless of the
+// backpressure policy.  It suits callbacks that must return a result to C.
+// Call must not be used on the dispatcher's own goroutine.
+func (d *Dispatcher) Call(m *mapper.Mapper, key mapper.Key, fn func(goValue interface{})) error {
+	goValue, ok := m.Lookup(key)
+	if !ok {
+		return fmt.Errorf("dispatch: key not mapped: 0x%x", key.Handle())
+	}
+	return d.Do(func() { fn(goValue) })
+}
+
+// Do calls fn on the dispatcher's goroutine, and waits for it to return.
+// Like Call, it must not be used on the dispatcher's own goroutine.
+func (d *Dispatcher) Do(fn func()) error {
+	done := make(chan struct{})
+	err := d.enqueue(func() {
+		defer close(done)
+		fn()
+	}, Block)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-d.stopped:
+		// Run may have returned after running fn.
+		select {
+		case <-done:
+			return nil
+		default:
+			return ErrStopped
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(fn func(), policy Backpressure) error {
+	select {
+	case <-d.stopped:
+		return ErrStopped
+	default:
+	}
+	if policy == Reject {
+		select {
+		case d.queue <- fn:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+	select {
+	case d.queue <- fn:
+		return nil
+	case <-d.stopped:
+		return ErrStopped
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dispatch_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/dispatch"
+)
+
+func TestDispatchInOrder(t *testing.T) {
+	m := mapper.New()
+	key := m.MapValue(new([]int))
+
+	d := dispatch.New(4, dispatch.Block)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	// Callbacks from several threads all run on the dispatcher goroutine, so
+	// the unsynchronized append is safe.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d.Dispatch(m, key, func(v interface{}) {
+				s := v.(*[]int)
+				*s = append(*s, i)
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	var n int
+	if err := d.Call(m, key, func(v interface{}) { n = len(*v.(*[]int)) }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 100 {
+		t.Fatalf("ran %d callbacks, want 100", n)
+	}
+}
+
+func TestDispatchReject(t *testing.T) {
+	m := mapper.New()
+	key := m.MapValue("value")
+	d := dispatch.New(1, dispatch.Reject)
+
+	if err := d.Dispatch(m, key, func(interface{}) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Dispatch(m, key, func(interface{}) {}); err != dispatch.ErrQueueFull {
+		t.Fatalf("got %v, want ErrQueueFull", err)
+	}
+	if err := d.Dispatch(m, mapper.KeyFromHandle(1<<20), func(interface{}) {}); err == nil {
+		t.Fatal("dispatch of unmapped key succeeded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Run(ctx)
+	if err := d.Call(m, key, func(interface{}) {}); err != dispatch.ErrStopped {
+		t.Fatalf("got %v, want ErrStopped", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package errcode maps Go errors to C int error codes, and back.
+//
+// A Go callback invoked by C can often only report failure by returning an
+// int.  Using a Registry, the callback returns a code for its error, and when
+// C later reports the failure back to Go, say, as the result of the C call
+// that invoked the callback, the code is exchanged for the original Go error,
+// rather than a bare integer.
+package errcode // go.jpap.org/mapper/errcode
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.jpap.org/mapper"
+)
+
+// Codes of registered errors have an absolute value less than MaxFixed.
+// Transient codes, returned by Code for other errors, lie between -MaxFixed
+// and -2*MaxFixed.
+const MaxFixed = 0x10000
+
+// UnknownError is returned by Err for a code that is not known.
+type UnknownError int
+
+func (e UnknownError) Error() string {
+	return fmt.Sprintf("unknown error code %d", int(e))
+}
+
+// Registry maps errors to codes.  The zero value is ready to use.
+type Registry struct {
+	// Overflow is the code returned by Code when no more transient codes are
+	// available; if zero, -1 is used.
+	Overflow int
+
+	mu      sync.Mutex
+	fixed   []fixed
+	pending *mapper.Mapper
+}
+
+type fixed struct {
+	code int
+	err  error
+}
+
+// Register associates err with a fixed code, such as an errno value used by
+// the C API.  Code returns the fixed code for any error that matches err
+// according to errors.Is, and Err returns err for the code.  The code must be
+// non-zero, with an absolute value less than MaxFixed.
+func (r *Registry) Register(code int, err error) {
+	if code == 0 || code <= -MaxFixed || code >= MaxFixed {
+		panic(fmt.Errorf("invalid fixed code: %d", code))
+	}
+	r.mu.Lock()
+	r.fixed = append(r.fixed, fixed{code, err})
+	r.mu.Unlock()
+}
+
+// Code returns the code for err, which is zero for a nil error.  If err
+// matches a registered error, its fixed code is returned.  Otherwise err is
+// held by the Registry under a new transient code, until it is retrieved by
+// Err.
+func (r *Registry) Code(err error) int {
+	if err == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.fixed {
+		if errors.Is(err, f.err) {
+			return f.code
+		}
+	}
+
+	if r.pending == nil {
+		r.pending = mapper.New(mapper.WithCompactHandles())
+	}
+	key, kerr := r.pending.TryMapValue(err)
+	if kerr != nil {
+		if r.Overflow == 0 {
+			return -1
+		}
+		return r.Overflow
+	}
+	return -MaxFixed - int(key.Handle())
+}
+
+// Err returns the error for code, which is nil for zero.  The error held for
+// a transient code is released, so Err returns an UnknownError if called with
+// the same transient code again.
+func (r *Registry) Err(code int) error {
+	if code == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.fixed {
+		if f.code == code {
+			return f.err
+		}
+	}
+
+	if code <= -MaxFixed && code > -2*MaxFixed && r.pending != nil {
+		key := mapper.KeyFromHandle(uintptr(-MaxFixed - code))
+		if err, ok := r.pending.Lookup(key); ok {
+			r.pending.Delete(key)
+			return err.(error)
+		}
+	}
+	return UnknownError(code)
+}
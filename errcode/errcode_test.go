@@ -0,0 +1,42 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package errcode_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"go.jpap.org/mapper/errcode"
+)
+
+func TestRegistry(t *testing.T) {
+	var r errcode.Registry
+	r.Register(-5, io.EOF)
+
+	if code := r.Code(nil); code != 0 {
+		t.Fatalf("nil error has code %d", code)
+	}
+	if code := r.Code(fmt.Errorf("wrapped: %w", io.EOF)); code != -5 {
+		t.Fatalf("wrapped io.EOF has code %d, want -5", code)
+	}
+	if err := r.Err(-5); err != io.EOF {
+		t.Fatalf("code -5 has error %v", err)
+	}
+
+	rich := errors.New("rich error")
+	code := r.Code(rich)
+	if code > -errcode.MaxFixed {
+		t.Fatalf("transient code %d overlaps fixed codes", code)
+	}
+	if err := r.Err(code); err != rich {
+		t.Fatalf("got %v, want %v", err, rich)
+	}
+	var unknown errcode.UnknownError
+	if err := r.Err(code); !errors.As(err, &unknown) {
+		t.Fatalf("transient code not released: %v", err)
+	}
+}
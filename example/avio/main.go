@@ -0,0 +1,142 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build mapperexamples
+// +build mapperexamples
+
+// Command avio probes a media file with FFmpeg, reading it through a Go
+// io.ReadSeeker using custom AVIO callbacks, rather than letting FFmpeg open
+// the file itself.
+//
+// The Go reader is mapped by an iobridge.Stream, whose handle is passed as the
+// AVIOContext's opaque pointer; short C adapters pass it on to the bridge's
+// callbacks.  The mapping is deleted only after avio_context_free, once FFmpeg
+// can no longer call back.
+//
+// The example needs FFmpeg's development files, and a build tag:
+//
+//	go run -tags mapperexamples ./example/avio file.mp4
+package main
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../iobridge
+#cgo pkg-config: libavformat libavcodec libavutil
+#include <errno.h>
+#include <stdint.h>
+#include <libavcodec/avcodec.h>
+#include <libavformat/avformat.h>
+#include <libavutil/mem.h>
+#include "iobridge.h"
+
+static int read_packet(void *opaque, uint8_t *buf, int size) {
+	return (int)mapper_io_read((uintptr_t)opaque, buf, size);
+}
+
+static int64_t seek(void *opaque, int64_t offset, int whence) {
+	return mapper_io_seek((uintptr_t)opaque, offset, whence);
+}
+
+// Note the use of uintptr_t for the handle passed in from Go.
+static AVIOContext *alloc_avio(uintptr_t handle, int buffer_size) {
+	unsigned char *buf = av_malloc(buffer_size);
+	if (buf == NULL) {
+		return NULL;
+	}
+	AVIOContext *avio = avio_alloc_context(buf, buffer_size, 0, (void *)handle,
+		read_packet, NULL, seek);
+	if (avio == NULL) {
+		av_free(buf);
+	}
+	return avio;
+}
+
+// free_avio frees the context and its buffer, which FFmpeg may have replaced.
+static void free_avio(AVIOContext *avio) {
+	av_freep(&avio->buffer);
+	avio_context_free(&avio);
+}
+
+static int open_input(AVFormatContext **fmt, AVIOContext *avio) {
+	*fmt = avformat_alloc_context();
+	if (*fmt == NULL) {
+		return AVERROR(ENOMEM);
+	}
+	(*fmt)->pb = avio;
+	(*fmt)->flags |= AVFMT_FLAG_CUSTOM_IO;
+	// On failure, avformat_open_input frees the context, but not avio.
+	return avformat_open_input(fmt, NULL, NULL, NULL);
+}
+
+static const char *av_err(int err) {
+	static char buf[AV_ERROR_MAX_STRING_SIZE];
+	return av_make_error_string(buf, sizeof(buf), err);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/iobridge"
+)
+
+const bufferSize = 32 << 10
+
+func probe(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stream := iobridge.New(f, iobridge.AVIO)
+	// Deferred calls run in reverse order: this runs after free_avio below.
+	defer stream.Close()
+
+	avio := C.alloc_avio(C.uintptr_t(stream.Handle()), bufferSize)
+	if avio == nil {
+		return fmt.Errorf("avio_alloc_context failed")
+	}
+	defer C.free_avio(avio)
+
+	var fmtCtx *C.AVFormatContext
+	if rc := C.open_input(&fmtCtx, avio); rc < 0 {
+		if err := stream.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("avformat_open_input: %s", C.GoString(C.av_err(rc)))
+	}
+	defer C.avformat_close_input(&fmtCtx)
+
+	if rc := C.avformat_find_stream_info(fmtCtx, nil); rc < 0 {
+		return fmt.Errorf("avformat_find_stream_info: %s", C.GoString(C.av_err(rc)))
+	}
+
+	duration := time.Duration(fmtCtx.duration) * (time.Second / C.AV_TIME_BASE)
+	fmt.Printf("%s: %s, %v, %d streams\n", name,
+		C.GoString(fmtCtx.iformat.long_name), duration, fmtCtx.nb_streams)
+	streams := unsafe.Slice(fmtCtx.streams, fmtCtx.nb_streams)
+	for i, st := range streams {
+		par := st.codecpar
+		fmt.Printf("  stream %d: %s %s\n", i,
+			C.GoString(C.av_get_media_type_string(par.codec_type)),
+			C.GoString(C.avcodec_get_name(par.codec_id)))
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: avio file\n")
+		os.Exit(2)
+	}
+	if err := probe(os.Args[1]); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("live mappings:", mapper.G.Stats().Live)
+}
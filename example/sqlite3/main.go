@@ -0,0 +1,231 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build mapperexamples
+// +build mapperexamples
+
+// Command sqlite3 registers Go functions and an update hook with SQLite, using
+// handles from the mapper as their user data.
+//
+// SQLite owns the user data of a function until it calls the function's
+// xDestroy callback, when the function is replaced, or the database is
+// closed; the mapping is deleted there, by the destructor trampoline of
+// package go.jpap.org/mapper/destructor, and nowhere else.  The update hook
+// has no destructor: its mapping is deleted when the hook is replaced, using
+// the user data returned by sqlite3_update_hook.
+//
+// The example needs SQLite's development files, and a build tag:
+//
+//	go run -tags mapperexamples ./example/sqlite3
+package main
+
+/*
+#cgo pkg-config: sqlite3
+#cgo CFLAGS: -I${SRCDIR}/../../destructor
+#include <stdint.h>
+#include <stdlib.h>
+#include <sqlite3.h>
+#include "destructor.h"
+
+extern void goFunc(sqlite3_context *ctx, int argc, sqlite3_value **argv);
+extern void goUpdateHook(void *user, int op, char *db, char *table, sqlite3_int64 rowid);
+
+typedef void (*update_hook_t)(void *, int, const char *, const char *, sqlite3_int64);
+
+// Note the use of uintptr_t for the handles passed in from Go.
+static int create_function(sqlite3 *db, const char *name, int nargs, uintptr_t handle) {
+	return sqlite3_create_function_v2(db, name, nargs, SQLITE_UTF8,
+		(void *)handle, goFunc, NULL, NULL, mapper_destroy);
+}
+
+static uintptr_t update_hook(sqlite3 *db, uintptr_t handle) {
+	return (uintptr_t)sqlite3_update_hook(db, (update_hook_t)goUpdateHook, (void *)handle);
+}
+
+static void result_text(sqlite3_context *ctx, const char *s, int n) {
+	sqlite3_result_text(ctx, s, n, SQLITE_TRANSIENT);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"log"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/destructor"
+)
+
+// function is a Go implementation of an SQL function taking and returning
+// text.
+type function func(args []string) string
+
+// updateHook is called for each row inserted, updated, or deleted.
+type updateHook func(op int, table string, rowid int64)
+
+type db struct {
+	db *C.sqlite3
+}
+
+func open(name string) (*db, error) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	var d db
+	if rc := C.sqlite3_open(cname, &d.db); rc != C.SQLITE_OK {
+		C.sqlite3_close(d.db)
+		return nil, fmt.Errorf("sqlite3_open: %s", C.GoString(C.sqlite3_errstr(rc)))
+	}
+	return &d, nil
+}
+
+func (d *db) err() error {
+	return fmt.Errorf("sqlite3: %s", C.GoString(C.sqlite3_errmsg(d.db)))
+}
+
+// close closes the database, which destroys its functions, deleting their
+// mappings.
+func (d *db) close() error {
+	d.setUpdateHook(nil)
+	if C.sqlite3_close(d.db) != C.SQLITE_OK {
+		return d.err()
+	}
+	return nil
+}
+
+// createFunction registers fn as the SQL function name, taking nargs
+// arguments.  Registering another function with the same name and number of
+// arguments destroys fn.
+func (d *db) createFunction(name string, nargs int, fn function) error {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	key := destructor.Map(fn, nil)
+	if C.create_function(d.db, cname, C.int(nargs), C.uintptr_t(key.Handle())) != C.SQLITE_OK {
+		// SQLite calls xDestroy on failure, which deletes the mapping.
+		return d.err()
+	}
+	return nil
+}
+
+// setUpdateHook sets, or clears if fn is nil, the database's update hook.
+func (d *db) setUpdateHook(fn updateHook) {
+	var handle uintptr
+	if fn != nil {
+		handle = mapper.G.MapValue(fn).Handle()
+	}
+	if old := C.update_hook(d.db, C.uintptr_t(handle)); old != 0 {
+		mapper.G.DeleteHandle(uintptr(old))
+	}
+}
+
+func (d *db) exec(sql string) error {
+	csql := C.CString(sql)
+	defer C.free(unsafe.Pointer(csql))
+	if C.sqlite3_exec(d.db, csql, nil, nil, nil) != C.SQLITE_OK {
+		return d.err()
+	}
+	return nil
+}
+
+// query runs sql, returning the text of the first column of each row.
+func (d *db) query(sql string) ([]string, error) {
+	csql := C.CString(sql)
+	defer C.free(unsafe.Pointer(csql))
+	var stmt *C.sqlite3_stmt
+	if C.sqlite3_prepare_v2(d.db, csql, -1, &stmt, nil) != C.SQLITE_OK {
+		return nil, d.err()
+	}
+	defer C.sqlite3_finalize(stmt)
+
+	var rows []string
+	for {
+		switch C.sqlite3_step(stmt) {
+		case C.SQLITE_ROW:
+			rows = append(rows, C.GoString((*C.char)(unsafe.Pointer(C.sqlite3_column_text(stmt, 0)))))
+		case C.SQLITE_DONE:
+			return rows, nil
+		default:
+			return nil, d.err()
+		}
+	}
+}
+
+//export goFunc
+func goFunc(ctx *C.sqlite3_context, argc C.int, argv **C.sqlite3_value) {
+	fn := mapper.G.GetPtr(C.sqlite3_user_data(ctx)).(function)
+	args := make([]string, argc)
+	for i, v := range unsafe.Slice(argv, argc) {
+		args[i] = C.GoString((*C.char)(unsafe.Pointer(C.sqlite3_value_text(v))))
+	}
+	res := fn(args)
+	cres := C.CString(res)
+	defer C.free(unsafe.Pointer(cres))
+	C.result_text(ctx, cres, C.int(len(res)))
+}
+
+//export goUpdateHook
+func goUpdateHook(user unsafe.Pointer, op C.int, _, table *C.char, rowid C.sqlite3_int64) {
+	fn := mapper.G.GetPtr(user).(updateHook)
+	fn(int(op), C.GoString(table), int64(rowid))
+}
+
+func main() {
+	d, err := open(":memory:")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reverse := func(args []string) string {
+		r := []rune(args[0])
+		for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+			r[i], r[j] = r[j], r[i]
+		}
+		return string(r)
+	}
+	if err := d.createFunction("reverse", 1, reverse); err != nil {
+		log.Fatal(err)
+	}
+
+	// Each function has its own mapping, so they can hold distinct state.
+	calls := 0
+	tag := func(args []string) string {
+		calls++
+		return fmt.Sprintf("%s#%d", args[0], calls)
+	}
+	if err := d.createFunction("tag", 1, tag); err != nil {
+		log.Fatal(err)
+	}
+
+	d.setUpdateHook(func(op int, table string, rowid int64) {
+		ops := map[int]string{C.SQLITE_INSERT: "insert", C.SQLITE_UPDATE: "update", C.SQLITE_DELETE: "delete"}
+		fmt.Printf("update hook: %s %s row %d\n", ops[op], table, rowid)
+	})
+
+	for _, sql := range []string{
+		"CREATE TABLE names (name TEXT)",
+		"INSERT INTO names VALUES ('gopher'), ('sqlite')",
+		"UPDATE names SET name = tag(name)",
+		"DELETE FROM names WHERE rowid = 1",
+	} {
+		if err := d.exec(sql); err != nil {
+			log.Fatal(err)
+		}
+	}
+	rows, err := d.query("SELECT reverse(name) FROM names")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("reversed:", rows)
+
+	// Replacing a function destroys the old one.
+	fmt.Println("live mappings:", mapper.G.Stats().Live)
+	if err := d.createFunction("reverse", 1, func(args []string) string { return args[0] }); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("live mappings after replacing reverse:", mapper.G.Stats().Live)
+
+	if err := d.close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("live mappings after close:", mapper.G.Stats().Live)
+}
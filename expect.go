@@ -0,0 +1,87 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// NamespaceOf is like Mapper.Namespace, but declares that the namespace
+// holds values of type T.  It panics if the namespace was already created
+// without T.
+//
+// In debug mode, mapping a value that is not a T into the namespace panics,
+// as does retrieving one of its values using GetAs or LookupAs with a type
+// that a T cannot be converted to.  Mistakes that would otherwise surface as
+// an "interface conversion" panic deep in a callback are then reported where
+// the value is mapped, or first retrieved.  When T is an interface type,
+// values of any type implementing T may be retrieved by their own type.
+func NamespaceOf[T any](mapper *Mapper, name string) *Namespace {
+	return mapper.namespace(name, typeOf[T]())
+}
+
+// Type returns the type of the values held in the namespace, or nil if it
+// was not created using NamespaceOf.
+func (ns *Namespace) Type() reflect.Type {
+	return ns.typ
+}
+
+// GetAs is like Get, but returns the mapped value as a T, panicking with the
+// key and the mapped value's type if it is not a T.
+func GetAs[T any](mapper *Mapper, key Key) T {
+	var goValue T
+	e, ok := mapper.lookupEntry(key)
+	if ok {
+		goValue, ok = entryAs[T](e)
+	} else {
+		// Get panics, unless an OnMiss handler supplies the value.
+		e.value = mapper.Get(key)
+		goValue, ok = e.value.(T)
+	}
+	if !ok {
+		panic(fmt.Errorf("key 0x%x is mapped to %v, not %v", key.v, typeName(e.valueType()), typeOf[T]()))
+	}
+	if debug.has(debugValidate) {
+		mapper.checkExpected(key, typeOf[T]())
+	}
+	return goValue
+}
+
+// typeOf returns the type T, which may be an interface type.
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// checkType panics, in debug mode, if goValue may not be mapped in the
+// namespace.
+func (ns *Namespace) checkType(goValue interface{}) {
+	if !debug.has(debugValidate) || ns.typ == nil {
+		return
+	}
+	typ := reflect.TypeOf(goValue)
+	if typ == nil && ns.typ.Kind() == reflect.Interface || typ != nil && typ.AssignableTo(ns.typ) {
+		return
+	}
+	panic(fmt.Errorf("mapping %T in namespace %q, which holds %v", goValue, ns.name, ns.typ))
+}
+
+// checkExpected panics, in debug mode, if key belongs to a namespace whose
+// values may not be retrieved as typ.
+func (mapper *Mapper) checkExpected(key Key, typ reflect.Type) {
+	if !debug.has(debugValidate) {
+		return
+	}
+	key = mapper.canonical(key)
+	e, ok := mapper.load(key)
+	ns := e.ns()
+	if !ok || ns == nil || ns.typ == nil {
+		return
+	}
+	if want := ns.typ; !want.AssignableTo(typ) && want.Kind() != reflect.Interface {
+		panic(fmt.Errorf("retrieving key 0x%x as %v from namespace %q, which holds %v",
+			key.v, typ, ns.name, want))
+	}
+}
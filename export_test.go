@@ -0,0 +1,72 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"time"
+	"unsafe"
+)
+
+// SetDebug sets debug mode for a test, returning a function that restores it.
+func SetDebug(on bool) (restore func()) {
+	old := debug
+	debug = 0
+	if on {
+		debug = debugAll
+	}
+	return func() { debug = old }
+}
+
+// LockStorage locks the storage of a Mapper created using WithShards, as a
+// thread in the middle of a lookup would.
+func (mapper *Mapper) LockStorage() {
+	mapper.m.(lockingStorage).lock()
+}
+
+// MaxFreed is the number of freed pointers remembered by a Mapper.
+const MaxFreed = maxFreed
+
+// SkipKeys advances the counter used by MapValue, so that the next key is
+// allocated as if n keys had been allocated meanwhile.
+func (mapper *Mapper) SkipKeys(n uintptr) {
+	mapper.atomicKey += n * (2 << mapper.reservedBits)
+}
+
+// RegisterShared registers s as the shared mapper of another copy of the
+// package, returning the value of the environment variable used, and a
+// function that looks up the shared mapper as another copy would.
+func RegisterShared(s SharedMapper) (env string, lookup func() SharedMapper) {
+	return registerShared(s), func() SharedMapper {
+		return lookupShared()
+	}
+}
+
+// SharedEnv is the environment variable holding the shared mapper.
+const SharedEnv = sharedEnv
+
+// ObfuscateHandle obfuscates the counting-pointer handle v as the mapper
+// would, returning the handle, and the plain handle recovered from it.
+func (mapper *Mapper) ObfuscateHandle(v uintptr) (handle, plain uintptr) {
+	o := mapper.obfuscation()
+	handle = o.handle(v)
+	return handle, o.plain(handle)
+}
+
+// EntrySize is the size of an entry.
+const EntrySize = unsafe.Sizeof(entry{})
+
+// LatencyBucket returns the latency histogram bucket counting ns, and the
+// largest latency the bucket counts.
+func LatencyBucket(ns uint64) (int, time.Duration) {
+	i := bucket(ns)
+	return i, bucketMax(i)
+}
+
+// ParseDebug parses a GOMAPPER_DEBUG value, returning the diagnostics it
+// enables.
+func ParseDebug(v string) (validate, stacks, tombstones, audit bool) {
+	d := parseDebug(v)
+	return d.has(debugValidate), d.has(debugStacks), d.has(debugTombstones), d.has(debugAudit)
+}
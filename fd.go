@@ -0,0 +1,39 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "fmt"
+
+// fdDomain is the Key domain of file descriptor keys.  It is beyond the range
+// used by KeyFromUint for any Domain, so the two never collide.
+const fdDomain = 1 << 17
+
+// KeyFromFD converts a file descriptor to a Key.  The returned key never
+// collides with keys of any other kind.
+func KeyFromFD(fd int) Key {
+	if fd < 0 {
+		panic(fmt.Errorf("invalid file descriptor: %d", fd))
+	}
+	return Key{v: uintptr(fd), domain: fdDomain}
+}
+
+// MapFD maps the given file descriptor to a Go value, and returns the
+// associated Key.  It lets an event loop wrapping a C library associate Go
+// state directly with the file descriptors reported by poll, epoll, or kqueue.
+func (mapper *Mapper) MapFD(fd int, goValue interface{}) Key {
+	key := KeyFromFD(fd)
+	mapper.MapPair(key, goValue)
+	return key
+}
+
+// GetFD calls Get after first converting the given file descriptor to a Key.
+func (mapper *Mapper) GetFD(fd int) (goValue interface{}) {
+	return mapper.Get(KeyFromFD(fd))
+}
+
+// DeleteFD deletes an existing mapping from the given file descriptor.
+func (mapper *Mapper) DeleteFD(fd int) {
+	mapper.Delete(KeyFromFD(fd))
+}
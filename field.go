@@ -0,0 +1,54 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// StoreHandle writes the key's handle into a pointer-sized user-data field
+// at the given byte offset within the C memory at base, such as the user_data
+// field of a C struct:
+//
+//	mapper.StoreHandle(unsafe.Pointer(foo), unsafe.Offsetof(foo.user_data), key)
+//
+// The field must be a void* or uintptr_t, aligned to the size of a pointer.
+// StoreHandle does not know the size of the memory at base, and so cannot
+// check that the field lies within it; take offset from unsafe.Offsetof, as
+// above, rather than computing it.  StoreHandle panics if base is nil, if the
+// field's address overflows, if the field is misaligned, or if the key was
+// made by KeyFromUint or KeyFromFD, because the handle of such a key cannot
+// be converted back to the same key by LoadHandle.
+func StoreHandle(base unsafe.Pointer, offset uintptr, key Key) {
+	checkField(base, offset)
+	if key.domain != 0 {
+		panic(fmt.Errorf("cannot store a token key handle: 0x%x", key.v))
+	}
+	*(*uintptr)(unsafe.Pointer(uintptr(base) + offset)) = key.v
+}
+
+// LoadHandle reads back a handle written by StoreHandle, returning its Key.
+// It panics under the same conditions as StoreHandle.
+func LoadHandle(base unsafe.Pointer, offset uintptr) Key {
+	checkField(base, offset)
+	return KeyFromHandle(*(*uintptr)(unsafe.Pointer(uintptr(base) + offset)))
+}
+
+// checkField checks the address of the pointer-sized field at offset within
+// the memory at base.  It cannot check the field against the size of that
+// memory, which it does not know.
+func checkField(base unsafe.Pointer, offset uintptr) {
+	if base == nil {
+		panic("nil base pointer")
+	}
+	addr := uintptr(base) + offset
+	if addr < uintptr(base) || addr+unsafe.Sizeof(uintptr(0)) < addr {
+		panic(fmt.Errorf("field address overflows: 0x%x + %d", uintptr(base), offset))
+	}
+	if addr%unsafe.Alignof(uintptr(0)) != 0 {
+		panic(fmt.Errorf("field is unaligned: 0x%x", addr))
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "sync"
+
+// BeforeFork, AfterForkParent, and AfterForkChild let a program that forks,
+// usually from C, keep the mapper usable in the child, in the manner of
+// pthread_atfork handlers.
+//
+// BeforeFork locks the mapper, so that the child inherits it in a consistent
+// state; AfterForkParent unlocks it in the parent; and AfterForkChild
+// reinitializes it in the child, whose copies of the locks may be held by
+// threads that do not exist there.
+//
+// Note that a forked child can only safely call into Go if the Go runtime
+// itself survives the fork, which it does not in general; the hooks cannot be
+// registered using pthread_atfork, whose child handler runs before any Go
+// code could.  They suit programs that fork deliberately, and reach Go in the
+// child only through a path they control, such as a sandbox helper that is
+// then handed work over a pipe.
+func (mapper *Mapper) BeforeFork() {
+	mapper.mux.Lock()
+	if s, ok := mapper.m.(lockingStorage); ok {
+		s.lock()
+	}
+	mapper.parts.Range(func(_, v interface{}) bool {
+		v.(*partition).mux.Lock()
+		return true
+	})
+}
+
+// AfterForkParent unlocks the mapper locked by BeforeFork, in the parent.
+func (mapper *Mapper) AfterForkParent() {
+	mapper.parts.Range(func(_, v interface{}) bool {
+		v.(*partition).mux.Unlock()
+		return true
+	})
+	if s, ok := mapper.m.(lockingStorage); ok {
+		s.unlock()
+	}
+	mapper.mux.Unlock()
+}
+
+// AfterForkChild reinitializes the mapper's locks in the child, whether or
+// not BeforeFork was called.  If retain is set, the child keeps the
+// mappings it inherited.  Otherwise they are invalidated: they are removed,
+// as by Clear, but without calling any functions registered by OnDelete,
+// since the resources they release belong to the parent.
+func (mapper *Mapper) AfterForkChild(retain bool) {
+	mapper.mux = sync.RWMutex{}
+	if s, ok := mapper.m.(lockingStorage); ok {
+		s.resetLocks()
+	}
+	mapper.parts.Range(func(_, v interface{}) bool {
+		v.(*partition).mux = sync.RWMutex{}
+		return true
+	})
+	if !retain {
+		mapper.clearLocked()
+	}
+}
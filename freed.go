@@ -0,0 +1,74 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"time"
+	"unsafe"
+)
+
+// maxFreed limits the freed pointers remembered by a Mapper.
+const maxFreed = 1024
+
+// Freed records that C has freed ptr, deleting the mapping of its key, and
+// returning false if it was not mapped.  Until ptr is mapped again, such as
+// after being returned by malloc once more, Get panics on its key reporting a
+// use after free, rather than a plain miss.
+//
+// Call Freed from the shim that frees or destroys the C objects wrapped by
+// the mapper, to keep the mapper in sync with C; the capi package exports it
+// to C as mapper_freed.  Only the most recently freed pointers are
+// remembered.
+func (mapper *Mapper) Freed(ptr unsafe.Pointer) bool {
+	return mapper.FreedHandle(uintptr(ptr))
+}
+
+// FreedHandle is like Freed, but takes the freed pointer as a handle.
+func (mapper *Mapper) FreedHandle(handle uintptr) bool {
+	key := mapper.canonical(Key{v: handle})
+	mapper.mux.Lock()
+	e, ok := mapper.deleteLocked(key)
+	if mapper.freed == nil {
+		mapper.freed = make(map[Key]time.Time)
+	}
+	if _, seen := mapper.freed[key]; !seen {
+		if len(mapper.freedOrder) == maxFreed {
+			delete(mapper.freed, mapper.freedOrder[0])
+			mapper.freedOrder = mapper.freedOrder[1:]
+		}
+		mapper.freedOrder = append(mapper.freedOrder, key)
+	}
+	mapper.freed[key] = time.Now()
+	mapper.mux.Unlock()
+	if ok {
+		mapper.checkOwner(key, e)
+		e.close()
+	}
+	return ok
+}
+
+// unfreeLocked forgets that the pointer of key was freed, as it is mapped
+// again.  The caller must hold the write lock.
+func (mapper *Mapper) unfreeLocked(key Key) {
+	if _, ok := mapper.freed[key]; !ok {
+		return
+	}
+	delete(mapper.freed, key)
+	for i, k := range mapper.freedOrder {
+		if k == key {
+			mapper.freedOrder = append(mapper.freedOrder[:i], mapper.freedOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// freedAt returns when the pointer of key was freed, and false if it has not
+// been freed since it was last mapped.
+func (mapper *Mapper) freedAt(key Key) (time.Time, bool) {
+	mapper.mux.RLock()
+	defer mapper.mux.RUnlock()
+	t, ok := mapper.freed[key]
+	return t, ok
+}
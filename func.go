@@ -0,0 +1,116 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// MapFunc maps and returns a new Key for the Go function fn, which may later
+// be called by InvokeHandle.  It panics if fn is not a non-nil function.
+//
+// This suits simple "call this Go func later" cases, where a single exported
+// trampoline can call any mapped function, rather than each needing its own
+// trampoline and type assertion.  Hot code should instead resolve the
+// function with its type, using LookupAs, and call it directly:
+//
+//	fn, ok := mapper.LookupAs[func(int)](&mapper.G, key)
+func (mapper *Mapper) MapFunc(fn interface{}) Key {
+	if v := reflect.ValueOf(fn); v.Kind() != reflect.Func || v.IsNil() {
+		panic(fmt.Errorf("not a function: %T", fn))
+	}
+	return mapper.MapValue(fn)
+}
+
+// InvokeHandle calls the function mapped to handle, typically by MapFunc,
+// with the given arguments, returning its results.  Each argument must be
+// assignable to the corresponding parameter, or convertible for numeric
+// types; a nil argument is the zero value of its parameter.  Variadic
+// functions take their variadic arguments individually.
+//
+// It returns an error, rather than calling the function, if handle is not
+// mapped to a function, or the arguments do not match its parameters.
+// Panics raised by the function are not recovered.
+func (mapper *Mapper) InvokeHandle(handle uintptr, args ...interface{}) ([]interface{}, error) {
+	goValue, ok := mapper.Lookup(KeyFromHandle(handle))
+	if !ok {
+		return nil, fmt.Errorf("handle not mapped: 0x%x", handle)
+	}
+	fn := reflect.ValueOf(goValue)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return nil, fmt.Errorf("handle 0x%x is mapped to %T, not a function", handle, goValue)
+	}
+	results, err := invoke(fn, args)
+	if err != nil {
+		return nil, fmt.Errorf("calling %T: %w", goValue, err)
+	}
+	return results, nil
+}
+
+// invoke calls fn with args, converted by funcArgs, returning its results.
+func invoke(fn reflect.Value, args []interface{}) ([]interface{}, error) {
+	in, err := funcArgs(fn.Type(), args)
+	if err != nil {
+		return nil, err
+	}
+	out := fn.Call(in)
+	results := make([]interface{}, len(out))
+	for i, v := range out {
+		results[i] = v.Interface()
+	}
+	return results, nil
+}
+
+// funcArgs converts args to the parameters of the function type t.
+func funcArgs(t reflect.Type, args []interface{}) ([]reflect.Value, error) {
+	n := t.NumIn()
+	if t.IsVariadic() {
+		if len(args) < n-1 {
+			return nil, fmt.Errorf("got %d arguments, want at least %d", len(args), n-1)
+		}
+	} else if len(args) != n {
+		return nil, fmt.Errorf("got %d arguments, want %d", len(args), n)
+	}
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var param reflect.Type
+		if t.IsVariadic() && i >= n-1 {
+			param = t.In(n - 1).Elem()
+		} else {
+			param = t.In(i)
+		}
+		v, err := funcArg(param, arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i, err)
+		}
+		in[i] = v
+	}
+	return in, nil
+}
+
+// funcArg converts arg to a value of the parameter type param.
+func funcArg(param reflect.Type, arg interface{}) (reflect.Value, error) {
+	if arg == nil {
+		switch param.Kind() {
+		case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice, reflect.UnsafePointer:
+			return reflect.Zero(param), nil
+		}
+		return reflect.Value{}, fmt.Errorf("nil is not a %v", param)
+	}
+	v := reflect.ValueOf(arg)
+	switch {
+	case v.Type().AssignableTo(param):
+		return v, nil
+	case isNumeric(v.Kind()) && isNumeric(param.Kind()):
+		return v.Convert(param), nil
+	}
+	return reflect.Value{}, fmt.Errorf("%T is not a %v", arg, param)
+}
+
+// isNumeric reports whether k is an integer or floating-point kind.
+func isNumeric(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
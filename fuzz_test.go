@@ -0,0 +1,158 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+// The fuzz targets run over their seed corpus with go test; to fuzz, run, for
+// example:
+//
+//	go test -run=NONE -fuzz=FuzzLookupHandle
+
+func FuzzKeyFromHandle(f *testing.F) {
+	f.Add(uint64(0))
+	f.Add(uint64(1))
+	f.Add(uint64(0xdeadbeef))
+	f.Add(^uint64(0))
+	f.Fuzz(func(t *testing.T, h uint64) {
+		key := mapper.KeyFromHandle(uintptr(h))
+		if key.Handle() != uintptr(h) {
+			t.Fatalf("KeyFromHandle(0x%x).Handle() = 0x%x", uintptr(h), key.Handle())
+		}
+		if _, _, ok := key.Token(); ok {
+			t.Fatalf("KeyFromHandle(0x%x) is a token key", uintptr(h))
+		}
+		if key != mapper.KeyFromHandle(key.Handle()) {
+			t.Fatalf("KeyFromHandle(0x%x) does not round-trip", uintptr(h))
+		}
+	})
+}
+
+func FuzzKeyFromPtr(f *testing.F) {
+	var buf [64]byte
+	f.Add(uint8(0))
+	f.Add(uint8(1))
+	f.Add(uint8(63))
+	f.Fuzz(func(t *testing.T, off uint8) {
+		p := unsafe.Pointer(&buf[int(off)%len(buf)])
+		odd := uintptr(p)&1 != 0
+		defer func() {
+			if r := recover(); (r != nil) != odd {
+				t.Fatalf("KeyFromPtr(%p) panic = %v", p, r)
+			}
+		}()
+		key := mapper.KeyFromPtr(p)
+		if key.Handle() != uintptr(p) {
+			t.Fatalf("KeyFromPtr(%p).Handle() = 0x%x", p, key.Handle())
+		}
+	})
+}
+
+func FuzzKeyFromUint(f *testing.F) {
+	f.Add(uint64(0), uint16(0))
+	f.Add(uint64(1)<<32|1, uint16(7))
+	f.Add(^uint64(0), ^uint16(0))
+	f.Fuzz(func(t *testing.T, token uint64, domain uint16) {
+		key := mapper.KeyFromUint(token, mapper.Domain(domain))
+		gotToken, gotDomain, ok := key.Token()
+		if !ok || gotToken != token || gotDomain != mapper.Domain(domain) {
+			t.Fatalf("KeyFromUint(%d, %d).Token() = %d, %d, %v", token, domain, gotToken, gotDomain, ok)
+		}
+		// A token key never aliases a handle key.
+		if key == mapper.KeyFromHandle(key.Handle()) {
+			t.Fatalf("KeyFromUint(%d, %d) equals a handle key", token, domain)
+		}
+	})
+}
+
+// FuzzLookupHandle feeds arbitrary handles to Lookup and Get on a mapper
+// holding both counting-pointer and pointer keys, checking that a handle
+// resolves to a mapping only if it names that mapping, ignoring reserved bits,
+// and that LookupHandle agrees.
+func FuzzLookupHandle(f *testing.F) {
+	f.Add(uint64(0), uint8(0))
+	f.Add(uint64(3), uint8(0))
+	f.Add(uint64(0x1000), uint8(2))
+	f.Add(uint64(0x1007), uint8(2))
+	f.Add(uint64(0x2002), uint8(1))
+	f.Add(^uint64(0), uint8(8))
+	f.Fuzz(func(t *testing.T, h uint64, bits uint8) {
+		n := uint(bits) % 9
+		m := mapper.New(mapper.WithReservedBits(n))
+		countingBit := uintptr(1) << n
+		reserved := countingBit - 1
+
+		// Counting-pointer keys, and pointer keys at aligned addresses.
+		want := make(map[uintptr]interface{})
+		for i := 0; i < 4; i++ {
+			key := m.MapValue(i)
+			if key.Handle()&countingBit == 0 || key.Handle()&reserved != 0 {
+				t.Fatalf("MapValue returned key 0x%x", key.Handle())
+			}
+			want[key.Handle()] = i
+		}
+		for i := uintptr(1); i <= 4; i++ {
+			key := mapper.KeyFromHandle(i * 0x1000)
+			m.MapPair(key, -int(i))
+			want[key.Handle()] = -int(i)
+		}
+
+		handle := uintptr(h)
+		v, ok := m.Lookup(mapper.KeyFromHandle(handle))
+		w, wok := want[handle&^reserved]
+		if ok != wok || v != w {
+			t.Fatalf("Lookup(0x%x) = %v, %v; want %v, %v", handle, v, ok, w, wok)
+		}
+		if hv, hok := m.LookupHandle(handle); hok != ok || hv != v {
+			t.Fatalf("LookupHandle(0x%x) = %v, %v; Lookup = %v, %v", handle, hv, hok, v, ok)
+		}
+		if ok {
+			// Never misclassify a pointer key as a counting key, or vice
+			// versa.
+			if isCounting := handle&countingBit != 0; isCounting != (v.(int) >= 0) {
+				t.Fatalf("Lookup(0x%x) = %v crosses key kinds", handle, v)
+			}
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); (r != nil) == ok {
+					t.Fatalf("GetHandle(0x%x) panic = %v, mapped %v", handle, r, ok)
+				}
+			}()
+			m.GetHandle(handle)
+		}()
+	})
+}
+
+func FuzzObfuscatedHandles(f *testing.F) {
+	f.Add(uint64(1), uint8(0), false)
+	f.Add(uint64(3), uint8(2), true)
+	f.Add(^uint64(0), uint8(8), false)
+	f.Fuzz(func(t *testing.T, n uint64, reserved uint8, compact bool) {
+		reserved %= 9
+		opts := []mapper.Option{mapper.WithObfuscatedHandles(), mapper.WithReservedBits(uint(reserved))}
+		max := ^uintptr(0)
+		if compact {
+			opts = append(opts, mapper.WithCompactHandles())
+			max = 0xffff
+		}
+		m := mapper.New(opts...)
+		bit := uintptr(1) << reserved
+		v := (uintptr(n)<<(reserved+1) | bit) & max
+		h, plain := m.ObfuscateHandle(v)
+		if plain != v {
+			t.Fatalf("handle 0x%x obfuscated to 0x%x, recovered as 0x%x", v, h, plain)
+		}
+		if h&(bit<<1-1) != bit || h > max {
+			t.Fatalf("handle 0x%x obfuscated to invalid 0x%x", v, h)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+)
+
+// maxGenerationBits limits WithGenerationBits.
+const maxGenerationBits = 8
+
+// ErrStaleHandle is wrapped by the error that Get panics with when given a
+// counting-pointer handle of an earlier generation; see WithGenerationBits.
+var ErrStaleHandle = errors.New("stale handle")
+
+// WithGenerationBits embeds a generation counter of n bits, from 1 to 8, in
+// the handles of keys returned by MapValue, and its variants.  The
+// generation of a key is advanced each time it is recycled, such as by a
+// Mapper created using WithKeyRecycling, and that of new keys each time
+// Clear restarts the counter used by MapValue.  Get of a stale handle, kept
+// by C after its mapping was deleted, then panics with an error wrapping
+// ErrStaleHandle, rather than resolving to the mapping that reused its key.
+//
+// A handle is only caught while it is fewer than 2^n generations old.  The
+// generation bits are taken from the top of the handle space, below any
+// version and ID bits set by WithHandleVersion and WithMapperID, leaving
+// fewer keys for MapValue.
+func WithGenerationBits(n int) Option {
+	if n < 1 || n > maxGenerationBits {
+		panic(fmt.Errorf("generation bits out of range [1, %d]: %d", maxGenerationBits, n))
+	}
+	return func(mapper *Mapper) {
+		mapper.generationBits = uint(n)
+	}
+}
+
+// generationTag returns the generation bits of counting-pointer handles of
+// generation gen, and the mask of the bits holding them.
+func (mapper *Mapper) generationTag(gen uintptr) (tag, mask uintptr) {
+	if mapper.generationBits == 0 {
+		return 0, 0
+	}
+	shift := uint(bits.Len(uint(mapper.countingMax())))
+	mask = (1<<mapper.generationBits - 1) << shift
+	return gen << shift & mask, mask
+}
+
+// handleTag returns the version, ID, and generation bits set in the handles
+// of new counting-pointer keys, and the mask of the bits holding them.  The
+// mask includes the counting-pointer bit when it is not a plain bit.
+func (mapper *Mapper) handleTag() (tag, mask uintptr) {
+	vtag, vmask := mapper.versionTag()
+	itag, imask := mapper.idTag()
+	gtag, gmask := mapper.generationTag(uintptr(atomic.LoadUint32(&mapper.generation)))
+	hbit := mapper.countingBit() &^ mapper.plainBit()
+	return vtag | itag | gtag | hbit, vmask | imask | gmask | hbit
+}
+
+// nextGeneration returns the counting-pointer handle v, advanced to the next
+// generation.
+func (mapper *Mapper) nextGeneration(v uintptr) uintptr {
+	_, mask := mapper.generationTag(0)
+	if mask == 0 {
+		return v
+	}
+	return v&^mask | (v+mask&-mask)&mask
+}
+
+// generationError returns an error if key is a counting-pointer key of an
+// earlier generation, and nil otherwise.
+func (mapper *Mapper) generationError(key Key) error {
+	_, mask := mapper.generationTag(0)
+	if mask == 0 || key.domain != 0 || key.v&mapper.countingBit() == 0 {
+		return nil
+	}
+	shift := uint(bits.TrailingZeros(uint(mask)))
+	gen := key.v & mask >> shift
+	mapper.mux.RLock()
+	defer mapper.mux.RUnlock()
+	for g := uintptr(0); g <= mask>>shift; g++ {
+		if g == gen {
+			continue
+		}
+		if _, ok := mapper.loadLocked(Key{v: key.v&^mask | g<<shift}); ok {
+			return fmt.Errorf("key not mapped: 0x%x is of generation %d, but its key was "+
+				"reused, and is mapped in generation %d: %w", key.v, gen, g, ErrStaleHandle)
+		}
+	}
+	// The keys of a recycling Mapper advance their generations separately.
+	if !mapper.recycle {
+		if cur := uintptr(atomic.LoadUint32(&mapper.generation)) & (mask >> shift); gen != cur {
+			return fmt.Errorf("key not mapped: 0x%x is of generation %d, from before the "+
+				"Mapper was cleared, not %d: %w", key.v, gen, cur, ErrStaleHandle)
+		}
+	}
+	return nil
+}
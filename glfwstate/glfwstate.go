@@ -0,0 +1,110 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package glfwstate attaches Go state to GLFW windows, using the window's
+// user pointer to hold a mapper handle.
+//
+// GLFW callbacks receive only the window, so per-window state is usually kept
+// behind glfwSetWindowUserPointer.  Windows maps the state, stores its handle
+// as the user pointer, resolves it in callbacks, and deletes the mapping when
+// the window is destroyed through it.
+//
+// The package does not link against GLFW: the GLFW functions it needs are
+// supplied by the caller, usually as small cgo wrappers that convert between
+// the handle and the void* user pointer:
+//
+//	static void setUser(void *w, uintptr_t h) {
+//		glfwSetWindowUserPointer((GLFWwindow *)w, (void *)h);
+//	}
+//	static uintptr_t getUser(void *w) {
+//		return (uintptr_t)glfwGetWindowUserPointer((GLFWwindow *)w);
+//	}
+//
+//	var windows = glfwstate.Windows{
+//		SetUserPointer: func(w unsafe.Pointer, h uintptr) { C.setUser(w, C.uintptr_t(h)) },
+//		GetUserPointer: func(w unsafe.Pointer) uintptr { return uintptr(C.getUser(w)) },
+//		DestroyWindow:  func(w unsafe.Pointer) { C.glfwDestroyWindow((*C.GLFWwindow)(w)) },
+//	}
+//
+//	//export goKeyCallback
+//	func goKeyCallback(w *C.GLFWwindow, key, scancode, action, mods C.int) {
+//		win := windows.State(unsafe.Pointer(w)).(*myWindow)
+//		...
+//	}
+package glfwstate // go.jpap.org/mapper/glfwstate
+
+import (
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+// Windows attaches Go state to GLFW windows.
+type Windows struct {
+	// Mapper holds the mappings of the windows' state; if nil, mapper.G is
+	// used.
+	Mapper *mapper.Mapper
+
+	// SetUserPointer calls glfwSetWindowUserPointer, converting the handle
+	// to a void* in C.
+	SetUserPointer func(window unsafe.Pointer, handle uintptr)
+
+	// GetUserPointer calls glfwGetWindowUserPointer, converting the result
+	// to a uintptr_t in C.
+	GetUserPointer func(window unsafe.Pointer) uintptr
+
+	// DestroyWindow calls glfwDestroyWindow.
+	DestroyWindow func(window unsafe.Pointer)
+}
+
+func (w *Windows) mapper() *mapper.Mapper {
+	if w.Mapper == nil {
+		return &mapper.G
+	}
+	return w.Mapper
+}
+
+// Attach maps state, and sets its handle as the window's user pointer.
+// State previously attached to the window is detached first.
+func (w *Windows) Attach(window unsafe.Pointer, state interface{}) {
+	w.Detach(window)
+	key := w.mapper().MapValue(state)
+	w.SetUserPointer(window, key.Handle())
+}
+
+// State returns the state attached to the window.  It panics if the window
+// has no state attached.
+func (w *Windows) State(window unsafe.Pointer) interface{} {
+	return w.mapper().GetHandle(w.GetUserPointer(window))
+}
+
+// Lookup is like State, but returns false instead of panicking if the window
+// has no state attached, as when a callback is called before Attach.
+func (w *Windows) Lookup(window unsafe.Pointer) (state interface{}, ok bool) {
+	handle := w.GetUserPointer(window)
+	if handle == 0 {
+		return nil, false
+	}
+	return w.mapper().Lookup(mapper.KeyFromHandle(handle))
+}
+
+// Detach deletes the mapping of the state attached to the window, if any, and
+// clears the window's user pointer.
+func (w *Windows) Detach(window unsafe.Pointer) {
+	if handle := w.GetUserPointer(window); handle != 0 {
+		w.SetUserPointer(window, 0)
+		w.mapper().DeleteHandle(handle)
+	}
+}
+
+// Destroy destroys the window, and then detaches its state.  Callbacks
+// called by GLFW while the window is being destroyed can still resolve the
+// state.
+func (w *Windows) Destroy(window unsafe.Pointer) {
+	handle := w.GetUserPointer(window)
+	w.DestroyWindow(window)
+	if handle != 0 {
+		w.mapper().DeleteHandle(handle)
+	}
+}
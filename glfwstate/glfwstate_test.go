@@ -0,0 +1,67 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package glfwstate_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/glfwstate"
+)
+
+// fakeWindow stands in for a GLFWwindow.
+type fakeWindow struct {
+	user      uintptr
+	destroyed bool
+}
+
+func fakeWindows(m *mapper.Mapper) *glfwstate.Windows {
+	return &glfwstate.Windows{
+		Mapper:         m,
+		SetUserPointer: func(w unsafe.Pointer, h uintptr) { (*fakeWindow)(w).user = h },
+		GetUserPointer: func(w unsafe.Pointer) uintptr { return (*fakeWindow)(w).user },
+		DestroyWindow:  func(w unsafe.Pointer) { (*fakeWindow)(w).destroyed = true },
+	}
+}
+
+func TestWindows(t *testing.T) {
+	m := mapper.New()
+	windows := fakeWindows(m)
+	var win1, win2 fakeWindow
+	w1, w2 := unsafe.Pointer(&win1), unsafe.Pointer(&win2)
+
+	if _, ok := windows.Lookup(w1); ok {
+		t.Fatal("Lookup succeeded before Attach")
+	}
+	windows.Attach(w1, "one")
+	windows.Attach(w2, "two")
+	if got := windows.State(w1); got != "one" {
+		t.Fatalf("State(w1) = %v", got)
+	}
+	if got, ok := windows.Lookup(w2); !ok || got != "two" {
+		t.Fatalf("Lookup(w2) = %v, %v", got, ok)
+	}
+
+	windows.Attach(w1, "uno")
+	if got := windows.State(w1); got != "uno" {
+		t.Fatalf("State(w1) after reattach = %v", got)
+	}
+	if s := m.Stats(); s.Live != 2 {
+		t.Fatalf("%d live mappings, want 2", s.Live)
+	}
+
+	windows.Destroy(w1)
+	if !win1.destroyed {
+		t.Fatal("window not destroyed")
+	}
+	windows.Detach(w2)
+	if _, ok := windows.Lookup(w2); ok {
+		t.Fatal("Lookup succeeded after Detach")
+	}
+	if s := m.Stats(); s.Live != 0 {
+		t.Fatalf("%d live mappings after Destroy and Detach", s.Live)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "sync"
+
+// Group owns several named Mappers, such as those of the separate object
+// types of a large binding, reporting on them together and tearing them
+// down in a consistent order.  A zero Group is ready to use.
+type Group struct {
+	mux     sync.Mutex
+	opts    []Option
+	names   []string // in order of creation
+	mappers map[string]*Mapper
+}
+
+// NewGroup returns a new Group, whose Mappers are created with opts.
+func NewGroup(opts ...Option) *Group {
+	return &Group{opts: opts}
+}
+
+// Mapper returns the group's Mapper with the given name, creating it with
+// the group's options, followed by opts, if there is none.  opts are ignored
+// if the Mapper exists.
+func (g *Group) Mapper(name string, opts ...Option) *Mapper {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if m, ok := g.mappers[name]; ok {
+		return m
+	}
+	m := New(append(g.opts[:len(g.opts):len(g.opts)], opts...)...)
+	if g.mappers == nil {
+		g.mappers = make(map[string]*Mapper)
+	}
+	g.mappers[name] = m
+	g.names = append(g.names, name)
+	return m
+}
+
+// Names returns the names of the group's Mappers, in order of creation.
+func (g *Group) Names() []string {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return append([]string(nil), g.names...)
+}
+
+// each calls fn with each of the group's Mappers, in order of creation, or in
+// reverse order if reverse is set.  fn is called without the group's lock
+// held.
+func (g *Group) each(reverse bool, fn func(name string, m *Mapper)) {
+	g.mux.Lock()
+	names := append([]string(nil), g.names...)
+	mappers := make([]*Mapper, len(names))
+	for i, name := range names {
+		mappers[i] = g.mappers[name]
+	}
+	g.mux.Unlock()
+
+	for i := range names {
+		if reverse {
+			i = len(names) - 1 - i
+		}
+		fn(names[i], mappers[i])
+	}
+}
+
+// Stats returns the totals of the statistics of the group's Mappers.  The
+// statistics of each Mapper are consistent, but are not taken at the same
+// instant.  Latency is not aggregated; see MapperStats.
+func (g *Group) Stats() Stats {
+	var total Stats
+	g.each(false, func(_ string, m *Mapper) {
+		s := m.Stats()
+		total.Live += s.Live
+		total.Mapped += s.Mapped
+		total.Deleted += s.Deleted
+		total.Retained += s.Retained
+	})
+	return total
+}
+
+// MapperStats returns the statistics of each of the group's Mappers, by name.
+func (g *Group) MapperStats() map[string]Stats {
+	stats := make(map[string]Stats)
+	g.each(false, func(name string, m *Mapper) {
+		stats[name] = m.Stats()
+	})
+	return stats
+}
+
+// Snapshot returns a Snapshot of each of the group's Mappers, by name.
+func (g *Group) Snapshot() map[string]*Snapshot {
+	snapshots := make(map[string]*Snapshot)
+	g.each(false, func(name string, m *Mapper) {
+		snapshots[name] = m.Snapshot()
+	})
+	return snapshots
+}
+
+// Orphans returns the Orphans of each of the group's Mappers that has any, by
+// name.  It is empty unless in debug mode.
+func (g *Group) Orphans() map[string]*Snapshot {
+	orphans := make(map[string]*Snapshot)
+	g.each(false, func(name string, m *Mapper) {
+		if s := m.Orphans(); len(s.Entries) != 0 {
+			orphans[name] = s
+		}
+	})
+	return orphans
+}
+
+// Clear clears each of the group's Mappers, in the reverse order of their
+// creation: Mappers created later tend to hold objects that depend on those
+// of Mappers created earlier, as a connection's statements depend on it.
+// Each Mapper is torn down in its own teardown order; see
+// SetTeardownPriority.
+func (g *Group) Clear() {
+	g.each(true, func(_ string, m *Mapper) {
+		m.Clear()
+	})
+}
+
+// Close clears the group, as Clear does, and returns nil.
+func (g *Group) Close() error {
+	g.Clear()
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+)
+
+// idBits is the number of handle bits holding the ID of a Mapper created
+// using WithMapperID.
+const idBits = 4
+
+// ErrForeignKey is wrapped by the error that Get panics with when given a
+// counting-pointer handle of another Mapper; see WithMapperID.
+var ErrForeignKey = errors.New("key of another mapper")
+
+// lastID is the ID last assigned by WithMapperID.
+var lastID uint32
+
+// WithMapperID assigns the Mapper an ID, from 1 to 15, and embeds it in the
+// handles of keys returned by MapValue, and its variants.  Get of a key
+// returned by another Mapper then panics with an error wrapping
+// ErrForeignKey, rather than resolving to an unrelated value of its own; in
+// debug mode, so does Delete.  Give each of the Mappers of a program that
+// might be confused with one another an ID: IDs are assigned in turn, and
+// are only distinct among 15 Mappers.
+//
+// The ID bits are taken from the top of the handle space, below any version
+// bits set by WithHandleVersion, leaving fewer keys for MapValue.
+func WithMapperID() Option {
+	return func(mapper *Mapper) {
+		mapper.id = uint8(atomic.AddUint32(&lastID, 1)%(1<<idBits-1) + 1)
+	}
+}
+
+// idTag returns the ID bits set in counting-pointer handles, and the mask of
+// the bits holding them.
+func (mapper *Mapper) idTag() (tag, mask uintptr) {
+	if mapper.id == 0 {
+		return 0, 0
+	}
+	shift := uint(bits.Len(uint(mapper.countingMax()))) + mapper.generationBits
+	return uintptr(mapper.id) << shift, (1<<idBits - 1) << shift
+}
+
+// idError returns an error if key is a counting-pointer key of another
+// Mapper, and nil otherwise.
+func (mapper *Mapper) idError(key Key) error {
+	tag, mask := mapper.idTag()
+	if mask == 0 || key.domain != 0 || key.v&mapper.countingBit() == 0 || key.v&mask == tag {
+		return nil
+	}
+	shift := uint(bits.TrailingZeros(uint(mask)))
+	return fmt.Errorf("key not mapped: 0x%x belongs to the Mapper with ID %d, not %d: %w",
+		key.v, key.v&mask>>shift, mapper.id, ErrForeignKey)
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// indexRef is a secondary key of an entry: the value of the named index.
+type indexRef struct {
+	name  string
+	value interface{}
+}
+
+// MapValueIndexed is like MapValue, but also indexes the mapping by value in
+// the index with the given name, as if by Index.
+func (mapper *Mapper) MapValueIndexed(goValue interface{}, name string, value interface{}) Key {
+	checkIndexValue(value)
+	key, err := mapper.mapCounting(entry{
+		value:   mapper.stored(goValue),
+		indexes: &[]indexRef{{name, value}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Index adds a secondary key to the mapping for key: value, in the index
+// with the given name, such as a device serial number, URL, or session ID.
+// The mapping can then be found by GetByIndex and LookupByIndex, for
+// callbacks that receive a logical identifier rather than the handle.
+//
+// Index returns false if key is not mapped.  Each value identifies a single
+// mapping in an index: indexing another mapping by the same value replaces
+// it.  A mapping leaves its indexes when it is deleted or replaced.  Index
+// panics if value is not comparable.
+func (mapper *Mapper) Index(key Key, name string, value interface{}) bool {
+	checkIndexValue(value)
+	key = mapper.canonical(key)
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	e, ok := mapper.loadLocked(key)
+	if !ok {
+		return false
+	}
+	ref := indexRef{name, value}
+	var refs []indexRef
+	if e.indexes != nil {
+		refs = *e.indexes
+	}
+	refs = append(refs[:len(refs):len(refs)], ref)
+	e.indexes = &refs
+	mapper.m.store(key, e)
+	mapper.indexLocked(key, ref)
+	return true
+}
+
+// GetByIndex retrieves the Go value of the mapping with the given value in
+// the named index, panicking if there is none.
+func (mapper *Mapper) GetByIndex(name string, value interface{}) (goValue interface{}) {
+	key, ok := mapper.LookupByIndex(name, value)
+	if ok {
+		goValue, ok = mapper.Lookup(key)
+	}
+	if !ok {
+		panic(fmt.Errorf("no mapping with %s %v", name, value))
+	}
+	return goValue
+}
+
+// LookupByIndex returns the key of the mapping with the given value in the
+// named index, and false if there is none.
+func (mapper *Mapper) LookupByIndex(name string, value interface{}) (Key, bool) {
+	if typ := reflect.TypeOf(value); typ == nil || !typ.Comparable() {
+		return Key{}, false
+	}
+	mapper.mux.RLock()
+	key, ok := mapper.indexes[name][value]
+	mapper.mux.RUnlock()
+	return key, ok
+}
+
+// checkIndexValue panics if value cannot be used in an index.
+func checkIndexValue(value interface{}) {
+	if typ := reflect.TypeOf(value); typ == nil || !typ.Comparable() {
+		panic(fmt.Errorf("index value is not comparable: %T", value))
+	}
+}
+
+// indexLocked indexes key by ref.  The caller must hold the write lock.
+func (mapper *Mapper) indexLocked(key Key, ref indexRef) {
+	if mapper.indexes == nil {
+		mapper.indexes = make(map[string]map[interface{}]Key)
+	}
+	index := mapper.indexes[ref.name]
+	if index == nil {
+		index = make(map[interface{}]Key)
+		mapper.indexes[ref.name] = index
+	}
+	index[ref.value] = key
+}
+
+// unindexLocked removes key from the indexes refs, unless another mapping has
+// since replaced it.  The caller must hold the write lock.
+func (mapper *Mapper) unindexLocked(key Key, refs []indexRef) {
+	for _, ref := range refs {
+		index := mapper.indexes[ref.name]
+		if cur, ok := index[ref.value]; ok && cur == key {
+			delete(index, ref.value)
+		}
+	}
+}
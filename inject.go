@@ -0,0 +1,85 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// MapStruct maps ptr, a pointer to a struct, using MapValue, and stores the
+// new key in each field of the struct tagged `mapper:"handle"`, before the
+// struct is used to build the C structures that carry the handle as user
+// data.  A tagged field must be a Key, or a uintptr that is set to the key's
+// handle.  Fields of nested structs, including embedded structs, are set too,
+// but fields reached through pointers are not.
+//
+//	type Options struct {
+//		Name     string
+//		UserData uintptr `mapper:"handle"`
+//	}
+//
+//	opts := &Options{Name: "decoder"}
+//	key := mapper.G.MapStruct(opts) // opts.UserData == key.Handle()
+//
+// MapStruct panics if ptr is not a non-nil pointer to a struct, or if a
+// tagged field has another type, or is not exported.  Get returns ptr.
+func (mapper *Mapper) MapStruct(ptr interface{}) Key {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		panic(fmt.Errorf("mapper: MapStruct of %T, not a pointer to a struct", ptr))
+	}
+	fields := handleFields(v.Elem().Type())
+	key := mapper.MapValue(ptr)
+	for _, index := range fields {
+		f := v.Elem().FieldByIndex(index)
+		if f.Type() == keyType {
+			f.Set(reflect.ValueOf(key))
+		} else {
+			f.SetUint(uint64(key.Handle()))
+		}
+	}
+	return key
+}
+
+var keyType = reflect.TypeOf(Key{})
+
+// handleFieldsCache holds the result of handleFields by type.
+var handleFieldsCache sync.Map
+
+// handleFields returns the indexes of the fields of the struct type t tagged
+// to hold a handle, panicking if any cannot.
+func handleFields(t reflect.Type) [][]int {
+	if fields, ok := handleFieldsCache.Load(t); ok {
+		return fields.([][]int)
+	}
+	fields := appendHandleFields(nil, nil, t)
+	handleFieldsCache.Store(t, fields)
+	return fields
+}
+
+// appendHandleFields appends the indexes of the fields of the struct type t
+// tagged to hold a handle to fields, prefixed by index.
+func appendHandleFields(fields [][]int, index []int, t reflect.Type) [][]int {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fi := append(index[:len(index):len(index)], i)
+		if f.Tag.Get("mapper") != "handle" {
+			if f.Type.Kind() == reflect.Struct && f.Type != keyType {
+				fields = appendHandleFields(fields, fi, f.Type)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			panic(fmt.Errorf("mapper: handle field %s.%s is not exported", t, f.Name))
+		}
+		if f.Type != keyType && f.Type.Kind() != reflect.Uintptr {
+			panic(fmt.Errorf("mapper: handle field %s.%s has type %s, not Key or uintptr", t, f.Name, f.Type))
+		}
+		fields = append(fields, fi)
+	}
+	return fields
+}
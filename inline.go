@@ -0,0 +1,122 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// MapWord is like MapValue, but stores a value of up to a word in size that
+// holds no pointers, such as an index, or a small handle struct, inline,
+// without the allocation needed to box it in an interface.  Values of other
+// types are boxed as usual: pointers need no allocation to box.
+//
+// Retrieving the value using LookupAs or GetAs, with its type, is also free
+// of allocation, whereas Get boxes the value on each call.  This suits
+// high-frequency callbacks that map and delete many tiny values.
+func MapWord[T any](mapper *Mapper, goValue T) Key {
+	in := inlineOf(typeOf[T]())
+	if in == nil {
+		return mapper.MapValue(goValue)
+	}
+	e := entry{value: in}
+	*(*T)(unsafe.Pointer(&e.word)) = goValue
+	key, err := mapper.mapCounting(e)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// inline is the value of an entry whose value of type typ is stored in its
+// word.  There is one inline for each type, so that boxing it, as a pointer,
+// needs no allocation.
+type inline struct {
+	typ reflect.Type
+}
+
+// inlines holds the inline of each type passed to inlineOf, or nil if values
+// of the type cannot be stored inline.  Unlike a sync.Map, reading it never
+// allocates.
+var (
+	inlinesMux sync.RWMutex
+	inlines    map[reflect.Type]*inline
+)
+
+// inlineOf returns the inline for typ, or nil if its values cannot be stored
+// inline.
+func inlineOf(typ reflect.Type) *inline {
+	inlinesMux.RLock()
+	in, ok := inlines[typ]
+	inlinesMux.RUnlock()
+	if ok {
+		return in
+	}
+	inlinesMux.Lock()
+	defer inlinesMux.Unlock()
+	if in, ok = inlines[typ]; !ok {
+		if typ.Size() <= unsafe.Sizeof(uintptr(0)) && !hasPointers(typ) {
+			in = &inline{typ}
+		}
+		if inlines == nil {
+			inlines = make(map[reflect.Type]*inline)
+		}
+		inlines[typ] = in
+	}
+	return in
+}
+
+// hasPointers reports whether values of typ hold pointers.
+func hasPointers(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Array:
+		return typ.Len() > 0 && hasPointers(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if hasPointers(typ.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// goValue returns the value of e, boxing it if it is stored inline.
+func (e entry) goValue() interface{} {
+	if in, ok := e.value.(*inline); ok {
+		word := e.word
+		return reflect.NewAt(in.typ, unsafe.Pointer(&word)).Elem().Interface()
+	}
+	return e.value
+}
+
+// valueType returns the type of the value of e, or nil if it is nil.
+func (e entry) valueType() reflect.Type {
+	if in, ok := e.value.(*inline); ok {
+		return in.typ
+	}
+	return reflect.TypeOf(e.value)
+}
+
+// entryAs returns the value of e as a T, without boxing a value stored
+// inline.
+func entryAs[T any](e entry) (goValue T, ok bool) {
+	if in, isInline := e.value.(*inline); isInline {
+		if in.typ != typeOf[T]() {
+			return goValue, false
+		}
+		return *(*T)(unsafe.Pointer(&e.word)), true
+	}
+	goValue, ok = e.value.(T)
+	return
+}
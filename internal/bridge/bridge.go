@@ -0,0 +1,88 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bridge maps the Go values of the bridge packages, such as iobridge
+// and chanbridge, whose C callbacks are given nothing but a handle.
+//
+// Each value is mapped in the Mapper that is its package's Target when the
+// value is created, and is found by the callbacks through that Mapper, even
+// once Target is changed.  So that the values of different Mappers are told
+// apart, the handles of live values are distinct across Mappers.
+package bridge // go.jpap.org/mapper/internal/bridge
+
+import (
+	"sync"
+
+	"go.jpap.org/mapper"
+)
+
+var (
+	// owners holds the Mapper of each value mapped by Map, by handle;
+	// protected by mu.
+	mu     sync.RWMutex
+	owners = make(map[uintptr]*mapper.Mapper)
+)
+
+// Map maps v to a new key in m, whose handle is not that of a live value
+// mapped by Map in another Mapper.
+func Map(m *mapper.Mapper, v interface{}) mapper.Key {
+	var taken []mapper.Key
+	defer func() {
+		for _, key := range taken {
+			m.Delete(key)
+		}
+	}()
+	for {
+		key := m.MapValue(v)
+		mu.Lock()
+		// The handle of a value of m that was not deleted by Delete, such as
+		// one removed by Clear, is free to reuse.
+		owner, ok := owners[key.Handle()]
+		if !ok || owner == m {
+			owners[key.Handle()] = m
+			mu.Unlock()
+			return key
+		}
+		mu.Unlock()
+		// Keep the key mapped until another is found, so that a Mapper that
+		// recycles keys does not allocate it again.
+		taken = append(taken, key)
+	}
+}
+
+// Lookup returns the value mapped for handle by Map, from the Mapper that
+// mapped it.
+func Lookup(handle uintptr) (v interface{}, ok bool) {
+	mu.RLock()
+	m := owners[handle]
+	mu.RUnlock()
+	if m == nil {
+		return nil, false
+	}
+	return m.LookupHandle(handle)
+}
+
+// Delete deletes the mapping of key made in m by Map.
+func Delete(m *mapper.Mapper, key mapper.Key) {
+	mu.Lock()
+	if owners[key.Handle()] == m {
+		delete(owners, key.Handle())
+	}
+	mu.Unlock()
+	m.Delete(key)
+}
+
+// DeleteHandle deletes the mapping of handle made by Map, from the Mapper
+// that mapped it, returning false if handle is not mapped by Map.
+func DeleteHandle(handle uintptr) bool {
+	mu.Lock()
+	m := owners[handle]
+	delete(owners, handle)
+	mu.Unlock()
+	if m == nil {
+		return false
+	}
+	m.DeleteHandle(handle)
+	return true
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bridge
+
+import (
+	"testing"
+
+	"go.jpap.org/mapper"
+)
+
+func TestMap(t *testing.T) {
+	a, b := mapper.New(mapper.WithKeyRecycling()), mapper.New(mapper.WithKeyRecycling())
+	ka := Map(a, "a")
+	kb := Map(b, "b")
+	if ka.Handle() == kb.Handle() {
+		t.Fatalf("values of different Mappers share the handle 0x%x", ka.Handle())
+	}
+	if b.Len() != 1 {
+		t.Fatalf("keys skipped by Map still mapped: %d", b.Len())
+	}
+	for k, want := range map[mapper.Key]string{ka: "a", kb: "b"} {
+		if v, ok := Lookup(k.Handle()); !ok || v != want {
+			t.Fatalf("Lookup = %v, %v, want %v", v, ok, want)
+		}
+	}
+
+	Delete(a, ka)
+	if v, ok := Lookup(ka.Handle()); ok {
+		t.Fatalf("Lookup after Delete = %v", v)
+	}
+	if k := Map(b, "b2"); k != ka {
+		t.Fatalf("handle of a deleted value not reused: 0x%x", k.Handle())
+	}
+
+	// The handles of values removed by Clear, rather than Delete, are reused
+	// by their Mapper.
+	b.Clear()
+	if k := Map(b, "b3"); k != ka {
+		t.Fatalf("handle of a cleared value not reused: 0x%x", k.Handle())
+	}
+
+	if !DeleteHandle(ka.Handle()) || b.Len() != 0 {
+		t.Fatal("DeleteHandle did not delete from the owning Mapper")
+	}
+	if DeleteHandle(ka.Handle()) {
+		t.Fatal("DeleteHandle of a deleted handle succeeded")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo LDFLAGS: -lpthread
+#include <pthread.h>
+#include <stdint.h>
+
+extern void goCallerCallback(uintptr_t handle);
+
+static void *callerThread(void *handle) {
+	goCallerCallback((uintptr_t)handle);
+	return NULL;
+}
+
+// callBack calls back into Go with handle on the calling thread.
+static void callBack(uintptr_t handle) {
+	goCallerCallback(handle);
+}
+
+// callBackForeign calls back into Go with handle on a thread created by C.
+static int callBackForeign(uintptr_t handle) {
+	pthread_t t;
+	if (pthread_create(&t, NULL, callerThread, (void *)handle) != 0) {
+		return -1;
+	}
+	return pthread_join(t, NULL);
+}
+*/
+import "C"
+import (
+	"strings"
+	"testing"
+
+	"go.jpap.org/mapper"
+)
+
+var callerMapper *mapper.Mapper
+
+//export goCallerCallback
+func goCallerCallback(handle uintptr) {
+	callerMapper.GetHandle(handle)
+}
+
+// RunTestCallers requires debug mode.
+func RunTestCallers(t *testing.T) {
+	callerMapper = mapper.New()
+	defer func() { callerMapper = nil }()
+
+	key := callerMapper.MapValue("callback state")
+	callerMapper.Get(key)
+	if c := callerMapper.Info(key).Callers; len(c) != 0 {
+		t.Fatalf("Get from Go recorded C callers: %+v", c)
+	}
+
+	C.callBack(C.uintptr_t(key.Handle()))
+	if C.callBackForeign(C.uintptr_t(key.Handle())) != 0 {
+		t.Fatal("cannot create thread")
+	}
+	info := callerMapper.Info(key)
+	if len(info.Callers) != 2 || !info.Callers[0].Foreign || info.Callers[1].Foreign {
+		t.Fatalf("unexpected callers: %+v", info.Callers)
+	}
+	if !strings.Contains(info.String(), "got from C on foreign thread") {
+		t.Fatalf("Describe omits foreign thread:\n%s", info)
+	}
+	if s := callerMapper.Snapshot(); len(s.Entries[0].Callers) != 2 {
+		t.Fatalf("snapshot omits callers: %+v", s.Entries[0])
+	}
+}
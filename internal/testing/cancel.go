@@ -0,0 +1,53 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../cancel
+#include "cancel.h"
+*/
+import "C"
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/cancel"
+)
+
+func RunTestCancelToken(t *testing.T) {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	tok := cancel.NewToken(ctx)
+	handle := C.uintptr_t(tok.Handle())
+	if C.mapper_token_cancelled(handle) != 0 {
+		t.Fatal("new token is cancelled")
+	}
+
+	cancelCtx()
+	deadline := time.Now().Add(10 * time.Second)
+	for C.mapper_token_cancelled(handle) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("token not cancelled with its context")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tok.Close()
+	if C.mapper_token_cancelled(handle) == 0 {
+		t.Fatal("closed token is not cancelled")
+	}
+
+	// Tokens are mapped in Target, and found through it once Target is
+	// changed.
+	m := mapper.New()
+	cancel.Target = m
+	tok = cancel.NewToken(context.Background())
+	cancel.Target = &mapper.G
+	defer tok.Close()
+	if m.Len() != 1 || C.mapper_token_cancelled(C.uintptr_t(tok.Handle())) != 0 {
+		t.Fatal("token of another Mapper not found")
+	}
+}
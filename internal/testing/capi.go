@@ -0,0 +1,113 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../capi
+#include <stdlib.h>
+#include "mapper.h"
+
+// destroyObject is the shim that frees a wrapped object.
+static void destroyObject(void *obj) {
+	mapper_freed((uintptr_t)obj);
+	free(obj);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/capi"
+)
+
+func RunTestCAPI(t *testing.T) {
+	var m mapper.Mapper
+	capi.Target = &m
+	defer func() { capi.Target = &mapper.G }()
+
+	key := m.MapValue("hello")
+	handle := C.uintptr_t(key.Handle())
+
+	if C.mapper_get(handle) != 1 {
+		t.Fatal("mapper_get did not find mapped handle")
+	}
+	var stats C.mapper_stats_t
+	C.mapper_stats(&stats)
+	if stats.live != 1 || stats.mapped != 1 || stats.deleted != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if C.mapper_delete(handle) != 1 {
+		t.Fatal("mapper_delete did not delete mapped handle")
+	}
+	if C.mapper_get(handle) != 0 || C.mapper_delete(handle) != 0 {
+		t.Fatal("handle still mapped after mapper_delete")
+	}
+	C.mapper_stats(&stats)
+	if stats.live != 0 || stats.deleted != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// Of several host threads racing to release a handle, only one does.
+	for i := 0; i < 100; i++ {
+		handle := C.uintptr_t(m.MapValue(i).Handle())
+		var deleted int32
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				atomic.AddInt32(&deleted, int32(C.mapper_delete(handle)))
+			}()
+		}
+		wg.Wait()
+		if deleted != 1 {
+			t.Fatalf("%d concurrent mapper_deletes succeeded", deleted)
+		}
+	}
+	C.mapper_stats(&stats)
+	if stats.live != 0 || stats.deleted != 101 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// Checking a handle does not consume its uses.
+	key = m.MapValueUses("once", 1)
+	handle = C.uintptr_t(key.Handle())
+	if C.mapper_get(handle) != 1 || C.mapper_get(handle) != 1 {
+		t.Fatal("mapper_get did not find a handle with uses")
+	}
+	if m.Get(key) != "once" || C.mapper_get(handle) != 0 {
+		t.Fatal("mapper_get consumed a use")
+	}
+
+	// Freeing a wrapped object deletes its mapping, and a later Get reports a
+	// use after free.
+	obj := C.malloc(16)
+	key = m.MapPtrPair(obj, "object")
+	C.destroyObject(obj)
+	if _, ok := m.Lookup(key); ok {
+		t.Fatal("freed pointer still mapped")
+	}
+	func() {
+		defer func() {
+			if r := recover(); !strings.Contains(fmt.Sprint(r), "use after free") {
+				t.Fatalf("Get of a freed pointer panicked with %v", r)
+			}
+		}()
+		m.Get(key)
+	}()
+	m.MapPair(key, "reused")
+	if m.Get(key) != "reused" {
+		t.Fatal("pointer mapped again after free not found")
+	}
+	if C.mapper_freed(C.uintptr_t(uintptr(obj))) != 1 {
+		t.Fatal("mapper_freed did not delete the mapped pointer")
+	}
+}
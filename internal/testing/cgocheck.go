@@ -0,0 +1,163 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+
+typedef struct {
+	uintptr_t handle;
+	int calls;
+} pattern_slot_t;
+
+// pattern_read_handle reads a handle from memory owned by Go; the memory
+// holds no Go pointers, so passing it is allowed.
+static uintptr_t pattern_read_handle(const uintptr_t *p) {
+	return *p;
+}
+
+// pattern_sum sums len bytes at p, which may be Go memory pinned by MapBytes,
+// or its copy in C memory.
+static int pattern_sum(const void *p, size_t len) {
+	const unsigned char *b = p;
+	int sum = 0;
+	for (size_t i = 0; i < len; i++) {
+		sum += b[i];
+	}
+	return sum;
+}
+
+extern void goPatternCallback(uintptr_t handle);
+
+// pattern_call calls back into Go with the handle held in slot.
+static void pattern_call(pattern_slot_t *slot) {
+	slot->calls++;
+	goPatternCallback(slot->handle);
+}
+*/
+import "C"
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+// cgoCheckEnv is set in the environment of the subprocess started by
+// RunCgoChecked.
+const cgoCheckEnv = "MAPPER_TEST_CGOCHECK"
+
+// RunCgoChecked runs run in a subprocess, re-running the calling test, with
+// the runtime's strictest checks on pointers passed between Go and C, and
+// with GOGC=1, so that objects are collected and moved as early as possible.
+//
+// Before Go 1.21, the strictest checks are enabled using
+// GODEBUG=cgocheck=2.  Since, they must be compiled in: run the tests with
+// GOEXPERIMENT=cgocheck2 for full checking.
+func RunCgoChecked(t *testing.T, run func(t *testing.T)) {
+	if os.Getenv(cgoCheckEnv) != "" {
+		run(t)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), cgoCheckEnv+"=1", "GOGC=1")
+	if cgoCheckGODEBUG != "" {
+		godebug := cgoCheckGODEBUG
+		if old := os.Getenv("GODEBUG"); old != "" {
+			godebug = old + "," + godebug
+		}
+		cmd.Env = append(cmd.Env, "GODEBUG="+godebug)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "--- PASS: "+t.Name()) {
+		t.Fatalf("%s under cgo pointer checks: %v\n%s", t.Name(), err, out)
+	}
+	if !cgoCheck2 && cgoCheckGODEBUG == "" {
+		t.Log("full cgo pointer checks need GOEXPERIMENT=cgocheck2")
+	}
+}
+
+// patternIterations is the number of times RunHandlePatterns repeats each
+// pattern, collecting garbage between repetitions.
+const patternIterations = 100
+
+var (
+	// patternMapper holds the mappings made by RunHandlePatterns.
+	patternMapper mapper.Mapper
+
+	// patternCalls counts calls to goPatternCallback.
+	patternCalls int
+)
+
+// RunHandlePatterns exercises the ways handles and mapped memory are passed
+// to C, as documented by the package.  It is intended to be run using
+// RunCgoChecked, so that any pattern that breaks the cgo pointer-passing
+// rules is caught by the runtime.
+func RunHandlePatterns(t *testing.T) {
+	m := &patternMapper
+	for i := 0; i < patternIterations; i++ {
+		// A handle passed by value, stored in C memory, and used to call
+		// back into Go.
+		slot := (*C.pattern_slot_t)(C.malloc(C.sizeof_pattern_slot_t))
+		key := m.MapValue(&GoObject{goCallback: func() { patternCalls++ }})
+		slot.handle = C.uintptr_t(key.Handle())
+		slot.calls = 0
+		runtime.GC()
+		calls := patternCalls
+		C.pattern_call(slot)
+		if patternCalls != calls+1 || slot.calls != 1 {
+			t.Fatal("callback through stored handle did not run")
+		}
+		m.Delete(key)
+
+		// A C pointer as a key, with its handle stored in the C memory it
+		// points to.
+		ptrKey := m.MapPtrPair(unsafe.Pointer(slot), &GoObject{goCallback: func() { patternCalls++ }})
+		mapper.StoreHandle(unsafe.Pointer(slot), unsafe.Offsetof(slot.handle), ptrKey)
+		runtime.GC()
+		C.pattern_call(slot)
+		if patternCalls != calls+2 {
+			t.Fatal("callback through pointer key did not run")
+		}
+		if mapper.LoadHandle(unsafe.Pointer(slot), unsafe.Offsetof(slot.handle)) != ptrKey {
+			t.Fatal("LoadHandle did not return the stored key")
+		}
+		m.DeletePtr(unsafe.Pointer(slot))
+		C.free(unsafe.Pointer(slot))
+
+		// A handle in Go memory, passed to C by pointer.
+		h := C.uintptr_t(m.MapValue(i).Handle())
+		runtime.GC()
+		if C.pattern_read_handle(&h) != h {
+			t.Fatal("handle read from Go memory differs")
+		}
+		m.DeleteHandle(uintptr(h))
+
+		// Bytes pinned, or copied, for C to use beyond the call.
+		b := []byte{1, 2, 3, byte(i)}
+		ptr, bkey := m.MapBytes(b)
+		runtime.GC()
+		if got, want := C.pattern_sum(ptr, C.size_t(len(b))), C.int(6+i); got != want {
+			t.Fatalf("sum of mapped bytes = %d, want %d", got, want)
+		}
+		m.Delete(bkey)
+	}
+
+	if s := m.Stats(); s.Live != 0 {
+		t.Fatalf("%d mappings left", s.Live)
+	}
+}
+
+//export goPatternCallback
+func goPatternCallback(handle C.uintptr_t) {
+	patternMapper.GetHandle(uintptr(handle)).(*GoObject).goCallback()
+}
@@ -0,0 +1,11 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build goexperiment.cgocheck2
+// +build goexperiment.cgocheck2
+
+package testing
+
+// cgoCheck2 is set when the full cgo pointer checks are compiled in.
+const cgoCheck2 = true
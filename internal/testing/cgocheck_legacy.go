@@ -0,0 +1,10 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.21
+// +build !go1.21
+
+package testing
+
+const cgoCheckGODEBUG = "cgocheck=2"
@@ -0,0 +1,86 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../chanbridge
+#include <stdlib.h>
+#include <string.h>
+#include "chanbridge.h"
+
+static int logLine(uintptr_t handle, const char *line) {
+	return mapper_chan_send(handle, (void *)line, strlen(line));
+}
+*/
+import "C"
+import (
+	"testing"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/chanbridge"
+)
+
+func RunTestChanBridge(t *testing.T) {
+	b := chanbridge.New(2, chanbridge.DropOldest)
+	handle := C.uintptr_t(b.Handle())
+
+	line := C.CString("hello")
+	defer C.free(unsafe.Pointer(line))
+	if C.logLine(handle, line) != 1 {
+		t.Fatal("send failed")
+	}
+	for i := 1; i <= 2; i++ {
+		if C.mapper_chan_send_value(handle, C.int64_t(i)) != 1 {
+			t.Fatal("send failed")
+		}
+	}
+	if b.Dropped() != 1 {
+		t.Fatalf("dropped %d events, want 1", b.Dropped())
+	}
+
+	b.Close()
+	if C.mapper_chan_send_value(handle, 3) != -1 {
+		t.Fatal("send after close did not fail")
+	}
+	var values []int64
+	for ev := range b.Events() {
+		values = append(values, ev.Value)
+	}
+	if len(values) != 2 || values[0] != 1 || values[1] != 2 {
+		t.Fatalf("got values %v", values)
+	}
+
+	// A blocked sender is released by Close.
+	b = chanbridge.New(0, chanbridge.Block)
+	done := make(chan C.int)
+	go func() { done <- C.mapper_chan_send_value(C.uintptr_t(b.Handle()), 1) }()
+	b.Close()
+	if res := <-done; res != -1 {
+		t.Fatalf("blocked send returned %d, want -1", res)
+	}
+
+	// Bridges are mapped in Target, and found through it once Target is
+	// changed.
+	m := mapper.New()
+	chanbridge.Target = m
+	b = chanbridge.New(1, chanbridge.DropNewest)
+	chanbridge.Target = &mapper.G
+	if m.Len() != 1 || C.mapper_chan_send_value(C.uintptr_t(b.Handle()), 5) != 1 {
+		t.Fatal("bridge of another Mapper not found")
+	}
+	if ev := <-b.Events(); ev.Value != 5 {
+		t.Fatalf("got value %d", ev.Value)
+	}
+	b.Close()
+
+	// An unbuffered channel has no oldest event to drop.
+	defer func() {
+		if recover() == nil {
+			t.Fatal("DropOldest without a buffer did not panic")
+		}
+	}()
+	chanbridge.New(0, chanbridge.DropOldest)
+}
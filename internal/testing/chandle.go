@@ -0,0 +1,61 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../chandle
+#include "chandle.h"
+
+typedef struct {
+	void *user;
+	uint32_t user32;
+} callback_t;
+
+// roundTrip stores the handle as a user pointer, as a C API would, and
+// returns it.
+static uintptr_t roundTrip(uintptr_t handle) {
+	callback_t cb = { mapper_handle_ptr(handle), 0 };
+	return mapper_ptr_handle(cb.user);
+}
+
+static void *userPointer(uintptr_t handle) {
+	return mapper_handle_ptr(handle);
+}
+*/
+import "C"
+import (
+	"testing"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/chandle"
+)
+
+func RunTestCHandle(t *testing.T) {
+	m := mapper.New(mapper.With32BitHandles())
+	key := m.MapValue("value")
+	h := C.roundTrip(chandle.CHandle[C.uintptr_t](key))
+	if got := m.Get(chandle.Key(h)); got != "value" {
+		t.Fatalf("Get after round trip = %v", got)
+	}
+	if got := chandle.Key(chandle.CHandle[C.uint32_t](key)); got != key {
+		t.Fatalf("32-bit round trip = %v, want %v", got, key)
+	}
+
+	// A pointer is only converted, never dereferenced.
+	p := (*C.callback_t)(C.userPointer(C.uintptr_t(0x1000)))
+	if got := chandle.KeyFromPointer(p); got.Handle() != 0x1000 {
+		t.Fatalf("KeyFromPointer = 0x%x", got.Handle())
+	}
+
+	if unsafe.Sizeof(uintptr(0)) > 4 {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("CHandle of a 64-bit handle as 32 bits did not panic")
+			}
+		}()
+		chandle.CHandle[C.uint32_t](mapper.KeyFromHandle(^uintptr(0)))
+	}
+}
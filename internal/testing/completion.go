@@ -0,0 +1,97 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../completion
+#cgo LDFLAGS: -lpthread
+#include <pthread.h>
+#include <stdlib.h>
+#include "completion.h"
+
+typedef struct {
+	uintptr_t handle;
+	uintptr_t payload;
+} operation_t;
+
+static void *runOperation(void *arg) {
+	operation_t *op = (operation_t *)arg;
+	mapper_complete(op->handle, 42, op->payload);
+	free(op);
+	return NULL;
+}
+
+// startOperation completes the operation on another thread.
+static int startOperation(uintptr_t handle, uintptr_t payload) {
+	operation_t *op = (operation_t *)malloc(sizeof(operation_t));
+	op->handle = handle;
+	op->payload = payload;
+	pthread_t thread;
+	if (pthread_create(&thread, NULL, runOperation, op) != 0) {
+		free(op);
+		return -1;
+	}
+	return pthread_detach(thread);
+}
+*/
+import "C"
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/completion"
+)
+
+func RunTestCompletion(t *testing.T) {
+	payload := mapper.G.MapValue("payload")
+	defer mapper.G.Delete(payload)
+
+	c := completion.New()
+	if C.startOperation(C.uintptr_t(c.Handle()), C.uintptr_t(payload.Handle())) != 0 {
+		t.Fatal("could not start operation")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := c.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != 42 || mapper.G.Get(res.Payload) != "payload" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if _, ok := mapper.G.Lookup(mapper.KeyFromHandle(c.Handle())); ok {
+		t.Fatal("completion still mapped")
+	}
+
+	// An abandoned completion ignores a late call from C.
+	c = completion.New()
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Wait(ctx); err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	C.mapper_complete(C.uintptr_t(c.Handle()), 0, 0)
+	select {
+	case <-c.Done():
+		t.Fatal("abandoned completion was resolved")
+	default:
+	}
+
+	// Completions are mapped in Target, and found through it once Target is
+	// changed.
+	m := mapper.New()
+	completion.Target = m
+	c = completion.New()
+	completion.Target = &mapper.G
+	if m.Len() != 1 {
+		t.Fatal("completion not mapped in Target")
+	}
+	C.mapper_complete(C.uintptr_t(c.Handle()), 7, 0)
+	if res, err := c.Wait(context.Background()); err != nil || res.Status != 7 || m.Len() != 0 {
+		t.Fatalf("completion of another Mapper: %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../destructor
+#include <stdint.h>
+#include "destructor.h"
+
+typedef void (*destroy_t)(void *);
+
+typedef struct {
+	void *user;
+	destroy_t destroy;
+} registration_t;
+
+static registration_t registration;
+
+// registerUser registers user data with its destructor, as a C API would.
+static void registerUser(uintptr_t user) {
+	registration.user = (void *)user;
+	registration.destroy = mapper_destroy;
+}
+
+// unregisterUser releases the registration, destroying its user data.
+static void unregisterUser(void) {
+	registration.destroy(registration.user);
+	registration.user = NULL;
+}
+*/
+import "C"
+import (
+	"testing"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/destructor"
+)
+
+func RunTestDestructor(t *testing.T) {
+	var tornDown interface{}
+	key := destructor.Map("user data", func(v interface{}) { tornDown = v })
+	C.registerUser(C.uintptr_t(key.Handle()))
+	if _, ok := mapper.G.Lookup(key); !ok {
+		t.Fatal("registered user data not mapped")
+	}
+
+	C.unregisterUser()
+	if _, ok := mapper.G.Lookup(key); ok {
+		t.Fatal("destroyed user data still mapped")
+	}
+	if tornDown != "user data" {
+		t.Fatalf("teardown called with %v", tornDown)
+	}
+
+	// Values are mapped in Target, and destroyed through the Mapper they were
+	// mapped in once Target is changed.
+	m := mapper.New()
+	destructor.Target = m
+	key = destructor.Map("other user data", nil)
+	destructor.Target = &mapper.G
+	C.registerUser(C.uintptr_t(key.Handle()))
+	if m.Len() != 1 {
+		t.Fatal("user data not mapped in Target")
+	}
+	C.unregisterUser()
+	if m.Len() != 0 {
+		t.Fatal("destroyed user data of another Mapper still mapped")
+	}
+}
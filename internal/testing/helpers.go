@@ -6,6 +6,7 @@
 package testing
 
 /*
+#include <stdint.h>
 #include <stdlib.h>
 #include <string.h>
 
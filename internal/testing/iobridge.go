@@ -0,0 +1,121 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../iobridge
+#include <stdio.h>
+#include <stdlib.h>
+#include "iobridge.h"
+
+// copyStream reads all of the input stream, and writes it to the output
+// stream, as a C library might.  It returns the number of bytes copied, or -1
+// on error.
+static int64_t copyStream(uintptr_t in, uintptr_t out) {
+	char buf[3];
+	int64_t total = 0;
+	for (;;) {
+		int64_t n = mapper_io_read(in, buf, sizeof(buf));
+		if (n == 0) {
+			return total;
+		}
+		if (n < 0 || mapper_io_write(out, buf, n) != n) {
+			return -1;
+		}
+		total += n;
+	}
+}
+*/
+import "C"
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/iobridge"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func RunTestIOBridge(t *testing.T) {
+	in := iobridge.New(strings.NewReader("hello, world"), iobridge.POSIX)
+	defer in.Close()
+	var buf bytes.Buffer
+	out := iobridge.New(&buf, iobridge.POSIX)
+	defer out.Close()
+
+	n := C.copyStream(C.uintptr_t(in.Handle()), C.uintptr_t(out.Handle()))
+	if n != 12 || buf.String() != "hello, world" {
+		t.Fatalf("copied %d bytes: %q", n, buf.String())
+	}
+	if pos := C.mapper_io_seek(C.uintptr_t(in.Handle()), 7, C.SEEK_SET); pos != 7 {
+		t.Fatalf("seek returned %d", pos)
+	}
+
+	// AVIO can ask for the size of the stream.
+	sized := iobridge.New(strings.NewReader("12345"), iobridge.AVIO)
+	defer sized.Close()
+	if size := C.mapper_io_seek(C.uintptr_t(sized.Handle()), 0, C.int(iobridge.AVIO.SizeWhence)); size != 5 {
+		t.Fatalf("size returned %d", size)
+	}
+
+	in = iobridge.New(strings.NewReader("data"), iobridge.POSIX)
+	defer in.Close()
+	failing := iobridge.New(failingWriter{}, iobridge.POSIX)
+	defer failing.Close()
+	if n := C.copyStream(C.uintptr_t(in.Handle()), C.uintptr_t(failing.Handle())); n != -1 {
+		t.Fatalf("copy to failing writer returned %d", n)
+	}
+	if err := failing.Err(); err == nil || err.Error() != "disk full" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Streams are mapped in Target, and reject negative sizes.
+	m := mapper.New()
+	iobridge.Target = m
+	defer func() { iobridge.Target = &mapper.G }()
+	s := iobridge.New(&buf, iobridge.AVIO)
+	defer s.Close()
+	if m.Len() != 1 {
+		t.Fatal("stream not mapped in Target")
+	}
+	var b [4]C.char
+	if n := C.mapper_io_read(C.uintptr_t(s.Handle()), unsafe.Pointer(&b[0]), -1); n != C.int64_t(iobridge.AVIO.Error) {
+		t.Fatalf("read of negative size returned %d", n)
+	}
+	if n := C.mapper_io_write(C.uintptr_t(s.Handle()), unsafe.Pointer(&b[0]), -1); n != C.int64_t(iobridge.AVIO.Error) {
+		t.Fatalf("write of negative size returned %d", n)
+	}
+	if err := s.Err(); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Streams are found through the Mapper they were mapped in, once Target
+	// is changed, even when another Mapper allocates the same keys.
+	first := iobridge.New(strings.NewReader("first"), iobridge.POSIX)
+	defer first.Close()
+	iobridge.Target = mapper.New()
+	second := iobridge.New(strings.NewReader("second"), iobridge.POSIX)
+	defer second.Close()
+	if first.Handle() == second.Handle() {
+		t.Fatalf("streams of different Mappers share the handle 0x%x", first.Handle())
+	}
+	for _, tc := range []struct {
+		s    *iobridge.Stream
+		want string
+	}{{first, "first"}, {second, "second"}} {
+		var data [8]byte
+		n := C.mapper_io_read(C.uintptr_t(tc.s.Handle()), unsafe.Pointer(&data[0]), C.int64_t(len(data)))
+		if got := string(data[:n]); got != tc.want {
+			t.Fatalf("read %q, want %q", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../progress
+#include "progress.h"
+
+// transfer reports progress for each of total steps, stopping early if asked
+// to.  It returns the number of steps completed.
+static int transfer(uintptr_t handle, int total) {
+	int i;
+	for (i = 0; i < total; i++) {
+		if (mapper_progress(handle, i + 1, total)) {
+			return i + 1;
+		}
+	}
+	return i;
+}
+*/
+import "C"
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/progress"
+)
+
+func RunTestProgress(t *testing.T) {
+	var updates []int64
+	p := progress.New(context.Background(), func(current, total int64) {
+		updates = append(updates, current)
+	})
+	if n := C.transfer(C.uintptr_t(p.Handle()), 3); n != 3 {
+		t.Fatalf("transfer completed %d steps, want 3", n)
+	}
+	if len(updates) != 3 || updates[2] != 3 {
+		t.Fatalf("got updates %v", updates)
+	}
+	p.Close()
+	if C.mapper_progress_cancelled(C.uintptr_t(p.Handle())) == 0 {
+		t.Fatal("closed progress not cancelled")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p = progress.New(ctx, func(current, total int64) {
+		if current == 2 {
+			cancel()
+			// The flag is set asynchronously.
+			for !p.Cancelled() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	})
+	defer p.Close()
+	if n := C.transfer(C.uintptr_t(p.Handle()), 10); n != 2 {
+		t.Fatalf("transfer completed %d steps, want 2", n)
+	}
+
+	// Progresses are mapped in Target, and found through it once Target is
+	// changed.
+	m := mapper.New()
+	progress.Target = m
+	other := progress.New(context.Background(), nil)
+	progress.Target = &mapper.G
+	defer other.Close()
+	if m.Len() != 1 || C.transfer(C.uintptr_t(other.Handle()), 3) != 3 {
+		t.Fatal("progress of another Mapper not found")
+	}
+}
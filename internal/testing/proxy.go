@@ -0,0 +1,80 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../proxy
+#include "proxy.h"
+
+typedef struct {
+	int64_t a, b;
+} proxy_args_t;
+
+static int64_t proxy_invoke(void *obj, int method, int64_t a, int64_t b) {
+	mapper_proxy_t *self = obj;
+	proxy_args_t args = {a, b};
+	return self->vtable[method](self, &args);
+}
+*/
+import "C"
+import (
+	"testing"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/proxy"
+)
+
+type calculator interface {
+	Add(a, b int64) int64
+	Mul(a, b int64) int64
+}
+
+type offsetCalc int64
+
+func (c offsetCalc) Add(a, b int64) int64 { return a + b + int64(c) }
+func (c offsetCalc) Mul(a, b int64) int64 { return a*b + int64(c) }
+
+var calcClass = proxy.NewClass(
+	func(impl interface{}, args unsafe.Pointer) int64 {
+		a := (*C.proxy_args_t)(args)
+		return impl.(calculator).Add(int64(a.a), int64(a.b))
+	},
+	func(impl interface{}, args unsafe.Pointer) int64 {
+		a := (*C.proxy_args_t)(args)
+		return impl.(calculator).Mul(int64(a.a), int64(a.b))
+	},
+)
+
+func RunTestProxy(t *testing.T) {
+	o1 := calcClass.New(offsetCalc(0))
+	defer o1.Close()
+	o2 := calcClass.New(offsetCalc(100))
+	defer o2.Close()
+
+	if got := C.proxy_invoke(o1.Ptr(), 0, 3, 4); got != 7 {
+		t.Fatalf("o1.Add = %d, want 7", got)
+	}
+	if got := C.proxy_invoke(o1.Ptr(), 1, 3, 4); got != 12 {
+		t.Fatalf("o1.Mul = %d, want 12", got)
+	}
+	if got := C.proxy_invoke(o2.Ptr(), 1, 3, 4); got != 112 {
+		t.Fatalf("o2.Mul = %d, want 112", got)
+	}
+
+	// Objects are mapped in Target, and found through it once Target is
+	// changed.
+	m := mapper.New()
+	proxy.Target = m
+	o3 := calcClass.New(offsetCalc(1000))
+	proxy.Target = &mapper.G
+	defer o3.Close()
+	if m.Len() != 1 {
+		t.Fatal("object not mapped in Target")
+	}
+	if got := C.proxy_invoke(o3.Ptr(), 0, 3, 4); got != 1007 {
+		t.Fatalf("o3.Add = %d, want 1007", got)
+	}
+}
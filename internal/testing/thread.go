@@ -0,0 +1,22 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+/*
+#cgo LDFLAGS: -lpthread
+#include <pthread.h>
+#include <stdint.h>
+
+static uintptr_t threadSelf(void) {
+	return (uintptr_t)pthread_self();
+}
+*/
+import "C"
+
+// ThreadSelf identifies the OS thread running the calling goroutine, which
+// should be locked to it.
+func ThreadSelf() uintptr {
+	return uintptr(C.threadSelf())
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package iobridge adapts a Go io.Reader, io.Writer, or io.Seeker into the
+// read, write, and seek callbacks expected by C APIs such as FFmpeg's AVIO,
+// libarchive, and SDL_RWops.
+//
+// A Stream maps the Go value in the Mapper Target, by default the global
+// mapper.G, and its handle is passed to C as the opaque user pointer of the
+// callbacks.  The exported C callbacks mapper_io_read, mapper_io_write, and
+// mapper_io_seek are declared in iobridge.h in this package's directory.
+// Their signatures rarely match a C API exactly, so a short C adapter is
+// usually needed, for example, for FFmpeg:
+//
+//	static int readPacket(void *opaque, uint8_t *buf, int size) {
+//		return (int)mapper_io_read((uintptr_t)opaque, buf, size);
+//	}
+//
+// C APIs differ in how they expect the end of a stream, and errors, to be
+// reported; these are described by Conventions.
+package iobridge // go.jpap.org/mapper/iobridge
+
+/*
+#include "iobridge.h"
+*/
+import "C"
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/internal/bridge"
+)
+
+// Target is the Mapper in which new Streams are mapped.  The exported C
+// callbacks retrieve each Stream from the Mapper it was mapped in, even once
+// Target is changed.  Target is not safe to change concurrently with New.
+var Target = &mapper.G
+
+// maxInt is the largest size of a buffer.
+const maxInt = int64(^uint(0) >> 1)
+
+// Conventions describe how a C API expects the end of a stream, and errors,
+// to be reported by the callbacks.
+type Conventions struct {
+	// EOF is returned by a read at the end of the stream.
+	EOF int64
+
+	// Error is returned by any callback that fails, including a callback on
+	// a stream that does not implement the operation.
+	Error int64
+
+	// SizeWhence, if non-zero, is a whence value asking seek to return the
+	// size of the stream without seeking.
+	SizeWhence int
+
+	// IgnoreWhence are flag bits cleared from whence before seeking.
+	IgnoreWhence int
+}
+
+var (
+	// AVIO describes FFmpeg's AVIOContext callbacks.
+	AVIO = Conventions{
+		EOF:          -0x20464f45, // AVERROR_EOF
+		Error:        -5,          // AVERROR(EIO)
+		SizeWhence:   0x10000,     // AVSEEK_SIZE
+		IgnoreWhence: 0x20000,     // AVSEEK_FORCE
+	}
+
+	// POSIX describes read(2), write(2), and lseek(2), as used by libarchive
+	// and SDL_RWops.
+	POSIX = Conventions{EOF: 0, Error: -1}
+)
+
+// Stream is a Go stream mapped for use by C callbacks.
+type Stream struct {
+	conv Conventions
+	r    io.Reader
+	w    io.Writer
+	s    io.Seeker
+	m    *mapper.Mapper
+	key  mapper.Key
+
+	mu  sync.Mutex
+	err error
+}
+
+// New maps the given stream, which should implement one or more of io.Reader,
+// io.Writer, and io.Seeker, for use by C callbacks following conv.
+func New(stream interface{}, conv Conventions) *Stream {
+	s := &Stream{conv: conv, m: Target}
+	s.r, _ = stream.(io.Reader)
+	s.w, _ = stream.(io.Writer)
+	s.s, _ = stream.(io.Seeker)
+	s.key = bridge.Map(s.m, s)
+	return s
+}
+
+// Handle returns the handle to pass to C as the callbacks' user pointer.
+func (s *Stream) Handle() uintptr {
+	return s.key.Handle()
+}
+
+// Err returns the last error, other than io.EOF, reported to C as a failure.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close deletes the stream's mapping.  It must be called only once C will no
+// longer invoke the callbacks, and does not close the underlying stream.
+func (s *Stream) Close() error {
+	bridge.Delete(s.m, s.key)
+	return nil
+}
+
+var errUnsupported = errors.New("iobridge: operation not supported by stream")
+
+func (s *Stream) fail(err error) int64 {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	return s.conv.Error
+}
+
+func streamFromHandle(handle C.uintptr_t) *Stream {
+	v, ok := bridge.Lookup(uintptr(handle))
+	if !ok {
+		// Panic with the Mapper's explanation of the miss.
+		v = Target.GetHandle(uintptr(handle))
+	}
+	return v.(*Stream)
+}
+
+// checkSize records the failure of a read or write given a size that is
+// negative, or too large for a buffer on this platform, returning false.
+func (s *Stream) checkSize(size C.int64_t) bool {
+	if size < 0 || int64(size) > maxInt {
+		s.fail(syscall.EINVAL)
+		return false
+	}
+	return true
+}
+
+func (s *Stream) read(buf []byte) int64 {
+	if s.r == nil {
+		return s.fail(errUnsupported)
+	}
+	if len(buf) == 0 {
+		return 0
+	}
+	n, err := io.ReadAtLeast(s.r, buf, 1)
+	if n > 0 {
+		return int64(n)
+	}
+	if err == io.EOF {
+		return s.conv.EOF
+	}
+	return s.fail(err)
+}
+
+func (s *Stream) write(buf []byte) int64 {
+	if s.w == nil {
+		return s.fail(errUnsupported)
+	}
+	n, err := s.w.Write(buf)
+	if err != nil {
+		return s.fail(err)
+	}
+	return int64(n)
+}
+
+func (s *Stream) seek(offset int64, whence int) int64 {
+	if s.s == nil {
+		return s.fail(errUnsupported)
+	}
+	whence &^= s.conv.IgnoreWhence
+	if s.conv.SizeWhence != 0 && whence == s.conv.SizeWhence {
+		return s.size()
+	}
+	pos, err := s.s.Seek(offset, whence)
+	if err != nil {
+		return s.fail(err)
+	}
+	return pos
+}
+
+// size returns the size of the stream, restoring the current offset.
+func (s *Stream) size() int64 {
+	pos, err := s.s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return s.fail(err)
+	}
+	end, err := s.s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return s.fail(err)
+	}
+	if _, err := s.s.Seek(pos, io.SeekStart); err != nil {
+		return s.fail(err)
+	}
+	return end
+}
+
+//export mapper_io_read
+func mapper_io_read(handle C.uintptr_t, buf unsafe.Pointer, size C.int64_t) C.int64_t {
+	s := streamFromHandle(handle)
+	if !s.checkSize(size) {
+		return C.int64_t(s.conv.Error)
+	}
+	return C.int64_t(s.read(unsafe.Slice((*byte)(buf), int(size))))
+}
+
+//export mapper_io_write
+func mapper_io_write(handle C.uintptr_t, buf unsafe.Pointer, size C.int64_t) C.int64_t {
+	s := streamFromHandle(handle)
+	if !s.checkSize(size) {
+		return C.int64_t(s.conv.Error)
+	}
+	return C.int64_t(s.write(unsafe.Slice((*byte)(buf), int(size))))
+}
+
+//export mapper_io_seek
+func mapper_io_seek(handle C.uintptr_t, offset C.int64_t, whence C.int) C.int64_t {
+	s := streamFromHandle(handle)
+	return C.int64_t(s.seek(int64(offset), int(whence)))
+}
@@ -0,0 +1,26 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Callbacks exported by go.jpap.org/mapper/iobridge.  Each takes the handle of
+// an iobridge.Stream, and returns a negative value on error, according to the
+// stream's Conventions.
+
+#ifndef GO_JPAP_ORG_MAPPER_IOBRIDGE_H
+#define GO_JPAP_ORG_MAPPER_IOBRIDGE_H
+
+#include <stdint.h>
+
+// mapper_io_read reads up to size bytes into buf, returning the number of
+// bytes read, or the stream's EOF value at the end of the stream.  A size that
+// is negative, or too large for a buffer, is an error.
+extern int64_t mapper_io_read(uintptr_t handle, void *buf, int64_t size);
+
+// mapper_io_write writes size bytes from buf, returning the number of bytes
+// written.  A size that is negative, or too large for a buffer, is an error.
+extern int64_t mapper_io_write(uintptr_t handle, void *buf, int64_t size);
+
+// mapper_io_seek seeks as lseek does, returning the new offset.
+extern int64_t mapper_io_seek(uintptr_t handle, int64_t offset, int whence);
+
+#endif // GO_JPAP_ORG_MAPPER_IOBRIDGE_H
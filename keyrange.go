@@ -0,0 +1,198 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// KeyRange is a block of consecutive counting-pointer keys, reserved by
+// ReserveKeys.  Key i has the handle Base() + i*Stride(), unless the mapper
+// obfuscates handles; see WithObfuscatedHandles.
+type KeyRange struct {
+	base   uintptr
+	n      int
+	stride uintptr
+
+	// obf obfuscates the handles of the keys, whose plain handles start at
+	// base, and tag holds their version and generation bits, within tagMask;
+	// see WithHandleVersion and WithGenerationBits.
+	obf          obfuscation
+	tag, tagMask uintptr
+}
+
+// ReserveKeys reserves a block of n consecutive counting-pointer keys, which
+// are not mapped until passed to MapPair.  It panics with
+// ErrKeySpaceExhausted if the block cannot be allocated.
+//
+// Reserving a block up front suits C APIs that want an array of distinct user
+// pointers, such as one per channel or stream, and takes a single atomic
+// operation, rather than one per key.
+func (mapper *Mapper) ReserveKeys(n int) KeyRange {
+	r, err := mapper.reserveKeys(n)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// reserveKeys implements ReserveKeys, reserving another block if the first
+// includes an excluded handle.
+func (mapper *Mapper) reserveKeys(n int) (KeyRange, error) {
+	for {
+		r, err := mapper.reserveBlock(n)
+		if err != nil || !r.excludes(mapper.excluded) {
+			return r, err
+		}
+	}
+}
+
+// excludes reports whether r includes any of the excluded handles.
+func (r KeyRange) excludes(excluded map[uintptr]bool) bool {
+	if len(excluded) == 0 {
+		return false
+	}
+	for i := 0; i < r.n; i++ {
+		if excluded[r.Key(i).v] {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveBlock reserves a block of n keys.
+func (mapper *Mapper) reserveBlock(n int) (KeyRange, error) {
+	if n < 0 {
+		panic(fmt.Errorf("invalid number of keys: %d", n))
+	}
+	stride := uintptr(2) << mapper.reservedBits
+	r := KeyRange{n: n, stride: stride, obf: mapper.obfuscation()}
+	r.tag, r.tagMask = mapper.handleTag()
+	if n == 0 {
+		return r, nil
+	}
+	size := uintptr(n) * stride
+	if size/stride != uintptr(n) {
+		return KeyRange{}, ErrKeySpaceExhausted
+	}
+
+	var end uintptr
+	if mapper.recycle {
+		mapper.mux.Lock()
+		end = mapper.atomicKey + size
+		if end >= mapper.atomicKey {
+			atomic.StoreUintptr(&mapper.atomicKey, end)
+		}
+		mapper.mux.Unlock()
+	} else {
+		end = atomic.AddUintptr(&mapper.atomicKey, size)
+	}
+	// Fail on wrap-around
+	if end < size {
+		return KeyRange{}, ErrKeySpaceExhausted
+	}
+	r.base = (end - size + stride) | mapper.plainBit()
+	if end > mapper.countingMax() {
+		return KeyRange{}, ErrKeySpaceExhausted
+	}
+	return r, nil
+}
+
+// Len returns the number of keys in the range.
+func (r KeyRange) Len() int {
+	return r.n
+}
+
+// Base returns the handle of the first key in the range.
+func (r KeyRange) Base() uintptr {
+	return r.obf.handle(r.base) | r.tag
+}
+
+// Stride returns the difference between the handles of consecutive keys.  It
+// is two, unless the mapper has reserved bits; see WithReservedBits.
+func (r KeyRange) Stride() uintptr {
+	return r.stride
+}
+
+// Key returns the ith key in the range.  It panics if i is out of range.
+func (r KeyRange) Key(i int) Key {
+	if i < 0 || i >= r.n {
+		panic(fmt.Errorf("key index out of range [%d] with length %d", i, r.n))
+	}
+	return Key{v: r.obf.handle(r.base+uintptr(i)*r.stride) | r.tag}
+}
+
+// Index returns the index of key in the range, and false if the key is not
+// in the range.
+func (r KeyRange) Index(key Key) (int, bool) {
+	if key.domain != 0 || r.n == 0 {
+		return 0, false
+	}
+	if key.v&r.tagMask != r.tag {
+		return 0, false
+	}
+	v := r.obf.plain(key.v &^ r.tagMask)
+	if v < r.base {
+		return 0, false
+	}
+	d := v - r.base
+	if d%r.stride != 0 || d/r.stride >= uintptr(r.n) {
+		return 0, false
+	}
+	return int(d / r.stride), true
+}
+
+// MapSlice reserves a KeyRange for the elements of s, and maps each element
+// s[i] to the key r.Key(i), whose handle is r.Base() + i*r.Stride().  C APIs
+// that index callbacks by, for example, channel number, can then compute the
+// handle for element i arithmetically.
+//
+// The elements are copied into the mapper: to share elements with the slice,
+// pass a slice of pointers.
+func MapSlice[T any](mapper *Mapper, s []T) KeyRange {
+	if err := mapper.admitN(len(s)); err != nil {
+		panic(err)
+	}
+	r, err := mapper.reserveKeys(len(s))
+	if err != nil {
+		mapper.limit.refund(len(s))
+		panic(err)
+	}
+	entries := make([]entry, len(s))
+	for i, v := range s {
+		entries[i].value = mapper.stored(v)
+		mapper.sized(&entries[i])
+	}
+	mapper.mux.Lock()
+	for i, e := range entries {
+		// Reserved keys are not yet mapped, so nothing is replaced.
+		mapper.mapLocked(r.Key(i), e)
+	}
+	mapper.mux.Unlock()
+	mapper.checkRetained()
+	return r
+}
+
+// GetIndex calls Get with the ith key in r.
+func (mapper *Mapper) GetIndex(r KeyRange, i int) (goValue interface{}) {
+	return mapper.Get(r.Key(i))
+}
+
+// DeleteRange deletes the mappings of all keys in r.
+func (mapper *Mapper) DeleteRange(r KeyRange) {
+	var closing []entry
+	mapper.mux.Lock()
+	for i := 0; i < r.n; i++ {
+		if e, ok := mapper.deleteLocked(r.Key(i)); ok && e.release != nil {
+			closing = append(closing, e)
+		}
+	}
+	mapper.mux.Unlock()
+
+	for _, e := range closing {
+		e.close()
+	}
+}
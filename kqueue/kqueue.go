@@ -0,0 +1,100 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd
+// +build darwin dragonfly freebsd openbsd
+
+// Package kqueue stores mappings in the udata field of kevent structures, so
+// that a reactor can resolve the Go value registered for an event.
+//
+// The udata field is a *byte in package syscall, so it must not hold a
+// counting-pointer handle, which is not a valid address.  Instead, each
+// registration allocates a small cookie, which the kernel returns in udata
+// untouched, and which is the pointer key of the mapping:
+//
+//	var reg kqueue.Registry
+//
+//	ev := syscall.Kevent_t{Ident: uint64(fd), Filter: syscall.EVFILT_READ, Flags: syscall.EV_ADD}
+//	reg.Set(&ev, conn)
+//	syscall.Kevent(kq, []syscall.Kevent_t{ev}, nil, nil)
+//	...
+//	n, _ := syscall.Kevent(kq, nil, events, nil)
+//	for _, ev := range events[:n] {
+//		conn := reg.Get(&ev).(*Conn)
+//		...
+//	}
+//
+// Delete the registration once the event has been removed from the kqueue,
+// or has fired for the last time, as for an EV_ONESHOT event.
+package kqueue // go.jpap.org/mapper/kqueue
+
+import (
+	"syscall"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+)
+
+// Registry maps the udata of kevent structures to Go values.  The zero value
+// is ready to use, with the global mapper.G.
+type Registry struct {
+	// Mapper holds the registrations; if nil, mapper.G is used.  It must not
+	// reserve more than two bits; see mapper.WithReservedBits.
+	Mapper *mapper.Mapper
+}
+
+// registration is the mapped value of a registration, which keeps its cookie
+// alive while the kernel holds it.
+type registration struct {
+	cookie *uint64
+	value  interface{}
+}
+
+func (r *Registry) mapper() *mapper.Mapper {
+	if r.Mapper == nil {
+		return &mapper.G
+	}
+	return r.Mapper
+}
+
+// Udata maps value, and returns the udata that resolves to it.
+func (r *Registry) Udata(value interface{}) *byte {
+	// Go heap objects do not move, so the cookie's address is stable.
+	reg := registration{cookie: new(uint64), value: value}
+	r.mapper().MapPtrPair(unsafe.Pointer(reg.cookie), reg)
+	return (*byte)(unsafe.Pointer(reg.cookie))
+}
+
+// Set maps value, and stores its udata in ev.
+func (r *Registry) Set(ev *syscall.Kevent_t, value interface{}) {
+	ev.Udata = r.Udata(value)
+}
+
+// Get returns the value registered for the udata of ev.  It panics if the
+// udata is not registered.
+func (r *Registry) Get(ev *syscall.Kevent_t) interface{} {
+	return r.mapper().GetPtr(unsafe.Pointer(ev.Udata)).(registration).value
+}
+
+// Lookup is like Get, but returns false instead of panicking if the udata is
+// not registered, as for an event registered by other code.
+func (r *Registry) Lookup(ev *syscall.Kevent_t) (value interface{}, ok bool) {
+	if ev.Udata == nil {
+		return nil, false
+	}
+	v, ok := r.mapper().Lookup(mapper.KeyFromHandle(uintptr(unsafe.Pointer(ev.Udata))))
+	if !ok {
+		return nil, false
+	}
+	reg, ok := v.(registration)
+	return reg.value, ok
+}
+
+// Delete deletes the registration for the udata of ev.  The kernel must no
+// longer hold the udata.
+func (r *Registry) Delete(ev *syscall.Kevent_t) {
+	if ev.Udata != nil {
+		r.mapper().DeletePtr(unsafe.Pointer(ev.Udata))
+	}
+}
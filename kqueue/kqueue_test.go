@@ -0,0 +1,60 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd
+// +build darwin dragonfly freebsd openbsd
+
+package kqueue_test
+
+import (
+	"syscall"
+	"testing"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/kqueue"
+)
+
+func TestRegistry(t *testing.T) {
+	m := mapper.New()
+	reg := kqueue.Registry{Mapper: m}
+
+	kq, err := syscall.Kqueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(kq)
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	// The types of the fields of Kevent_t vary by platform.
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, p[0], syscall.EVFILT_READ, syscall.EV_ADD|syscall.EV_ONESHOT)
+	reg.Set(&ev, "pipe")
+	if _, err := syscall.Kevent(kq, []syscall.Kevent_t{ev}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syscall.Write(p[1], []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([]syscall.Kevent_t, 1)
+	n, err := syscall.Kevent(kq, nil, events, nil)
+	if err != nil || n != 1 {
+		t.Fatalf("Kevent = %d, %v", n, err)
+	}
+	if got := reg.Get(&events[0]); got != "pipe" {
+		t.Fatalf("Get = %v", got)
+	}
+	reg.Delete(&events[0])
+	if _, ok := reg.Lookup(&events[0]); ok {
+		t.Fatal("Lookup succeeded after Delete")
+	}
+	if s := m.Stats(); s.Live != 0 {
+		t.Fatalf("%d live mappings", s.Live)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// WithLatencyMetrics records the latency of each Map, Get, and Delete,
+// reported by Stats.  Latency includes the wait for the Mapper's lock, so
+// that lock contention shows up in the reported percentiles.
+func WithLatencyMetrics() Option {
+	return func(mapper *Mapper) {
+		mapper.latency = new(latencies)
+	}
+}
+
+// Latency summarizes the recorded latencies of an operation.  Percentiles are
+// accurate to within 25%.
+type Latency struct {
+	Count    uint64
+	P50, P99 time.Duration
+}
+
+// Latencies are the latencies of a Mapper's operations, as reported by Stats.
+// Map includes MapPair and MapValue, and their variants; Get includes Lookup,
+// and Delete includes DeletePtr and DeleteHandle.
+type Latencies struct {
+	Map, Get, Delete Latency
+}
+
+// latencies holds the histograms of a Mapper's operations.
+type latencies struct {
+	mapping, get, del histogram
+}
+
+// latencies returns the latency summaries, or zero if latencies are not
+// recorded.
+func (l *latencies) latencies() Latencies {
+	if l == nil {
+		return Latencies{}
+	}
+	return Latencies{
+		Map:    l.mapping.latency(),
+		Get:    l.get.latency(),
+		Delete: l.del.latency(),
+	}
+}
+
+// subBuckets is the number of buckets each power of two is divided into.
+const subBuckets = 4
+
+// histogram counts latencies in buckets of nanoseconds, each power of two
+// divided into subBuckets buckets.  Counts are modified atomically.
+type histogram struct {
+	counts [64 * subBuckets]uint64
+}
+
+// since records the latency of an operation begun at start.
+func (h *histogram) since(start time.Time) {
+	ns := time.Since(start)
+	if ns < 0 {
+		ns = 0
+	}
+	atomic.AddUint64(&h.counts[bucket(uint64(ns))], 1)
+}
+
+// bucket returns the histogram bucket counting ns.
+func bucket(ns uint64) int {
+	if ns < subBuckets {
+		return int(ns)
+	}
+	n := bits.Len64(ns)
+	sub := int(ns>>(n-3)) & (subBuckets - 1)
+	return (n-2)*subBuckets + sub
+}
+
+// bucketMax returns the largest latency counted by bucket i.
+func bucketMax(i int) time.Duration {
+	if i < subBuckets {
+		return time.Duration(i)
+	}
+	n := i/subBuckets + 2
+	sub := uint64(i % subBuckets)
+	max := (subBuckets+sub+1)<<(n-3) - 1
+	if max > 1<<63-1 {
+		max = 1<<63 - 1
+	}
+	return time.Duration(max)
+}
+
+// latency summarizes the histogram.
+func (h *histogram) latency() Latency {
+	var counts [len(h.counts)]uint64
+	var l Latency
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		l.Count += counts[i]
+	}
+	l.P50 = percentile(&counts, l.Count, 50)
+	l.P99 = percentile(&counts, l.Count, 99)
+	return l
+}
+
+// percentile returns the pth percentile of the total latencies in counts.
+func percentile(counts *[64 * subBuckets]uint64, total uint64, p uint64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	rank := (total*p + 99) / 100
+	var seen uint64
+	for i, n := range counts {
+		if seen += n; seen >= rank {
+			return bucketMax(i)
+		}
+	}
+	return bucketMax(len(counts) - 1)
+}
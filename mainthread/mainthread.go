@@ -0,0 +1,71 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mainthread runs callbacks resolved through a mapper.Mapper on the
+// process' main thread, as GUI and graphics C libraries such as Cocoa, GLFW,
+// and SDL require.
+//
+// Importing the package locks the main goroutine to the main thread.  The
+// program's main function then hands control to Run, which runs the rest of
+// the program on another goroutine, while serving calls on the main thread:
+//
+//	func main() {
+//		mainthread.Run(program)
+//	}
+//
+//	//export onKey
+//	func onKey(window C.uintptr_t, key C.int) {
+//		mainthread.Dispatch(&mapper.G, mapper.KeyFromHandle(uintptr(window)), func(v interface{}) {
+//			v.(*Window).keyPressed(int(key))
+//		})
+//	}
+package mainthread // go.jpap.org/mapper/mainthread
+
+import (
+	"context"
+	"runtime"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/dispatch"
+)
+
+func init() {
+	// Package initialization runs on the main goroutine, which the Go
+	// runtime starts on the main thread.
+	runtime.LockOSThread()
+}
+
+// d serves the main thread.  Dispatch blocks once 64 callbacks are queued.
+var d = dispatch.New(64, dispatch.Block)
+
+// Run calls run on a new goroutine, and runs queued callbacks on the calling
+// goroutine, which must be the main goroutine, until run returns.  Call Run
+// once, from the program's main function: once it returns, the main thread is
+// no longer served, and Call, Dispatch, and CallKey return
+// dispatch.ErrStopped.
+func Run(run func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		run()
+	}()
+	d.Run(ctx)
+}
+
+// Call calls fn on the main thread, and waits for it to return.  It must not
+// be called on the main thread itself.
+func Call(fn func()) error {
+	return d.Do(fn)
+}
+
+// Dispatch resolves key in m, and queues fn to be called with the resolved
+// value on the main thread.
+func Dispatch(m *mapper.Mapper, key mapper.Key, fn func(goValue interface{})) error {
+	return d.Dispatch(m, key, fn)
+}
+
+// CallKey is like Dispatch, but waits for fn to return.
+func CallKey(m *mapper.Mapper, key mapper.Key, fn func(goValue interface{})) error {
+	return d.Call(m, key, fn)
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mainthread_test
+
+import (
+	"os"
+	"testing"
+
+	"go.jpap.org/mapper"
+	itest "go.jpap.org/mapper/internal/testing"
+	"go.jpap.org/mapper/mainthread"
+)
+
+// mainThread is initialized on the main goroutine, which importing mainthread
+// locks to the main thread.
+var mainThread = itest.ThreadSelf()
+
+func TestMain(m *testing.M) {
+	// TestMain runs on the main goroutine, so it can serve the main thread.
+	code := 0
+	mainthread.Run(func() {
+		code = m.Run()
+	})
+	os.Exit(code)
+}
+
+func TestCallKey(t *testing.T) {
+	m := mapper.New()
+	key := m.MapValue("window")
+
+	var got interface{}
+	var thread uintptr
+	if err := mainthread.CallKey(m, key, func(v interface{}) {
+		got, thread = v, itest.ThreadSelf()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got != "window" {
+		t.Fatalf("got %v", got)
+	}
+	if thread != mainThread {
+		t.Fatal("callback did not run on the main thread")
+	}
+
+	called := false
+	if err := mainthread.Call(func() { called, thread = true, itest.ThreadSelf() }); err != nil || !called {
+		t.Fatalf("call did not run: %v", err)
+	}
+	if thread != mainThread {
+		t.Fatal("call did not run on the main thread")
+	}
+}
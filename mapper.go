@@ -5,31 +5,279 @@
 package mapper
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 // Mapper maps between Key and Go values.
 type Mapper struct {
 	mux sync.RWMutex
-	m   map[Key]interface{}
+
+	// m holds the mappings, created on first use unless New configures it;
+	// see storage.
+	m storage
 
 	// atomicKey is a sizeof(pointer)/2 value (lower bit is reserved) that is
 	// incremented for each new Key "allocation".
 	atomicKey uintptr
+
+	// maxHandle, if non-zero, is the largest handle value the Mapper may use.
+	maxHandle uintptr
+
+	// version, if non-zero, is set in the top bits of counting-pointer
+	// handles; see WithHandleVersion.
+	version uint8
+
+	// generationBits is the number of handle bits, below any version bits,
+	// holding the generation of counting-pointer keys, with generation that
+	// of new keys, modified atomically with mux held; see
+	// WithGenerationBits.
+	generationBits uint
+	generation     uint32
+
+	// id, if non-zero, is set in the handle bits above the generation bits;
+	// see WithMapperID.
+	id uint8
+
+	// reservedBits is the number of low handle bits reserved for use by C
+	// code; the counting-pointer bit sits just above them, unless highBit
+	// places it at the top of the handle space; see WithHighCountingBit.
+	reservedBits uint
+	highBit      bool
+
+	// recycle enables reuse of deleted counting keys, which are held in free.
+	// When set, atomicKey is only modified with mux held.
+	recycle bool
+	free    []uintptr
+
+	// monotonic preserves atomicKey across Clear; see WithMonotonicKeys.
+	monotonic bool
+
+	// ordered orders iteration by insertion; see WithInsertionOrder.
+	ordered bool
+
+	// capacity is the number of mappings m is allocated to hold; see
+	// WithCapacity.
+	capacity int
+
+	// newStorage, if set, creates the storage of m, which is then created by
+	// New.  lockFree is set if its load method may be called without mux.
+	newStorage func(capacity int) storage
+	lockFree   bool
+
+	// commitSeq is odd while a Txn commits changes to the mapper, and is
+	// modified atomically with mux held; see load.
+	commitSeq uint32
+
+	// excluded holds handles that are never used; see WithExcludedHandles.
+	excluded map[uintptr]bool
+
+	// obfuscated permutes counting-pointer handles; see
+	// WithObfuscatedHandles.
+	obfuscated bool
+
+	// partitioned enables per-type partitions, held in parts by
+	// reflect.Type; see WithTypePartitions.
+	partitioned bool
+	parts       sync.Map
+
+	// mapped and deleted count mappings created and removed over the lifetime
+	// of the Mapper; protected by mux.
+	mapped, deleted uint64
+
+	// namespaces holds the Mapper's namespaces by name; protected by mux.
+	namespaces map[string]*Namespace
+
+	// ownerWarn, if set, is called in debug mode when a goroutine deletes a
+	// mapping created by another; see WithOwnershipWarnings.
+	ownerWarn func(msg string)
+
+	// onMiss, if set, is called by Get for unmapped keys; protected by mux.
+	onMiss func(Key) (interface{}, bool)
+
+	// tombstones records recently deleted keys in debug mode, with buried
+	// holding them in order of deletion; protected by mux.  See Info.
+	tombstones map[Key]tombstone
+	buried     []Key
+
+	// auditLog records recent operations in debug mode; protected by mux.
+	// See Audit.
+	auditLog *auditRing
+
+	// indexes holds the secondary indexes, by name; protected by mux.  See
+	// Index.
+	indexes map[string]map[interface{}]Key
+
+	// watchers holds the watchers of each watched key; protected by mux.
+	// See Watch.
+	watchers map[Key][]*watcher
+
+	// teardown, if set, tears down each value removed from the Mapper,
+	// reporting errors to teardownError; see WithAutoClose.
+	teardown      func(goValue interface{}) error
+	teardownError func(key Key, err error)
+
+	// freed records when recently freed pointers were freed, with
+	// freedOrder holding them in order; protected by mux.  See Freed.
+	freed      map[Key]time.Time
+	freedOrder []Key
+
+	// profile, if set, samples retrievals; see WithGetSampling.
+	profile *getProfile
+
+	// limit, if set, limits the rate of mappings; see WithRateLimit.
+	limit *rateLimiter
+
+	// latency, if set, records the latency of operations; see
+	// WithLatencyMetrics.
+	latency *latencies
+
+	// copyMode selects the copy of each value stored; see WithCopyOnMap.
+	copyMode copyMode
+
+	// sizer, if set, estimates the size of each value mapped, checked
+	// against sizeLimits; see WithSizeAccounting.  retained is the total
+	// estimated size, modified atomically with mux held, and overTotal is
+	// set while it exceeds sizeLimits.Total.
+	sizer      Sizer
+	sizeLimits SizeLimits
+	retained   int64
+	overTotal  int32
+}
+
+// entry is a mapped Go value, with its bookkeeping.  It is kept within the
+// 128 bytes that a Go map stores without a separate allocation: rarely used
+// fields are held by pointer.
+type entry struct {
+	value   interface{}
+	created time.Time
+
+	// release, if set, is called once the entry is removed from the Mapper,
+	// without the lock held.
+	release func()
+
+	// uses, if set, is the number of remaining lookups of the entry, which
+	// is deleted by the last; see MapValueUses.
+	uses *int64
+
+	// size is the estimated size of value; see WithSizeAccounting.
+	size int64
+
+	// word holds the value when value is an *inline; see MapWord.
+	word uintptr
+
+	// seq orders entries by when their keys were first mapped.
+	seq uint64
+
+	// indexes, if set, are the secondary keys of the entry; see Index.
+	indexes *[]indexRef
+
+	// extra, if set, holds the fields that most entries leave unset.  Keeping
+	// them out of line keeps the entry small enough for a Go map to store
+	// it inline.
+	extra *entryExtra
+}
+
+// entryExtra holds the rarely set fields of an entry.  It is shared by the
+// copies of the entry, so it is copied before it is modified; see
+// writableExtra.
+type entryExtra struct {
+	// ns is the namespace holding the entry, or nil if it has none.
+	ns *Namespace
+
+	// closer, if set, is the closer of the value called by release; see
+	// autoClose.
+	closer *closer
+
+	// diag holds the details recorded in debug mode; see Info.
+	diag *diagnostics
+
+	// priority orders the entry in teardown; see SetTeardownPriority.
+	priority int
+
+	// borrow, if set, counts the borrows of the entry; see Borrow.
+	borrow *borrow
+}
+
+// writableExtra returns the extra fields of the entry for modification,
+// first copying them, so that other copies of the entry are unaffected.
+func (e *entry) writableExtra() *entryExtra {
+	x := new(entryExtra)
+	if e.extra != nil {
+		*x = *e.extra
+	}
+	e.extra = x
+	return x
+}
+
+// ns returns the namespace holding the entry, or nil if it has none.
+func (e entry) ns() *Namespace {
+	if e.extra == nil {
+		return nil
+	}
+	return e.extra.ns
+}
+
+// closer returns the closer of the entry's value, if any.
+func (e entry) closer() *closer {
+	if e.extra == nil {
+		return nil
+	}
+	return e.extra.closer
+}
+
+// diag returns the details of the entry recorded in debug mode, if any.
+func (e entry) diag() *diagnostics {
+	if e.extra == nil {
+		return nil
+	}
+	return e.extra.diag
+}
+
+// priority returns the teardown priority of the entry.
+func (e entry) priority() int {
+	if e.extra == nil {
+		return 0
+	}
+	return e.extra.priority
+}
+
+// borrow returns the borrow count of the entry, if it was ever borrowed.
+func (e entry) borrow() *borrow {
+	if e.extra == nil {
+		return nil
+	}
+	return e.extra.borrow
+}
+
+// close releases the resources held by a removed entry, once it is not
+// borrowed.
+func (e entry) close() {
+	if e.release != nil {
+		e.borrow().after(e.release)
+	}
 }
 
 // Key is an opaque token used to map onto Go values.
 type Key struct {
 	v uintptr
+
+	// domain is zero for pointer and counting-pointer keys.  For a key made
+	// by KeyFromUint, it is one more than the key's Domain, and hi holds the
+	// upper 32 bits of a 64-bit token on 32-bit platforms.  Storage holds
+	// keys with a domain apart from the others, which it keys by v alone;
+	// see keyMap.
+	domain, hi uint32
 }
 
 // We use the LSB on a cgo pointer to mark it as a synthetic "counting-pointer"
 // key type.  This means that real memory pointer values supplied by the package
 // user and obtained from cgo (e.g. from malloc) must be at least two bytes
-// aligned.
+// aligned, unless the Mapper is created using WithHighCountingBit.
 const countingPointerBit = 1
 
 // Handle returns an opaque "pointer" value that be passed to a C function via
@@ -52,11 +300,16 @@ const countingPointerBit = 1
 //
 // The following issue on the Go repository tracks this topic:
 // https://github.com/golang/go/issues/22906
+//
+// Keys made by KeyFromUint and KeyFromFD cannot be passed as handles, as
+// their handles are not converted back to the same keys; see KeyFromUint.
 func (k Key) Handle() uintptr {
 	return k.v
 }
 
-// KeyFromPtr converts the given cgo pointer to a Key.
+// KeyFromPtr converts the given cgo pointer to a Key.  Pointers that are not
+// 2-byte aligned are instead passed to the MapPtrPair, GetPtr, and DeletePtr
+// methods of a Mapper created using WithHighCountingBit.
 //
 // Strictly speaking, ptr can be any pointer, but a pointer to a Go object can
 // be moved (e.g. when the stack is resized), which can render the resulting
@@ -70,56 +323,269 @@ func KeyFromPtr(ptr unsafe.Pointer) Key {
 	if uintptr(ptr)&countingPointerBit != 0 {
 		panic(fmt.Errorf("ptr is unaligned: 0x%x", ptr))
 	}
-	return Key{uintptr(ptr)}
+	return Key{v: uintptr(ptr)}
 }
 
 // KeyFromHandle converts a handle to a Key.
 func KeyFromHandle(handle uintptr) Key {
-	return Key{handle}
+	return Key{v: handle}
 }
 
+// Handle64 is like Handle, but returns the handle as a fixed 64-bit integer,
+// for C ABIs whose user data is a 64-bit integer on all platforms, such as
+// io_uring.  For a key made by KeyFromUint, it is the full 64-bit token.
+func (k Key) Handle64() uint64 {
+	if token, _, ok := k.Token(); ok {
+		return token
+	}
+	return uint64(k.v)
+}
+
+// KeyFromHandle64 converts a handle returned by Handle64 to a Key.  It panics
+// if the handle does not fit in a uintptr, as cannot happen for a handle
+// returned by Handle64 on the same platform.
+func KeyFromHandle64(handle uint64) Key {
+	if uint64(uintptr(handle)) != handle {
+		panic(fmt.Errorf("handle exceeds pointer size: 0x%x", handle))
+	}
+	return Key{v: uintptr(handle)}
+}
+
+// ErrKeySpaceExhausted is returned by TryMapValue when no more keys can be
+// allocated.
+var ErrKeySpaceExhausted = errors.New("key space exhausted")
+
 // G is the global mapper... for users who don't care about lock contention.
 // For those that do, we recommend a separate Mapper instance.
 var G Mapper
 
 // MapPair creates a mapping between the provided Key and Go values.
 func (mapper *Mapper) MapPair(key Key, goValue interface{}) {
+	mapper.checkPair(key)
+	if err := mapper.admit(nil); err != nil {
+		panic(err)
+	}
 	mapper.doMap(key, goValue)
 }
 
+// checkPair panics if key cannot be mapped by MapPair.
+func (mapper *Mapper) checkPair(key Key) {
+	if key.domain == 0 {
+		if mapper.maxHandle != 0 && key.v > mapper.maxHandle {
+			panic(fmt.Errorf("key exceeds handle limit: 0x%x", key.v))
+		}
+		if mapper.excluded[key.v] {
+			panic(fmt.Errorf("key is an excluded handle: 0x%x", key.v))
+		}
+		if key.v&mapper.reservedMask() != 0 {
+			panic(fmt.Errorf("key uses reserved bits: 0x%x", key.v))
+		}
+	}
+}
+
 // MapPtrPair is like MapPair, but maps from the given cgo pointer, and returns
 // the associated Key.  This method is a convenience wrapper around KeyFromPtr
 // and MapPair.
 func (mapper *Mapper) MapPtrPair(ptr unsafe.Pointer, goValue interface{}) Key {
-	key := KeyFromPtr(ptr)
+	key := mapper.ptrKey(ptr)
 	mapper.MapPair(key, goValue)
 	return key
 }
 
+// ptrKey is KeyFromPtr, additionally checking that ptr clears the
+// counting-pointer bit.
+func (mapper *Mapper) ptrKey(ptr unsafe.Pointer) Key {
+	if mapper.highBit {
+		key := Key{v: uintptr(ptr)}
+		if key.v&mapper.countingBit() != 0 {
+			panic(fmt.Errorf("ptr uses the counting-pointer bit: 0x%x", ptr))
+		}
+		return key
+	}
+	key := KeyFromPtr(ptr)
+	if key.v&mapper.countingBit() != 0 {
+		panic(fmt.Errorf("ptr is unaligned for reserved bits: 0x%x", ptr))
+	}
+	return key
+}
+
+// KeyFromAddr is like KeyFromPtr, but for the address of a C object that is
+// held as a uintptr, and never converted to unsafe.Pointer, such as the
+// pointer of a SWIG wrapper.  It panics if addr uses the mapper's
+// counting-pointer bit, as MapPtrPair does.
+func (mapper *Mapper) KeyFromAddr(addr uintptr) Key {
+	if mapper.highBit {
+		if addr&mapper.countingBit() != 0 {
+			panic(fmt.Errorf("ptr uses the counting-pointer bit: 0x%x", addr))
+		}
+		return Key{v: addr}
+	}
+	if addr&countingPointerBit != 0 {
+		panic(fmt.Errorf("ptr is unaligned: 0x%x", addr))
+	}
+	if addr&mapper.countingBit() != 0 {
+		panic(fmt.Errorf("ptr is unaligned for reserved bits: 0x%x", addr))
+	}
+	return Key{v: addr}
+}
+
 // MapValue maps and returns a new Key for the given Go value.
 //
 // The key here is a sizeof(pointer)/2 atomic, that is simply incremented by two
-// on each call.  On a 64-bit platform, this key-space is so large that is will
+// on each call (shifted left by the number of reserved bits; see
+// WithReservedBits).  On a 64-bit platform, this key-space is so large that is will
 // unlikely ever run out during the lifetime of a program... but if it does, we
 // panic.  To avoid running out of space on a 32-bit platform (where
 // 2,147,483,648 mappings are possible), use MapPtrPair instead.
 func (mapper *Mapper) MapValue(goValue interface{}) Key {
-	key := Key{atomic.AddUintptr(&mapper.atomicKey, 2) | countingPointerBit}
-	// Crash on wrap-around
-	if key.v == 0 {
-		panic("key space exhausted")
+	key, err := mapper.TryMapValue(goValue)
+	if err != nil {
+		panic(err)
 	}
-	mapper.doMap(key, goValue)
 	return key
 }
 
+// TryMapValue is like MapValue, but returns ErrKeySpaceExhausted instead of
+// panicking when no more keys can be allocated, or ErrRateLimited when the
+// mapping is rejected by a RateLimit.
+func (mapper *Mapper) TryMapValue(goValue interface{}) (Key, error) {
+	return mapper.mapCounting(entry{value: mapper.stored(goValue)})
+}
+
+// mapCounting maps e to a new counting-pointer key.
+func (mapper *Mapper) mapCounting(e entry) (Key, error) {
+	if err := mapper.admit(e.ns()); err != nil {
+		return Key{}, err
+	}
+	if mapper.recycle {
+		key, err := mapper.mapRecycled(e)
+		if err != nil {
+			mapper.refund(e.ns())
+		}
+		return key, err
+	}
+	var key Key
+	for {
+		n := atomic.AddUintptr(&mapper.atomicKey, 2<<mapper.reservedBits)
+		key.v = n | mapper.plainBit()
+		// Fail on wrap-around
+		if n == 0 || n > mapper.countingMax() {
+			mapper.refund(e.ns())
+			return Key{}, ErrKeySpaceExhausted
+		}
+		key.v = mapper.countingHandle(key.v)
+		if !mapper.excluded[key.v] {
+			break
+		}
+	}
+	mapper.mapEntry(key, e)
+	return key, nil
+}
+
+// mapRecycled is mapCounting for a Mapper that recycles deleted keys.
+func (mapper *Mapper) mapRecycled(e entry) (Key, error) {
+	var start time.Time
+	if mapper.latency != nil {
+		start = time.Now()
+	}
+	mapper.sized(&e)
+	mapper.mux.Lock()
+	key, err := mapper.recycledKeyLocked()
+	if err == nil {
+		// A fresh key never replaces an existing mapping.
+		mapper.mapLocked(key, e)
+	}
+	mapper.mux.Unlock()
+	if mapper.latency != nil {
+		mapper.latency.mapping.since(start)
+	}
+	mapper.checkRetained()
+	return key, err
+}
+
+// recycledKeyLocked allocates a key, reusing a deleted key if there is one.
+func (mapper *Mapper) recycledKeyLocked() (Key, error) {
+	var key Key
+	for n := len(mapper.free); n > 0; n-- {
+		key.v = mapper.nextGeneration(mapper.free[n-1])
+		mapper.free = mapper.free[:n-1]
+		if !mapper.excluded[key.v] {
+			return key, nil
+		}
+	}
+	for {
+		n := mapper.atomicKey + 2<<mapper.reservedBits
+		key.v = n | mapper.plainBit()
+		if n == 0 || n > mapper.countingMax() {
+			return Key{}, ErrKeySpaceExhausted
+		}
+		atomic.StoreUintptr(&mapper.atomicKey, n)
+		key.v = mapper.countingHandle(key.v)
+		if !mapper.excluded[key.v] {
+			return key, nil
+		}
+	}
+}
+
 // Get retrieves the Go value from the given key.
 func (mapper *Mapper) Get(key Key) (goValue interface{}) {
-	mapper.mux.RLock()
-	goValue, ok := mapper.m[key]
-	mapper.mux.RUnlock()
+	goValue, ok := mapper.Lookup(key)
 	if !ok {
-		panic(fmt.Errorf("key not mapped: 0x%x", key))
+		mapper.mux.RLock()
+		onMiss := mapper.onMiss
+		mapper.mux.RUnlock()
+		if onMiss != nil {
+			if goValue, ok = onMiss(key); ok {
+				return
+			}
+		}
+		panic(mapper.missError(key))
+	}
+	return
+}
+
+// OnMiss sets fn to be called when Get, GetPtr, or GetHandle finds no mapping
+// for a key, instead of panicking.  If fn returns true, Get returns its
+// value; otherwise Get panics as usual.  fn may map the key again, for lazy
+// re-registration, or return a placeholder: C libraries occasionally replay
+// callbacks for objects that have already been released.  fn is called
+// without any Mapper lock held; a nil fn removes the handler.  Lookup does
+// not call fn.
+func (mapper *Mapper) OnMiss(fn func(key Key) (goValue interface{}, ok bool)) {
+	mapper.mux.Lock()
+	mapper.onMiss = fn
+	mapper.mux.Unlock()
+}
+
+// Lookup is like Get, but returns false instead of panicking when the key is
+// not mapped.
+func (mapper *Mapper) Lookup(key Key) (goValue interface{}, ok bool) {
+	e, ok := mapper.lookupEntry(key)
+	if !ok {
+		return nil, false
+	}
+	return e.goValue(), true
+}
+
+// lookupEntry returns the entry mapped by key, consuming one of its uses.
+func (mapper *Mapper) lookupEntry(key Key) (e entry, ok bool) {
+	if mapper.profile != nil {
+		mapper.profile.sample()
+	}
+	var start time.Time
+	if mapper.latency != nil {
+		start = time.Now()
+	}
+	key = mapper.canonical(key)
+	e, ok = mapper.load(key)
+	if ok && e.uses != nil {
+		ok = mapper.use(key, e)
+	}
+	if mapper.latency != nil {
+		mapper.latency.get.since(start)
+	}
+	if ok && debug.has(debugStacks) {
+		e.diag().got()
 	}
 	return
 }
@@ -127,7 +593,7 @@ func (mapper *Mapper) Get(key Key) (goValue interface{}) {
 // GetPtr calls Get after first converting the given cgo pointer to a Key.
 func (mapper *Mapper) GetPtr(ptr unsafe.Pointer) (goValue interface{}) {
 	// We don't use KeyFromPtr because the ptr may be a counting-pointer type.
-	key := Key{uintptr(ptr)}
+	key := Key{v: uintptr(ptr)}
 	return mapper.Get(key)
 }
 
@@ -137,39 +603,358 @@ func (mapper *Mapper) GetHandle(handle uintptr) (goValue interface{}) {
 	return mapper.Get(key)
 }
 
-// Delete an existing mapping via the given key.
+// LookupPtr calls Lookup after first converting the given cgo pointer to a
+// Key.
+func (mapper *Mapper) LookupPtr(ptr unsafe.Pointer) (goValue interface{}, ok bool) {
+	// We don't use KeyFromPtr because the ptr may be a counting-pointer type.
+	return mapper.Lookup(Key{v: uintptr(ptr)})
+}
+
+// LookupHandle calls Lookup after first converting the given handle to a Key.
+// Unlike GetHandle, it does not panic when a C callback passes a handle that
+// is no longer mapped.
+func (mapper *Mapper) LookupHandle(handle uintptr) (goValue interface{}, ok bool) {
+	return mapper.Lookup(KeyFromHandle(handle))
+}
+
+// Has reports whether key is mapped.  Unlike Get, it does not panic when the
+// key is not mapped, nor consult the function set by OnMiss; unlike Lookup,
+// it does not consume a use of a mapping made by MapValueUses.
+func (mapper *Mapper) Has(key Key) bool {
+	_, ok := mapper.load(mapper.canonical(key))
+	return ok
+}
+
+// HasPtr calls Has after first converting the given cgo pointer to a Key.
+func (mapper *Mapper) HasPtr(ptr unsafe.Pointer) bool {
+	// We don't use KeyFromPtr because the ptr may be a counting-pointer type.
+	return mapper.Has(Key{v: uintptr(ptr)})
+}
+
+// HasHandle calls Has after first converting the given handle to a Key.
+func (mapper *Mapper) HasHandle(handle uintptr) bool {
+	return mapper.Has(KeyFromHandle(handle))
+}
+
+// Delete an existing mapping via the given key.  Use Pop to also retrieve the
+// deleted value, and learn whether the key was mapped.  In debug mode, Delete
+// panics if the key belongs to another Mapper; see WithMapperID.
 func (mapper *Mapper) Delete(key Key) {
+	if _, ok := mapper.remove(key); !ok && debug.has(debugValidate) {
+		if err := mapper.idError(key); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Pop retrieves the Go value from the given key, and deletes its mapping,
+// under a single acquisition of the lock, returning false if the key is not
+// mapped.  It is Delete for callers that clean up the deleted value, such as
+// by closing a channel or freeing C resources, without a separate Get.  It
+// suits C callbacks that fire exactly once, such as completion handlers: of
+// several concurrent Pops of a key, only one succeeds.  As for Delete, the
+// functions registered by OnDelete run before Pop returns.
+func (mapper *Mapper) Pop(key Key) (goValue interface{}, ok bool) {
+	e, ok := mapper.remove(key)
+	if !ok {
+		return nil, false
+	}
+	return e.goValue(), true
+}
+
+// remove deletes the mapping of key, returning its entry once closed.
+func (mapper *Mapper) remove(key Key) (e entry, ok bool) {
+	var start time.Time
+	if mapper.latency != nil {
+		start = time.Now()
+	}
+	key = mapper.canonical(key)
 	mapper.mux.Lock()
-	delete(mapper.m, key)
+	e, ok = mapper.deleteLocked(key)
 	mapper.mux.Unlock()
+	if mapper.latency != nil {
+		mapper.latency.del.since(start)
+	}
+	if ok {
+		mapper.checkOwner(key, e)
+		e.close()
+	}
+	return
+}
+
+// OnDelete registers fn to be called once the mapping for key is removed by
+// Delete or Clear, or replaced by a new mapping of the same key.  Functions
+// are called in the reverse order of registration, without any Mapper lock
+// held.  OnDelete returns false, without registering fn, if key is not
+// mapped.
+func (mapper *Mapper) OnDelete(key Key, fn func()) bool {
+	key = mapper.canonical(key)
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	e, ok := mapper.loadLocked(key)
+	if !ok {
+		return false
+	}
+	if prev := e.release; prev != nil {
+		e.release = func() {
+			fn()
+			prev()
+		}
+	} else {
+		e.release = fn
+	}
+	mapper.m.store(key, e)
+	return true
+}
+
+// DeleteAfter schedules the mapping for key to be deleted once the duration d
+// has elapsed, returning false if key is not mapped.  This suits C APIs that
+// document that no callbacks arrive more than some time after cancellation:
+// deleting the mapping then avoids both a premature panic in a late callback
+// and a permanent leak.
+//
+// The scheduled deletion is abandoned if the mapping is deleted, or replaced,
+// meanwhile; a new mapping of the same key is never deleted by it.
+func (mapper *Mapper) DeleteAfter(key Key, d time.Duration) bool {
+	key = mapper.canonical(key)
+	e, ok := mapper.load(key)
+	if !ok {
+		return false
+	}
+	time.AfterFunc(d, func() {
+		mapper.mux.Lock()
+		cur, ok := mapper.loadLocked(key)
+		if ok && cur.seq == e.seq && cur.created.Equal(e.created) {
+			cur, _ = mapper.deleteLocked(key)
+		} else {
+			ok = false
+		}
+		mapper.mux.Unlock()
+		if ok {
+			cur.close()
+		}
+	})
+	return true
 }
 
 // DeletePtr deletes an existing mapping from the given cgo pointer.
 func (mapper *Mapper) DeletePtr(ptr unsafe.Pointer) {
-	key := KeyFromPtr(ptr)
+	// We don't use KeyFromPtr because the ptr may be a counting-pointer type.
+	key := Key{v: uintptr(ptr)}
 	mapper.Delete(key)
 }
 
 // DeletePtr deletes an existing mapping from the given handle.
 func (mapper *Mapper) DeleteHandle(handle uintptr) {
 	// We don't use KeyFromPtr because the ptr may be a counting-pointer type.
-	key := Key{handle}
+	key := Key{v: handle}
 	mapper.Delete(key)
 }
 
-// Clear all mappings.
+// Clear all mappings.  Functions registered by OnDelete are called in
+// teardown order; see SetTeardownPriority.
+//
+// Unless the mapper was created using WithMonotonicKeys, Clear restarts the
+// allocation of keys by MapValue, so that a handle obtained before Clear
+// can alias a mapping made after it.
 func (mapper *Mapper) Clear() {
 	mapper.mux.Lock()
-	mapper.m = nil
-	mapper.atomicKey = 0
+	closing := mapper.clearLocked()
 	mapper.mux.Unlock()
+
+	for _, e := range closing {
+		e.close()
+	}
+}
+
+// clearLocked removes all mappings, returning the entries that the caller
+// must close after releasing the lock, in teardown order.
+func (mapper *Mapper) clearLocked() (closing []entry) {
+	// Keys preserved across Clear are recycled as though deleted, advancing
+	// their generations when reused.
+	recycle := mapper.monotonic && mapper.recycle
+	mapper.eachLocked(func(key Key, e entry) bool {
+		if e.release != nil {
+			closing = append(closing, e)
+		}
+		if recycle && key.domain == 0 && key.v&mapper.countingBit() != 0 {
+			mapper.free = append(mapper.free, key.v)
+		}
+		return true
+	})
+	sortTeardown(closing)
+	for _, ns := range mapper.namespaces {
+		ns.deleted += uint64(ns.live)
+		ns.live = 0
+	}
+	if mapper.partitioned {
+		mapper.clearPartitions()
+	}
+	mapper.deleted += uint64(mapper.lenLocked())
+	mapper.audit(AuditCleared, Key{}, entry{})
+	for key := range mapper.watchers {
+		mapper.notifyLocked(key, Deleted)
+	}
+	if mapper.m != nil {
+		mapper.m.clear()
+	}
+	mapper.indexes = nil
+	atomic.StoreInt64(&mapper.retained, 0)
+	atomic.StoreInt32(&mapper.overTotal, 0)
+	if !mapper.monotonic {
+		mapper.free = nil
+		mapper.atomicKey = 0
+		if mapper.generationBits != 0 {
+			atomic.AddUint32(&mapper.generation, 1)
+		}
+	}
+	return closing
+}
+
+// countingBit returns the bit that marks a counting-pointer key.
+func (mapper *Mapper) countingBit() uintptr {
+	if mapper.highBit {
+		return mapper.handleMax() &^ (mapper.handleMax() >> 1)
+	}
+	return countingPointerBit << mapper.reservedBits
+}
+
+// plainBit returns the bit that marks a plain counting-pointer handle, before
+// it is obfuscated, and its tag bits are set; see handleTag.
+func (mapper *Mapper) plainBit() uintptr {
+	if mapper.highBit {
+		return 0
+	}
+	return mapper.countingBit()
+}
+
+// reservedMask returns the handle bits reserved for use by C code.
+func (mapper *Mapper) reservedMask() uintptr {
+	return 1<<mapper.reservedBits - 1
+}
+
+// canonical returns key with any reserved bits cleared.
+func (mapper *Mapper) canonical(key Key) Key {
+	if key.domain == 0 {
+		key.v &^= mapper.reservedMask()
+	}
+	return key
 }
 
 func (mapper *Mapper) doMap(key Key, goValue interface{}) {
-	mapper.mux.Lock()
-	if mapper.m == nil {
-		mapper.m = make(map[Key]interface{})
+	mapper.mapEntry(key, entry{value: mapper.stored(goValue)})
+}
+
+// mapEntry maps key to e, returning the entry it replaces, if any, once
+// closed.
+func (mapper *Mapper) mapEntry(key Key, e entry) (old entry, replaced bool) {
+	var start time.Time
+	if mapper.latency != nil {
+		start = time.Now()
 	}
-	mapper.m[key] = goValue
+	mapper.sized(&e)
+	mapper.mux.Lock()
+	old, replaced = mapper.mapLocked(key, e)
 	mapper.mux.Unlock()
+	if mapper.latency != nil {
+		mapper.latency.mapping.since(start)
+	}
+	if replaced {
+		old.close()
+	}
+	mapper.checkRetained()
+	return
+}
+
+// mapLocked maps key to e, returning the entry it replaces, if any.  The
+// caller must close the replaced entry after releasing the lock.
+func (mapper *Mapper) mapLocked(key Key, e entry) (old entry, replaced bool) {
+	m := mapper.storageLocked()
+	old, replaced = m.load(key)
+	if replaced {
+		e.seq = old.seq
+		if p := old.priority(); p != 0 {
+			e.writableExtra().priority = p
+		}
+	} else {
+		mapper.mapped++
+		e.seq = mapper.mapped
+	}
+	if !replaced || old.ns() != e.ns() {
+		if replaced {
+			old.ns().removed()
+		}
+		e.ns().added()
+	}
+	e.created = time.Now()
+	if len(mapper.freed) != 0 {
+		mapper.unfreeLocked(key)
+	}
+	if mapper.teardown != nil && e.release == nil {
+		mapper.autoClose(key, &e)
+	}
+	if debug.has(debugStacks) {
+		e.writableExtra().diag = newDiagnostics()
+	}
+	if replaced {
+		mapper.audit(AuditReplaced, key, e)
+	} else {
+		mapper.audit(AuditMapped, key, e)
+	}
+	m.store(key, e)
+	if old.indexes != nil {
+		mapper.unindexLocked(key, *old.indexes)
+	}
+	if replaced && len(mapper.watchers) != 0 {
+		mapper.notifyLocked(key, Replaced)
+	}
+	if e.indexes != nil {
+		for _, ref := range *e.indexes {
+			mapper.indexLocked(key, ref)
+		}
+	}
+	if e.size != 0 || old.size != 0 {
+		atomic.AddInt64(&mapper.retained, e.size-old.size)
+	}
+	if mapper.partitioned {
+		if replaced && old.valueType() != e.valueType() {
+			mapper.unpartition(key, old)
+		}
+		mapper.partition(key, e)
+	}
+	return
+}
+
+// deleteLocked deletes the mapping for key, returning its entry, if any.  The
+// caller must close the entry after releasing the lock.
+func (mapper *Mapper) deleteLocked(key Key) (e entry, ok bool) {
+	e, ok = mapper.loadLocked(key)
+	if !ok {
+		return
+	}
+	mapper.m.delete(key)
+	mapper.deleted++
+	if debug.has(debugTombstones) {
+		mapper.bury(key, e)
+	}
+	mapper.audit(AuditDeleted, key, e)
+	if e.indexes != nil {
+		mapper.unindexLocked(key, *e.indexes)
+	}
+	if len(mapper.watchers) != 0 {
+		mapper.notifyLocked(key, Deleted)
+	}
+	if e.size != 0 {
+		if atomic.AddInt64(&mapper.retained, -e.size) <= mapper.sizeLimits.Total {
+			atomic.StoreInt32(&mapper.overTotal, 0)
+		}
+	}
+	e.ns().removed()
+	if mapper.partitioned {
+		mapper.unpartition(key, e)
+	}
+	if mapper.recycle && key.domain == 0 && key.v&mapper.countingBit() != 0 {
+		mapper.free = append(mapper.free, key.v)
+	}
+	return
 }
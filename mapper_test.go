@@ -5,8 +5,21 @@
 package mapper_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
+	"go.jpap.org/mapper"
 	itest "go.jpap.org/mapper/internal/testing"
 )
 
@@ -17,3 +30,2885 @@ func TestMapCgoPointer(t *testing.T) {
 func TestMapGoKey(t *testing.T) {
 	itest.RunTestMapGoKey(t)
 }
+
+func TestCAPI(t *testing.T) {
+	itest.RunTestCAPI(t)
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	var m mapper.Mapper
+	k1 := m.MapValue("one")
+	k2 := m.MapValue(2)
+
+	var buf bytes.Buffer
+	if err := m.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	s, err := mapper.ReadDump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(s.Entries))
+	}
+	want := []struct {
+		handle uintptr
+		typ    string
+	}{{k1.Handle(), "string"}, {k2.Handle(), "int"}}
+	for i, e := range s.Entries {
+		if e.Handle != want[i].handle || e.Type != want[i].typ {
+			t.Errorf("entry %d: got %#x %s, want %#x %s", i, e.Handle, e.Type, want[i].handle, want[i].typ)
+		}
+		if e.Age(s) < 0 {
+			t.Errorf("entry %d: negative age", i)
+		}
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	m := mapper.New(mapper.WithKeyRecycling())
+	kept := m.MapValue("kept")
+	removed := m.MapValue("removed")
+	replaced := m.MapValue("replaced")
+	// Tokens of different domains share a handle.
+	keptToken := mapper.KeyFromUint(7, 1)
+	removedToken := mapper.KeyFromUint(7, 2)
+	m.MapPair(keptToken, "kept token")
+	m.MapPair(removedToken, "removed token")
+	a := m.Snapshot()
+
+	m.Delete(removed)
+	added := m.MapValue("added")
+	if added != removed {
+		t.Fatalf("handle of a deleted value not reused: %#x", added.Handle())
+	}
+	time.Sleep(time.Millisecond)
+	m.MapPair(replaced, "replacement")
+	m.Delete(removedToken)
+	b := m.Snapshot()
+
+	d := mapper.Diff(a, b)
+	check := func(name string, entries []mapper.SnapshotEntry, want ...mapper.Key) {
+		if len(entries) != len(want) {
+			t.Fatalf("%s: got %+v, want %d entries", name, entries, len(want))
+		}
+		for i, e := range entries {
+			if e.Handle != want[i].Handle() {
+				t.Errorf("%s: got %+v, want handle %#x", name, e, want[i].Handle())
+			}
+		}
+	}
+	check("added", d.Added, added)
+	check("removed", d.Removed, removed, removedToken)
+	check("changed", d.Changed, replaced)
+	check("retained", d.Retained, kept, keptToken)
+	if d.Removed[1].Domain == d.Retained[1].Domain {
+		t.Errorf("tokens of different domains share domain %d", d.Removed[1].Domain)
+	}
+}
+
+func TestTruncatedHandleHint(t *testing.T) {
+	if unsafe.Sizeof(uintptr(0)) <= 4 {
+		t.Skip("handles are 32 bits")
+	}
+	defer mapper.SetDebug(true)()
+
+	m := mapper.New()
+	shift := 32
+	key := mapper.KeyFromHandle(uintptr(0xabcd)<<shift | 0x1000)
+	m.MapPair(key, "value")
+
+	defer func() {
+		err, _ := recover().(error)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("0x%x truncated to 32 bits", key.Handle())) {
+			t.Fatalf("unexpected panic: %v", err)
+		}
+	}()
+	m.GetHandle(0x1000)
+}
+
+func TestWith32BitHandles(t *testing.T) {
+	m := mapper.New(mapper.With32BitHandles())
+	if h := m.MapValue("value").Handle(); uint64(h) > 0xffffffff {
+		t.Fatalf("handle exceeds 32 bits: %#x", h)
+	}
+	if unsafe.Sizeof(uintptr(0)) <= 4 {
+		return
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("mapping a 64-bit key did not panic")
+		}
+	}()
+	shift := 40
+	m.MapPair(mapper.KeyFromHandle(uintptr(1)<<shift), "value")
+}
+
+func TestWithReservedBits(t *testing.T) {
+	m := mapper.New(mapper.WithReservedBits(2))
+
+	key := m.MapValue("value")
+	if h := key.Handle(); h&0x7 != 0x4 {
+		t.Fatalf("handle %#x does not have the counting bit above two reserved bits", h)
+	}
+	// C code sets its own flags in the reserved bits.
+	if v := m.GetHandle(key.Handle() | 0x3); v != "value" {
+		t.Fatalf("got %v", v)
+	}
+	m.DeleteHandle(key.Handle() | 0x1)
+	if _, ok := m.Lookup(key); ok {
+		t.Fatal("mapping not deleted")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("mapping an unaligned pointer did not panic")
+		}
+	}()
+	// Find a pointer that is 4-byte, but not 8-byte aligned.
+	var buf [16]byte
+	i := 0
+	for uintptr(unsafe.Pointer(&buf[i]))&0x7 != 0x4 {
+		i++
+	}
+	m.MapPtrPair(unsafe.Pointer(&buf[i]), "value")
+}
+
+func TestWithCompactHandles(t *testing.T) {
+	m := mapper.New(mapper.WithCompactHandles())
+
+	var last mapper.Key
+	for i := 0; i < 1<<15-1; i++ {
+		key, err := m.TryMapValue(i)
+		if err != nil {
+			t.Fatalf("mapping %d: %v", i, err)
+		}
+		if key.Handle() > 0xffff {
+			t.Fatalf("handle exceeds 16 bits: %#x", key.Handle())
+		}
+		last = key
+	}
+	if _, err := m.TryMapValue("one too many"); err != mapper.ErrKeySpaceExhausted {
+		t.Fatalf("got %v, want ErrKeySpaceExhausted", err)
+	}
+
+	m.Delete(last)
+	key, err := m.TryMapValue("recycled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != last {
+		t.Fatalf("got key %#x, want recycled key %#x", key.Handle(), last.Handle())
+	}
+}
+
+func TestWithKeyRecycling(t *testing.T) {
+	m := mapper.New(mapper.WithKeyRecycling(), mapper.With32BitHandles())
+	first := m.MapValue("first")
+	m.Delete(first)
+	if key := m.MapValue("second"); key != first {
+		t.Fatalf("got key %#x, want recycled key %#x", key.Handle(), first.Handle())
+	}
+
+	// Exhaust the 32-bit key space.
+	m.SkipKeys(1<<31 - 10)
+	var last mapper.Key
+	for i := 0; ; i++ {
+		key, err := m.TryMapValue(i)
+		if err == mapper.ErrKeySpaceExhausted {
+			break
+		} else if err != nil || i > 10 {
+			t.Fatalf("mapping %d: %v", i, err)
+		}
+		last = key
+	}
+	m.Delete(last)
+	if key, err := m.TryMapValue("recycled"); err != nil || key != last {
+		t.Fatalf("got key %#x, %v, want recycled key %#x", key.Handle(), err, last.Handle())
+	}
+}
+
+func TestKeyFromUint(t *testing.T) {
+	const timers, sessions mapper.Domain = 1, 2
+	m := mapper.New()
+
+	counting := m.MapValue("counting")
+	m.MapPair(mapper.KeyFromUint(uint64(counting.Handle()), timers), "timer")
+	m.MapPair(mapper.KeyFromUint(uint64(counting.Handle()), sessions), "session")
+	m.MapPair(mapper.KeyFromUint(1<<40, sessions), "big session")
+
+	for key, want := range map[mapper.Key]string{
+		counting: "counting",
+		mapper.KeyFromUint(uint64(counting.Handle()), timers):   "timer",
+		mapper.KeyFromUint(uint64(counting.Handle()), sessions): "session",
+		mapper.KeyFromUint(1<<40, sessions):                     "big session",
+	} {
+		if v := m.Get(key); v != want {
+			t.Errorf("got %v, want %v", v, want)
+		}
+	}
+	if _, ok := m.Lookup(mapper.KeyFromUint(1<<40, timers)); ok {
+		t.Error("token mapped in the wrong domain")
+	}
+
+	token, domain, ok := mapper.KeyFromUint(1<<40|7, sessions).Token()
+	if !ok || token != 1<<40|7 || domain != sessions {
+		t.Errorf("got token %#x, domain %d, ok %v", token, domain, ok)
+	}
+	if _, _, ok := counting.Token(); ok {
+		t.Error("counting key reported as a token")
+	}
+}
+
+func TestMapFD(t *testing.T) {
+	m := mapper.New()
+	m.MapFD(3, "fd")
+	m.MapPair(mapper.KeyFromUint(3, 0), "token")
+	m.MapPair(mapper.KeyFromHandle(3), "handle")
+
+	if v := m.GetFD(3); v != "fd" {
+		t.Fatalf("got %v", v)
+	}
+	if _, _, ok := mapper.KeyFromFD(3).Token(); ok {
+		t.Error("fd key reported as a token")
+	}
+	m.DeleteFD(3)
+	if _, ok := m.Lookup(mapper.KeyFromFD(3)); ok {
+		t.Fatal("fd mapping not deleted")
+	}
+	if m.Stats().Live != 2 {
+		t.Fatal("fd deletion removed other mappings")
+	}
+}
+
+func TestStoreLoadHandle(t *testing.T) {
+	type object struct {
+		flags    int32
+		userData uintptr
+	}
+	var obj object
+	base, offset := unsafe.Pointer(&obj), unsafe.Offsetof(obj.userData)
+
+	m := mapper.New()
+	key := m.MapValue("value")
+	mapper.StoreHandle(base, offset, key)
+	if obj.userData != key.Handle() {
+		t.Fatalf("stored %#x, want %#x", obj.userData, key.Handle())
+	}
+	if got := mapper.LoadHandle(base, offset); got != key {
+		t.Fatalf("loaded %#x, want %#x", got.Handle(), key.Handle())
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("overflowing field address did not panic")
+			}
+		}()
+		mapper.LoadHandle(base, -uintptr(base))
+	}()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("misaligned field did not panic")
+		}
+	}()
+	mapper.StoreHandle(base, offset+1, key)
+}
+
+func TestCOwned(t *testing.T) {
+	m := mapper.New()
+	obj := new(uint64) // stands in for C memory
+	destroyed := 0
+	o := mapper.NewCOwned(m, unsafe.Pointer(obj), "state", func(ptr unsafe.Pointer) {
+		// Callbacks during destruction still resolve.
+		if v := m.GetPtr(ptr); v != "state" {
+			t.Errorf("got %v during destroy", v)
+		}
+		destroyed++
+	})
+	if v := m.Get(o.Key()); v != "state" {
+		t.Fatalf("got %v", v)
+	}
+
+	o.Close()
+	o.Close()
+	if destroyed != 1 {
+		t.Fatalf("destroyed %d times", destroyed)
+	}
+	if _, ok := m.Lookup(o.Key()); ok {
+		t.Fatal("mapping not deleted")
+	}
+}
+
+func TestIOBridge(t *testing.T) {
+	itest.RunTestIOBridge(t)
+}
+
+func TestMapBytes(t *testing.T) {
+	m := mapper.New()
+	b := []byte("payload")
+	ptr, key := m.MapBytes(b)
+	if ptr == nil {
+		t.Fatal("nil pointer")
+	}
+	if got := *(*byte)(ptr); got != 'p' {
+		t.Fatalf("pointer refers to %q", got)
+	}
+	if mapper.BytesPinned && ptr != unsafe.Pointer(&b[0]) {
+		t.Fatal("pinned pointer does not refer to the slice")
+	}
+	if v := m.Get(key).([]byte); &v[0] != &b[0] {
+		t.Fatal("Get did not return the mapped slice")
+	}
+	m.Delete(key)
+
+	if ptr, _ := m.MapBytes(nil); ptr != nil {
+		t.Fatal("non-nil pointer for empty slice")
+	}
+	m.Clear()
+}
+
+func TestOnDelete(t *testing.T) {
+	m := mapper.New()
+	var calls []string
+	key := m.MapValue("value")
+	m.OnDelete(key, func() { calls = append(calls, "first") })
+	m.OnDelete(key, func() { calls = append(calls, "second") })
+
+	m.Delete(key)
+	if len(calls) != 2 || calls[0] != "second" || calls[1] != "first" {
+		t.Fatalf("got calls %v", calls)
+	}
+	if m.OnDelete(key, func() {}) {
+		t.Fatal("registered on an unmapped key")
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	itest.RunTestCompletion(t)
+}
+
+func TestChanBridge(t *testing.T) {
+	itest.RunTestChanBridge(t)
+}
+
+func TestProgress(t *testing.T) {
+	itest.RunTestProgress(t)
+}
+
+func TestCancelToken(t *testing.T) {
+	itest.RunTestCancelToken(t)
+}
+
+func TestProxy(t *testing.T) {
+	itest.RunTestProxy(t)
+}
+
+func TestCHandle(t *testing.T) {
+	itest.RunTestCHandle(t)
+}
+
+func TestDestructor(t *testing.T) {
+	itest.RunTestDestructor(t)
+}
+
+func TestCallers(t *testing.T) {
+	defer mapper.SetDebug(true)()
+	itest.RunTestCallers(t)
+}
+
+func TestNamespace(t *testing.T) {
+	var m mapper.Mapper
+	dec := m.Namespace("decoders")
+	if m.Namespace("decoders") != dec {
+		t.Fatal("Namespace returned a new namespace for the same name")
+	}
+	enc := m.Namespace("encoders")
+	if ns, ok := m.LookupNamespace("encoders"); !ok || ns != enc {
+		t.Fatal("LookupNamespace did not return the namespace")
+	}
+	if _, ok := m.LookupNamespace("parsers"); ok {
+		t.Fatal("LookupNamespace found a namespace never created")
+	}
+
+	k1 := dec.MapValue("d1")
+	k2 := dec.MapValue("d2")
+	k3 := enc.MapValue("e1")
+	k4 := m.MapValue("plain")
+
+	if got := m.Get(k1); got != "d1" {
+		t.Fatalf("Get = %v, want d1", got)
+	}
+	if s := dec.Stats(); s.Live != 2 || s.Mapped != 2 {
+		t.Fatalf("decoders stats = %+v", s)
+	}
+	if s := m.Stats(); s.Live != 4 {
+		t.Fatalf("mapper stats = %+v", s)
+	}
+	snap := enc.Snapshot()
+	if len(snap.Entries) != 1 || snap.Entries[0].Handle != k3.Handle() || snap.Entries[0].Namespace != "encoders" {
+		t.Fatalf("encoders snapshot = %+v", snap.Entries)
+	}
+
+	m.Delete(k1)
+	dec.Clear()
+	if s := dec.Stats(); s.Live != 0 || s.Deleted != 2 {
+		t.Fatalf("decoders stats after clear = %+v", s)
+	}
+	if _, ok := m.Lookup(k2); ok {
+		t.Fatal("namespace mapping survived Clear")
+	}
+	if _, ok := m.Lookup(k3); !ok {
+		t.Fatal("Clear removed a mapping of another namespace")
+	}
+	if _, ok := m.Lookup(k4); !ok {
+		t.Fatal("Clear removed a mapping outside any namespace")
+	}
+
+	m.Clear()
+	if s := enc.Stats(); s.Live != 0 || s.Deleted != 1 {
+		t.Fatalf("encoders stats after mapper clear = %+v", s)
+	}
+}
+
+func TestTypePartitions(t *testing.T) {
+	type decoder struct{ id int }
+	for _, partitioned := range []bool{false, true} {
+		var opts []mapper.Option
+		if partitioned {
+			opts = append(opts, mapper.WithTypePartitions())
+		}
+		m := mapper.New(opts...)
+		k1 := m.MapValue(&decoder{1})
+		k2 := m.MapValue("two")
+		m.MapValue(&decoder{3})
+
+		if d, ok := mapper.LookupAs[*decoder](m, k1); !ok || d.id != 1 {
+			t.Fatalf("LookupAs[*decoder](k1) = %v, %v", d, ok)
+		}
+		if _, ok := mapper.LookupAs[*decoder](m, k2); ok {
+			t.Fatal("LookupAs[*decoder] succeeded for a string")
+		}
+		if s, ok := mapper.LookupAs[fmt.Stringer](m, k2); ok {
+			t.Fatalf("LookupAs[fmt.Stringer] = %v for a string", s)
+		}
+		if s := m.SnapshotType(reflect.TypeOf(&decoder{})); len(s.Entries) != 2 {
+			t.Fatalf("SnapshotType = %+v, want 2 entries", s.Entries)
+		}
+
+		m.MapPair(k1, &decoder{1})
+		m.MapPair(k1, "one")
+		if _, ok := mapper.LookupAs[*decoder](m, k1); ok {
+			t.Fatal("LookupAs found a replaced mapping")
+		}
+		if s, ok := mapper.LookupAs[string](m, k1); !ok || s != "one" {
+			t.Fatalf("LookupAs[string](k1) = %q, %v", s, ok)
+		}
+
+		if !partitioned {
+			if m.TypeStats() != nil {
+				t.Fatal("TypeStats non-nil without partitions")
+			}
+			continue
+		}
+		m.Delete(k2)
+		stats := m.TypeStats()
+		if s := stats["string"]; s.Live != 1 || s.Mapped != 2 || s.Deleted != 1 {
+			t.Fatalf("string stats = %+v", s)
+		}
+		if s := stats["*mapper_test.decoder"]; s.Live != 1 || s.Mapped != 2 || s.Deleted != 1 {
+			t.Fatalf("decoder stats = %+v", s)
+		}
+		m.Clear()
+		if s := m.TypeStats()["string"]; s.Live != 0 || s.Deleted != 2 {
+			t.Fatalf("string stats after Clear = %+v", s)
+		}
+	}
+}
+
+func TestWithMonotonicKeys(t *testing.T) {
+	m := mapper.New(mapper.WithMonotonicKeys())
+	k1 := m.MapValue(1)
+	m.Clear()
+	k2 := m.MapValue(2)
+	if k2 == k1 {
+		t.Fatalf("key 0x%x reused after Clear", k1.Handle())
+	}
+	if _, ok := m.Lookup(k1); ok {
+		t.Fatal("handle from before Clear resolves")
+	}
+
+	// A recycling mapper reuses the keys preserved across Clear.
+	for _, opts := range [][]mapper.Option{
+		{mapper.WithCompactHandles(), mapper.WithMonotonicKeys()},
+		{mapper.WithCompactHandles(), mapper.WithMonotonicKeys(), mapper.WithGenerationBits(2)},
+		{mapper.WithSlotTable(), mapper.WithCompactHandles(), mapper.WithMonotonicKeys()},
+	} {
+		m := mapper.New(opts...)
+		var n int
+		for ; ; n++ {
+			if _, err := m.TryMapValue(n); err != nil {
+				break
+			}
+		}
+		m.Clear()
+		for i := 0; i < n; i++ {
+			key, err := m.TryMapValue(i)
+			if err != nil {
+				t.Fatalf("TryMapValue #%d of %d after Clear returned %v", i, n, err)
+			}
+			if got := m.Get(key); got != i {
+				t.Fatalf("Get after Clear = %v, want %d", got, i)
+			}
+		}
+	}
+
+	var plain mapper.Mapper
+	k1 = plain.MapValue(1)
+	plain.Clear()
+	if k2 := plain.MapValue(2); k2 != k1 {
+		t.Fatalf("Clear did not restart keys: 0x%x, want 0x%x", k2.Handle(), k1.Handle())
+	}
+}
+
+func TestMapValueUses(t *testing.T) {
+	var m mapper.Mapper
+	released := false
+	key := m.MapValueUses("frame", 3)
+	m.OnDelete(key, func() { released = true })
+	for i := 0; i < 3; i++ {
+		if got := m.Get(key); got != "frame" {
+			t.Fatalf("Get #%d = %v", i+1, got)
+		}
+	}
+	if !released {
+		t.Fatal("mapping not deleted by its last use")
+	}
+	if _, ok := m.Lookup(key); ok {
+		t.Fatal("Lookup succeeded after the last use")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Get did not panic after the last use")
+			}
+		}()
+		m.Get(key)
+	}()
+	if s := m.Stats(); s.Live != 0 || s.Deleted != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestReserveKeys(t *testing.T) {
+	m := mapper.New(mapper.WithReservedBits(2))
+	before := m.MapValue("before")
+	r := m.ReserveKeys(4)
+	after := m.MapValue("after")
+
+	if r.Len() != 4 || r.Stride() != 8 {
+		t.Fatalf("Len, Stride = %d, %d", r.Len(), r.Stride())
+	}
+	seen := map[mapper.Key]bool{before: true, after: true}
+	for i := 0; i < r.Len(); i++ {
+		key := r.Key(i)
+		if seen[key] {
+			t.Fatalf("reserved key 0x%x aliases another key", key.Handle())
+		}
+		seen[key] = true
+		if key.Handle() != r.Base()+uintptr(i)*r.Stride() {
+			t.Fatalf("Key(%d) = 0x%x", i, key.Handle())
+		}
+		if j, ok := r.Index(key); !ok || j != i {
+			t.Fatalf("Index(Key(%d)) = %d, %v", i, j, ok)
+		}
+		if _, ok := m.Lookup(key); ok {
+			t.Fatalf("reserved key %d is mapped", i)
+		}
+	}
+	if _, ok := r.Index(after); ok {
+		t.Fatal("Index found a key outside the range")
+	}
+
+	m.MapPair(r.Key(2), "channel 2")
+	if got := m.GetHandle(r.Base() + 2*r.Stride()); got != "channel 2" {
+		t.Fatalf("GetHandle = %v", got)
+	}
+
+	c := mapper.New(mapper.WithCompactHandles())
+	c.ReserveKeys(32767)
+	if _, err := c.TryMapValue(1); err != mapper.ErrKeySpaceExhausted {
+		t.Fatalf("TryMapValue after reserving all keys = %v", err)
+	}
+}
+
+func TestMapSlice(t *testing.T) {
+	var m mapper.Mapper
+	channels := []string{"left", "right", "center"}
+	r := mapper.MapSlice(&m, channels)
+	for i, want := range channels {
+		if got := m.GetHandle(r.Base() + 2*uintptr(i)); got != want {
+			t.Fatalf("channel %d = %v, want %v", i, got, want)
+		}
+		if got := m.GetIndex(r, i); got != want {
+			t.Fatalf("GetIndex(%d) = %v, want %v", i, got, want)
+		}
+	}
+	other := m.MapValue("other")
+	m.Delete(r.Key(1))
+	m.DeleteRange(r)
+	if s := m.Stats(); s.Live != 1 || s.Deleted != 3 {
+		t.Fatalf("stats after DeleteRange = %+v", s)
+	}
+	if _, ok := m.Lookup(other); !ok {
+		t.Fatal("DeleteRange deleted a key outside the range")
+	}
+}
+
+func TestHandlePatternsCgoChecked(t *testing.T) {
+	itest.RunCgoChecked(t, itest.RunHandlePatterns)
+}
+
+func TestOwnershipWarnings(t *testing.T) {
+	defer mapper.SetDebug(true)()
+	var warnings []string
+	m := mapper.New(mapper.WithOwnershipWarnings(func(msg string) {
+		warnings = append(warnings, msg)
+	}))
+
+	own := m.MapValue("own")
+	m.Delete(own)
+	if len(warnings) != 0 {
+		t.Fatalf("warned on delete by the creating goroutine: %q", warnings)
+	}
+
+	keys := make(chan mapper.Key)
+	go func() { keys <- m.MapValue("other") }()
+	key := <-keys
+	// The goroutine may not have exited yet; wait for it.
+	orphans := m.Orphans()
+	for i := 0; i < 100 && len(orphans.Entries) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		orphans = m.Orphans()
+	}
+	if len(orphans.Entries) != 1 || orphans.Entries[0].Handle != key.Handle() || orphans.Entries[0].Goroutine == 0 {
+		t.Fatalf("orphans = %+v", orphans.Entries)
+	}
+
+	m.Delete(key)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], fmt.Sprintf("0x%x", key.Handle())) {
+		t.Fatalf("warnings = %q", warnings)
+	}
+}
+
+func TestFreedHandle(t *testing.T) {
+	defer mapper.SetDebug(true)()
+	var warnings []string
+	m := mapper.New(mapper.WithOwnershipWarnings(func(msg string) {
+		warnings = append(warnings, msg)
+	}))
+	isFreed := func(key mapper.Key) (freed bool) {
+		defer func() {
+			freed = strings.Contains(fmt.Sprint(recover()), "use after free")
+		}()
+		m.Get(key)
+		return false
+	}
+
+	// Freeing, mapping, and freeing a pointer again remembers it once, so
+	// that it is remembered until maxFreed other pointers are freed.
+	key := mapper.KeyFromHandle(0x1000)
+	for i := 0; i < 3; i++ {
+		m.MapPair(key, i)
+		if isFreed(key) {
+			t.Fatal("mapped pointer reported freed")
+		}
+		if !m.FreedHandle(key.Handle()) || !isFreed(key) {
+			t.Fatal("freed pointer not reported freed")
+		}
+	}
+	for i := 1; i < mapper.MaxFreed; i++ {
+		m.FreedHandle(uintptr(0x1000 + i*16))
+	}
+	if !isFreed(key) {
+		t.Fatal("pointer forgotten before others were freed")
+	}
+	m.FreedHandle(0x100000)
+	if isFreed(key) {
+		t.Fatal("oldest freed pointer remembered beyond the limit")
+	}
+
+	// Freeing a mapping made by another goroutine warns, as Delete does.
+	done := make(chan bool)
+	go func() {
+		m.MapPair(key, "other")
+		done <- true
+	}()
+	<-done
+	if !m.FreedHandle(key.Handle()) || len(warnings) != 1 {
+		t.Fatalf("warnings = %q", warnings)
+	}
+}
+
+func TestShared(t *testing.T) {
+	s := mapper.Shared()
+	if mapper.Shared() != s {
+		t.Fatal("Shared returned another mapper")
+	}
+	h := s.MapValue("shared")
+	defer s.DeleteHandle(h)
+	if got := mapper.G.GetHandle(h); got != "shared" {
+		t.Fatalf("G.GetHandle = %v; the shared mapper is not G", got)
+	}
+
+	// Another copy of the package finds the registered mapper, unless the
+	// registration is from another process.
+	old := os.Getenv(mapper.SharedEnv)
+	defer os.Setenv(mapper.SharedEnv, old)
+	env, lookup := mapper.RegisterShared(s)
+	os.Setenv(mapper.SharedEnv, env)
+	if lookup() != s {
+		t.Fatal("registered shared mapper not found")
+	}
+	os.Setenv(mapper.SharedEnv, "1:"+env[strings.IndexByte(env, ':')+1:])
+	if lookup() != nil {
+		t.Fatal("shared mapper of another process found")
+	}
+}
+
+func TestForkHooks(t *testing.T) {
+	for _, retain := range []bool{false, true} {
+		m := mapper.New(mapper.WithTypePartitions(), mapper.WithShards(4))
+		released := false
+		key := m.MapValue("inherited")
+		m.OnDelete(key, func() { released = true })
+
+		m.BeforeFork()
+		// The child inherits the mapper locked.
+		m.AfterForkChild(retain)
+		if _, ok := m.Lookup(key); ok != retain {
+			t.Fatalf("retain %v: inherited mapping present = %v", retain, ok)
+		}
+		if released {
+			t.Fatalf("retain %v: OnDelete function called in the child", retain)
+		}
+		if v, ok := mapper.LookupAs[string](m, key); ok != retain || retain && v != "inherited" {
+			t.Fatalf("retain %v: LookupAs = %q, %v", retain, v, ok)
+		}
+		m.Delete(m.MapValue("child"))
+	}
+
+	// The child reinitializes shard locks held by threads of the parent.
+	m := mapper.New(mapper.WithShards(4))
+	m.MapValue("inherited")
+	m.LockStorage()
+	m.AfterForkChild(false)
+	if n := m.Len(); n != 0 {
+		t.Fatalf("%d inherited mappings in the child", n)
+	}
+
+	// Lookups, which lock only a shard, wait while the parent forks.
+	key := m.MapValue("parent")
+	m.BeforeFork()
+	got := make(chan interface{})
+	go func() { got <- m.Get(key) }()
+	select {
+	case v := <-got:
+		t.Fatalf("Get during fork = %v", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+	m.AfterForkParent()
+	if v := <-got; v != "parent" {
+		t.Fatalf("Get after fork in parent = %v", v)
+	}
+}
+
+func TestOnMiss(t *testing.T) {
+	var m mapper.Mapper
+	key := m.MapValue("released")
+	m.Delete(key)
+
+	var missed []mapper.Key
+	m.OnMiss(func(k mapper.Key) (interface{}, bool) {
+		missed = append(missed, k)
+		if k != key {
+			return nil, false
+		}
+		return "placeholder", true
+	})
+	if got := m.GetHandle(key.Handle()); got != "placeholder" {
+		t.Fatalf("Get = %v, want placeholder", got)
+	}
+	if _, ok := m.Lookup(key); ok || len(missed) != 1 {
+		t.Fatalf("Lookup called OnMiss, or mapped the key: missed %d", len(missed))
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Get did not panic when OnMiss declined")
+			}
+		}()
+		m.GetHandle(key.Handle() + 2)
+	}()
+
+	m.OnMiss(nil)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Get did not panic after removing OnMiss")
+			}
+		}()
+		m.Get(key)
+	}()
+}
+
+func TestWithCopyOnMap(t *testing.T) {
+	type node struct {
+		Name  string
+		tags  []string
+		next  *node
+		attrs map[string]interface{}
+	}
+	newConfig := func() *node {
+		n := &node{Name: "a", tags: []string{"x"}, attrs: map[string]interface{}{"k": []int{1}}}
+		n.next = n // A cycle.
+		return n
+	}
+
+	shallow := mapper.New(mapper.WithCopyOnMap(false))
+	cfg := newConfig()
+	key := shallow.MapValue(cfg)
+	cfg.Name = "changed"
+	cfg.tags[0] = "shared"
+	got := shallow.Get(key).(*node)
+	if got == cfg || got.Name != "a" {
+		t.Fatalf("shallow copy shares the struct: %+v", got)
+	}
+	if got.tags[0] != "shared" {
+		t.Fatal("shallow copy copied a nested slice")
+	}
+
+	deep := mapper.New(mapper.WithCopyOnMap(true))
+	cfg = newConfig()
+	key = deep.MapValue(cfg)
+	cfg.Name = "changed"
+	cfg.tags[0] = "changed"
+	cfg.attrs["k"].([]int)[0] = 2
+	got = deep.Get(key).(*node)
+	if got.Name != "a" || got.tags[0] != "x" || got.attrs["k"].([]int)[0] != 1 {
+		t.Fatalf("deep copy shares state: %+v", got)
+	}
+	if got.next != got {
+		t.Fatal("deep copy did not preserve the cycle")
+	}
+
+	s := []int{1, 2}
+	deep.MapPair(key, s)
+	s[0] = 3
+	if got := deep.Get(key).([]int); got[0] != 1 {
+		t.Fatalf("MapPair did not copy: %v", got)
+	}
+	ptr, bkey := deep.MapBytes([]byte{1})
+	if b := deep.Get(bkey).([]byte); unsafe.Pointer(&b[0]) != ptr && mapper.BytesPinned {
+		t.Fatal("MapBytes copied the bytes")
+	}
+	deep.Delete(bkey)
+}
+
+func TestWithSizeAccounting(t *testing.T) {
+	if n := mapper.ReflectSizer(make([]byte, 10, 100)); n < 100 {
+		t.Fatalf("ReflectSizer(slice of cap 100) = %d", n)
+	}
+	type frame struct {
+		planes [][]byte
+		name   string
+	}
+	f := &frame{planes: [][]byte{make([]byte, 1000), make([]byte, 500)}, name: "f"}
+	if n := mapper.ReflectSizer(f); n < 1500 {
+		t.Fatalf("ReflectSizer(frame) = %d", n)
+	}
+
+	var warnings []string
+	m := mapper.New(mapper.WithSizeAccounting(mapper.ReflectSizer, mapper.SizeLimits{
+		PerMapping: 1 << 10,
+		Total:      4 << 10,
+		Warn:       func(msg string) { warnings = append(warnings, msg) },
+	}))
+	small := m.MapValue(make([]byte, 100))
+	if len(warnings) != 0 {
+		t.Fatalf("warned for a small value: %q", warnings)
+	}
+	big := m.MapValue(make([]byte, 2<<10))
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "[]uint8") {
+		t.Fatalf("warnings = %q", warnings)
+	}
+	ks := []mapper.Key{m.MapValue(make([]byte, 1000)), m.MapValue(make([]byte, 1000))}
+	if len(warnings) != 2 || !strings.Contains(warnings[1], "live mappings") {
+		t.Fatalf("no warning for the total: %q", warnings)
+	}
+	m.MapValue(make([]byte, 10))
+	if len(warnings) != 2 {
+		t.Fatalf("warned again while above the total: %q", warnings)
+	}
+
+	before := m.Stats().Retained
+	m.Delete(big)
+	if after := m.Stats().Retained; before-after < 2<<10 {
+		t.Fatalf("Retained went from %d to %d after deleting 2KiB", before, after)
+	}
+	snap := m.Snapshot()
+	for _, e := range snap.Entries {
+		if e.Handle == small.Handle() && e.Size < 100 {
+			t.Fatalf("snapshot size of small = %d", e.Size)
+		}
+	}
+	m.Delete(ks[0])
+	m.Delete(ks[1])
+	m.MapValue(make([]byte, 4<<10))
+	if len(warnings) != 4 {
+		t.Fatalf("no new warnings after rising above the total again: %q", warnings)
+	}
+	m.Clear()
+	if r := m.Stats().Retained; r != 0 {
+		t.Fatalf("Retained after Clear = %d", r)
+	}
+}
+
+func TestMapFunc(t *testing.T) {
+	var m mapper.Mapper
+	var got []string
+	key := m.MapFunc(func(prefix string, n int, rest ...interface{}) (int, error) {
+		got = append(got, fmt.Sprint(prefix, n, rest))
+		return len(got), nil
+	})
+	res, err := m.InvokeHandle(key.Handle(), "a", int32(1), "x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0] != 1 || res[1] != nil || got[0] != "a1 [x <nil>]" {
+		t.Fatalf("got results %v, calls %q", res, got)
+	}
+	if _, err := m.InvokeHandle(key.Handle(), "a", 2); err != nil || len(got) != 2 {
+		t.Fatalf("variadic with no extra arguments: %v", err)
+	}
+
+	for _, args := range [][]interface{}{{"a"}, {1, 2}, {nil, 1}} {
+		if _, err := m.InvokeHandle(key.Handle(), args...); err == nil {
+			t.Fatalf("invoked with %v", args)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("function called with bad arguments: %q", got)
+	}
+	if _, err := m.InvokeHandle(m.MapValue(1).Handle()); err == nil {
+		t.Fatal("invoked a non-function")
+	}
+	m.Delete(key)
+	if _, err := m.InvokeHandle(key.Handle(), "a", 1); err == nil {
+		t.Fatal("invoked an unmapped handle")
+	}
+
+	fn, ok := mapper.LookupAs[func()](&m, m.MapFunc(func() { got = nil }))
+	if !ok {
+		t.Fatal("typed lookup failed")
+	}
+	fn()
+	if got != nil {
+		t.Fatal("typed call failed")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MapFunc of a non-function did not panic")
+		}
+	}()
+	m.MapFunc(42)
+}
+
+func TestWithObfuscatedHandles(t *testing.T) {
+	m := mapper.New(mapper.WithObfuscatedHandles())
+	keys := make([]mapper.Key, 100)
+	seen := make(map[uintptr]bool)
+	consecutive := 0
+	for i := range keys {
+		keys[i] = m.MapValue(i)
+		h := keys[i].Handle()
+		if h&1 == 0 || seen[h] {
+			t.Fatalf("bad handle 0x%x", h)
+		}
+		seen[h] = true
+		if i > 0 && h-keys[i-1].Handle() == 2 {
+			consecutive++
+		}
+	}
+	if consecutive > 5 {
+		t.Fatalf("%d of %d handles follow their predecessor", consecutive, len(keys))
+	}
+	for i, key := range keys {
+		if got := m.GetHandle(key.Handle()); got != i {
+			t.Fatalf("GetHandle(0x%x) = %v, want %d", key.Handle(), got, i)
+		}
+	}
+
+	m = mapper.New(mapper.WithObfuscatedHandles(), mapper.WithCompactHandles(), mapper.WithReservedBits(2))
+	for i := 0; i < 1000; i++ {
+		key := m.MapValue(i)
+		if h := key.Handle(); h > 0xffff || h&7 != 4 {
+			t.Fatalf("bad compact handle 0x%x", h)
+		}
+		if got := m.GetHandle(key.Handle() | 3); got != i {
+			t.Fatalf("GetHandle(0x%x) = %v, want %d", key.Handle()|3, got, i)
+		}
+		m.Delete(key)
+	}
+
+	r := mapper.MapSlice(m, []string{"a", "b", "c"})
+	if r.Base() != r.Key(0).Handle() {
+		t.Fatalf("Base() = 0x%x, want 0x%x", r.Base(), r.Key(0).Handle())
+	}
+	for i := 0; i < r.Len(); i++ {
+		if j, ok := r.Index(r.Key(i)); !ok || j != i {
+			t.Fatalf("Index(Key(%d)) = %d, %v", i, j, ok)
+		}
+		if got := m.GetIndex(r, i); got != string(rune('a'+i)) {
+			t.Fatalf("GetIndex(%d) = %v", i, got)
+		}
+	}
+	if _, ok := r.Index(m.MapValue(0)); ok {
+		t.Fatal("key outside the range has an index")
+	}
+}
+
+func TestMapPtrPairs(t *testing.T) {
+	var m mapper.Mapper
+	buf := make([]uint64, 3)
+	ptrs := []unsafe.Pointer{unsafe.Pointer(&buf[0]), unsafe.Pointer(&buf[1]), unsafe.Pointer(&buf[2])}
+	keys := m.MapPtrPairs(ptrs, []interface{}{"a", "b", "c"})
+	for i, key := range keys {
+		if key != mapper.KeyFromPtr(ptrs[i]) {
+			t.Fatalf("key %d = %v, want %v", i, key, mapper.KeyFromPtr(ptrs[i]))
+		}
+		if got := m.GetPtr(ptrs[i]); got != string(rune('a'+i)) {
+			t.Fatalf("GetPtr(ptrs[%d]) = %v", i, got)
+		}
+	}
+
+	// Nothing is mapped if any pointer is rejected: one of two adjacent
+	// uint64s is not 16-byte aligned.
+	m2 := mapper.New(mapper.WithReservedBits(3))
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("MapPtrPairs of an unaligned pointer did not panic")
+			}
+		}()
+		m2.MapPtrPairs(ptrs[:2], []interface{}{1, 2})
+	}()
+	if n := m2.Stats().Live; n != 0 {
+		t.Fatalf("%d mappings after a rejected batch", n)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MapPtrPairs of mismatched slices did not panic")
+		}
+	}()
+	m.MapPtrPairs(ptrs, []interface{}{1})
+}
+
+func TestBatch(t *testing.T) {
+	var m mapper.Mapper
+	buf := make([]uint64, 3)
+	keys := []mapper.Key{mapper.KeyFromPtr(unsafe.Pointer(&buf[0])), mapper.KeyFromPtr(unsafe.Pointer(&buf[1]))}
+	m.MapAll(keys, []interface{}{"a", "b"})
+	keys = append(keys, m.MapValue("c"))
+	if got := m.GetAll(keys); !reflect.DeepEqual(got, []interface{}{"a", "b", "c"}) {
+		t.Fatalf("GetAll = %v", got)
+	}
+
+	var deleted []string
+	for i, key := range keys {
+		name := string(rune('a' + i))
+		m.OnDelete(key, func() { deleted = append(deleted, name) })
+	}
+	m.DeleteAll([]mapper.Key{keys[2], keys[0], keys[2]})
+	if !reflect.DeepEqual(deleted, []string{"c", "a"}) {
+		t.Fatalf("DeleteAll deleted %v", deleted)
+	}
+	if n := m.Len(); n != 1 {
+		t.Fatalf("%d mappings after DeleteAll, want 1", n)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("GetAll of a deleted key did not panic")
+			}
+		}()
+		m.GetAll(keys)
+	}()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MapAll of mismatched slices did not panic")
+		}
+	}()
+	m.MapAll(keys, nil)
+}
+
+func TestNamespaceOf(t *testing.T) {
+	defer mapper.SetDebug(true)()
+	var m mapper.Mapper
+	type widget struct{ name string }
+	ns := mapper.NamespaceOf[*widget](&m, "widgets")
+	if ns != m.Namespace("widgets") || ns.Type() != reflect.TypeOf(&widget{}) {
+		t.Fatal("NamespaceOf did not create a typed namespace")
+	}
+	key := ns.MapValue(&widget{"w"})
+	if w := mapper.GetAs[*widget](&m, key); w.name != "w" {
+		t.Fatalf("GetAs = %v", w)
+	}
+	if _, ok := mapper.LookupAs[interface{}](&m, key); !ok {
+		t.Fatal("LookupAs[interface{}] failed")
+	}
+
+	panics := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("%s did not panic", name)
+			} else if !strings.Contains(fmt.Sprint(r), "widget") {
+				t.Fatalf("%s panicked with %v", name, r)
+			}
+		}()
+		fn()
+	}
+	panics("mapping a string", func() { ns.MapValue("w") })
+	panics("GetAs[string]", func() { mapper.GetAs[string](&m, key) })
+	panics("LookupAs[string]", func() { mapper.LookupAs[string](&m, key) })
+	panics("NamespaceOf[string]", func() { mapper.NamespaceOf[string](&m, "widgets") })
+
+	// A namespace of an interface type admits retrieval by concrete type.
+	sns := mapper.NamespaceOf[fmt.Stringer](&m, "stringers")
+	key = sns.MapValue(time.Second)
+	if d := mapper.GetAs[time.Duration](&m, key); d != time.Second {
+		t.Fatalf("GetAs[time.Duration] = %v", d)
+	}
+
+	// Outside debug mode, types are not checked at map time.
+	mapper.SetDebug(false)
+	ns.MapValue("w")
+}
+
+func TestMapperOf(t *testing.T) {
+	type sample struct{ left, right int16 }
+	var m mapper.MapperOf[sample]
+	key := m.MapValue(sample{1, 2})
+	if got := m.Get(key); got != (sample{1, 2}) {
+		t.Fatalf("Get = %v", got)
+	}
+	if got := m.GetHandle(key.Handle()); got.right != 2 {
+		t.Fatalf("GetHandle = %v", got)
+	}
+	var buf [2]uint64
+	pkey := m.MapPtrPair(unsafe.Pointer(&buf[0]), sample{3, 4})
+	if got := m.GetPtr(unsafe.Pointer(&buf[0])); got != (sample{3, 4}) || pkey.Handle()&1 != 0 {
+		t.Fatalf("GetPtr = %v", got)
+	}
+	if got, ok := m.LookupPtr(unsafe.Pointer(&buf[0])); !ok || got != (sample{3, 4}) {
+		t.Fatalf("LookupPtr = %v, %v", got, ok)
+	}
+	m.DeletePtr(unsafe.Pointer(&buf[0]))
+	if _, ok := m.Lookup(pkey); ok {
+		t.Fatal("pointer key still mapped")
+	}
+	if _, ok := m.LookupPtr(unsafe.Pointer(&buf[0])); ok {
+		t.Fatal("LookupPtr found deleted pointer key")
+	}
+
+	if got, ok := m.LookupHandle(key.Handle()); !ok || got != (sample{1, 2}) {
+		t.Fatalf("LookupHandle = %v, %v", got, ok)
+	}
+	m.DeleteHandle(key.Handle())
+	if _, ok := m.Lookup(key); ok {
+		t.Fatal("key still mapped")
+	}
+	if n := testing.AllocsPerRun(100, func() { m.Delete(m.MapValue(sample{5, 6})) }); n != 0 {
+		t.Fatalf("MapValue and Delete allocate %v times", n)
+	}
+
+	m.MapValue(sample{})
+	m.Clear()
+	if _, ok := m.Lookup(key); ok {
+		t.Fatal("mapped after Clear")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Get of a deleted key did not panic")
+		}
+	}()
+	m.Get(key)
+}
+
+func TestMapWord(t *testing.T) {
+	type handle struct {
+		index uint16
+		gen   uint16
+	}
+	// Debug mode allocates to record diagnostics.
+	defer mapper.SetDebug(false)()
+	for _, m := range []*mapper.Mapper{mapper.New(), mapper.New(mapper.WithTypePartitions())} {
+		key := mapper.MapWord(m, handle{7, 1})
+		if h, ok := mapper.LookupAs[handle](m, key); !ok || h != (handle{7, 1}) {
+			t.Fatalf("LookupAs = %v, %v", h, ok)
+		}
+		if h := mapper.GetAs[handle](m, key); h.index != 7 {
+			t.Fatalf("GetAs = %v", h)
+		}
+		if got := m.Get(key); got != (handle{7, 1}) {
+			t.Fatalf("Get = %v", got)
+		}
+		if _, ok := mapper.LookupAs[uint32](m, key); ok {
+			t.Fatal("LookupAs of another type succeeded")
+		}
+		if typ := m.Snapshot().Entries[0].Type; typ != "mapper_test.handle" {
+			t.Fatalf("snapshot type = %q", typ)
+		}
+		m.Delete(key)
+
+		n := testing.AllocsPerRun(100, func() {
+			key := mapper.MapWord(m, ^uintptr(0)>>3)
+			if v, _ := mapper.LookupAs[uintptr](m, key); v != ^uintptr(0)>>3 {
+				t.Fatalf("LookupAs = 0x%x", v)
+			}
+			m.Delete(key)
+		})
+		if n != 0 {
+			t.Fatalf("MapWord, LookupAs, and Delete allocate %v times", n)
+		}
+	}
+
+	// Values that are too large, or hold pointers, are boxed.
+	var m mapper.Mapper
+	s := "not inline"
+	if got := mapper.GetAs[*string](&m, mapper.MapWord(&m, &s)); got != &s {
+		t.Fatalf("GetAs = %p, want %p", got, &s)
+	}
+	if got := m.Get(mapper.MapWord(&m, [4]uint64{1, 2, 3, 4})); got != [4]uint64{1, 2, 3, 4} {
+		t.Fatalf("Get = %v", got)
+	}
+}
+
+func TestWithInsertionOrder(t *testing.T) {
+	m := mapper.New(mapper.WithInsertionOrder())
+	var buf [4]uint64
+	want := []uintptr{
+		m.MapPtrPair(unsafe.Pointer(&buf[3]), "parent").Handle(),
+		m.MapValue("child").Handle(),
+		m.MapPtrPair(unsafe.Pointer(&buf[0]), "grandchild").Handle(),
+	}
+	// Replacing a mapping keeps its place.
+	m.MapPtrPair(unsafe.Pointer(&buf[3]), "parent again")
+
+	entries := m.Snapshot().Entries
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if e.Handle != want[i] {
+			t.Fatalf("entry %d has handle 0x%x, want 0x%x", i, e.Handle, want[i])
+		}
+	}
+
+	m.Delete(mapper.KeyFromHandle(want[0]))
+	m.MapPtrPair(unsafe.Pointer(&buf[3]), "new parent")
+	if entries := m.Snapshot().Entries; entries[2].Handle != want[0] {
+		t.Fatalf("a key mapped again is not last: %+v", entries)
+	}
+}
+
+func TestDeleteAfter(t *testing.T) {
+	var m mapper.Mapper
+	deleted := make(chan struct{})
+	key := m.MapValue("late callbacks")
+	m.OnDelete(key, func() { close(deleted) })
+	if !m.DeleteAfter(key, 10*time.Millisecond) {
+		t.Fatal("DeleteAfter of a mapped key failed")
+	}
+	if _, ok := m.Lookup(key); !ok {
+		t.Fatal("deleted before the duration elapsed")
+	}
+	select {
+	case <-deleted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("not deleted after the duration elapsed")
+	}
+	if m.DeleteAfter(key, 0) {
+		t.Fatal("DeleteAfter of an unmapped key succeeded")
+	}
+
+	// A replaced mapping is not deleted.
+	var buf [1]uint64
+	ptr := unsafe.Pointer(&buf[0])
+	m.MapPtrPair(ptr, 1)
+	m.DeleteAfter(mapper.KeyFromPtr(ptr), 10*time.Millisecond)
+	m.MapPtrPair(ptr, 2)
+	time.Sleep(50 * time.Millisecond)
+	if got := m.GetPtr(ptr); got != 2 {
+		t.Fatalf("GetPtr = %v, want 2", got)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	defer mapper.SetDebug(false)()
+	var m mapper.Mapper
+	key := m.Namespace("frames").MapValue([]byte("frame"))
+	info := m.Info(key)
+	if !info.Mapped || info.Type != "[]uint8" || info.Namespace != "frames" || info.Stack != "" {
+		t.Fatalf("Info = %+v", info)
+	}
+	if s := m.Describe(mapper.KeyFromHandle(1 << 20)); s != "key 0x100000: not mapped" {
+		t.Fatalf("Describe of an unmapped key = %q", s)
+	}
+
+	mapper.SetDebug(true)
+	key = m.MapValueUses("callback", 3)
+	m.Get(key)
+	info = m.Info(key)
+	if info.LastGet.IsZero() || info.Uses != 2 || info.Goroutine == 0 {
+		t.Fatalf("Info in debug mode = %+v", info)
+	}
+	if !strings.Contains(info.Stack, "TestDescribe") || strings.Contains(info.Stack, "mapper.(*Mapper)") {
+		t.Fatalf("creation stack:\n%s", info.Stack)
+	}
+	s := m.Describe(key)
+	for _, want := range []string{"mapped", "type: string", "uses remaining: 2", "last get:", "TestDescribe"} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("Describe does not contain %q:\n%s", want, s)
+		}
+	}
+
+	m.Delete(key)
+	info = m.Info(key)
+	if info.Mapped || info.Deleted.IsZero() || info.Type != "string" {
+		t.Fatalf("Info of a deleted key = %+v", info)
+	}
+	if s := m.Describe(key); !strings.Contains(s, "not mapped; deleted") {
+		t.Fatalf("Describe of a deleted key = %q", s)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	defer mapper.SetDebug(false)()
+	var m mapper.Mapper
+	m.Delete(m.MapValue(1))
+	if r := m.Audit(); r != nil {
+		t.Fatalf("Audit outside debug mode = %v", r)
+	}
+
+	mapper.SetDebug(true)
+	key := m.MapValue(1)
+	m.MapPair(key, "one")
+	m.Delete(key)
+	m.Clear()
+	var ops []mapper.AuditOp
+	for _, r := range m.Audit() {
+		if r.Goroutine == 0 || r.Time.IsZero() || r.Op != mapper.AuditCleared && r.Key != key {
+			t.Fatalf("record %+v", r)
+		}
+		ops = append(ops, r.Op)
+	}
+	want := []mapper.AuditOp{mapper.AuditMapped, mapper.AuditReplaced, mapper.AuditDeleted, mapper.AuditCleared}
+	if !reflect.DeepEqual(ops, want) {
+		t.Fatalf("Audit ops = %v, want %v", ops, want)
+	}
+	if r := m.Audit(); r[1].Type != "string" {
+		t.Fatalf("replaced record %+v", r[1])
+	}
+
+	// The ring keeps only the most recent operations.
+	for i := 0; i < 1000; i++ {
+		key = m.MapValue(i)
+	}
+	r := m.Audit()
+	if len(r) != 256 || r[0].Op != mapper.AuditMapped || r[len(r)-1].Key != key {
+		t.Fatalf("Audit after many mappings has %d records, from %+v to %+v", len(r), r[0], r[len(r)-1])
+	}
+}
+
+func TestIndex(t *testing.T) {
+	var m mapper.Mapper
+	type serial string
+	key := m.MapValueIndexed("camera", "serial", serial("A123"))
+	if got := m.GetByIndex("serial", serial("A123")); got != "camera" {
+		t.Fatalf("GetByIndex = %v", got)
+	}
+	if _, ok := m.LookupByIndex("serial", "A123"); ok {
+		t.Fatal("found an index value of another type")
+	}
+	if !m.Index(key, "url", "rtsp://camera") {
+		t.Fatal("Index of a mapped key failed")
+	}
+	if k, ok := m.LookupByIndex("url", "rtsp://camera"); !ok || k != key {
+		t.Fatalf("LookupByIndex = %v, %v", k, ok)
+	}
+	if _, ok := m.LookupByIndex("url", []byte("not comparable")); ok {
+		t.Fatal("found a non-comparable index value")
+	}
+
+	// Indexing another mapping by the same value replaces it.
+	other := m.MapValue("microphone")
+	m.Index(other, "url", "rtsp://camera")
+	if got := m.GetByIndex("url", "rtsp://camera"); got != "microphone" {
+		t.Fatalf("GetByIndex after replacement = %v", got)
+	}
+	m.Delete(key)
+	if _, ok := m.LookupByIndex("serial", serial("A123")); ok {
+		t.Fatal("deleted mapping still indexed")
+	}
+	if _, ok := m.LookupByIndex("url", "rtsp://camera"); !ok {
+		t.Fatal("deleting a replaced mapping removed its replacement from the index")
+	}
+	m.Clear()
+	if _, ok := m.LookupByIndex("url", "rtsp://camera"); ok {
+		t.Fatal("indexed after Clear")
+	}
+	if m.Index(other, "url", "x") {
+		t.Fatal("Index of an unmapped key succeeded")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("indexing by a non-comparable value did not panic")
+		}
+	}()
+	m.MapValueIndexed("x", "bad", []int{1})
+}
+
+func TestWithExcludedHandles(t *testing.T) {
+	for _, opts := range [][]mapper.Option{nil, {mapper.WithCompactHandles()}} {
+		m := mapper.New(append(opts, mapper.WithExcludedHandles(3, 7, 0xb, ^uintptr(0)))...)
+		for i := 0; i < 10; i++ {
+			switch h := m.MapValue(i).Handle(); h {
+			case 3, 7, 0xb:
+				t.Fatalf("MapValue returned the excluded handle 0x%x", h)
+			}
+		}
+		r := m.ReserveKeys(2)
+		for i := 0; i < r.Len(); i++ {
+			if h := r.Key(i).Handle(); h == 3 || h == 7 || h == 0xb {
+				t.Fatalf("ReserveKeys returned the excluded handle 0x%x", h)
+			}
+		}
+		func() {
+			defer func() {
+				if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "excluded") {
+					t.Fatalf("MapPair of an excluded handle panicked with %v", r)
+				}
+			}()
+			m.MapPair(mapper.KeyFromHandle(7), "sentinel")
+		}()
+	}
+}
+
+func TestContext(t *testing.T) {
+	if _, ok := mapper.FromContext(context.Background()); ok {
+		t.Fatal("found a mapper in the background context")
+	}
+	m := mapper.New()
+	ctx, cancel := context.WithCancel(mapper.NewContext(context.Background(), m))
+	defer cancel()
+	if got, ok := mapper.FromContext(ctx); !ok || got != m {
+		t.Fatalf("FromContext = %p, %v; want %p", got, ok, m)
+	}
+}
+
+func TestHandle64(t *testing.T) {
+	var m mapper.Mapper
+	key := m.MapValue("io")
+	if got := m.Get(mapper.KeyFromHandle64(key.Handle64())); got != "io" {
+		t.Fatalf("Get after round trip = %v", got)
+	}
+	if h := mapper.KeyFromUint(1<<40|5, 3).Handle64(); h != 1<<40|5 {
+		t.Fatalf("Handle64 of a token key = 0x%x", h)
+	}
+	if unsafe.Sizeof(uintptr(0)) < 8 {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("KeyFromHandle64 of a 64-bit handle did not panic")
+			}
+		}()
+		mapper.KeyFromHandle64(1 << 40)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	var session, global mapper.Mapper
+	obj := &struct{ name string }{"promoted"}
+	key := session.MapValue(obj)
+	released := false
+	session.OnDelete(key, func() { released = true })
+
+	var tx mapper.Txn
+	promoted := tx.Move(&session, key, &global)
+	extra := tx.MapValue(&global, "extra")
+	if _, ok := global.Lookup(extra); ok {
+		t.Fatal("mapped before Commit")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := session.Lookup(key); ok {
+		t.Fatal("still mapped in the session mapper")
+	}
+	if global.Get(promoted) != obj || global.Get(extra) != "extra" {
+		t.Fatal("not mapped in the global mapper")
+	}
+	if released {
+		t.Fatal("moving the mapping ran its OnDelete function")
+	}
+	global.Delete(promoted)
+	if !released {
+		t.Fatal("OnDelete function did not move with the mapping")
+	}
+
+	// A failed transaction applies nothing.
+	var buf [1]uint64
+	pkey := mapper.KeyFromPtr(unsafe.Pointer(&buf[0]))
+	tx.MapPair(&session, pkey, 1)
+	tx.Delete(&global, extra)
+	tx.Delete(&global, extra)
+	if err := tx.Commit(); err == nil {
+		t.Fatal("deleting a key twice did not fail")
+	}
+	if _, ok := session.Lookup(pkey); ok {
+		t.Fatal("failed transaction mapped a key")
+	}
+	if _, ok := global.Lookup(extra); !ok {
+		t.Fatal("failed transaction deleted a key")
+	}
+
+	// Concurrent transactions across the same mappers in opposite orders
+	// do not deadlock.
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			a, b := &session, &global
+			if i == 1 {
+				a, b = b, a
+			}
+			for j := 0; j < 1000; j++ {
+				var tx mapper.Txn
+				k := tx.MapValue(a, j)
+				tx.Move(a, k, b)
+				if err := tx.Commit(); err != nil {
+					t.Error(err)
+				}
+			}
+			done <- true
+		}(i)
+	}
+	<-done
+	<-done
+
+	// Lookups that take no lock do not observe a move part way through.
+	a, b := mapper.New(mapper.WithShards(4)), mapper.New(mapper.WithCopyOnWrite())
+	var mux sync.Mutex
+	var from, to mapper.Key
+	go func() {
+		for j := 0; j < 1000; j++ {
+			var tx mapper.Txn
+			k := a.MapValue(j)
+			moved := tx.Move(a, k, b)
+			mux.Lock()
+			from, to = k, moved
+			mux.Unlock()
+			if err := tx.Commit(); err != nil {
+				t.Error(err)
+			}
+		}
+		done <- true
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		mux.Lock()
+		k, moved := from, to
+		mux.Unlock()
+		if k != (mapper.Key{}) && !a.Has(k) && !b.Has(moved) {
+			t.Fatal("key mapped by neither mapper part way through a move")
+		}
+	}
+}
+
+func TestTxnMove(t *testing.T) {
+	type closed struct{ mapper string }
+	var torn []closed
+	teardown := func(name string) mapper.Option {
+		return mapper.WithAutoClose(func(goValue interface{}) error {
+			torn = append(torn, closed{name})
+			return nil
+		}, nil)
+	}
+	session, global := mapper.New(teardown("session")), mapper.New(teardown("global"))
+
+	nsKey := session.Namespace("decoders").MapValue("decoder")
+	session.Index(nsKey, "serial", 42)
+	usesKey := session.MapValueUses("once", 2)
+	session.Get(usesKey)
+	released := false
+	session.OnDelete(usesKey, func() { released = true })
+
+	var tx mapper.Txn
+	movedNS := tx.Move(session, nsKey, global)
+	movedUses := tx.Move(session, usesKey, global)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(torn) != 0 || released {
+		t.Fatal("moving tore down the values")
+	}
+
+	// The namespace, indexes, and remaining uses move with the mappings.
+	if s := session.Namespace("decoders").Stats(); s.Live != 0 {
+		t.Fatalf("session namespace stats = %+v", s)
+	}
+	ns, ok := global.LookupNamespace("decoders")
+	if !ok || ns.Stats().Live != 1 {
+		t.Fatal("mapping did not move to the namespace of the destination")
+	}
+	if _, ok := session.LookupByIndex("serial", 42); ok {
+		t.Fatal("index still finds the mapping in the session mapper")
+	}
+	if key, ok := global.LookupByIndex("serial", 42); !ok || key != movedNS {
+		t.Fatal("index did not move with the mapping")
+	}
+	if global.Get(movedUses) != "once" {
+		t.Fatal("moved mapping not found")
+	}
+	if global.Has(movedUses) {
+		t.Fatal("uses did not move with the mapping")
+	}
+
+	// The destination tears the values down, after OnDelete functions.
+	if !released || len(torn) != 1 || torn[0].mapper != "global" {
+		t.Fatalf("last use tore down %+v, released %v", torn, released)
+	}
+	global.Delete(movedNS)
+	if len(torn) != 2 || torn[1].mapper != "global" {
+		t.Fatalf("delete tore down %+v", torn)
+	}
+
+	// Moving into a Mapper without teardown drops the teardown.
+	var plain mapper.Mapper
+	key := session.MapValue("plain")
+	moved := tx.Move(session, key, &plain)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	plain.Delete(moved)
+	if len(torn) != 2 {
+		t.Fatalf("mapper without teardown tore down %+v", torn)
+	}
+
+	// A namespace of the destination for another type aborts the move.
+	key = mapper.NamespaceOf[int](session, "counts").MapValue(1)
+	mapper.NamespaceOf[string](global, "counts")
+	tx.Move(session, key, global)
+	if err := tx.Commit(); err == nil {
+		t.Fatal("moving into a namespace for another type did not fail")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	var m mapper.Mapper
+	var buf [2]uint64
+	ptr := unsafe.Pointer(&buf[0])
+	key := m.MapPtrPair(ptr, "v1")
+	events, cancel := m.Watch(key)
+	defer cancel()
+	m.MapPtrPair(ptr, "v2")
+	m.Delete(key)
+	for _, want := range []mapper.EventKind{mapper.Replaced, mapper.Deleted} {
+		if ev := <-events; ev.Kind != want || ev.Key != key {
+			t.Fatalf("got event %v %v, want %v", ev.Key, ev.Kind, want)
+		}
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("channel not closed after deletion")
+	}
+
+	// Watching an unmapped key returns a closed channel.
+	if _, ok := <-func() <-chan mapper.Event { ch, _ := m.Watch(key); return ch }(); ok {
+		t.Fatal("watching an unmapped key received an event")
+	}
+
+	// Cancel stops watching; Clear reports deletion to other watchers.
+	key = m.MapValue("v")
+	events, cancel = m.Watch(key)
+	other, _ := m.Watch(key)
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("channel not closed after cancel")
+	}
+	m.Clear()
+	if ev := <-other; ev.Kind != mapper.Deleted {
+		t.Fatalf("got %v after Clear", ev.Kind)
+	}
+
+	// A watcher that falls behind misses replacements, but not deletion.
+	key = m.MapPtrPair(ptr, 0)
+	events, _ = m.Watch(key)
+	for i := 1; i < 100; i++ {
+		m.MapPtrPair(ptr, i)
+	}
+	m.DeletePtr(ptr)
+	n := 0
+	for range events {
+		n++
+	}
+	if n == 0 || n >= 100 {
+		t.Fatalf("received %d events", n)
+	}
+}
+
+func TestTeardownOrder(t *testing.T) {
+	var m mapper.Mapper
+	var order []string
+	track := func(key mapper.Key, name string) {
+		m.OnDelete(key, func() { order = append(order, "release "+name) })
+	}
+	parent := m.MapValue("parent")
+	track(parent, "parent")
+	track(m.MapValue("child"), "child")
+	logger := m.MapValue("logger")
+	track(logger, "logger")
+	m.SetTeardownPriority(logger, 1)
+	track(m.MapValue("grandchild"), "grandchild")
+	// Replacing a mapping keeps its place.
+	m.MapPair(parent, "parent again")
+	track(parent, "parent again")
+
+	m.ClearFunc(func(key mapper.Key, goValue interface{}) {
+		order = append(order, fmt.Sprint("destroy ", goValue))
+	})
+	want := []string{
+		"release parent",
+		"destroy grandchild", "release grandchild",
+		"destroy child", "release child",
+		"destroy parent again", "release parent again",
+		"destroy logger", "release logger",
+	}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Fatalf("teardown order:\n%q\nwant:\n%q", order, want)
+	}
+
+	order = nil
+	track(m.MapValue("a"), "a")
+	track(m.MapValue("b"), "b")
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(order) != fmt.Sprint([]string{"release b", "release a"}) {
+		t.Fatalf("Close order: %q", order)
+	}
+	if m.SetTeardownPriority(parent, 0) {
+		t.Fatal("SetTeardownPriority of an unmapped key succeeded")
+	}
+}
+
+func TestEntrySize(t *testing.T) {
+	// A Go map stores larger values in a separate allocation, which would
+	// cost an allocation for each mapping.
+	if mapper.EntrySize > 128 {
+		t.Fatalf("entry is %d bytes, above 128", mapper.EntrySize)
+	}
+	// The rarely set fields are held out of line, leaving room to grow; a
+	// new field should join them unless most entries set it.
+	if unsafe.Sizeof(uintptr(0)) == 8 && mapper.EntrySize != 96 {
+		t.Fatalf("entry is %d bytes, want 96", mapper.EntrySize)
+	}
+}
+
+func TestClearCountingPointers(t *testing.T) {
+	var m mapper.Mapper
+	var buf [1]uint64
+	ptr := unsafe.Pointer(&buf[0])
+	counting := m.MapValue("refcon")
+	m.MapPtrPair(ptr, "object")
+	token := mapper.KeyFromUint(42, 1)
+	m.MapPair(token, "timer")
+
+	m.ClearPointers()
+	if _, ok := m.Lookup(mapper.KeyFromPtr(ptr)); ok {
+		t.Fatal("pointer key survived ClearPointers")
+	}
+	if _, ok := m.Lookup(counting); !ok {
+		t.Fatal("counting key removed by ClearPointers")
+	}
+	m.MapPtrPair(ptr, "object")
+	m.ClearCounting()
+	if _, ok := m.Lookup(counting); ok {
+		t.Fatal("counting key survived ClearCounting")
+	}
+	if _, ok := m.Lookup(mapper.KeyFromPtr(ptr)); !ok {
+		t.Fatal("pointer key removed by ClearCounting")
+	}
+	if _, ok := m.Lookup(token); !ok {
+		t.Fatal("token key removed")
+	}
+	if s := m.Stats(); s.Live != 2 {
+		t.Fatalf("Stats = %+v", s)
+	}
+}
+
+// closer records whether it was closed.
+type closer struct {
+	name   string
+	closed *[]string
+	err    error
+}
+
+func (c closer) Close() error {
+	*c.closed = append(*c.closed, c.name)
+	return c.err
+}
+
+func TestWithAutoClose(t *testing.T) {
+	var closed []string
+	var errs []error
+	m := mapper.New(mapper.WithAutoClose(nil, func(key mapper.Key, err error) {
+		errs = append(errs, err)
+	}))
+	a := m.MapValue(closer{"a", &closed, nil})
+	m.OnDelete(a, func() { closed = append(closed, "on delete a") })
+	m.Delete(a)
+	if fmt.Sprint(closed) != "[on delete a a]" {
+		t.Fatalf("closed %q", closed)
+	}
+
+	// Replacing a value closes it, unless it is mapped again.
+	closed = nil
+	var buf [1]uint64
+	ptr := unsafe.Pointer(&buf[0])
+	b := closer{"b", &closed, nil}
+	m.MapPtrPair(ptr, b)
+	m.MapPtrPair(ptr, b)
+	if len(closed) != 0 {
+		t.Fatalf("mapping the same value again closed %q", closed)
+	}
+	m.MapPtrPair(ptr, closer{"c", &closed, errors.New("c failed")})
+	m.MapValue("not a closer")
+	m.Clear()
+	if fmt.Sprint(closed) != "[b c]" {
+		t.Fatalf("closed %q", closed)
+	}
+	if len(errs) != 1 || errs[0].Error() != "c failed" {
+		t.Fatalf("errors %v", errs)
+	}
+
+	// A teardown function handles other values.
+	var destroyed []interface{}
+	m = mapper.New(mapper.WithAutoClose(func(goValue interface{}) error {
+		destroyed = append(destroyed, goValue)
+		return nil
+	}, nil))
+	m.Delete(m.MapValue(42))
+	if fmt.Sprint(destroyed) != "[42]" {
+		t.Fatalf("destroyed %v", destroyed)
+	}
+}
+
+//go:noinline
+func hotCallback(m *mapper.Mapper, key mapper.Key) { m.Get(key) }
+
+//go:noinline
+func coldCallback(m *mapper.Mapper, key mapper.Key) { m.Get(key) }
+
+func TestWithGetSampling(t *testing.T) {
+	if p := mapper.New().GetProfile(); p != nil {
+		t.Fatalf("GetProfile without sampling = %v", p)
+	}
+	m := mapper.New(mapper.WithGetSampling(10))
+	key := m.MapValue("v")
+	for i := 0; i < 1000; i++ {
+		hotCallback(m, key)
+		if i%10 == 0 {
+			coldCallback(m, key)
+		}
+	}
+	profile := m.GetProfile()
+	if len(profile) != 2 {
+		t.Fatalf("got %d paths, want 2", len(profile))
+	}
+	if !strings.Contains(profile[0].Stack, "hotCallback") || !strings.Contains(profile[1].Stack, "coldCallback") {
+		t.Fatalf("profile:\n%s\n%s", profile[0].Stack, profile[1].Stack)
+	}
+	if total := profile[0].Estimate + profile[1].Estimate; total != 1100 {
+		t.Fatalf("estimated %d retrievals, want 1100", total)
+	}
+}
+
+func TestWithLatencyMetrics(t *testing.T) {
+	if s := mapper.New().Stats(); s.Latency != (mapper.Latencies{}) {
+		t.Fatalf("latency recorded without WithLatencyMetrics: %+v", s.Latency)
+	}
+	m := mapper.New(mapper.WithLatencyMetrics())
+	for i := 0; i < 100; i++ {
+		key := m.MapValue(i)
+		m.Get(key)
+		m.Lookup(key)
+		m.Delete(key)
+	}
+	l := m.Stats().Latency
+	if l.Map.Count != 100 || l.Get.Count != 200 || l.Delete.Count != 100 {
+		t.Fatalf("unexpected counts: %+v", l)
+	}
+	for _, op := range []mapper.Latency{l.Map, l.Get, l.Delete} {
+		if op.P50 <= 0 || op.P99 < op.P50 || op.P99 > time.Second {
+			t.Fatalf("unexpected percentiles: %+v", op)
+		}
+	}
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	prev := -1
+	for _, ns := range []uint64{0, 1, 3, 4, 5, 7, 8, 9, 15, 16, 100, 1000, 12345, 1 << 40, 1<<63 - 1, 1<<64 - 1} {
+		i, max := mapper.LatencyBucket(ns)
+		if i < prev {
+			t.Fatalf("bucket(%d) = %d, before bucket %d", ns, i, prev)
+		}
+		prev = i
+		if uint64(max) < ns && ns < 1<<63 || float64(max) > 1.25*float64(ns)+1 {
+			t.Fatalf("bucket(%d) counts up to %d", ns, max)
+		}
+	}
+}
+
+func TestBorrow(t *testing.T) {
+	var m mapper.Mapper
+	key := m.MapValue("state")
+	torn := 0
+	m.OnDelete(key, func() { torn++ })
+
+	v, release := m.Borrow(key)
+	_, release2 := m.Borrow(key)
+	if v != "state" {
+		t.Fatalf("Borrow = %v", v)
+	}
+	m.Delete(key)
+	if _, ok := m.Lookup(key); ok {
+		t.Fatal("borrowed mapping not deleted")
+	}
+	release()
+	release()
+	if torn != 0 {
+		t.Fatal("mapping torn down while borrowed")
+	}
+	release2()
+	if torn != 1 {
+		t.Fatalf("mapping torn down %d times after release", torn)
+	}
+
+	// ClearFunc defers destroy too.
+	key = m.MapValue("cleared")
+	destroyed := false
+	_, release = m.Borrow(key)
+	m.ClearFunc(func(mapper.Key, interface{}) { destroyed = true })
+	if destroyed {
+		t.Fatal("ClearFunc destroyed borrowed value")
+	}
+	release()
+	if !destroyed {
+		t.Fatal("ClearFunc did not destroy released value")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Borrow of unmapped key did not panic")
+		}
+	}()
+	m.Borrow(key)
+}
+
+func TestGroup(t *testing.T) {
+	g := mapper.NewGroup(mapper.WithInsertionOrder())
+	conns := g.Mapper("conns")
+	stmts := g.Mapper("stmts")
+	if g.Mapper("conns") != conns {
+		t.Fatal("Mapper returned a new mapper for the same name")
+	}
+	if names := g.Names(); !reflect.DeepEqual(names, []string{"conns", "stmts"}) {
+		t.Fatalf("Names = %v", names)
+	}
+
+	var order []string
+	conn := conns.MapValue("conn")
+	conns.OnDelete(conn, func() { order = append(order, "conn") })
+	for i := 0; i < 2; i++ {
+		stmt := stmts.MapValue(i)
+		stmts.OnDelete(stmt, func() { order = append(order, "stmt") })
+	}
+
+	if s := g.Stats(); s.Live != 3 || s.Mapped != 3 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if s := g.MapperStats(); s["conns"].Live != 1 || s["stmts"].Live != 2 {
+		t.Fatalf("unexpected mapper stats: %+v", s)
+	}
+	if s := g.Snapshot(); len(s["stmts"].Entries) != 2 {
+		t.Fatalf("unexpected snapshot: %+v", s)
+	}
+
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"stmt", "stmt", "conn"}) {
+		t.Fatalf("torn down in order %v", order)
+	}
+	if s := g.Stats(); s.Live != 0 || s.Deleted != 3 {
+		t.Fatalf("unexpected stats after Close: %+v", s)
+	}
+}
+
+func TestMapStruct(t *testing.T) {
+	type callbacks struct {
+		Key mapper.Key `mapper:"handle"`
+	}
+	type options struct {
+		Name     string
+		UserData uintptr `mapper:"handle"`
+		Other    uintptr
+		callbacks
+		Nested struct {
+			UserData uintptr `mapper:"handle"`
+		}
+	}
+	var m mapper.Mapper
+	opts := &options{Name: "decoder"}
+	key := m.MapStruct(opts)
+	if m.Get(key) != opts {
+		t.Fatal("MapStruct did not map the struct pointer")
+	}
+	if opts.UserData != key.Handle() || opts.Key != key || opts.Nested.UserData != key.Handle() || opts.Other != 0 {
+		t.Fatalf("unexpected fields: %+v", opts)
+	}
+
+	type bad struct {
+		UserData int `mapper:"handle"`
+	}
+	for _, ptr := range []interface{}{options{}, (*options)(nil), &bad{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("MapStruct(%#v) did not panic", ptr)
+				}
+			}()
+			m.MapStruct(ptr)
+		}()
+	}
+	if s := m.Stats(); s.Live != 1 {
+		t.Fatalf("failed MapStruct left %d mappings", s.Live-1)
+	}
+}
+
+type stream struct{ written []byte }
+
+func (s *stream) Write(p []byte) (int, error) {
+	s.written = append(s.written, p...)
+	return len(p), nil
+}
+
+func (s *stream) Len() int { return len(s.written) }
+
+func TestInvokeMethod(t *testing.T) {
+	var m mapper.Mapper
+	s := &stream{}
+	handle := m.MapValue(s).Handle()
+
+	res, err := m.InvokeMethod(handle, "Write", []byte("hi"))
+	if err != nil || len(res) != 2 || res[0] != 2 || string(s.written) != "hi" {
+		t.Fatalf("Write: %v, %v", res, err)
+	}
+	if _, err := m.InvokeMethod(handle, "Read", nil); err == nil {
+		t.Fatal("invoked a missing method")
+	}
+
+	methods := mapper.NewMethodTable("Write", "Len", "Close")
+	for i := 0; i < 2; i++ {
+		if _, err := methods.Invoke(&m, handle, 0, []byte("!")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err := methods.Invoke(&m, handle, 1); err != nil || res[0] != 4 {
+		t.Fatalf("Len: %v, %v", res, err)
+	}
+	for _, id := range []int{-1, 2, 3} {
+		if _, err := methods.Invoke(&m, handle, id); err == nil {
+			t.Fatalf("invoked method ID %d", id)
+		}
+	}
+	if _, err := methods.Invoke(&m, handle, 0, 1); err == nil {
+		t.Fatal("invoked with a bad argument")
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	var rejected []string
+	reject := func(label string) { rejected = append(rejected, label) }
+	m := mapper.New(mapper.WithRateLimit(mapper.RateLimit{Rate: 1e-3, Burst: 3, Reject: reject}))
+	for i := 0; i < 3; i++ {
+		m.MapValue(i)
+	}
+	if _, err := m.TryMapValue(3); !errors.Is(err, mapper.ErrRateLimited) {
+		t.Fatalf("TryMapValue above the limit returned %v", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != mapper.ErrRateLimited {
+				t.Fatalf("MapPair above the limit panicked with %v", r)
+			}
+		}()
+		m.MapPair(mapper.KeyFromHandle(0x1000), "pair")
+	}()
+
+	ns := mapper.New().Namespace("callbacks")
+	ns.SetRateLimit(mapper.RateLimit{Rate: 1000, Burst: 1, Wait: true, Reject: reject})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		ns.MapValue(i)
+	}
+	if d := time.Since(start); d < time.Millisecond {
+		t.Fatalf("waiting mappings took only %v", d)
+	}
+	if !reflect.DeepEqual(rejected, []string{"", "", "callbacks", "callbacks"}) {
+		t.Fatalf("rejected %q", rejected)
+	}
+	ns.SetRateLimit(mapper.RateLimit{})
+	if _, err := ns.TryMapValue(3); err != nil {
+		t.Fatalf("TryMapValue after removing the limit returned %v", err)
+	}
+	if s := m.Stats(); s.Live != 3 {
+		t.Fatalf("rejected mappings made: %+v", s)
+	}
+
+	// Mappings that are not made leave the mapper's tokens.
+	m = mapper.New(mapper.WithRateLimit(mapper.RateLimit{Rate: 1e-3, Burst: 2}))
+	ns = m.Namespace("callbacks")
+	ns.SetRateLimit(mapper.RateLimit{Rate: 1e-3, Burst: 1})
+	ns.MapValue(0)
+	if _, err := ns.TryMapValue(1); !errors.Is(err, mapper.ErrRateLimited) {
+		t.Fatalf("TryMapValue above the namespace limit returned %v", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != mapper.ErrRateLimited {
+				t.Fatalf("MapAll above the limit panicked with %v", r)
+			}
+		}()
+		m.MapAll([]mapper.Key{mapper.KeyFromHandle(0x1000), mapper.KeyFromHandle(0x2000)}, []interface{}{"a", "b"})
+	}()
+	if _, err := m.TryMapValue(2); err != nil {
+		t.Fatalf("TryMapValue after rejected mappings returned %v", err)
+	}
+
+	// MapSlice, and the mappings of a Txn, are limited, but replacing a
+	// mapping using CompareAndSwap is not.
+	m = mapper.New(mapper.WithRateLimit(mapper.RateLimit{Rate: 1e-3, Burst: 2}))
+	func() {
+		defer func() {
+			if r := recover(); r != mapper.ErrRateLimited {
+				t.Fatalf("MapSlice above the limit panicked with %v", r)
+			}
+		}()
+		mapper.MapSlice(m, []int{0, 1, 2})
+	}()
+	var tx mapper.Txn
+	for i := 0; i < 3; i++ {
+		tx.MapValue(m, i)
+	}
+	if err := tx.Commit(); !errors.Is(err, mapper.ErrRateLimited) {
+		t.Fatalf("Commit above the limit returned %v", err)
+	}
+	tx.MapValue(m, 0)
+	tx.Delete(m, mapper.KeyFromHandle(0x1000))
+	if err := tx.Commit(); err == nil || errors.Is(err, mapper.ErrRateLimited) {
+		t.Fatalf("Commit deleting an unmapped key returned %v", err)
+	}
+	r := mapper.MapSlice(m, []int{0, 1})
+	if !m.CompareAndSwap(r.Key(0), 0, 10) {
+		t.Fatal("CompareAndSwap at the limit failed")
+	}
+	if _, err := m.TryMapValue(2); !errors.Is(err, mapper.ErrRateLimited) {
+		t.Fatalf("TryMapValue above the limit returned %v", err)
+	}
+	if s := m.Stats(); s.Live != 2 {
+		t.Fatalf("rejected mappings made: %+v", s)
+	}
+
+	// A mapping that finds no key takes no token.
+	m = mapper.New(mapper.WithCompactHandles(), mapper.WithRateLimit(mapper.RateLimit{Rate: 1e-3, Burst: 1 << 15}))
+	for {
+		if _, err := m.TryMapValue(0); err != nil {
+			if !errors.Is(err, mapper.ErrKeySpaceExhausted) {
+				t.Fatalf("TryMapValue returned %v", err)
+			}
+			break
+		}
+	}
+	if _, err := m.TryMapValue(0); !errors.Is(err, mapper.ErrKeySpaceExhausted) {
+		t.Fatalf("TryMapValue returned %v", err)
+	}
+	m.MapPair(mapper.KeyFromHandle(0x1000), "pair")
+}
+
+func TestWithHandleVersion(t *testing.T) {
+	host := mapper.New(mapper.WithHandleVersion(1), mapper.With32BitHandles())
+	plugin := mapper.New(mapper.WithHandleVersion(2), mapper.With32BitHandles(), mapper.WithObfuscatedHandles())
+	key := host.MapValue("host")
+	if key.Handle()>>28 != 1 {
+		t.Fatalf("handle 0x%x lacks version 1", key.Handle())
+	}
+	pkey := plugin.MapValue("plugin")
+	if pkey.Handle()>>28 != 2 || plugin.Get(pkey) != "plugin" {
+		t.Fatalf("handle 0x%x lacks version 2", pkey.Handle())
+	}
+	r := host.ReserveKeys(3)
+	if k := r.Key(2); k.Handle() != r.Base()+2*r.Stride() || k.Handle()>>28 != 1 {
+		t.Fatalf("range key 0x%x lacks version", k.Handle())
+	}
+	if i, ok := r.Index(r.Key(1)); !ok || i != 1 {
+		t.Fatalf("Index = %d, %v", i, ok)
+	}
+
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, mapper.ErrHandleVersion) || !strings.Contains(err.Error(), "version 2, not 1") {
+			t.Fatalf("Get of another version panicked with %v", err)
+		}
+	}()
+	host.Get(pkey)
+}
+
+func TestWithGenerationBits(t *testing.T) {
+	stale := func(m *mapper.Mapper, key mapper.Key, want string) {
+		t.Helper()
+		defer func() {
+			t.Helper()
+			err, _ := recover().(error)
+			if !errors.Is(err, mapper.ErrStaleHandle) || !strings.Contains(err.Error(), want) {
+				t.Fatalf("Get of a stale handle panicked with %v", err)
+			}
+		}()
+		m.Get(key)
+	}
+
+	// Without recycling, new keys are of the same generation, below the
+	// version bits.
+	m := mapper.New(mapper.WithGenerationBits(2), mapper.WithHandleVersion(3), mapper.With32BitHandles())
+	first := m.MapValue("first")
+	second := m.MapValue("second")
+	if first.Handle()>>28 != 3 || first.Handle()>>26&3 != 0 || second.Handle()>>26&3 != 0 {
+		t.Fatalf("handles 0x%x and 0x%x lack version or generation", first.Handle(), second.Handle())
+	}
+
+	// A recycled key advances its generation.
+	r := mapper.New(mapper.WithGenerationBits(2), mapper.WithKeyRecycling(), mapper.With32BitHandles())
+	key := r.MapValue("first")
+	r.Delete(key)
+	recycled := r.MapValue("second")
+	if recycled.Handle() != key.Handle()+1<<30 {
+		t.Fatalf("recycled handle 0x%x, want 0x%x in the next generation", recycled.Handle(), key.Handle()+1<<30)
+	}
+	if _, ok := r.Lookup(key); ok || r.Get(recycled) != "second" {
+		t.Fatal("stale handle resolved to the recycled key")
+	}
+	stale(r, key, "generation 0, but its key was reused, and is mapped in generation 1")
+
+	// Clear starts a new generation.
+	m.Clear()
+	if k := m.MapValue("after"); k.Handle() != first.Handle()+1<<26 {
+		t.Fatalf("handle 0x%x after Clear, want generation 1 of 0x%x", k.Handle(), first.Handle())
+	}
+	stale(m, first, "generation 0, but its key was reused")
+	stale(m, second, "generation 0, from before the Mapper was cleared, not 1")
+}
+
+func TestWithMapperID(t *testing.T) {
+	defer mapper.SetDebug(true)()
+	a := mapper.New(mapper.WithMapperID(), mapper.WithHandleVersion(1), mapper.With32BitHandles())
+	b := mapper.New(mapper.WithMapperID(), mapper.WithHandleVersion(1), mapper.With32BitHandles())
+	akey, bkey := a.MapValue("a"), b.MapValue("b")
+	if akey.Handle()>>28 != 1 || bkey.Handle()>>28 != 1 || akey.Handle() == bkey.Handle() {
+		t.Fatalf("handles 0x%x and 0x%x share an ID, or lack the version", akey.Handle(), bkey.Handle())
+	}
+	if a.Get(akey) != "a" || b.Get(bkey) != "b" {
+		t.Fatal("keys not mapped by their own Mapper")
+	}
+	r := a.ReserveKeys(2)
+	a.MapPair(r.Key(1), "reserved")
+	if i, ok := r.Index(r.Key(1)); !ok || i != 1 || a.Get(r.Key(1)) != "reserved" {
+		t.Fatalf("Index = %d, %v", i, ok)
+	}
+
+	foreign := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			t.Helper()
+			err, _ := recover().(error)
+			if !errors.Is(err, mapper.ErrForeignKey) || !strings.Contains(err.Error(), "belongs to the Mapper with ID") {
+				t.Fatalf("%s of a key of another Mapper panicked with %v", name, err)
+			}
+		}()
+		fn()
+	}
+	foreign("Get", func() { a.Get(bkey) })
+	foreign("Delete", func() { a.Delete(bkey) })
+	if b.Get(bkey) != "b" {
+		t.Fatal("Delete by another Mapper deleted the key")
+	}
+}
+
+func TestWithHighCountingBit(t *testing.T) {
+	m := mapper.New(mapper.WithHighCountingBit())
+	buf := make([]byte, 16)
+	odd := unsafe.Pointer(&buf[1])
+	if uintptr(odd)&1 == 0 {
+		odd = unsafe.Pointer(&buf[2])
+	}
+	m.MapPtrPair(odd, "packed")
+	key := m.MapValue("counting")
+	if key.Handle()>>(8*unsafe.Sizeof(uintptr(0))-1) != 1 {
+		t.Fatalf("handle 0x%x lacks the top bit", key.Handle())
+	}
+	if m.GetPtr(odd) != "packed" || m.Get(key) != "counting" {
+		t.Fatal("mappings not found")
+	}
+	m.ClearPointers()
+	if m.HasPtr(odd) || !m.Has(key) {
+		t.Fatal("ClearPointers cleared the wrong mappings")
+	}
+
+	// The top bit is that of the limited handle, above the version and
+	// generation bits.
+	c := mapper.New(mapper.WithHighCountingBit(), mapper.With32BitHandles(),
+		mapper.WithHandleVersion(5), mapper.WithGenerationBits(1), mapper.WithObfuscatedHandles())
+	key = c.MapValue("tagged")
+	if key.Handle()>>27 != 1<<4|5 || key.Handle()>>26&1 != 0 || c.Get(key) != "tagged" {
+		t.Fatalf("handle 0x%x lacks its tags", key.Handle())
+	}
+	r := c.ReserveKeys(3)
+	c.MapPair(r.Key(2), "reserved")
+	if i, ok := r.Index(r.Key(2)); !ok || i != 2 || c.Get(r.Key(2)) != "reserved" {
+		t.Fatalf("Index = %d, %v", i, ok)
+	}
+}
+
+func TestDebugEnv(t *testing.T) {
+	if os.Getenv("GOMAPPER_DEBUG") == "stacks" {
+		var m mapper.Mapper
+		if info := m.Info(m.MapValue(1)); info.Stack == "" {
+			t.Fatal("GOMAPPER_DEBUG=stacks did not record the stack")
+		}
+		return
+	}
+	for v, want := range map[string][4]bool{
+		"1":                    {true, true, true, true},
+		"all":                  {true, true, true, true},
+		"0":                    {},
+		"stacks, tombstones":   {false, true, true, false},
+		"validate,nonexistent": {true, false, false, false},
+		"audit":                {false, false, false, true},
+	} {
+		if validate, stacks, tombstones, audit := mapper.ParseDebug(v); [4]bool{validate, stacks, tombstones, audit} != want {
+			t.Errorf("ParseDebug(%q) = %v, %v, %v, %v", v, validate, stacks, tombstones, audit)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDebugEnv$")
+	cmd.Env = append(os.Environ(), "GOMAPPER_DEBUG=stacks")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+func TestMapValueWithFinalizer(t *testing.T) {
+	m := mapper.New(mapper.WithAutoClose(nil, nil))
+	var finalized []interface{}
+	finalize := func(v interface{}) { finalized = append(finalized, v) }
+
+	key := m.MapValueWithFinalizer("deleted", finalize)
+	m.OnDelete(key, func() { finalized = append(finalized, "OnDelete") })
+	m.Delete(key)
+	m.Delete(key)
+
+	var closed []string
+	c := closer{name: "c", closed: &closed}
+	m.MapValueWithFinalizer(c, finalize)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(closed) != 0 {
+		t.Fatal("auto-closed a value with a finalizer")
+	}
+	if want := []interface{}{"OnDelete", "deleted", c}; !reflect.DeepEqual(finalized, want) {
+		t.Fatalf("finalized %v, want %v", finalized, want)
+	}
+
+	expired := make(chan interface{}, 1)
+	key = m.MapValueWithFinalizer("expired", func(v interface{}) { expired <- v })
+	m.DeleteAfter(key, time.Millisecond)
+	select {
+	case v := <-expired:
+		if v != "expired" {
+			t.Fatalf("finalized %v", v)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expired mapping not finalized")
+	}
+}
+
+func TestLookupPtr(t *testing.T) {
+	var m mapper.Mapper
+	var buf [2]uint64
+	m.MapPtrPair(unsafe.Pointer(&buf[0]), "ptr")
+	if v, ok := m.LookupPtr(unsafe.Pointer(&buf[0])); !ok || v != "ptr" {
+		t.Fatalf("LookupPtr = %v, %v", v, ok)
+	}
+	m.DeletePtr(unsafe.Pointer(&buf[0]))
+	if v, ok := m.LookupPtr(unsafe.Pointer(&buf[0])); ok {
+		t.Fatalf("LookupPtr of deleted pointer = %v", v)
+	}
+	key := m.MapValue("value")
+	if v, ok := m.LookupHandle(key.Handle()); !ok || v != "value" {
+		t.Fatalf("LookupHandle = %v, %v", v, ok)
+	}
+	if _, ok := m.LookupHandle(key.Handle() + 2); ok {
+		t.Fatal("LookupHandle found an unmapped handle")
+	}
+}
+
+func TestHas(t *testing.T) {
+	var m mapper.Mapper
+	var buf [2]uint64
+	if m.HasPtr(unsafe.Pointer(&buf[0])) {
+		t.Fatal("HasPtr of an unmapped pointer")
+	}
+	m.MapPtrPair(unsafe.Pointer(&buf[0]), "ptr")
+	if !m.HasPtr(unsafe.Pointer(&buf[0])) {
+		t.Fatal("HasPtr did not find a mapped pointer")
+	}
+	key := m.MapValueUses("once", 1)
+	if !m.Has(key) || !m.HasHandle(key.Handle()) || !m.Has(key) {
+		t.Fatal("Has did not find a mapped key")
+	}
+	// Has does not consume the only use.
+	if m.Get(key) != "once" || m.Has(key) || m.HasHandle(key.Handle()) {
+		t.Fatal("Has found a key after its last use")
+	}
+
+	var typed mapper.MapperOf[string]
+	key = typed.MapValue("typed")
+	if !typed.Has(key) || !typed.HasHandle(key.Handle()) || typed.HasPtr(unsafe.Pointer(&buf[0])) {
+		t.Fatal("MapperOf.Has is wrong")
+	}
+}
+
+func TestWithCapacity(t *testing.T) {
+	// Debug mode allocates to record diagnostics.
+	defer mapper.SetDebug(false)()
+	m := mapper.New(mapper.WithCapacity(1000))
+	for i := 0; i < 2; i++ {
+		n := testing.AllocsPerRun(1, func() {
+			for j := 0; j < 200; j++ {
+				m.MapValue(struct{}{})
+			}
+		})
+		if n != 0 {
+			t.Fatalf("mapping into a preallocated Mapper allocates %v times", n)
+		}
+		if l := m.Len(); l != 400 {
+			t.Fatalf("Len = %d, want 400", l)
+		}
+		m.Clear()
+	}
+}
+
+func TestStorage(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []mapper.Option
+	}{
+		{"Map", nil},
+		{"Shards", []mapper.Option{mapper.WithShards(5), mapper.WithCapacity(64)}},
+		{"ReadMostly", []mapper.Option{mapper.WithReadMostly()}},
+		{"CopyOnWrite", []mapper.Option{mapper.WithCopyOnWrite()}},
+		{"TypePartitions", []mapper.Option{mapper.WithTypePartitions()}},
+		{"SlotTable", []mapper.Option{mapper.WithSlotTable()}},
+		{"SlotTableObfuscated", []mapper.Option{
+			mapper.WithSlotTable(), mapper.WithHandleVersion(3), mapper.WithObfuscatedHandles(),
+		}},
+		{"SlotTableHighBit", []mapper.Option{
+			mapper.WithSlotTable(), mapper.WithHighCountingBit(), mapper.WithObfuscatedHandles(),
+		}},
+		{"SlotTableGenerations", []mapper.Option{
+			mapper.WithSlotTable(), mapper.WithGenerationBits(4), mapper.WithHandleVersion(2),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testStorage(t, mapper.New(tc.opts...))
+		})
+	}
+}
+
+func testStorage(t *testing.T, m *mapper.Mapper) {
+	keys := make([]mapper.Key, 100)
+	for i := range keys {
+		keys[i] = m.MapValue(i)
+	}
+	var buf [2]uint64
+	pkey := m.MapPtrPair(unsafe.Pointer(&buf[0]), "ptr")
+	// A token key equal to the handle of a counting key.
+	tkey := mapper.KeyFromUint(uint64(keys[0].Handle()), 1)
+	m.MapPair(tkey, "token")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				i := n % len(keys)
+				if got := m.Get(keys[i]); got != i {
+					t.Errorf("Get = %v, want %d", got, i)
+					return
+				}
+				m.Delete(m.MapValue(n))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := m.GetPtr(unsafe.Pointer(&buf[0])); got != "ptr" {
+		t.Fatalf("GetPtr = %v", got)
+	}
+	if got, ok := mapper.LookupAs[string](m, tkey); !ok || got != "token" {
+		t.Fatalf("LookupAs token key = %v, %v", got, ok)
+	}
+	if s := m.Stats(); s.Live != len(keys)+2 || s.Mapped != uint64(len(keys)+2+4000) {
+		t.Fatalf("stats = %+v", s)
+	}
+	if n := len(m.Snapshot().Entries); n != len(keys)+2 {
+		t.Fatalf("snapshot has %d entries", n)
+	}
+	m.Delete(pkey)
+	if m.Has(pkey) {
+		t.Fatal("deleted pointer key still mapped")
+	}
+	m.Delete(tkey)
+	if m.Has(tkey) || m.Get(keys[0]) != 0 {
+		t.Fatal("deleting the token key deleted the wrong mapping")
+	}
+	m.Clear()
+	if _, ok := m.Lookup(keys[0]); ok || m.Len() != 0 {
+		t.Fatal("mappings survived Clear")
+	}
+	if key := m.MapValue("again"); m.Get(key) != "again" {
+		t.Fatal("mapping after Clear not found")
+	}
+}
+
+func TestPop(t *testing.T) {
+	var m mapper.Mapper
+	key := m.MapValue("once")
+	deleted := false
+	m.OnDelete(key, func() { deleted = true })
+	if v, ok := m.Pop(key); !ok || v != "once" || !deleted {
+		t.Fatalf("Pop = %v, %v; OnDelete ran: %v", v, ok, deleted)
+	}
+	if v, ok := m.Pop(key); ok {
+		t.Fatalf("second Pop = %v", v)
+	}
+	if s := m.Stats(); s.Live != 0 || s.Deleted != 1 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	// Only one of many concurrent Pops succeeds.
+	key = m.MapValue("racy")
+	var popped int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := m.Pop(key); ok {
+				atomic.AddInt32(&popped, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if popped != 1 {
+		t.Fatalf("%d Pops succeeded", popped)
+	}
+
+	var typed mapper.MapperOf[int]
+	key = typed.MapValue(7)
+	if v, ok := typed.Pop(key); !ok || v != 7 {
+		t.Fatalf("MapperOf.Pop = %v, %v", v, ok)
+	}
+	if _, ok := typed.Lookup(key); ok {
+		t.Fatal("popped key still mapped")
+	}
+}
+
+func TestPopConcurrent(t *testing.T) {
+	// Goroutines racing to pop the same keys each clean up the values they
+	// pop, as closing a channel twice panics.
+	var m mapper.Mapper
+	keys := make([]mapper.Key, 1000)
+	for i := range keys {
+		keys[i] = m.MapValue(make(chan int))
+	}
+	popped := make([]int32, len(keys))
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := range keys {
+				i := (n + g*len(keys)/8) % len(keys)
+				v, ok := m.Pop(keys[i])
+				if !ok {
+					continue
+				}
+				close(v.(chan int))
+				atomic.AddInt32(&popped[i], 1)
+				if m.Has(keys[i]) {
+					t.Errorf("key %d still mapped after Pop", i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	for i, n := range popped {
+		if n != 1 {
+			t.Fatalf("key %d popped %d times", i, n)
+		}
+	}
+	if s := m.Stats(); s.Live != 0 || s.Deleted != uint64(len(keys)) {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
+
+func TestLen(t *testing.T) {
+	var m mapper.Mapper
+	ns := m.Namespace("ns")
+	if m.Len() != 0 || ns.Len() != 0 {
+		t.Fatal("new mapper is not empty")
+	}
+	key := m.MapValue(1)
+	ns.MapValue(2)
+	if m.Len() != 2 || ns.Len() != 1 {
+		t.Fatalf("Len = %d, namespace Len = %d", m.Len(), ns.Len())
+	}
+	m.Delete(key)
+	if m.Len() != 1 {
+		t.Fatalf("Len after Delete = %d", m.Len())
+	}
+
+	var typed mapper.MapperOf[int]
+	typed.MapValue(1)
+	if typed.Len() != 1 {
+		t.Fatalf("MapperOf.Len = %d", typed.Len())
+	}
+}
+
+func TestKeys(t *testing.T) {
+	var m mapper.Mapper
+	ns := m.Namespace("ns")
+	a := m.MapValue(1)
+	b := ns.MapValue(2)
+	c := mapper.KeyFromHandle(0x1000)
+	m.MapPair(c, 3)
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []mapper.Key{a, b, c}) {
+		t.Fatalf("Keys = %v", keys)
+	}
+	if keys := ns.Keys(); !reflect.DeepEqual(keys, []mapper.Key{b}) {
+		t.Fatalf("namespace Keys = %v", keys)
+	}
+
+	ordered := mapper.New(mapper.WithInsertionOrder())
+	c = mapper.KeyFromHandle(0x1000)
+	ordered.MapPair(c, 1)
+	a = ordered.MapValue(2)
+	if keys := ordered.Keys(); !reflect.DeepEqual(keys, []mapper.Key{c, a}) {
+		t.Fatalf("ordered Keys = %v", keys)
+	}
+	if keys := mapper.New().Keys(); len(keys) != 0 {
+		t.Fatalf("Keys of empty mapper = %v", keys)
+	}
+}
+
+func TestRange(t *testing.T) {
+	var m mapper.Mapper
+	ns := m.Namespace("ns")
+	a := m.MapValue("a")
+	b := ns.MapValue("b")
+	m.MapValue("c")
+
+	var got []interface{}
+	m.Range(func(key mapper.Key, v interface{}) bool {
+		got = append(got, v)
+		// Ranging does not hold the lock.
+		m.Delete(key)
+		return key != b
+	})
+	if !reflect.DeepEqual(got, []interface{}{"a", "b"}) {
+		t.Fatalf("Range visited %v", got)
+	}
+	if _, ok := m.Lookup(a); ok || m.Len() != 1 {
+		t.Fatalf("Range did not stop: %d left", m.Len())
+	}
+
+	ns.MapValue("d")
+	got = nil
+	ns.Range(func(_ mapper.Key, v interface{}) bool {
+		got = append(got, v)
+		return true
+	})
+	if !reflect.DeepEqual(got, []interface{}{"d"}) {
+		t.Fatalf("namespace Range visited %v", got)
+	}
+}
+
+func TestGetOrMap(t *testing.T) {
+	var m mapper.Mapper
+	key := mapper.KeyFromHandle(0x1000)
+	if v, loaded := m.GetOrMap(key, "first"); loaded || v != "first" {
+		t.Fatalf("GetOrMap of unmapped key = %v, %v", v, loaded)
+	}
+	if v, loaded := m.GetOrMap(key, "second"); !loaded || v != "first" {
+		t.Fatalf("GetOrMap of mapped key = %v, %v", v, loaded)
+	}
+
+	// Concurrent callers agree on a single value.
+	key = mapper.KeyFromHandle(0x2000)
+	actual := make([]interface{}, 8)
+	var wg sync.WaitGroup
+	for i := range actual {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			actual[i], _ = m.GetOrMap(key, i)
+		}(i)
+	}
+	wg.Wait()
+	for _, v := range actual {
+		if v != actual[0] || v != m.Get(key) {
+			t.Fatalf("GetOrMap results differ: %v", actual)
+		}
+	}
+	if s := m.Stats(); s.Mapped != 2 {
+		t.Fatalf("GetOrMap made %d mappings", s.Mapped)
+	}
+
+	var typed mapper.MapperOf[int]
+	if v, loaded := typed.GetOrMap(key, 1); loaded || v != 1 {
+		t.Fatalf("MapperOf.GetOrMap = %v, %v", v, loaded)
+	}
+	if v, loaded := typed.GetOrMap(key, 2); !loaded || v != 1 {
+		t.Fatalf("MapperOf.GetOrMap = %v, %v", v, loaded)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	var m mapper.Mapper
+	key := mapper.KeyFromHandle(0x1000)
+	if old, existed := m.Swap(key, "v1"); existed || old != nil {
+		t.Fatalf("Swap of unmapped key = %v, %v", old, existed)
+	}
+	replaced := false
+	m.OnDelete(key, func() { replaced = true })
+	if old, existed := m.Swap(key, "v2"); !existed || old != "v1" || !replaced {
+		t.Fatalf("Swap = %v, %v; OnDelete ran: %v", old, existed, replaced)
+	}
+	if m.Get(key) != "v2" {
+		t.Fatal("Swap did not map the new value")
+	}
+
+	var typed mapper.MapperOf[int]
+	typed.Swap(key, 1)
+	if old, existed := typed.Swap(key, 2); !existed || old != 1 || typed.Get(key) != 2 {
+		t.Fatalf("MapperOf.Swap = %v, %v", old, existed)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	var m mapper.Mapper
+	key := m.MapValue("idle")
+	if m.CompareAndSwap(key, "running", "stopped") {
+		t.Fatal("swapped a different value")
+	}
+	if !m.CompareAndSwap(key, "idle", "running") || m.Get(key) != "running" {
+		t.Fatal("CompareAndSwap did not swap the current value")
+	}
+	if m.CompareAndSwap(mapper.KeyFromHandle(0x1000), nil, "x") {
+		t.Fatal("swapped an unmapped key")
+	}
+
+	// Of many concurrent swaps from the same value, one succeeds.
+	var swapped int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if m.CompareAndSwap(key, "running", i) {
+				atomic.AddInt32(&swapped, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if swapped != 1 {
+		t.Fatalf("%d swaps succeeded", swapped)
+	}
+
+	var typed mapper.MapperOf[int]
+	key = typed.MapValue(1)
+	if mapper.CompareAndSwapOf(&typed, key, 2, 3) || !mapper.CompareAndSwapOf(&typed, key, 1, 3) || typed.Get(key) != 3 {
+		t.Fatal("CompareAndSwapOf failed")
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	var m mapper.Mapper
+	key := mapper.KeyFromHandle(0x1000)
+	m.MapPair(key, "first registration")
+	deleted := 0
+	m.OnDelete(key, func() { deleted++ })
+
+	// A racing registration maps the key again before teardown.
+	m.MapPair(key, "second registration")
+	if m.CompareAndDelete(key, "first registration") {
+		t.Fatal("deleted a remapped key")
+	}
+	if !m.CompareAndDelete(key, "second registration") || m.Len() != 0 {
+		t.Fatal("CompareAndDelete did not delete the current value")
+	}
+	if m.CompareAndDelete(key, "second registration") {
+		t.Fatal("deleted an unmapped key")
+	}
+	if deleted != 1 {
+		t.Fatalf("OnDelete ran %d times", deleted)
+	}
+
+	var typed mapper.MapperOf[int]
+	key = typed.MapValue(1)
+	if mapper.CompareAndDeleteOf(&typed, key, 2) || !mapper.CompareAndDeleteOf(&typed, key, 1) || typed.Len() != 0 {
+		t.Fatal("CompareAndDeleteOf failed")
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mapperhttp serves a mapper.Mapper's live mappings over HTTP, for
+// inspection using the mapperctl command.
+//
+// Importing the package registers handlers for the global mapper.G at
+// /debug/mapper, and its statistics at /debug/mapper/stats, on
+// http.DefaultServeMux, in the manner of net/http/pprof:
+//
+//	import _ "go.jpap.org/mapper/mapperhttp"
+//
+// Use Handler and StatsHandler to serve another Mapper.
+package mapperhttp // go.jpap.org/mapper/mapperhttp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.jpap.org/mapper"
+)
+
+func init() {
+	http.Handle("/debug/mapper", Handler(&mapper.G))
+	http.Handle("/debug/mapper/stats", StatsHandler(&mapper.G))
+}
+
+// Handler returns an HTTP handler that responds with a dump of m, as written
+// by (*mapper.Mapper).Dump.  The namespace query parameter, if given, limits
+// the dump to the mappings of the named Namespace, responding with 404 Not
+// Found if there is none; the handler does not create namespaces.
+func Handler(m *mapper.Mapper) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dump := m.Dump
+		if name := r.URL.Query().Get("namespace"); name != "" {
+			ns, ok := m.LookupNamespace(name)
+			if !ok {
+				http.Error(w, "unknown namespace: "+name, http.StatusNotFound)
+				return
+			}
+			dump = ns.Dump
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if err := dump(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// StatsHandler returns an HTTP handler that responds with the JSON encoding
+// of m's Stats, for collection by metrics systems.  Latencies are in
+// nanoseconds, and are only recorded by a Mapper created using
+// mapper.WithLatencyMetrics.
+func StatsHandler(m *mapper.Mapper) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if err := json.NewEncoder(w).Encode(m.Stats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
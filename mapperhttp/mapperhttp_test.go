@@ -0,0 +1,73 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapperhttp_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/mapperhttp"
+)
+
+func TestHandler(t *testing.T) {
+	var m mapper.Mapper
+	key := m.MapValue(struct{}{})
+
+	rec := httptest.NewRecorder()
+	mapperhttp.Handler(&m).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/mapper", nil))
+
+	s, err := mapper.ReadDump(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Entries) != 1 || s.Entries[0].Handle != key.Handle() {
+		t.Fatalf("unexpected snapshot: %+v", s)
+	}
+}
+
+func TestHandlerNamespace(t *testing.T) {
+	var m mapper.Mapper
+	key := m.Namespace("decoders").MapValue(struct{}{})
+	m.MapValue(struct{}{})
+
+	rec := httptest.NewRecorder()
+	mapperhttp.Handler(&m).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/mapper?namespace=decoders", nil))
+	s, err := mapper.ReadDump(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Entries) != 1 || s.Entries[0].Handle != key.Handle() {
+		t.Fatalf("unexpected snapshot: %+v", s)
+	}
+
+	// Unknown namespaces are not found, rather than created.
+	rec = httptest.NewRecorder()
+	mapperhttp.Handler(&m).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/mapper?namespace=encoders", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if _, ok := m.LookupNamespace("encoders"); ok {
+		t.Fatal("request created a namespace")
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	m := mapper.New(mapper.WithLatencyMetrics())
+	m.Get(m.MapValue(struct{}{}))
+
+	rec := httptest.NewRecorder()
+	mapperhttp.StatsHandler(m).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/mapper/stats", nil))
+
+	var s mapper.Stats
+	if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Live != 1 || s.Latency.Map.Count != 1 || s.Latency.Get.Count != 1 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
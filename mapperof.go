@@ -0,0 +1,230 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// MapperOf is a Mapper specialized to values of type T, which it stores
+// without boxing them in an interface.  Mapping a small struct then costs no
+// allocation, beyond the growth of the map, and Get needs no type assertion.
+//
+// MapperOf has its own key space, and supports only the core operations of a
+// Mapper, which it otherwise mirrors.  The zero MapperOf is ready to use.
+type MapperOf[T any] struct {
+	mux sync.RWMutex
+	m   map[Key]T
+
+	// atomicKey is as for Mapper.
+	atomicKey uintptr
+}
+
+// MapPair creates a mapping between the provided Key and Go value.
+func (mapper *MapperOf[T]) MapPair(key Key, goValue T) {
+	mapper.mux.Lock()
+	if mapper.m == nil {
+		mapper.m = make(map[Key]T)
+	}
+	mapper.m[key] = goValue
+	mapper.mux.Unlock()
+}
+
+// GetOrMap returns the Go value mapped by key, if any, and otherwise maps key
+// to goValue and returns it, under a single acquisition of the lock; loaded
+// reports whether the value was already mapped.
+func (mapper *MapperOf[T]) GetOrMap(key Key, goValue T) (actual T, loaded bool) {
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	if actual, loaded = mapper.m[key]; loaded {
+		return actual, true
+	}
+	if mapper.m == nil {
+		mapper.m = make(map[Key]T)
+	}
+	mapper.m[key] = goValue
+	return goValue, false
+}
+
+// Swap maps key to goValue, returning the Go value it replaces, if any, under
+// a single acquisition of the lock.
+func (mapper *MapperOf[T]) Swap(key Key, goValue T) (old T, existed bool) {
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	old, existed = mapper.m[key]
+	if mapper.m == nil {
+		mapper.m = make(map[Key]T)
+	}
+	mapper.m[key] = goValue
+	return
+}
+
+// CompareAndSwapOf maps key to newValue in mapper if it is mapped to a Go
+// value equal to old, and reports whether it did, under a single acquisition
+// of the lock.  It is a function, rather than a method, so that T must be a
+// comparable type.
+func CompareAndSwapOf[T comparable](mapper *MapperOf[T], key Key, old, newValue T) bool {
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	cur, ok := mapper.m[key]
+	if !ok || cur != old {
+		return false
+	}
+	mapper.m[key] = newValue
+	return true
+}
+
+// MapPtrPair is like MapPair, but maps from the given cgo pointer, and returns
+// the associated Key.
+func (mapper *MapperOf[T]) MapPtrPair(ptr unsafe.Pointer, goValue T) Key {
+	key := KeyFromPtr(ptr)
+	mapper.MapPair(key, goValue)
+	return key
+}
+
+// MapValue maps and returns a new Key for the given Go value, panicking if no
+// more keys can be allocated.
+func (mapper *MapperOf[T]) MapValue(goValue T) Key {
+	key, err := mapper.TryMapValue(goValue)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// TryMapValue is like MapValue, but returns ErrKeySpaceExhausted instead of
+// panicking when no more keys can be allocated.
+func (mapper *MapperOf[T]) TryMapValue(goValue T) (Key, error) {
+	n := atomic.AddUintptr(&mapper.atomicKey, 2)
+	// Fail on wrap-around
+	if n == 0 {
+		return Key{}, ErrKeySpaceExhausted
+	}
+	key := Key{v: n | countingPointerBit}
+	mapper.MapPair(key, goValue)
+	return key, nil
+}
+
+// Get retrieves the Go value from the given key, panicking if it is not
+// mapped.
+func (mapper *MapperOf[T]) Get(key Key) T {
+	goValue, ok := mapper.Lookup(key)
+	if !ok {
+		panic(fmt.Errorf("key not mapped: 0x%x", key.v))
+	}
+	return goValue
+}
+
+// GetPtr calls Get after first converting the given cgo pointer to a Key.
+func (mapper *MapperOf[T]) GetPtr(ptr unsafe.Pointer) T {
+	return mapper.Get(Key{v: uintptr(ptr)})
+}
+
+// GetHandle calls Get after first converting the given handle to a Key.
+func (mapper *MapperOf[T]) GetHandle(handle uintptr) T {
+	return mapper.Get(KeyFromHandle(handle))
+}
+
+// Lookup is like Get, but returns false, instead of panicking, if the key is
+// not mapped.
+func (mapper *MapperOf[T]) Lookup(key Key) (goValue T, ok bool) {
+	mapper.mux.RLock()
+	goValue, ok = mapper.m[key]
+	mapper.mux.RUnlock()
+	return
+}
+
+// LookupPtr calls Lookup after first converting the given cgo pointer to a
+// Key.
+func (mapper *MapperOf[T]) LookupPtr(ptr unsafe.Pointer) (goValue T, ok bool) {
+	return mapper.Lookup(Key{v: uintptr(ptr)})
+}
+
+// LookupHandle calls Lookup after first converting the given handle to a Key.
+func (mapper *MapperOf[T]) LookupHandle(handle uintptr) (goValue T, ok bool) {
+	return mapper.Lookup(KeyFromHandle(handle))
+}
+
+// Has reports whether key is mapped.
+func (mapper *MapperOf[T]) Has(key Key) bool {
+	mapper.mux.RLock()
+	_, ok := mapper.m[key]
+	mapper.mux.RUnlock()
+	return ok
+}
+
+// HasPtr calls Has after first converting the given cgo pointer to a Key.
+func (mapper *MapperOf[T]) HasPtr(ptr unsafe.Pointer) bool {
+	return mapper.Has(Key{v: uintptr(ptr)})
+}
+
+// HasHandle calls Has after first converting the given handle to a Key.
+func (mapper *MapperOf[T]) HasHandle(handle uintptr) bool {
+	return mapper.Has(KeyFromHandle(handle))
+}
+
+// Delete an existing mapping via the given key.
+func (mapper *MapperOf[T]) Delete(key Key) {
+	mapper.mux.Lock()
+	delete(mapper.m, key)
+	mapper.mux.Unlock()
+}
+
+// Pop retrieves the Go value from the given key, and deletes its mapping,
+// under a single acquisition of the lock, returning false if the key is not
+// mapped.
+func (mapper *MapperOf[T]) Pop(key Key) (goValue T, ok bool) {
+	mapper.mux.Lock()
+	goValue, ok = mapper.m[key]
+	if ok {
+		delete(mapper.m, key)
+	}
+	mapper.mux.Unlock()
+	return
+}
+
+// CompareAndDeleteOf deletes the mapping of key in mapper if it is mapped to a
+// Go value equal to old, and reports whether it did, under a single
+// acquisition of the lock.  It is a function, rather than a method, so that T
+// must be a comparable type.
+func CompareAndDeleteOf[T comparable](mapper *MapperOf[T], key Key, old T) bool {
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	cur, ok := mapper.m[key]
+	if !ok || cur != old {
+		return false
+	}
+	delete(mapper.m, key)
+	return true
+}
+
+// DeletePtr calls Delete after first converting the given cgo pointer to a
+// Key.
+func (mapper *MapperOf[T]) DeletePtr(ptr unsafe.Pointer) {
+	mapper.Delete(Key{v: uintptr(ptr)})
+}
+
+// DeleteHandle calls Delete after first converting the given handle to a Key.
+func (mapper *MapperOf[T]) DeleteHandle(handle uintptr) {
+	mapper.Delete(KeyFromHandle(handle))
+}
+
+// Len returns the number of live mappings.
+func (mapper *MapperOf[T]) Len() int {
+	mapper.mux.RLock()
+	defer mapper.mux.RUnlock()
+	return len(mapper.m)
+}
+
+// Clear deletes all mappings.
+func (mapper *MapperOf[T]) Clear() {
+	mapper.mux.Lock()
+	mapper.m = nil
+	atomic.StoreUintptr(&mapper.atomicKey, 0)
+	mapper.mux.Unlock()
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// InvokeMethod calls the named method of the value mapped to handle, with
+// the given arguments, returning its results.  Arguments are converted as by
+// InvokeHandle.
+//
+// It returns an error, rather than calling the method, if handle is not
+// mapped, its value has no such exported method, or the arguments do not
+// match its parameters.  Panics raised by the method are not recovered.
+func (mapper *Mapper) InvokeMethod(handle uintptr, name string, args ...interface{}) ([]interface{}, error) {
+	goValue, ok := mapper.Lookup(KeyFromHandle(handle))
+	if !ok {
+		return nil, fmt.Errorf("handle not mapped: 0x%x", handle)
+	}
+	fn := reflect.ValueOf(goValue).MethodByName(name)
+	if !fn.IsValid() {
+		return nil, fmt.Errorf("handle 0x%x is mapped to %T, without method %s", handle, goValue, name)
+	}
+	results, err := invoke(fn, args)
+	if err != nil {
+		return nil, fmt.Errorf("calling %T.%s: %w", goValue, name, err)
+	}
+	return results, nil
+}
+
+// MethodTable numbers methods by ID, for C vtables whose entry points all
+// call one exported Go callback with a handle and the ID of the entry point.
+// The callback invokes the method using Invoke:
+//
+//	var streamMethods = mapper.NewMethodTable("Read", "Write", "Close")
+//
+//	//export goStreamMethod
+//	func goStreamMethod(handle C.uintptr_t, id C.int, buf unsafe.Pointer, n C.size_t) C.int {
+//		res, err := streamMethods.Invoke(&mapper.G, uintptr(handle), int(id), buf, int(n))
+//		...
+//	}
+//
+// This suits prototyping a binding; hot entry points are better served by
+// callbacks of their own, which resolve their values using LookupAs.  The
+// methods of each type are resolved once, and cached.
+type MethodTable struct {
+	names []string
+
+	// methods holds the method index of each ID, or -1, by type.
+	mux     sync.RWMutex
+	methods map[reflect.Type][]int
+}
+
+// NewMethodTable returns a MethodTable in which ID i is the method names[i].
+func NewMethodTable(names ...string) *MethodTable {
+	return &MethodTable{
+		names:   append([]string(nil), names...),
+		methods: make(map[reflect.Type][]int),
+	}
+}
+
+// Invoke calls the method with the given ID of the value mapped to handle in
+// mapper, as InvokeMethod does.
+func (t *MethodTable) Invoke(mapper *Mapper, handle uintptr, id int, args ...interface{}) ([]interface{}, error) {
+	if id < 0 || id >= len(t.names) {
+		return nil, fmt.Errorf("method ID %d out of range [0, %d)", id, len(t.names))
+	}
+	goValue, ok := mapper.Lookup(KeyFromHandle(handle))
+	if !ok {
+		return nil, fmt.Errorf("handle not mapped: 0x%x", handle)
+	}
+	v := reflect.ValueOf(goValue)
+	i := t.methodsOf(v.Type())[id]
+	if i < 0 {
+		return nil, fmt.Errorf("handle 0x%x is mapped to %T, without method %s", handle, goValue, t.names[id])
+	}
+	results, err := invoke(v.Method(i), args)
+	if err != nil {
+		return nil, fmt.Errorf("calling %T.%s: %w", goValue, t.names[id], err)
+	}
+	return results, nil
+}
+
+// methodsOf returns the method index of each ID for values of type typ.
+func (t *MethodTable) methodsOf(typ reflect.Type) []int {
+	t.mux.RLock()
+	methods, ok := t.methods[typ]
+	t.mux.RUnlock()
+	if ok {
+		return methods
+	}
+	methods = make([]int, len(t.names))
+	for id, name := range t.names {
+		methods[id] = -1
+		if m, ok := typ.MethodByName(name); ok {
+			methods[id] = m.Index
+		}
+	}
+	t.mux.Lock()
+	t.methods[typ] = methods
+	t.mux.Unlock()
+	return methods
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Namespace groups mappings within a Mapper, so that they can be counted,
+// inspected, and cleared together.  The mappings of all namespaces share the
+// Mapper's storage and key space: a Key made through a Namespace is retrieved
+// and deleted using the Mapper's Get and Delete methods, as usual.
+//
+// Namespaces let subsystems sharing the global G be accounted for separately,
+// without each having to plumb through a Mapper of their own.
+type Namespace struct {
+	mapper *Mapper
+	name   string
+
+	// typ, if set, is the type of value expected in the namespace; see
+	// NamespaceOf.
+	typ reflect.Type
+
+	// live, mapped, and deleted are as for Stats; protected by mapper.mux.
+	live            int
+	mapped, deleted uint64
+
+	// limit holds the *rateLimiter of the namespace, if any; see
+	// SetRateLimit.
+	limit atomic.Value
+}
+
+// Namespace returns the namespace of the mapper with the given name, creating
+// it on first use.
+func (mapper *Mapper) Namespace(name string) *Namespace {
+	return mapper.namespace(name, nil)
+}
+
+// LookupNamespace returns the namespace of the mapper with the given name, if
+// it has been created, without creating it.
+func (mapper *Mapper) LookupNamespace(name string) (ns *Namespace, ok bool) {
+	mapper.mux.RLock()
+	ns, ok = mapper.namespaces[name]
+	mapper.mux.RUnlock()
+	return
+}
+
+// namespace implements Namespace, and NamespaceOf when typ is set.
+func (mapper *Mapper) namespace(name string, typ reflect.Type) *Namespace {
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	ns, ok := mapper.namespaces[name]
+	if ok && typ != nil && ns.typ != typ {
+		if ns.typ == nil {
+			panic(fmt.Errorf("namespace %q was created without a type, not %v", name, typ))
+		}
+		panic(fmt.Errorf("namespace %q was created for %v, not %v", name, ns.typ, typ))
+	}
+	if !ok {
+		ns = mapper.namespaceLocked(name, typ)
+	}
+	return ns
+}
+
+// namespaceLocked returns the namespace of the mapper with the given name,
+// creating it for values of type typ, if set, on first use.  The caller must
+// hold the write lock.
+func (mapper *Mapper) namespaceLocked(name string, typ reflect.Type) *Namespace {
+	ns, ok := mapper.namespaces[name]
+	if !ok {
+		ns = &Namespace{mapper: mapper, name: name, typ: typ}
+		if mapper.namespaces == nil {
+			mapper.namespaces = make(map[string]*Namespace)
+		}
+		mapper.namespaces[name] = ns
+	}
+	return ns
+}
+
+// Name returns the name of the namespace.
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// Mapper returns the Mapper holding the namespace.
+func (ns *Namespace) Mapper() *Mapper {
+	return ns.mapper
+}
+
+// MapPair is like Mapper.MapPair, but the mapping belongs to the namespace.
+// Replacing a mapping moves it into the namespace.
+func (ns *Namespace) MapPair(key Key, goValue interface{}) {
+	ns.mapper.checkPair(key)
+	ns.checkType(goValue)
+	if err := ns.mapper.admit(ns); err != nil {
+		panic(err)
+	}
+	ns.mapper.mapEntry(key, entry{value: ns.mapper.stored(goValue), extra: &entryExtra{ns: ns}})
+}
+
+// MapPtrPair is like Mapper.MapPtrPair, but the mapping belongs to the
+// namespace.
+func (ns *Namespace) MapPtrPair(ptr unsafe.Pointer, goValue interface{}) Key {
+	key := ns.mapper.ptrKey(ptr)
+	ns.MapPair(key, goValue)
+	return key
+}
+
+// MapValue is like Mapper.MapValue, but the mapping belongs to the namespace.
+func (ns *Namespace) MapValue(goValue interface{}) Key {
+	key, err := ns.TryMapValue(goValue)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// TryMapValue is like Mapper.TryMapValue, but the mapping belongs to the
+// namespace.
+func (ns *Namespace) TryMapValue(goValue interface{}) (Key, error) {
+	ns.checkType(goValue)
+	return ns.mapper.mapCounting(entry{value: ns.mapper.stored(goValue), extra: &entryExtra{ns: ns}})
+}
+
+// Len returns the number of live mappings in the namespace.
+func (ns *Namespace) Len() int {
+	ns.mapper.mux.RLock()
+	defer ns.mapper.mux.RUnlock()
+	return ns.live
+}
+
+// Stats returns a consistent snapshot of the namespace's statistics.
+func (ns *Namespace) Stats() Stats {
+	ns.mapper.mux.RLock()
+	defer ns.mapper.mux.RUnlock()
+	return Stats{
+		Live:    ns.live,
+		Mapped:  ns.mapped,
+		Deleted: ns.deleted,
+	}
+}
+
+// Snapshot returns a description of the namespace's live mappings.
+func (ns *Namespace) Snapshot() *Snapshot {
+	return ns.mapper.snapshot(ns)
+}
+
+// Dump is like Mapper.Dump, but only includes the namespace's mappings.
+func (ns *Namespace) Dump(w io.Writer) error {
+	return json.NewEncoder(w).Encode(ns.Snapshot())
+}
+
+// Clear deletes all mappings in the namespace, leaving others in the Mapper
+// untouched.  Functions registered by OnDelete are called in teardown order;
+// see SetTeardownPriority.
+func (ns *Namespace) Clear() {
+	ns.mapper.clearWhere(func(_ Key, e entry) bool {
+		return e.ns() == ns
+	})
+}
+
+// added records a new mapping in ns, which may be nil.  The caller must hold
+// the Mapper's write lock.
+func (ns *Namespace) added() {
+	if ns != nil {
+		ns.live++
+		ns.mapped++
+	}
+}
+
+// removed records the removal of a mapping from ns, which may be nil.  The
+// caller must hold the Mapper's write lock.
+func (ns *Namespace) removed() {
+	if ns != nil {
+		ns.live--
+		ns.deleted++
+	}
+}
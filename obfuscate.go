@@ -0,0 +1,130 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"sync"
+)
+
+// WithObfuscatedHandles permutes the handles of keys returned by MapValue,
+// and its variants, using a random secret chosen once per process, so that
+// handles leaked into logs, or crafted by untrusted native plugins, cannot be
+// guessed or enumerated from one another.  Handles still carry the
+// counting-pointer bit, clear any reserved bits, and respect handle limits
+// such as With32BitHandles.
+//
+// The handles of a KeyRange are then no longer consecutive, and C code must
+// be given each handle, rather than compute it from Base and Stride.
+//
+// Handles are obfuscated only to frustrate guessing; the permutation is not
+// cryptographically strong.  Obfuscation is off by default, as it makes
+// handles harder to follow while debugging.
+func WithObfuscatedHandles() Option {
+	return func(mapper *Mapper) {
+		mapper.obfuscated = true
+	}
+}
+
+// obfuscation is a keyed permutation of counting-pointer handles.  The bits
+// of a handle above shift, limited by mask, are permuted, leaving the
+// counting-pointer and reserved bits below shift unchanged.  The zero
+// obfuscation leaves handles unchanged.
+type obfuscation struct {
+	shift uint
+	mask  uintptr
+}
+
+// obfuscation returns the Mapper's permutation of handles.
+func (mapper *Mapper) obfuscation() obfuscation {
+	if !mapper.obfuscated {
+		return obfuscation{}
+	}
+	shift := mapper.reservedBits + 1
+	return obfuscation{shift: shift, mask: mapper.countingMax() >> shift}
+}
+
+// handle obfuscates the counting-pointer handle v.
+func (o obfuscation) handle(v uintptr) uintptr {
+	if o.mask == 0 {
+		return v
+	}
+	low := v & (1<<o.shift - 1)
+	return o.permute(v>>o.shift)<<o.shift | low
+}
+
+// plain reverses handle.
+func (o obfuscation) plain(v uintptr) uintptr {
+	if o.mask == 0 {
+		return v
+	}
+	low := v & (1<<o.shift - 1)
+	return o.unpermute(v>>o.shift&o.mask)<<o.shift | low
+}
+
+// The permutation of x, limited to the bits of mask, which is 2^w - 1,
+// alternates keyed XOR, multiplication by an odd number, and an XOR-shift by
+// half the width; each of which is invertible modulo 2^w.
+
+func (o obfuscation) permute(x uintptr) uintptr {
+	s := obfuscationSecret()
+	half := uint(bits.Len(uint(o.mask))+1) / 2
+	x = (x ^ s.xor[0]) * s.mul[0] & o.mask
+	x ^= x >> half
+	x = x * s.mul[1] & o.mask
+	x ^= x >> half
+	return (x ^ s.xor[1]) & o.mask
+}
+
+func (o obfuscation) unpermute(x uintptr) uintptr {
+	s := obfuscationSecret()
+	half := uint(bits.Len(uint(o.mask))+1) / 2
+	x = (x ^ s.xor[1]) & o.mask
+	x ^= x >> half
+	x = x * s.inv[1] & o.mask
+	x ^= x >> half
+	return (x*s.inv[0] ^ s.xor[0]) & o.mask
+}
+
+// secret is the per-process key of the handle permutation.
+type secret struct {
+	xor, mul, inv [2]uintptr
+}
+
+var (
+	secretOnce sync.Once
+	theSecret  secret
+)
+
+// obfuscationSecret returns the per-process secret, choosing it on first
+// use.
+func obfuscationSecret() *secret {
+	secretOnce.Do(func() {
+		var b [32]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		for i := 0; i < 2; i++ {
+			theSecret.xor[i] = uintptr(binary.LittleEndian.Uint64(b[16*i:]))
+			theSecret.mul[i] = uintptr(binary.LittleEndian.Uint64(b[16*i+8:])) | 1
+			theSecret.inv[i] = inverse(theSecret.mul[i])
+		}
+	})
+	return &theSecret
+}
+
+// inverse returns the multiplicative inverse of the odd number a, modulo
+// 2^n for any n up to the size of a uintptr.
+func inverse(a uintptr) uintptr {
+	// Newton's method doubles the number of correct low bits each step,
+	// starting from the three bits that a is its own inverse for.
+	x := a
+	for i := 0; i < 5; i++ {
+		x *= 2 - a*x
+	}
+	return x
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "fmt"
+
+// Option configures a Mapper created by New.
+type Option func(*Mapper)
+
+// New returns a new Mapper, configured with the given options.  A zero Mapper
+// is ready to use, and is equivalent to New called without options.
+func New(opts ...Option) *Mapper {
+	mapper := &Mapper{}
+	for _, opt := range opts {
+		opt(mapper)
+	}
+	if mapper.newStorage != nil || mapper.capacity != 0 {
+		mapper.m = mapper.makeStorage()
+	}
+	return mapper
+}
+
+// With32BitHandles limits all handles to 32 bits, for use with C APIs that
+// store the user pointer in a 32-bit field.  The number of keys returned by
+// MapValue is then limited to 2,147,483,648 on all platforms, and MapPair
+// panics when given a key that does not fit in 32 bits.
+func With32BitHandles() Option {
+	return func(mapper *Mapper) {
+		mapper.maxHandle = uintptr(^uint32(0))
+	}
+}
+
+// maxReservedBits limits WithReservedBits, keeping a useful key space.
+const maxReservedBits = 8
+
+// WithReservedBits reserves the n low bits of each handle for use by C APIs
+// that store their own flags in the low bits of user pointers.
+//
+// Keys returned by MapValue have the reserved bits cleared, and pointers
+// passed to MapPtrPair must be aligned to 2^(n+1) bytes; that is, the
+// reserved bits and the counting-pointer bit above them must be zero.  The
+// reserved bits are masked off handles passed to Get, Lookup, Delete, and
+// their variants, so that a handle returned by C with flags set still
+// resolves to its mapping.  n is limited to 8.
+func WithReservedBits(n uint) Option {
+	if n > maxReservedBits {
+		panic(fmt.Errorf("too many reserved bits: %d", n))
+	}
+	return func(mapper *Mapper) {
+		mapper.reservedBits = n
+	}
+}
+
+// WithHighCountingBit marks the keys returned by MapValue, and its variants,
+// using the top bit of the handle space, rather than the low bit, so that
+// MapPtrPair, GetPtr, and DeletePtr accept pointers that are not 2-byte
+// aligned, such as pointers into the packed buffers of some C APIs.  Such
+// pointers must not set the top bit, which user-space addresses leave clear
+// on common 64-bit platforms; using With32BitHandles, or WithCompactHandles,
+// the top bit is that of the limited handle.  KeyFromPtr still requires
+// aligned pointers.
+//
+// The handles of keys returned by MapValue are then large, and not just odd,
+// numbers.
+func WithHighCountingBit() Option {
+	return func(mapper *Mapper) {
+		mapper.highBit = true
+	}
+}
+
+// WithCompactHandles limits all handles to 16 bits, for C APIs whose user
+// field is only 16 bits wide, such as some RTOS and driver callback tables.
+//
+// Keys deleted from the Mapper are recycled, but at most 32,767 keys can be
+// mapped by MapValue at once; thereafter TryMapValue returns
+// ErrKeySpaceExhausted, and MapValue panics.  MapPair panics when given a key
+// that does not fit in 16 bits, which rules out cgo pointers.
+func WithCompactHandles() Option {
+	return func(mapper *Mapper) {
+		mapper.maxHandle = 0xffff
+		mapper.recycle = true
+	}
+}
+
+// WithKeyRecycling reuses the keys of deleted mappings for new keys returned
+// by MapValue, and its variants, so that a long-running process cannot
+// exhaust the key space, as can happen on 32-bit platforms, or using
+// With32BitHandles; TryMapValue then returns ErrKeySpaceExhausted only while
+// the whole key space is mapped.  Deleted keys are held in a free list, and
+// reused most recently deleted first.
+//
+// A stale handle, used by C after its mapping is deleted, may resolve to the
+// mapping of a recycled key.
+func WithKeyRecycling() Option {
+	return func(mapper *Mapper) {
+		mapper.recycle = true
+	}
+}
+
+// WithExcludedHandles declares handles that the Mapper never uses, such as
+// sentinel values of a C API, like MAP_FAILED, or ^uintptr(0).  Keys returned
+// by MapValue, and its variants, skip the excluded handles, and MapPair
+// panics when given one.  The zero handle is never used, and need not be
+// excluded.
+func WithExcludedHandles(handles ...uintptr) Option {
+	return func(mapper *Mapper) {
+		if mapper.excluded == nil {
+			mapper.excluded = make(map[uintptr]bool)
+		}
+		for _, h := range handles {
+			mapper.excluded[h] = true
+		}
+	}
+}
+
+// WithTypePartitions partitions the Mapper's mappings by the dynamic type of
+// their values.  Each partition has its own lock, so that LookupAs, which
+// consults only the partition of its type, neither contends with lookups of
+// other types, nor needs a type assertion to verify the mapped value.
+// TypeStats and SnapshotType report on a single partition.
+//
+// Mapping and deleting are slightly more expensive, as each updates both the
+// Mapper and a partition.
+func WithTypePartitions() Option {
+	return func(mapper *Mapper) {
+		mapper.partitioned = true
+	}
+}
+
+// WithMonotonicKeys preserves the counter used by MapValue across Clear, so
+// that a handle obtained before Clear, and used after it by mistake, never
+// resolves to a newer mapping.  Keys are then only reused by a mapper that
+// recycles deleted keys, such as one created using WithKeyRecycling, which
+// recycles the keys of mappings removed by Clear as it does deleted keys.
+func WithMonotonicKeys() Option {
+	return func(mapper *Mapper) {
+		mapper.monotonic = true
+	}
+}
+
+// WithInsertionOrder orders the mappings described by Snapshot, and its
+// variants, by when their keys were first mapped, oldest first, rather than
+// by handle.  Replacing the mapping of a key keeps its place.
+//
+// Iterating in a deterministic order matters when wrapped C objects depend on
+// one another, such as children that must be destroyed before their parents.
+func WithInsertionOrder() Option {
+	return func(mapper *Mapper) {
+		mapper.ordered = true
+	}
+}
+
+// WithCopyOnMap stores a copy of each value mapped, so that later changes to
+// the original, for example, to a configuration passed to long-lived C
+// callbacks, cannot change what the callbacks observe.  Get returns the
+// stored copy.
+//
+// A Go value is already copied when mapped, except for what it refers to.
+// A shallow copy also copies the target of a pointer, and the elements of a
+// slice or map, one level deep.  A deep copy copies everything reachable
+// from the value, including unexported struct fields, preserving shared
+// references and cycles; channels, functions, and unsafe pointers are
+// shared, not copied.
+//
+// Values mapped by MapBytes are never copied.
+func WithCopyOnMap(deep bool) Option {
+	return func(mapper *Mapper) {
+		if deep {
+			mapper.copyMode = copyDeep
+		} else {
+			mapper.copyMode = copyShallow
+		}
+	}
+}
+
+// WithCapacity preallocates room for n mappings, so that a Mapper expected to
+// hold many at once, such as one per network connection, does not pause to
+// grow its storage under load.  The storage is again preallocated after
+// Clear.
+func WithCapacity(n int) Option {
+	if n < 0 {
+		panic(fmt.Errorf("negative capacity: %d", n))
+	}
+	return func(mapper *Mapper) {
+		mapper.capacity = n
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// WithOwnershipWarnings calls warn, in debug mode, when a mapping is deleted
+// by a goroutine other than the one that created it.  Mappings are often
+// owned by the goroutine that creates them, and deletion elsewhere can hint
+// at confusion over ownership, which underlies many leaks and double frees.
+// If warn is nil, warnings are logged using the log package.
+//
+// See Orphans to find live mappings whose creating goroutine has exited.
+func WithOwnershipWarnings(warn func(msg string)) Option {
+	if warn == nil {
+		warn = func(msg string) { log.Print(msg) }
+	}
+	return func(mapper *Mapper) {
+		mapper.ownerWarn = warn
+	}
+}
+
+// goid returns the ID of the calling goroutine.  It is slow, and is only
+// used in debug mode.
+func goid() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// liveGoroutines returns the IDs of all live goroutines.
+func liveGoroutines() map[uint64]bool {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	live := make(map[uint64]bool)
+	prefix := []byte("goroutine ")
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		if !bytes.HasPrefix(line, prefix) {
+			continue
+		}
+		line = line[len(prefix):]
+		if i := bytes.IndexByte(line, ' '); i > 0 {
+			line = line[:i]
+		}
+		if id, err := strconv.ParseUint(string(line), 10, 64); err == nil {
+			live[id] = true
+		}
+	}
+	return live
+}
+
+// checkOwner warns if the calling goroutine did not create e.  The caller
+// must not hold the lock.
+func (mapper *Mapper) checkOwner(key Key, e entry) {
+	d := e.diag()
+	if !debug.has(debugStacks) || mapper.ownerWarn == nil || d == nil {
+		return
+	}
+	if id := goid(); id != d.goid {
+		mapper.ownerWarn(fmt.Sprintf("mapper: key 0x%x created by goroutine %d, deleted by goroutine %d",
+			key.v, d.goid, id))
+	}
+}
+
+// Orphans returns a Snapshot of the live mappings whose creating goroutine
+// has exited.  Goroutines are only recorded in debug mode; otherwise the
+// snapshot is empty.
+func (mapper *Mapper) Orphans() *Snapshot {
+	s := &Snapshot{Time: time.Now()}
+	if !debug.has(debugStacks) {
+		return s
+	}
+	live := liveGoroutines()
+	mapper.mux.RLock()
+	mapper.eachLocked(func(key Key, e entry) bool {
+		if d := e.diag(); d != nil && !live[d.goid] {
+			s.Entries = append(s.Entries, snapshotEntry(key, e))
+		}
+		return true
+	})
+	mapper.mux.RUnlock()
+
+	sort.Slice(s.Entries, func(i, j int) bool {
+		return s.Entries[i].Handle < s.Entries[j].Handle
+	})
+	return s
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// partition holds the mappings of a single type; see WithTypePartitions.
+type partition struct {
+	mux sync.RWMutex
+	m   keyMap
+
+	// mapped and deleted are as for Stats; protected by the Mapper's mux.
+	mapped, deleted uint64
+}
+
+// partitionOf returns the partition for typ, creating it if create is set.
+func (mapper *Mapper) partitionOf(typ reflect.Type, create bool) *partition {
+	if p, ok := mapper.parts.Load(typ); ok {
+		return p.(*partition)
+	}
+	if !create {
+		return nil
+	}
+	p, _ := mapper.parts.LoadOrStore(typ, &partition{})
+	return p.(*partition)
+}
+
+// partition adds or replaces the mapping of key to e in the partition for the
+// type of its value.  The caller must hold the Mapper's write lock.
+func (mapper *Mapper) partition(key Key, e entry) {
+	p := mapper.partitionOf(e.valueType(), true)
+	p.mux.Lock()
+	if _, ok := p.m.load(key); !ok {
+		p.mapped++
+	}
+	p.m.store(key, e, 0)
+	p.mux.Unlock()
+}
+
+// unpartition removes the mapping of key to e from the partition for the type
+// of its value.  The caller must hold the Mapper's write lock.
+func (mapper *Mapper) unpartition(key Key, e entry) {
+	p := mapper.partitionOf(e.valueType(), false)
+	p.mux.Lock()
+	p.m.delete(key)
+	p.mux.Unlock()
+	p.deleted++
+}
+
+// clearPartitions empties all partitions.  The caller must hold the Mapper's
+// write lock.
+func (mapper *Mapper) clearPartitions() {
+	mapper.parts.Range(func(_, v interface{}) bool {
+		p := v.(*partition)
+		p.mux.Lock()
+		p.deleted += uint64(p.m.len())
+		p.m = keyMap{}
+		p.mux.Unlock()
+		return true
+	})
+}
+
+// LookupAs is like Lookup, but only succeeds if the mapped value is of type
+// T.  When the mapper was created using WithTypePartitions, and T is not an
+// interface type, only the partition for T is consulted.  In debug mode,
+// LookupAs panics if the key belongs to a namespace whose values cannot be a
+// T; see NamespaceOf.
+func LookupAs[T any](mapper *Mapper, key Key) (goValue T, ok bool) {
+	if debug.has(debugValidate) {
+		mapper.checkExpected(key, typeOf[T]())
+	}
+	if mapper.partitioned {
+		if mapper.profile != nil {
+			mapper.profile.sample()
+		}
+		typ := reflect.TypeOf(&goValue).Elem()
+		if typ.Kind() != reflect.Interface {
+			p := mapper.partitionOf(typ, false)
+			if p == nil {
+				return goValue, false
+			}
+			key = mapper.canonical(key)
+			p.mux.RLock()
+			e, ok := p.m.load(key)
+			p.mux.RUnlock()
+			if !ok || e.uses != nil && !mapper.use(key, e) {
+				return goValue, false
+			}
+			if debug.has(debugStacks) {
+				e.diag().got()
+			}
+			return entryAs[T](e)
+		}
+	}
+	e, ok := mapper.lookupEntry(key)
+	if !ok {
+		return goValue, false
+	}
+	return entryAs[T](e)
+}
+
+// TypeStats returns the statistics of each partition of a mapper created
+// using WithTypePartitions, by type name, as formatted by the %T verb.  It
+// returns nil for other mappers.
+func (mapper *Mapper) TypeStats() map[string]Stats {
+	if !mapper.partitioned {
+		return nil
+	}
+	mapper.mux.RLock()
+	defer mapper.mux.RUnlock()
+	stats := make(map[string]Stats)
+	mapper.parts.Range(func(k, v interface{}) bool {
+		p := v.(*partition)
+		stats[typeName(k.(reflect.Type))] = Stats{
+			Live:    p.m.len(),
+			Mapped:  p.mapped,
+			Deleted: p.deleted,
+		}
+		return true
+	})
+	return stats
+}
+
+// SnapshotType is like Snapshot, but only describes the mappings whose values
+// have the given type.  For a mapper created using WithTypePartitions, only
+// the type's partition is consulted.
+func (mapper *Mapper) SnapshotType(typ reflect.Type) *Snapshot {
+	if !mapper.partitioned {
+		s := mapper.Snapshot()
+		name := typeName(typ)
+		entries := s.Entries[:0]
+		for _, e := range s.Entries {
+			if e.Type == name {
+				entries = append(entries, e)
+			}
+		}
+		s.Entries = entries
+		return s
+	}
+
+	s := &Snapshot{Time: time.Now()}
+	if p := mapper.partitionOf(typ, false); p != nil {
+		p.mux.RLock()
+		s.Entries = make([]SnapshotEntry, 0, p.m.len())
+		p.m.each(func(key Key, e entry) bool {
+			s.Entries = append(s.Entries, snapshotEntry(key, e))
+			return true
+		})
+		p.mux.RUnlock()
+	}
+	mapper.sortSnapshot(s)
+	return s
+}
+
+// typeName returns the name of typ as formatted by the %T verb.
+func typeName(typ reflect.Type) string {
+	if typ == nil {
+		return "<nil>"
+	}
+	return typ.String()
+}
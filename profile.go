@@ -0,0 +1,98 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// maxSampleDepth limits the frames recorded for each sampled Get.
+const maxSampleDepth = 16
+
+// WithGetSampling records the call stack of one in every n retrievals by
+// Get, Lookup, and their variants, for GetProfile to report the hottest
+// paths resolving handles.  Those callbacks may benefit the most from
+// caching their values, or from a Mapper of their own.  Sampling costs an
+// atomic increment for each retrieval, and a stack walk for each sample.
+func WithGetSampling(n int) Option {
+	return func(mapper *Mapper) {
+		if n > 0 {
+			mapper.profile = &getProfile{every: uint64(n)}
+		}
+	}
+}
+
+// GetSample is a call path retrieving values from a Mapper, as reported by
+// GetProfile.
+type GetSample struct {
+	// Samples is the number of retrievals sampled on the path, and Estimate
+	// is the estimated total number of retrievals on the path.
+	Samples  int
+	Estimate uint64
+
+	// Stack is the call stack, omitting the frames of this package.
+	Stack string
+}
+
+// GetProfile returns the call paths sampled by a Mapper created using
+// WithGetSampling, hottest first.  It returns nil for other mappers.
+func (mapper *Mapper) GetProfile() []GetSample {
+	p := mapper.profile
+	if p == nil {
+		return nil
+	}
+	p.mux.Lock()
+	samples := make([]GetSample, 0, len(p.stacks))
+	for stack, n := range p.stacks {
+		depth := 0
+		for depth < len(stack) && stack[depth] != 0 {
+			depth++
+		}
+		samples = append(samples, GetSample{
+			Samples:  n,
+			Estimate: uint64(n) * p.every,
+			Stack:    formatStack(stack[:depth]),
+		})
+	}
+	p.mux.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Samples != samples[j].Samples {
+			return samples[i].Samples > samples[j].Samples
+		}
+		return samples[i].Stack < samples[j].Stack
+	})
+	return samples
+}
+
+// getProfile samples the call stacks of retrievals.
+type getProfile struct {
+	every uint64
+
+	// n counts retrievals; accessed atomically.
+	n uint64
+
+	// stacks counts the samples of each stack; protected by mux.
+	mux    sync.Mutex
+	stacks map[[maxSampleDepth]uintptr]int
+}
+
+// sample records the caller's stack, if it is the retrieval to sample.
+func (p *getProfile) sample() {
+	if atomic.AddUint64(&p.n, 1)%p.every != 0 {
+		return
+	}
+	var stack [maxSampleDepth]uintptr
+	runtime.Callers(3, stack[:])
+	p.mux.Lock()
+	if p.stacks == nil {
+		p.stacks = make(map[[maxSampleDepth]uintptr]int)
+	}
+	p.stacks[stack]++
+	p.mux.Unlock()
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package progress connects the progress callback of a long-running C
+// operation to a Go function and a context.
+//
+// A Progress maps a Go function and a context in the Mapper Target, by default
+// the global mapper.G.  C code passes the progress' handle to
+// mapper_progress, declared in progress.h in this package's directory, to
+// report progress, and stops the operation when it returns non-zero, because
+// the context is done.  Code that cannot report progress can poll
+// mapper_progress_cancelled instead.  The return values
+// suit libcurl's CURLOPT_XFERINFOFUNCTION and FFmpeg's AVIOInterruptCB, for
+// example, with a short C adapter:
+//
+//	static int xferinfo(void *p, curl_off_t dltotal, curl_off_t dlnow,
+//	                    curl_off_t ultotal, curl_off_t ulnow) {
+//		return mapper_progress((uintptr_t)p, dlnow, dltotal);
+//	}
+package progress // go.jpap.org/mapper/progress
+
+/*
+#include "progress.h"
+*/
+import "C"
+import (
+	"context"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/cancel"
+	"go.jpap.org/mapper/internal/bridge"
+)
+
+// Target is the Mapper in which new Progresses are mapped.  The exported C
+// functions retrieve each Progress from the Mapper it was mapped in, even once
+// Target is changed.  Target is not safe to change concurrently with New.
+var Target = &mapper.G
+
+// Progress is a mapped progress callback.
+type Progress struct {
+	m   *mapper.Mapper
+	key mapper.Key
+	fn  func(current, total int64)
+	tok *cancel.Token
+}
+
+// New returns a new Progress, mapped in Target, that calls fn with each
+// progress update.  The fn argument may be nil, when C only polls for
+// cancellation.  fn is called on the thread calling mapper_progress, and must
+// be safe for concurrent use if C reports progress from several threads.
+//
+// The operation should be cancelled once ctx is done.
+func New(ctx context.Context, fn func(current, total int64)) *Progress {
+	p := &Progress{m: Target, fn: fn, tok: cancel.NewToken(ctx)}
+	p.key = bridge.Map(p.m, p)
+	return p
+}
+
+// Handle returns the handle to pass to C.
+func (p *Progress) Handle() uintptr {
+	return p.key.Handle()
+}
+
+// Token returns the progress' cancellation token, whose handle can be polled
+// using mapper_token_cancelled by code that only has access to it.
+func (p *Progress) Token() *cancel.Token {
+	return p.tok
+}
+
+// Cancelled reports whether the operation should be cancelled.
+func (p *Progress) Cancelled() bool {
+	return p.tok.Cancelled()
+}
+
+// Close deletes the progress' mapping, and closes its token.  C calls made
+// with its handle thereafter report that the operation should be cancelled.
+func (p *Progress) Close() error {
+	bridge.Delete(p.m, p.key)
+	return p.tok.Close()
+}
+
+func (p *Progress) update(current, total int64) bool {
+	if p.fn != nil {
+		p.fn(current, total)
+	}
+	return p.Cancelled()
+}
+
+func lookup(handle C.uintptr_t) *Progress {
+	v, ok := bridge.Lookup(uintptr(handle))
+	if !ok {
+		return nil
+	}
+	return v.(*Progress)
+}
+
+func cbool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+//export mapper_progress
+func mapper_progress(handle C.uintptr_t, current, total C.int64_t) C.int {
+	p := lookup(handle)
+	if p == nil {
+		return 1
+	}
+	return cbool(p.update(int64(current), int64(total)))
+}
+
+//export mapper_progress_cancelled
+func mapper_progress_cancelled(handle C.uintptr_t) C.int {
+	p := lookup(handle)
+	return cbool(p == nil || p.Cancelled())
+}
@@ -0,0 +1,19 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#ifndef GO_JPAP_ORG_MAPPER_PROGRESS_H
+#define GO_JPAP_ORG_MAPPER_PROGRESS_H
+
+#include <stdint.h>
+
+// mapper_progress delivers a progress update to the Go function of the
+// progress with the given handle.  It returns non-zero if the operation should
+// be cancelled, as mapper_progress_cancelled does.
+extern int mapper_progress(uintptr_t handle, int64_t current, int64_t total);
+
+// mapper_progress_cancelled returns non-zero if the operation should be
+// cancelled, because the progress' context is done, or it has been closed.
+extern int mapper_progress_cancelled(uintptr_t handle);
+
+#endif // GO_JPAP_ORG_MAPPER_PROGRESS_H
@@ -0,0 +1,18 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#include "proxy.h"
+
+#define SLOT(i) \
+	static int64_t slot##i(mapper_proxy_t *self, void *args) { \
+		return mapper_proxy_call(self, i, args); \
+	}
+
+SLOT(0) SLOT(1) SLOT(2) SLOT(3) SLOT(4) SLOT(5) SLOT(6) SLOT(7)
+SLOT(8) SLOT(9) SLOT(10) SLOT(11) SLOT(12) SLOT(13) SLOT(14) SLOT(15)
+
+const mapper_proxy_method_t mapper_proxy_slots[MAPPER_PROXY_MAX_METHODS] = {
+	slot0, slot1, slot2, slot3, slot4, slot5, slot6, slot7,
+	slot8, slot9, slot10, slot11, slot12, slot13, slot14, slot15,
+};
@@ -0,0 +1,132 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package proxy creates C objects whose methods are implemented by Go values.
+//
+// Wrapping a C plugin API usually means handing C an object with a table of
+// function pointers, each of which must find its way back to a Go value.  A
+// proxy Object is a C mapper_proxy_t, declared in proxy.h in this package's
+// directory, whose vtable slots all call back into Go, where the object's
+// handle is resolved through the Mapper Target, by default the global
+// mapper.G, and the method of its Class with the slot's index is called with
+// the Go value:
+//
+//	var codecClass = proxy.NewClass(
+//		func(impl interface{}, args unsafe.Pointer) int64 { // slot 0: open
+//			return impl.(Codec).Open()
+//		},
+//		func(impl interface{}, args unsafe.Pointer) int64 { // slot 1: decode
+//			a := (*C.decode_args_t)(args)
+//			return impl.(Codec).Decode(a.buf, a.len)
+//		},
+//	)
+//
+//	obj := codecClass.New(myCodec)
+//	defer obj.Close()
+//	C.register_codec((*C.mapper_proxy_t)(obj.Ptr()))
+//
+// C calls a method through the vtable, passing the object, and a pointer to
+// a struct holding the method's arguments:
+//
+//	decode_args_t a = {buf, len};
+//	obj->vtable[1](obj, &a);
+//
+// When the C API has its own vtable layout, a short C shim translates each of
+// its entries into a call through the proxy's vtable.
+package proxy // go.jpap.org/mapper/proxy
+
+/*
+#include <stdlib.h>
+#include "proxy.h"
+*/
+import "C"
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/internal/bridge"
+)
+
+// Target is the Mapper in which new Objects are mapped.  The vtable slots
+// retrieve each Object from the Mapper it was mapped in, even once Target is
+// changed.  Target is not safe to change concurrently with New.
+var Target = &mapper.G
+
+// MaxMethods is the maximum number of methods in a Class.
+const MaxMethods = C.MAPPER_PROXY_MAX_METHODS
+
+// Method implements a method of a C object in terms of its Go value, impl.
+// The layout of args is agreed with the C caller.
+type Method func(impl interface{}, args unsafe.Pointer) int64
+
+// Class is the set of methods shared by objects.
+type Class struct {
+	methods []Method
+}
+
+// NewClass returns a new Class, whose vtable slot i calls methods[i].
+func NewClass(methods ...Method) *Class {
+	if len(methods) > MaxMethods {
+		panic(fmt.Errorf("too many methods: %d", len(methods)))
+	}
+	return &Class{methods: methods}
+}
+
+// Object is a C object implemented by a Go value.
+type Object struct {
+	class *Class
+	impl  interface{}
+	ptr   *C.mapper_proxy_t
+	m     *mapper.Mapper
+	key   mapper.Key
+	once  sync.Once
+}
+
+// New returns a new C object of the class, implemented by impl.  The object is
+// allocated in C memory, and must be released using Close.
+func (c *Class) New(impl interface{}) *Object {
+	ptr := (*C.mapper_proxy_t)(C.malloc(C.sizeof_mapper_proxy_t))
+	ptr.vtable = &C.mapper_proxy_slots[0]
+	o := &Object{class: c, impl: impl, ptr: ptr, m: Target}
+	o.key = bridge.Map(o.m, o)
+	ptr.handle = C.uintptr_t(o.key.Handle())
+	return o
+}
+
+// Ptr returns the C object, a mapper_proxy_t*.
+func (o *Object) Ptr() unsafe.Pointer {
+	return unsafe.Pointer(o.ptr)
+}
+
+// Impl returns the object's Go implementation.
+func (o *Object) Impl() interface{} {
+	return o.impl
+}
+
+// Close deletes the object's mapping, and frees the C object.  It must only be
+// called once C no longer calls the object's methods.
+func (o *Object) Close() error {
+	o.once.Do(func() {
+		bridge.Delete(o.m, o.key)
+		C.free(unsafe.Pointer(o.ptr))
+		o.ptr = nil
+	})
+	return nil
+}
+
+//export mapper_proxy_call
+func mapper_proxy_call(self *C.mapper_proxy_t, method C.int, args unsafe.Pointer) C.int64_t {
+	v, ok := bridge.Lookup(uintptr(self.handle))
+	if !ok {
+		// Panic with the Mapper's explanation of the miss.
+		v = Target.GetHandle(uintptr(self.handle))
+	}
+	o := v.(*Object)
+	if int(method) >= len(o.class.methods) || o.class.methods[method] == nil {
+		panic(fmt.Errorf("proxy: method %d not implemented", method))
+	}
+	return C.int64_t(o.class.methods[method](o.impl, args))
+}
@@ -0,0 +1,36 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// C objects whose methods are implemented by Go values; see package
+// go.jpap.org/mapper/proxy.
+
+#ifndef GO_JPAP_ORG_MAPPER_PROXY_H
+#define GO_JPAP_ORG_MAPPER_PROXY_H
+
+#include <stdint.h>
+
+#define MAPPER_PROXY_MAX_METHODS 16
+
+typedef struct mapper_proxy mapper_proxy_t;
+
+// A method takes the object, and a pointer to its arguments, whose layout is
+// agreed between the caller and the Go implementation.
+typedef int64_t (*mapper_proxy_method_t)(mapper_proxy_t *self, void *args);
+
+struct mapper_proxy {
+	// vtable has a slot for each method of the object's class.
+	const mapper_proxy_method_t *vtable;
+
+	// handle maps the object to its Go implementation.
+	uintptr_t handle;
+};
+
+// mapper_proxy_call calls the method with the given index on the object.  It
+// is the target of every vtable slot.
+extern int64_t mapper_proxy_call(mapper_proxy_t *self, int method, void *args);
+
+// mapper_proxy_slots is the vtable shared by all objects.
+extern const mapper_proxy_method_t mapper_proxy_slots[MAPPER_PROXY_MAX_METHODS];
+
+#endif // GO_JPAP_ORG_MAPPER_PROXY_H
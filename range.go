@@ -0,0 +1,92 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "sort"
+
+// Keys returns the keys of the live mappings, taken under a single
+// acquisition of the lock, sorted as the entries of a Snapshot are.  Shutdown
+// code can use them to tear down the C registrations still outstanding.
+func (mapper *Mapper) Keys() []Key {
+	return mappingKeys(mapper.mappings(nil))
+}
+
+// Keys is like Mapper.Keys, but only returns the keys of the namespace.
+func (ns *Namespace) Keys() []Key {
+	return mappingKeys(ns.mapper.mappings(ns))
+}
+
+// Range calls fn with the key and value of each live mapping, in the order
+// of Keys, until fn returns false.  Like sync.Map.Range, Range does not
+// reflect a single point in time: the mappings are taken under a single
+// acquisition of the lock, but fn is called without any lock held, so that
+// it may use the mapper, and mappings deleted meanwhile are still visited.
+// Range does not consume the uses of a mapping made by MapValueUses.
+func (mapper *Mapper) Range(fn func(key Key, goValue interface{}) bool) {
+	rangeMappings(mapper.mappings(nil), fn)
+}
+
+// Range is like Mapper.Range, but only visits the mappings of the namespace.
+func (ns *Namespace) Range(fn func(key Key, goValue interface{}) bool) {
+	rangeMappings(ns.mapper.mappings(ns), fn)
+}
+
+// rangeMappings calls fn with each of ms, until fn returns false.
+func rangeMappings(ms []mapping, fn func(Key, interface{}) bool) {
+	for _, m := range ms {
+		if !fn(m.key, m.e.goValue()) {
+			return
+		}
+	}
+}
+
+// mappingKeys returns the keys of ms.
+func mappingKeys(ms []mapping) []Key {
+	keys := make([]Key, len(ms))
+	for i, m := range ms {
+		keys[i] = m.key
+	}
+	return keys
+}
+
+// mappings returns the live mappings in ns, or all mappings if ns is nil,
+// sorted as the entries of a Snapshot are.
+func (mapper *Mapper) mappings(ns *Namespace) []mapping {
+	mapper.mux.RLock()
+	n := mapper.lenLocked()
+	if ns != nil {
+		n = ns.live
+	}
+	ms := make([]mapping, 0, n)
+	mapper.eachLocked(func(key Key, e entry) bool {
+		if ns == nil || e.ns() == ns {
+			ms = append(ms, mapping{key, e})
+		}
+		return true
+	})
+	mapper.mux.RUnlock()
+
+	if mapper.ordered {
+		sort.Slice(ms, func(i, j int) bool {
+			return ms[i].e.seq < ms[j].e.seq
+		})
+	} else {
+		sort.Slice(ms, func(i, j int) bool {
+			return keyLess(ms[i].key, ms[j].key)
+		})
+	}
+	return ms
+}
+
+// keyLess orders keys by handle, and then by the domain of tokens.
+func keyLess(a, b Key) bool {
+	if a.v != b.v {
+		return a.v < b.v
+	}
+	if a.hi != b.hi {
+		return a.hi < b.hi
+	}
+	return a.domain < b.domain
+}
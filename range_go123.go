@@ -0,0 +1,26 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+// +build go1.23
+
+package mapper
+
+import "iter"
+
+// All returns an iterator over the live mappings, visited as by Range, for
+// use with range-over-func loops and the iterator helpers of the maps and
+// slices packages:
+//
+//	for key, goValue := range mapper.G.All() {
+//		...
+//	}
+func (mapper *Mapper) All() iter.Seq2[Key, interface{}] {
+	return mapper.Range
+}
+
+// All is like Mapper.All, but only visits the mappings of the namespace.
+func (ns *Namespace) All() iter.Seq2[Key, interface{}] {
+	return ns.Range
+}
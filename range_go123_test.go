@@ -0,0 +1,43 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+// +build go1.23
+
+package mapper_test
+
+import (
+	"maps"
+	"testing"
+
+	"go.jpap.org/mapper"
+)
+
+func TestAll(t *testing.T) {
+	var m mapper.Mapper
+	ns := m.Namespace("ns")
+	a := m.MapValue("a")
+	b := ns.MapValue("b")
+
+	got := maps.Collect(m.All())
+	if len(got) != 2 || got[a] != "a" || got[b] != "b" {
+		t.Fatalf("All = %v", got)
+	}
+	n := 0
+	for key, v := range m.All() {
+		if key != a || v != "a" {
+			t.Fatalf("first mapping = 0x%x, %v", key.Handle(), v)
+		}
+		n++
+		break
+	}
+	if n != 1 {
+		t.Fatal("All did not stop at break")
+	}
+	for key := range ns.All() {
+		if key != b {
+			t.Fatalf("namespace All visited 0x%x", key.Handle())
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by TryMapValue when a mapping is rejected by a
+// RateLimit, and wrapped by the error returned by Txn.Commit.  MapValue and
+// MapPair panic with it.
+var ErrRateLimited = errors.New("mapping rate limit exceeded")
+
+// RateLimit is a token bucket limiting the rate at which mappings are made
+// by MapValue and MapPair, and their variants, including MapAll, MapSlice,
+// and the mappings of a Txn, so that a C library registering callbacks in a
+// loop is throttled, and surfaced, rather than silently growing the Mapper.
+type RateLimit struct {
+	// Rate is the sustained number of mappings allowed per second, and Burst
+	// the number allowed at once.
+	Rate  float64
+	Burst int
+
+	// Wait delays mappings above the limit until they are allowed, rather
+	// than rejecting them.
+	Wait bool
+
+	// Reject, if set, is called each time a mapping is rejected, or delayed,
+	// with the name of the limited Namespace, or "" for the Mapper.  It is
+	// called without any Mapper lock held.
+	Reject func(label string)
+}
+
+// WithRateLimit limits the rate of the mapper's mappings; see RateLimit.
+// Namespaces can be limited separately using Namespace.SetRateLimit.
+func WithRateLimit(limit RateLimit) Option {
+	return func(mapper *Mapper) {
+		mapper.limit = newRateLimiter(limit, "")
+	}
+}
+
+// SetRateLimit limits the rate of the namespace's mappings, in addition to
+// any limit of the Mapper; see RateLimit.  A limit with zero Rate and Burst
+// removes it.
+func (ns *Namespace) SetRateLimit(limit RateLimit) {
+	var l *rateLimiter
+	if limit.Rate != 0 || limit.Burst != 0 {
+		l = newRateLimiter(limit, ns.name)
+	}
+	ns.limit.Store(l)
+}
+
+// admit takes a token from the mapper's bucket, and that of ns, if it is not
+// nil, for a new mapping.  A mapping rejected by ns takes no token from the
+// mapper.
+func (mapper *Mapper) admit(ns *Namespace) error {
+	if err := mapper.limit.admit(); err != nil {
+		return err
+	}
+	if ns != nil {
+		l, _ := ns.limit.Load().(*rateLimiter)
+		if err := l.admit(); err != nil {
+			mapper.limit.refund(1)
+			return err
+		}
+	}
+	return nil
+}
+
+// admitN takes n tokens from the mapper's bucket, as admit does for n
+// mappings.  If any is rejected, those taken are refunded.
+func (mapper *Mapper) admitN(n int) error {
+	for i := 0; i < n; i++ {
+		if err := mapper.admit(nil); err != nil {
+			mapper.limit.refund(i)
+			return err
+		}
+	}
+	return nil
+}
+
+// refund returns the tokens taken by admit for a mapping in ns, which may be
+// nil, that was not made.
+func (mapper *Mapper) refund(ns *Namespace) {
+	mapper.limit.refund(1)
+	if ns != nil {
+		l, _ := ns.limit.Load().(*rateLimiter)
+		l.refund(1)
+	}
+}
+
+// rateLimiter implements a RateLimit.
+type rateLimiter struct {
+	RateLimit
+	label string
+
+	// tokens is the number of tokens in the bucket at last; protected by
+	// mux.  It is negative while waiting mappings are owed tokens.
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter with a full bucket.
+func newRateLimiter(limit RateLimit, label string) *rateLimiter {
+	return &rateLimiter{
+		RateLimit: limit,
+		label:     label,
+		tokens:    float64(limit.Burst),
+		last:      time.Now(),
+	}
+}
+
+// admit takes a token, waiting for it or returning ErrRateLimited if there
+// are none.  l may be nil, to admit every mapping.
+func (l *rateLimiter) admit() error {
+	if l == nil {
+		return nil
+	}
+	l.mux.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.Rate
+	if burst := float64(l.Burst); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		l.mux.Unlock()
+		return nil
+	}
+	var wait time.Duration
+	if l.Wait && l.Rate > 0 {
+		wait = time.Duration((1 - l.tokens) / l.Rate * float64(time.Second))
+		l.tokens--
+	}
+	l.mux.Unlock()
+
+	if l.Reject != nil {
+		l.Reject(l.label)
+	}
+	if wait == 0 {
+		return ErrRateLimited
+	}
+	time.Sleep(wait)
+	return nil
+}
+
+// refund returns n tokens taken by admit for mappings that were not made.
+// l may be nil.
+func (l *rateLimiter) refund(n int) {
+	if l == nil || n == 0 {
+		return
+	}
+	l.mux.Lock()
+	l.tokens += float64(n)
+	if burst := float64(l.Burst); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.mux.Unlock()
+}
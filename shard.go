@@ -0,0 +1,144 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// maxShards limits WithShards.
+const maxShards = 1 << 16
+
+// WithShards spreads the mappings over n shards, selected by a hash of the
+// key, each with its own lock.  Get, Lookup, and their variants then lock
+// only the shard of their key, rather than the whole Mapper, so that many
+// threads, such as the C threads of an audio pipeline, can retrieve values
+// concurrently without contending on a single lock.  n is rounded up to a
+// power of two, and is limited to 65,536.
+//
+// Mapping and deleting lock both the Mapper and a shard, and are slightly
+// more expensive.
+func WithShards(n int) Option {
+	if n < 1 || n > maxShards {
+		panic(fmt.Errorf("invalid number of shards: %d", n))
+	}
+	return func(mapper *Mapper) {
+		mapper.newStorage = func(capacity int) storage {
+			return newShardedStorage(n, capacity)
+		}
+		mapper.lockFree = true
+	}
+}
+
+// shard is one of the shards of shardedStorage.
+type shard struct {
+	mux sync.RWMutex
+	m   keyMap
+
+	// capacity is the number of entries m is allocated to hold.
+	capacity int
+
+	// pad keeps the locks of neighbouring shards on separate cache lines.
+	_ [64]byte
+}
+
+// shardedStorage is the storage of a Mapper created using WithShards.  As the
+// Mapper's write lock is held while it is modified, only load, which is
+// called without it, and the methods that modify a shard need to lock it.
+type shardedStorage struct {
+	shards []shard
+
+	// shift selects the shard from the top bits of a 64-bit hash.
+	shift uint
+}
+
+func newShardedStorage(n, capacity int) *shardedStorage {
+	b := bits.Len(uint(n - 1))
+	s := &shardedStorage{
+		shards: make([]shard, 1<<b),
+		shift:  uint(64 - b),
+	}
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.capacity = (capacity + len(s.shards) - 1) / len(s.shards)
+		sh.m = makeKeyMap(sh.capacity)
+	}
+	return s
+}
+
+// shardOf returns the shard holding key.
+func (s *shardedStorage) shardOf(key Key) *shard {
+	// Counting keys differ only above their reserved and counting-pointer
+	// bits, and pointers by their alignment, so mix all bits into the top.
+	h := (uint64(key.v) ^ uint64(key.domain)<<32 ^ uint64(key.hi)) * 0x9e3779b97f4a7c15
+	return &s.shards[h>>s.shift]
+}
+
+func (s *shardedStorage) load(key Key) (e entry, ok bool) {
+	sh := s.shardOf(key)
+	sh.mux.RLock()
+	e, ok = sh.m.load(key)
+	sh.mux.RUnlock()
+	return
+}
+
+func (s *shardedStorage) store(key Key, e entry) {
+	sh := s.shardOf(key)
+	sh.mux.Lock()
+	sh.m.store(key, e, sh.capacity)
+	sh.mux.Unlock()
+}
+
+func (s *shardedStorage) delete(key Key) {
+	sh := s.shardOf(key)
+	sh.mux.Lock()
+	sh.m.delete(key)
+	sh.mux.Unlock()
+}
+
+func (s *shardedStorage) len() int {
+	n := 0
+	for i := range s.shards {
+		n += s.shards[i].m.len()
+	}
+	return n
+}
+
+func (s *shardedStorage) each(fn func(key Key, e entry) bool) {
+	for i := range s.shards {
+		if !s.shards[i].m.each(fn) {
+			return
+		}
+	}
+}
+
+func (s *shardedStorage) lock() {
+	for i := range s.shards {
+		s.shards[i].mux.Lock()
+	}
+}
+
+func (s *shardedStorage) unlock() {
+	for i := range s.shards {
+		s.shards[i].mux.Unlock()
+	}
+}
+
+func (s *shardedStorage) resetLocks() {
+	for i := range s.shards {
+		s.shards[i].mux = sync.RWMutex{}
+	}
+}
+
+func (s *shardedStorage) clear() {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mux.Lock()
+		sh.m = keyMap{}
+		sh.mux.Unlock()
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"os"
+	"sync"
+)
+
+// SharedMapper is the subset of Mapper methods shared between copies of this
+// package loaded into one Go runtime; see Shared.  Keys are exchanged as
+// handles, since each copy of the package has its own Key type.
+type SharedMapper interface {
+	MapValue(goValue interface{}) (handle uintptr)
+	GetHandle(handle uintptr) (goValue interface{})
+	LookupHandle(handle uintptr) (goValue interface{}, ok bool)
+	DeleteHandle(handle uintptr)
+}
+
+// sharedEnv is the environment variable through which copies of this package
+// find the shared mapper.
+const sharedEnv = "GOMAPPER_SHARED"
+
+var (
+	sharedOnce sync.Once
+	shared     SharedMapper
+)
+
+// Shared returns a mapper shared by all copies of this package loaded into
+// the process' Go runtime, such as a copy vendored by a plugin opened using
+// plugin.Open.  The first copy to call Shared registers its global G as the
+// shared mapper; the others use it.
+//
+// Shared is registered through the process' environment, so that copies of
+// the package need not share any symbol.  A Go runtime cannot resolve values
+// mapped by another, so a c-shared library loaded into a process with another
+// Go runtime registers a shared mapper of its own, and handles must not be
+// passed between the two.  Call Shared from an init function, or before
+// opening plugins, so that copies do not race to register.
+//
+// Without cgo, plugins cannot be opened, and Shared returns a mapper using G.
+func Shared() SharedMapper {
+	sharedOnce.Do(func() {
+		shared = lookupShared()
+		if shared == nil {
+			shared = sharedMapper{&G}
+			if id := registerShared(shared); id != "" {
+				os.Setenv(sharedEnv, id)
+			}
+		}
+	})
+	return shared
+}
+
+// sharedMapper adapts a Mapper to SharedMapper.
+type sharedMapper struct {
+	mapper *Mapper
+}
+
+func (s sharedMapper) MapValue(goValue interface{}) uintptr {
+	return s.mapper.MapValue(goValue).Handle()
+}
+
+func (s sharedMapper) GetHandle(handle uintptr) interface{} {
+	return s.mapper.GetHandle(handle)
+}
+
+func (s sharedMapper) LookupHandle(handle uintptr) (interface{}, bool) {
+	return s.mapper.LookupHandle(handle)
+}
+
+func (s sharedMapper) DeleteHandle(handle uintptr) {
+	s.mapper.DeleteHandle(handle)
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package mapper
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/cgo"
+)
+
+// registerShared registers s as the shared mapper of the process, returning
+// the value of the environment variable through which other copies of this
+// package find it.
+func registerShared(s SharedMapper) string {
+	return sharedID(cgo.NewHandle(s))
+}
+
+// sharedID identifies the handle of a shared mapper registered by this
+// process and Go runtime; the address of a runtime function distinguishes Go
+// runtimes loaded into the process.
+func sharedID(h cgo.Handle) string {
+	return fmt.Sprintf("%d:%x:%d", os.Getpid(), reflect.ValueOf(runtime.GC).Pointer(), h)
+}
+
+// lookupShared returns the shared mapper registered by another copy of this
+// package, or nil if there is none.
+func lookupShared() SharedMapper {
+	var pid int
+	var rt uintptr
+	var h cgo.Handle
+	id := os.Getenv(sharedEnv)
+	if _, err := fmt.Sscanf(id, "%d:%x:%d", &pid, &rt, &h); err != nil {
+		return nil
+	}
+	// The variable may be inherited from a parent process, or set by another
+	// Go runtime.
+	if sharedID(h) != id {
+		return nil
+	}
+	s, _ := h.Value().(SharedMapper)
+	return s
+}
@@ -0,0 +1,19 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !cgo
+// +build !cgo
+
+package mapper
+
+// registerShared does not register s: without cgo, a process has no plugins,
+// or other copies of this package, with which to share it.
+func registerShared(s SharedMapper) string {
+	return ""
+}
+
+// lookupShared returns nil, as registerShared registers nothing.
+func lookupShared() SharedMapper {
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync/atomic"
+)
+
+// Sizer estimates the memory, in bytes, retained by a mapped Go value.
+type Sizer func(goValue interface{}) int64
+
+// SizeLimits are the thresholds above which a Mapper created using
+// WithSizeAccounting warns.  A zero limit is not checked.
+type SizeLimits struct {
+	// PerMapping is the largest estimated size of a single mapped value.
+	PerMapping int64
+
+	// Total is the largest estimated size of all live mapped values.  The
+	// Mapper warns each time the total rises above the limit.
+	Total int64
+
+	// Warn is called with each warning; if nil, warnings are logged using
+	// the log package.
+	Warn func(msg string)
+}
+
+// WithSizeAccounting estimates the size of each value mapped using sizer,
+// which may be ReflectSizer, and warns when a value, or the total of all live
+// values, exceeds the given limits.  The total is reported by Stats, and the
+// size of each mapping by Snapshot.
+//
+// Mappings that keep large buffers alive, such as video frames, are
+// otherwise a hidden memory cost.  The sizer is called for each value mapped,
+// without any lock held, and should be cheap.
+func WithSizeAccounting(sizer Sizer, limits SizeLimits) Option {
+	if limits.Warn == nil {
+		limits.Warn = func(msg string) { log.Print(msg) }
+	}
+	return func(mapper *Mapper) {
+		mapper.sizer = sizer
+		mapper.sizeLimits = limits
+	}
+}
+
+// sized estimates the size of e's value, warning if it exceeds the
+// per-mapping limit.
+func (mapper *Mapper) sized(e *entry) {
+	if mapper.sizer == nil {
+		return
+	}
+	e.size = mapper.sizer(e.goValue())
+	if limit := mapper.sizeLimits.PerMapping; limit > 0 && e.size > limit {
+		mapper.sizeLimits.Warn(fmt.Sprintf("mapper: mapping a %T of about %d bytes, above the limit of %d",
+			e.goValue(), e.size, limit))
+	}
+}
+
+// checkRetained warns if the total size of live mappings has risen above the
+// limit.  The caller must not hold the lock.
+func (mapper *Mapper) checkRetained() {
+	limit := mapper.sizeLimits.Total
+	if mapper.sizer == nil || limit <= 0 {
+		return
+	}
+	total := atomic.LoadInt64(&mapper.retained)
+	if total <= limit {
+		atomic.StoreInt32(&mapper.overTotal, 0)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&mapper.overTotal, 0, 1) {
+		mapper.sizeLimits.Warn(fmt.Sprintf("mapper: live mappings retain about %d bytes, above the limit of %d",
+			total, limit))
+	}
+}
+
+// ReflectSizer is a Sizer that estimates the size of a value by walking it
+// using reflection: it counts the memory of the value, and of everything it
+// references, once, by capacity for slices, and approximately for maps.
+// Channels and functions count as a pointer.  It is costly for large data
+// structures, for which a Sizer that knows their layout is preferable.
+func ReflectSizer(goValue interface{}) int64 {
+	if goValue == nil {
+		return 0
+	}
+	v := reflect.ValueOf(goValue)
+	s := sizer{seen: make(map[uintptr]bool)}
+	return int64(v.Type().Size()) + s.referenced(v)
+}
+
+// sizer implements ReflectSizer.
+type sizer struct {
+	seen map[uintptr]bool
+}
+
+// referenced returns the size of the memory referenced by v, excluding v
+// itself.
+func (s *sizer) referenced(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || s.seen[v.Pointer()] {
+			return 0
+		}
+		s.seen[v.Pointer()] = true
+		return int64(v.Type().Elem().Size()) + s.referenced(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() || s.seen[v.Pointer()] {
+			return 0
+		}
+		s.seen[v.Pointer()] = true
+		n := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			n += s.referenced(v.Index(i))
+		}
+		return n
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Map:
+		if v.IsNil() || s.seen[v.Pointer()] {
+			return 0
+		}
+		s.seen[v.Pointer()] = true
+		t := v.Type()
+		n := int64(v.Len()) * int64(t.Key().Size()+t.Elem().Size())
+		iter := v.MapRange()
+		for iter.Next() {
+			n += s.referenced(iter.Key()) + s.referenced(iter.Value())
+		}
+		return n
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		e := v.Elem()
+		return int64(e.Type().Size()) + s.referenced(e)
+	case reflect.Struct:
+		var n int64
+		for i := 0; i < v.NumField(); i++ {
+			n += s.referenced(v.Field(i))
+		}
+		return n
+	case reflect.Array:
+		var n int64
+		for i := 0; i < v.Len(); i++ {
+			n += s.referenced(v.Index(i))
+		}
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+// maxSlotGap limits how far beyond the end of a slot table a key may be
+// stored, growing the table; keys further out are stored in its overflow map.
+const maxSlotGap = 1024
+
+// WithSlotTable stores the mappings of keys returned by MapValue, and its
+// variants, in a table indexed by key, rather than in a hash map, as the
+// handles of cgo.Handle index a table.  Retrieval is then a bounds check and
+// an index, with consecutive keys adjacent in memory, and each mapping uses
+// less memory.  Other keys, such as pointers, are stored in a hash map.
+//
+// Keys deleted from the Mapper are recycled, so that the table stays dense;
+// the table shrinks only when cleared.
+func WithSlotTable() Option {
+	return func(mapper *Mapper) {
+		mapper.recycle = true
+		mapper.newStorage = func(capacity int) storage {
+			return &slotStorage{
+				index:    mapper.slotIndex,
+				slots:    make([]slot, 0, capacity),
+				capacity: capacity,
+			}
+		}
+	}
+}
+
+// slotIndex returns the index in a slot table of the counting-pointer key,
+// or false if key is not one.
+func (mapper *Mapper) slotIndex(key Key) (int, bool) {
+	if key.domain != 0 || key.v&mapper.countingBit() == 0 {
+		return 0, false
+	}
+	_, mask := mapper.handleTag()
+	i := int(mapper.obfuscation().plain(key.v&^mask)>>(mapper.reservedBits+1)) - 1
+	return i, i >= 0
+}
+
+// slot is an entry of a slot table.
+type slot struct {
+	// v is the handle of the key mapped, or zero if the slot is empty.
+	v uintptr
+	e entry
+}
+
+// slotStorage is the storage of a Mapper created using WithSlotTable.
+type slotStorage struct {
+	// index returns the index of a key in slots; see slotIndex.
+	index func(key Key) (int, bool)
+
+	// slots holds n entries of counting-pointer keys, by index.
+	slots []slot
+	n     int
+
+	// overflow holds the entries of other keys, and of keys whose slot is
+	// out of reach, or taken by another key with the same index, such as
+	// one of another version.
+	overflow keyMap
+
+	// capacity is the number of entries slots is allocated to hold.
+	capacity int
+}
+
+func (s *slotStorage) load(key Key) (e entry, ok bool) {
+	if i, ok := s.index(key); ok && i < len(s.slots) && s.slots[i].v == key.v {
+		return s.slots[i].e, true
+	}
+	return s.overflow.load(key)
+}
+
+func (s *slotStorage) store(key Key, e entry) {
+	if i, ok := s.index(key); ok && i < len(s.slots)+maxSlotGap {
+		if i >= len(s.slots) {
+			s.slots = append(s.slots, make([]slot, i+1-len(s.slots))...)
+		}
+		if sl := &s.slots[i]; sl.v == 0 || sl.v == key.v {
+			if sl.v == 0 {
+				s.n++
+			}
+			*sl = slot{v: key.v, e: e}
+			if s.overflow.len() != 0 {
+				s.overflow.delete(key)
+			}
+			return
+		}
+	}
+	s.overflow.store(key, e, 0)
+}
+
+func (s *slotStorage) delete(key Key) {
+	if i, ok := s.index(key); ok && i < len(s.slots) && s.slots[i].v == key.v {
+		s.slots[i] = slot{}
+		s.n--
+		return
+	}
+	s.overflow.delete(key)
+}
+
+func (s *slotStorage) len() int {
+	return s.n + s.overflow.len()
+}
+
+func (s *slotStorage) each(fn func(key Key, e entry) bool) {
+	for i := range s.slots {
+		if sl := &s.slots[i]; sl.v != 0 && !fn(Key{v: sl.v}, sl.e) {
+			return
+		}
+	}
+	s.overflow.each(fn)
+}
+
+func (s *slotStorage) clear() {
+	s.slots = make([]slot, 0, s.capacity)
+	s.n = 0
+	s.overflow = keyMap{}
+}
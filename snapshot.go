@@ -0,0 +1,206 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// Snapshot describes the live mappings of a Mapper at a point in time.  It
+// does not retain the mapped Go values.
+type Snapshot struct {
+	// Time is when the snapshot was taken.
+	Time time.Time `json:"time"`
+
+	// Entries are sorted by handle and domain, or by insertion for a Mapper
+	// created using WithInsertionOrder.
+	Entries []SnapshotEntry `json:"entries"`
+}
+
+// SnapshotEntry describes a single mapping in a Snapshot.
+type SnapshotEntry struct {
+	Handle  uintptr   `json:"handle"`
+	Type    string    `json:"type"`
+	Created time.Time `json:"created"`
+
+	// Domain is zero for pointer and counting-pointer keys.  Keys made by
+	// KeyFromUint, or by MapFD, are held apart from those, and from each other
+	// by domain, so that keys of different domains can share a Handle: it is
+	// one more than the Domain of a key made by KeyFromUint.
+	Domain uint32 `json:"domain,omitempty"`
+
+	// Seq numbers the mappings of the Mapper in the order they were made.
+	// Mapping a key that is mapped keeps its Seq, but sets its Created time;
+	// mapping a key again after it was deleted gives it a new Seq.
+	Seq uint64 `json:"seq"`
+
+	// Namespace is the name of the mapping's Namespace, if any.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Goroutine is the ID of the goroutine that created the mapping.  It is
+	// only recorded in debug mode.
+	Goroutine uint64 `json:"goroutine,omitempty"`
+
+	// Size is the estimated size of the mapped value, in bytes.  It is only
+	// estimated by a Mapper created using WithSizeAccounting.
+	Size int64 `json:"size,omitempty"`
+
+	// Callers are the most recent retrievals of the mapping by Go code
+	// called back from C, most recent first.  They are only recorded in
+	// debug mode.
+	Callers []Caller `json:"callers,omitempty"`
+}
+
+// Age returns the age of the mapping at the time of the snapshot.
+func (e SnapshotEntry) Age(s *Snapshot) time.Duration {
+	return s.Time.Sub(e.Created)
+}
+
+// Snapshot returns a description of the mapper's live mappings.
+func (mapper *Mapper) Snapshot() *Snapshot {
+	return mapper.snapshot(nil)
+}
+
+// snapshot returns a Snapshot of the mappings in ns, or all mappings if ns is
+// nil.
+func (mapper *Mapper) snapshot(ns *Namespace) *Snapshot {
+	mapper.mux.RLock()
+	s := &Snapshot{Time: time.Now()}
+	if ns == nil {
+		s.Entries = make([]SnapshotEntry, 0, mapper.lenLocked())
+	} else {
+		s.Entries = make([]SnapshotEntry, 0, ns.live)
+	}
+	mapper.eachLocked(func(key Key, e entry) bool {
+		if ns == nil || e.ns() == ns {
+			s.Entries = append(s.Entries, snapshotEntry(key, e))
+		}
+		return true
+	})
+	mapper.mux.RUnlock()
+
+	mapper.sortSnapshot(s)
+	return s
+}
+
+// snapshotEntry describes the mapping of key to e.
+func snapshotEntry(key Key, e entry) SnapshotEntry {
+	se := SnapshotEntry{
+		Handle:  key.v,
+		Type:    typeName(e.valueType()),
+		Created: e.created,
+		Domain:  key.domain,
+		Seq:     e.seq,
+	}
+	if ns := e.ns(); ns != nil {
+		se.Namespace = ns.name
+	}
+	if d := e.diag(); d != nil {
+		se.Goroutine = d.goid
+		se.Callers = d.recentCallers()
+	}
+	se.Size = e.size
+	return se
+}
+
+// Dump writes a Snapshot of the mapper to w, in a JSON format that can be read
+// back using ReadDump.
+func (mapper *Mapper) Dump(w io.Writer) error {
+	return json.NewEncoder(w).Encode(mapper.Snapshot())
+}
+
+// ReadDump reads a Snapshot written by Dump.
+func ReadDump(r io.Reader) (*Snapshot, error) {
+	var s Snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SnapshotDiff is the difference between two snapshots, as returned by Diff.
+type SnapshotDiff struct {
+	Before, After *Snapshot
+
+	// Added entries are in After, but not Before.
+	Added []SnapshotEntry
+
+	// Removed entries are in Before, but not After.  Their ages are relative
+	// to Before.
+	Removed []SnapshotEntry
+
+	// Retained entries are in both snapshots, as they appear in After.
+	Retained []SnapshotEntry
+
+	// Changed entries are in both snapshots, but their keys were mapped to
+	// new values in between, as they appear in After.
+	Changed []SnapshotEntry
+}
+
+// Diff compares two snapshots of the same Mapper, with a taken before b.  An
+// entry is retained only if it refers to the same mapping in both, and is
+// changed if the mapping was replaced in between, such as by MapPair or
+// Swap.  A key that was deleted and then mapped again in between is reported
+// as both removed and added.
+//
+// Running a workload twice, and diffing snapshots taken after each run, is a
+// simple way to find leaked mappings: they are retained or added.
+func Diff(a, b *Snapshot) *SnapshotDiff {
+	type id struct {
+		handle uintptr
+		domain uint32
+		seq    uint64
+	}
+	idOf := func(e SnapshotEntry) id {
+		return id{e.Handle, e.Domain, e.Seq}
+	}
+
+	inA := make(map[id]SnapshotEntry, len(a.Entries))
+	for _, e := range a.Entries {
+		inA[idOf(e)] = e
+	}
+	inB := make(map[id]bool, len(b.Entries))
+	for _, e := range b.Entries {
+		inB[idOf(e)] = true
+	}
+
+	d := &SnapshotDiff{Before: a, After: b}
+	for _, e := range a.Entries {
+		if !inB[idOf(e)] {
+			d.Removed = append(d.Removed, e)
+		}
+	}
+	for _, e := range b.Entries {
+		switch old, ok := inA[idOf(e)]; {
+		case !ok:
+			d.Added = append(d.Added, e)
+		case !old.Created.Equal(e.Created):
+			d.Changed = append(d.Changed, e)
+		default:
+			d.Retained = append(d.Retained, e)
+		}
+	}
+	return d
+}
+
+// sortSnapshot sorts the entries of s by handle, or by insertion if the
+// mapper is ordered.
+func (mapper *Mapper) sortSnapshot(s *Snapshot) {
+	if mapper.ordered {
+		sort.Slice(s.Entries, func(i, j int) bool {
+			return s.Entries[i].Seq < s.Entries[j].Seq
+		})
+		return
+	}
+	sort.Slice(s.Entries, func(i, j int) bool {
+		if s.Entries[i].Handle != s.Entries[j].Handle {
+			return s.Entries[i].Handle < s.Entries[j].Handle
+		}
+		return s.Entries[i].Domain < s.Entries[j].Domain
+	})
+}
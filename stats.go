@@ -0,0 +1,50 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "sync/atomic"
+
+// Stats describes the state of a Mapper at a point in time.
+type Stats struct {
+	// Live is the number of mappings currently held.
+	Live int
+
+	// Mapped is the number of mappings created over the lifetime of the
+	// Mapper.  Replacing the value of an existing mapping is not counted.
+	Mapped uint64
+
+	// Deleted is the number of mappings removed by Delete or Clear.
+	Deleted uint64
+
+	// Retained is the estimated size, in bytes, of the live mapped values.
+	// It is only estimated by a Mapper created using WithSizeAccounting.
+	Retained int64
+
+	// Latency summarizes the latencies of the Mapper's operations.  It is
+	// only recorded by a Mapper created using WithLatencyMetrics.
+	Latency Latencies
+}
+
+// Len returns the number of live mappings, as reported by Stats.  A count
+// that keeps rising can reveal a C library that never calls its destroy
+// callback.
+func (mapper *Mapper) Len() int {
+	mapper.mux.RLock()
+	defer mapper.mux.RUnlock()
+	return mapper.lenLocked()
+}
+
+// Stats returns a consistent snapshot of the mapper's statistics.
+func (mapper *Mapper) Stats() Stats {
+	mapper.mux.RLock()
+	defer mapper.mux.RUnlock()
+	return Stats{
+		Live:     mapper.lenLocked(),
+		Mapped:   mapper.mapped,
+		Deleted:  mapper.deleted,
+		Retained: atomic.LoadInt64(&mapper.retained),
+		Latency:  mapper.latency.latencies(),
+	}
+}
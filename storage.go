@@ -0,0 +1,232 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "sync/atomic"
+
+// storage holds the entries of a Mapper, by key.  Its methods are called with
+// the Mapper's lock held, and those that modify it with the write lock held.
+// For a Mapper with lockFree set, load is also called without the lock,
+// concurrently with the other methods.
+type storage interface {
+	// load returns the entry mapped by key.
+	load(key Key) (e entry, ok bool)
+
+	// store maps key to e, replacing any existing entry.
+	store(key Key, e entry)
+
+	// delete removes the entry mapped by key, if any.
+	delete(key Key)
+
+	// len returns the number of entries.
+	len() int
+
+	// each calls fn for each entry, in no particular order, until fn returns
+	// false.  fn must not modify the storage.
+	each(fn func(key Key, e entry) bool)
+
+	// clear removes all entries, releasing their memory.
+	clear()
+}
+
+// lockingStorage is implemented by storage with locks of its own, which the
+// fork hooks hold across a fork; see BeforeFork.
+type lockingStorage interface {
+	// lock acquires the storage's locks, for writing.
+	lock()
+
+	// unlock releases the locks acquired by lock.
+	unlock()
+
+	// resetLocks reinitializes the storage's locks, whether or not they are
+	// held.
+	resetLocks()
+}
+
+// keyMap holds entries by key, in Go maps.  The keys made by KeyFromUint and
+// KeyFromFD, whose domain is set, are held apart from the others, so that
+// pointer and counting-pointer keys, which are most keys, are hashed and
+// compared as a single word.
+type keyMap struct {
+	m      map[uintptr]entry
+	tokens map[Key]entry
+}
+
+// makeKeyMap returns a keyMap allocated to hold capacity entries, or nil maps
+// if capacity is zero.
+func makeKeyMap(capacity int) keyMap {
+	if capacity == 0 {
+		return keyMap{}
+	}
+	return keyMap{m: make(map[uintptr]entry, capacity)}
+}
+
+func (km *keyMap) load(key Key) (e entry, ok bool) {
+	if key.domain != 0 {
+		e, ok = km.tokens[key]
+		return
+	}
+	e, ok = km.m[key.v]
+	return
+}
+
+// store maps key to e, allocating a map to hold capacity entries if needed.
+func (km *keyMap) store(key Key, e entry, capacity int) {
+	if key.domain != 0 {
+		if km.tokens == nil {
+			km.tokens = make(map[Key]entry)
+		}
+		km.tokens[key] = e
+		return
+	}
+	if km.m == nil {
+		km.m = make(map[uintptr]entry, capacity)
+	}
+	km.m[key.v] = e
+}
+
+func (km *keyMap) delete(key Key) {
+	if key.domain != 0 {
+		delete(km.tokens, key)
+		return
+	}
+	delete(km.m, key.v)
+}
+
+func (km *keyMap) len() int {
+	return len(km.m) + len(km.tokens)
+}
+
+// each calls fn for each entry until fn returns false, and reports whether
+// it did not.
+func (km *keyMap) each(fn func(key Key, e entry) bool) bool {
+	for v, e := range km.m {
+		if !fn(Key{v: v}, e) {
+			return false
+		}
+	}
+	for key, e := range km.tokens {
+		if !fn(key, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// copied returns a copy of km, allocated to hold at least capacity entries
+// whose keys have no domain.
+func (km *keyMap) copied(capacity int) keyMap {
+	if n := len(km.m); n > capacity {
+		capacity = n
+	}
+	c := keyMap{m: make(map[uintptr]entry, capacity)}
+	for v, e := range km.m {
+		c.m[v] = e
+	}
+	if len(km.tokens) != 0 {
+		c.tokens = make(map[Key]entry, len(km.tokens)+1)
+		for key, e := range km.tokens {
+			c.tokens[key] = e
+		}
+	}
+	return c
+}
+
+// mapStorage is the default storage: a keyMap, allocated to hold capacity
+// entries on first use.
+type mapStorage struct {
+	m        keyMap
+	capacity int
+}
+
+func newMapStorage(capacity int) storage {
+	return &mapStorage{m: makeKeyMap(capacity), capacity: capacity}
+}
+
+func (s *mapStorage) load(key Key) (e entry, ok bool) {
+	return s.m.load(key)
+}
+
+func (s *mapStorage) store(key Key, e entry) {
+	s.m.store(key, e, s.capacity)
+}
+
+func (s *mapStorage) delete(key Key) {
+	s.m.delete(key)
+}
+
+func (s *mapStorage) len() int {
+	return s.m.len()
+}
+
+func (s *mapStorage) each(fn func(key Key, e entry) bool) {
+	s.m.each(fn)
+}
+
+func (s *mapStorage) clear() {
+	s.m = keyMap{}
+}
+
+// makeStorage returns new storage for the mapper, as configured by its
+// options.
+func (mapper *Mapper) makeStorage() storage {
+	if mapper.newStorage != nil {
+		return mapper.newStorage(mapper.capacity)
+	}
+	return newMapStorage(mapper.capacity)
+}
+
+// storageLocked returns the storage of the mapper, creating it on first use.
+// The caller must hold the write lock.
+func (mapper *Mapper) storageLocked() storage {
+	if mapper.m == nil {
+		mapper.m = mapper.makeStorage()
+	}
+	return mapper.m
+}
+
+// load returns the entry mapped by key, taking the read lock unless the
+// mapper's storage allows lock-free reads.  A lock-free read that overlaps a
+// Txn commit is retried with the lock held, so that the transaction appears
+// atomic, as though the read were made before or after it.
+func (mapper *Mapper) load(key Key) (e entry, ok bool) {
+	if mapper.lockFree {
+		if seq := atomic.LoadUint32(&mapper.commitSeq); seq&1 == 0 {
+			e, ok = mapper.m.load(key)
+			if atomic.LoadUint32(&mapper.commitSeq) == seq {
+				return
+			}
+		}
+	}
+	mapper.mux.RLock()
+	e, ok = mapper.loadLocked(key)
+	mapper.mux.RUnlock()
+	return
+}
+
+// loadLocked returns the entry mapped by key.  The caller must hold the lock.
+func (mapper *Mapper) loadLocked(key Key) (e entry, ok bool) {
+	if mapper.m == nil {
+		return entry{}, false
+	}
+	return mapper.m.load(key)
+}
+
+// lenLocked returns the number of live mappings.  The caller must hold the
+// lock.
+func (mapper *Mapper) lenLocked() int {
+	if mapper.m == nil {
+		return 0
+	}
+	return mapper.m.len()
+}
+
+// eachLocked calls fn for each mapping until fn returns false.  The caller
+// must hold the lock, and fn must not modify the mappings.
+func (mapper *Mapper) eachLocked(fn func(key Key, e entry) bool) {
+	if mapper.m != nil {
+		mapper.m.each(fn)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper_test
+
+import (
+	"flag"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.jpap.org/mapper"
+)
+
+// Run the stress tests for longer as a soak test, preferably with -race:
+//
+//	go test -race -run Stress -soak 10m
+var soak = flag.Duration("soak", 0, "run each stress test for `duration`")
+
+// stressDuration returns the time for which each stress test runs.
+func stressDuration() time.Duration {
+	switch {
+	case *soak > 0:
+		return *soak
+	case testing.Short():
+		return 50 * time.Millisecond
+	}
+	return 500 * time.Millisecond
+}
+
+// stressWorkers returns the number of goroutines used by a stress test.
+func stressWorkers() int {
+	return 2 * runtime.GOMAXPROCS(0)
+}
+
+// stressValue is mapped by the stress tests, recording which goroutine
+// mapped it, and when.
+type stressValue struct {
+	worker, seq int
+}
+
+// TestStressMapGetDelete checks that concurrent Map, Get, and Delete neither
+// hand out a key that is already mapped, nor lose or corrupt a mapping.
+func TestStressMapGetDelete(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []mapper.Option
+	}{
+		{"default", nil},
+		{"compact", []mapper.Option{mapper.WithCompactHandles()}},
+		{"partitioned", []mapper.Option{mapper.WithTypePartitions()}},
+		{"reserved", []mapper.Option{mapper.WithReservedBits(3)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := mapper.New(tc.opts...)
+			var live sync.Map // Key -> worker
+			deadline := time.Now().Add(stressDuration())
+			var wg sync.WaitGroup
+			for w := 0; w < stressWorkers(); w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					var held []mapper.Key
+					for seq := 0; time.Now().Before(deadline); seq++ {
+						// Hold up to 64 keys, so the compact key space is
+						// not exhausted.
+						if len(held) < 64 && seq%3 != 2 {
+							key := m.MapValue(stressValue{w, seq})
+							if other, dup := live.LoadOrStore(key, w); dup {
+								t.Errorf("key 0x%x mapped by workers %d and %d", key.Handle(), other, w)
+								return
+							}
+							held = append(held, key)
+						}
+						for _, key := range held {
+							v, ok := m.Lookup(key)
+							if !ok {
+								t.Errorf("worker %d lost key 0x%x", w, key.Handle())
+								return
+							}
+							if v.(stressValue).worker != w {
+								t.Errorf("worker %d key 0x%x resolves to %+v", w, key.Handle(), v)
+								return
+							}
+						}
+						if seq%3 == 2 && len(held) > 0 {
+							key := held[0]
+							held = held[1:]
+							live.Delete(key)
+							m.Delete(key)
+						}
+					}
+					for _, key := range held {
+						live.Delete(key)
+						m.Delete(key)
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			if s := m.Stats(); s.Live != 0 || s.Mapped != s.Deleted {
+				t.Fatalf("stats after all deletes = %+v", s)
+			}
+		})
+	}
+}
+
+// TestStressClear checks that Clear, racing with Map and Get, never causes a
+// key to resolve to another goroutine's value, given WithMonotonicKeys.
+func TestStressClear(t *testing.T) {
+	m := mapper.New(mapper.WithMonotonicKeys())
+	deadline := time.Now().Add(stressDuration())
+	var clears int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			m.Clear()
+			atomic.AddInt64(&clears, 1)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for w := 0; w < stressWorkers(); w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for seq := 0; time.Now().Before(deadline); seq++ {
+				key := m.MapValue(stressValue{w, seq})
+				v, ok := m.Lookup(key)
+				if ok && v != (stressValue{w, seq}) {
+					t.Errorf("worker %d key 0x%x resolves to %+v", w, key.Handle(), v)
+					return
+				}
+				m.Delete(key)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if clears == 0 {
+		t.Fatal("Clear never ran")
+	}
+}
+
+// TestStressExhaustion checks that concurrent allocation up to the end of a
+// 32-bit key space hands out every remaining key exactly once, and then
+// fails cleanly.
+func TestStressExhaustion(t *testing.T) {
+	const remaining = 4096
+	m := mapper.New(mapper.With32BitHandles())
+	m.SkipKeys(1<<31 - 1 - remaining)
+
+	var mu sync.Mutex
+	seen := make(map[mapper.Key]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < stressWorkers(); w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for seq := 0; ; seq++ {
+				key, err := m.TryMapValue(stressValue{w, seq})
+				if err == mapper.ErrKeySpaceExhausted {
+					return
+				}
+				if err != nil {
+					t.Errorf("TryMapValue: %v", err)
+					return
+				}
+				mu.Lock()
+				dup := seen[key]
+				seen[key] = true
+				mu.Unlock()
+				if dup {
+					t.Errorf("key 0x%x allocated twice", key.Handle())
+					return
+				}
+				if key.Handle() > 0xffffffff {
+					t.Errorf("key 0x%x exceeds 32 bits", key.Handle())
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(seen) != remaining {
+		t.Fatalf("allocated %d keys, want %d", len(seen), remaining)
+	}
+	if _, err := m.TryMapValue(0); err != mapper.ErrKeySpaceExhausted {
+		t.Fatalf("TryMapValue after exhaustion = %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package swig glues SWIG-generated director wrappers to a mapper.Mapper.
+//
+// A SWIG director is a C++ object whose virtual methods are implemented in Go.
+// When the C++ side invokes a callback, the Go side only receives the C++
+// object pointer; this package keeps a mapping from that pointer to the Go
+// value implementing the director, so that every callback resolves its Go
+// value through a single path.
+//
+// Create and destroy directors using NewDirector and DeleteDirector, which
+// wrap the SWIG-generated functions, so that each director is connected to
+// its Go value for exactly its lifetime:
+//
+//	var listeners swig.Directors
+//
+//	l := swig.NewDirector(&listeners, NewDirectorListener, &myListener{})
+//	defer swig.DeleteDirector(&listeners, l, DeleteDirectorListener)
+package swig // go.jpap.org/mapper/swig
+
+import (
+	"go.jpap.org/mapper"
+)
+
+// Director is implemented by every SWIG-generated wrapper type, including the
+// values returned by the NewDirectorXXX constructors.
+type Director interface {
+	Swigcptr() uintptr
+}
+
+// Directors tracks connected SWIG directors.  The zero value is ready to use,
+// and uses the global mapper.G.
+type Directors struct {
+	// Mapper holds the director mappings; if nil, mapper.G is used.
+	Mapper *mapper.Mapper
+}
+
+func (d *Directors) mapper() *mapper.Mapper {
+	if d.Mapper == nil {
+		return &mapper.G
+	}
+	return d.Mapper
+}
+
+// NewDirector creates a director using newDirector, usually a SWIG
+// NewDirectorXXX function, with goValue as its Go implementation, and
+// connects the director to goValue.
+func NewDirector[D Director](d *Directors, newDirector func(goValue interface{}) D, goValue interface{}) D {
+	director := newDirector(goValue)
+	d.Connect(director, goValue)
+	return director
+}
+
+// DeleteDirector disconnects director, and destroys it using deleteDirector,
+// usually the SWIG DeleteDirectorXXX function.
+func DeleteDirector[D Director](d *Directors, director D, deleteDirector func(D)) {
+	d.Disconnect(director)
+	deleteDirector(director)
+}
+
+// Connect maps goValue against the C++ object underlying director, which is
+// usually the value just returned by a SWIG NewDirectorXXX function.  The
+// returned Key can be used with the underlying Mapper directly.  Connect
+// panics if the Mapper cannot map the pointer of director, as for
+// MapPtrPair.  NewDirector calls Connect.
+func (d *Directors) Connect(director Director, goValue interface{}) mapper.Key {
+	m := d.mapper()
+	key := m.KeyFromAddr(director.Swigcptr())
+	m.MapPair(key, goValue)
+	return key
+}
+
+// Disconnect deletes the mapping for director.  It should be called just
+// before the director is destroyed using the SWIG DeleteDirectorXXX function,
+// as DeleteDirector does.
+func (d *Directors) Disconnect(director Director) {
+	m := d.mapper()
+	m.Delete(m.KeyFromAddr(director.Swigcptr()))
+}
+
+// Resolve returns the Go value connected to the given C++ object pointer, as
+// received by a director callback.  It panics if no director is connected.
+func (d *Directors) Resolve(cptr uintptr) interface{} {
+	m := d.mapper()
+	return m.Get(m.KeyFromAddr(cptr))
+}
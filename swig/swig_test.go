@@ -0,0 +1,84 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swig_test
+
+import (
+	"testing"
+
+	"go.jpap.org/mapper"
+	"go.jpap.org/mapper/swig"
+)
+
+type fakeDirector uintptr
+
+func (d fakeDirector) Swigcptr() uintptr { return uintptr(d) }
+
+func TestConnectResolveDisconnect(t *testing.T) {
+	var m mapper.Mapper
+	d := swig.Directors{Mapper: &m}
+	director := fakeDirector(0x1000)
+
+	d.Connect(director, "listener")
+	if v := d.Resolve(director.Swigcptr()); v != "listener" {
+		t.Fatalf("resolved %v", v)
+	}
+	d.Disconnect(director)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("resolve after disconnect did not panic")
+		}
+	}()
+	d.Resolve(director.Swigcptr())
+}
+
+// listener stands in for a SWIG-generated director interface.
+type listener interface {
+	Swigcptr() uintptr
+}
+
+func TestNewDeleteDirector(t *testing.T) {
+	var m mapper.Mapper
+	d := swig.Directors{Mapper: &m}
+	var deleted listener
+	newListener := func(goValue interface{}) listener { return fakeDirector(0x2000) }
+	deleteListener := func(l listener) {
+		if m.Has(mapper.KeyFromHandle(l.Swigcptr())) {
+			t.Fatal("director destroyed while connected")
+		}
+		deleted = l
+	}
+
+	l := swig.NewDirector(&d, newListener, "listener")
+	if v := d.Resolve(l.Swigcptr()); v != "listener" {
+		t.Fatalf("resolved %v", v)
+	}
+	swig.DeleteDirector(&d, l, deleteListener)
+	if deleted != l || m.Len() != 0 {
+		t.Fatalf("director not disconnected and destroyed: %v, %d", deleted, m.Len())
+	}
+}
+
+func TestConnectChecksPointer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		m    *mapper.Mapper
+		cptr uintptr
+	}{
+		{"unaligned", mapper.New(), 0x1001},
+		{"reserved bit", mapper.New(mapper.WithReservedBits(1)), 0x1002},
+		{"high bit", mapper.New(mapper.WithHighCountingBit()), ^uintptr(0)&^(^uintptr(0)>>1) | 0x1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := swig.Directors{Mapper: tc.m}
+			defer func() {
+				if recover() == nil {
+					t.Fatal("Connect did not panic")
+				}
+			}()
+			d.Connect(fakeDirector(tc.cptr), "listener")
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "sync"
+
+// WithReadMostly stores the mappings in a sync.Map, so that Get, Lookup, and
+// their variants retrieve values without taking any lock.  This suits
+// mappings that are created once, and then read many times, such as from C
+// callbacks invoked concurrently on many threads.
+//
+// Mapping and deleting are more expensive, and each mapping allocates.  For
+// mappings that change often, see WithShards.
+func WithReadMostly() Option {
+	return func(mapper *Mapper) {
+		mapper.newStorage = func(int) storage {
+			return &syncMapStorage{}
+		}
+		mapper.lockFree = true
+	}
+}
+
+// syncMapStorage is the storage of a Mapper created using WithReadMostly.
+type syncMapStorage struct {
+	m sync.Map
+
+	// n is the number of entries in m.
+	n int
+}
+
+func (s *syncMapStorage) load(key Key) (e entry, ok bool) {
+	v, ok := s.m.Load(key)
+	if !ok {
+		return entry{}, false
+	}
+	return v.(entry), true
+}
+
+func (s *syncMapStorage) store(key Key, e entry) {
+	// The Mapper's write lock is held, so the key cannot be stored meanwhile.
+	if _, ok := s.m.Load(key); !ok {
+		s.n++
+	}
+	s.m.Store(key, e)
+}
+
+func (s *syncMapStorage) delete(key Key) {
+	if _, ok := s.m.LoadAndDelete(key); ok {
+		s.n--
+	}
+}
+
+func (s *syncMapStorage) len() int {
+	return s.n
+}
+
+func (s *syncMapStorage) each(fn func(key Key, e entry) bool) {
+	s.m.Range(func(k, v interface{}) bool {
+		return fn(k.(Key), v.(entry))
+	})
+}
+
+func (s *syncMapStorage) clear() {
+	s.m.Range(func(k, _ interface{}) bool {
+		s.m.Delete(k)
+		return true
+	})
+	s.n = 0
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "sort"
+
+// SetTeardownPriority sets the priority of the mapping for key in teardown
+// by Clear, ClearFunc, and Close, returning false if key is not mapped.
+// Mappings of lower priority are torn down first; those of equal priority,
+// which is zero by default, are torn down newest first.  Replacing a mapping
+// keeps its priority.
+//
+// Tearing down newest first destroys the children of a wrapped C object
+// graph before their parents, when the children are mapped after them.  A
+// priority orders teardown where that does not hold.
+func (mapper *Mapper) SetTeardownPriority(key Key, priority int) bool {
+	key = mapper.canonical(key)
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	e, ok := mapper.loadLocked(key)
+	if ok {
+		e.writableExtra().priority = priority
+		mapper.m.store(key, e)
+	}
+	return ok
+}
+
+// ClearFunc is like Clear, but calls destroy with the key and value of each
+// mapping, in teardown order, before its functions registered by OnDelete.
+// destroy is called without any Mapper lock held.  See SetTeardownPriority
+// for the teardown order; a borrowed mapping is torn down once released, as
+// described by Borrow.
+func (mapper *Mapper) ClearFunc(destroy func(key Key, goValue interface{})) {
+	mapper.mux.Lock()
+	mappings := make([]mapping, 0, mapper.lenLocked())
+	mapper.eachLocked(func(key Key, e entry) bool {
+		mappings = append(mappings, mapping{key, e})
+		return true
+	})
+	mapper.clearLocked()
+	mapper.mux.Unlock()
+
+	sort.Slice(mappings, func(i, j int) bool {
+		return tearsDownBefore(mappings[i].e, mappings[j].e)
+	})
+	for _, m := range mappings {
+		m := m
+		m.e.borrow().after(func() {
+			if destroy != nil {
+				destroy(m.key, m.e.goValue())
+			}
+			m.e.close()
+		})
+	}
+}
+
+// Close tears down all mappings, as Clear does, and returns nil.  It lets a
+// Mapper be closed as an io.Closer, with the functions registered by
+// OnDelete destroying the wrapped C objects in teardown order; see
+// SetTeardownPriority.
+func (mapper *Mapper) Close() error {
+	mapper.Clear()
+	return nil
+}
+
+// mapping is a key and its entry.
+type mapping struct {
+	key Key
+	e   entry
+}
+
+// tearsDownBefore reports whether a is torn down before b.
+func tearsDownBefore(a, b entry) bool {
+	if a.priority() != b.priority() {
+		return a.priority() < b.priority()
+	}
+	return a.seq > b.seq
+}
+
+// sortTeardown sorts entries in teardown order.
+func sortTeardown(entries []entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return tearsDownBefore(entries[i], entries[j])
+	})
+}
+
+// ClearCounting deletes the mappings of keys returned by MapValue, and its
+// variants, leaving those of pointers, handles, and tokens untouched.
+// Functions registered by OnDelete are called in teardown order.
+func (mapper *Mapper) ClearCounting() {
+	bit := mapper.countingBit()
+	mapper.clearWhere(func(key Key, _ entry) bool {
+		return key.domain == 0 && key.v&bit != 0
+	})
+}
+
+// ClearPointers deletes the mappings of keys made from pointers, such as by
+// MapPtrPair, leaving others untouched.  After a C library is reset, the
+// pointers it returned are invalid, whereas long-lived registrations made
+// using MapValue survive.  Functions registered by OnDelete are called in
+// teardown order.
+func (mapper *Mapper) ClearPointers() {
+	bit := mapper.countingBit()
+	mapper.clearWhere(func(key Key, _ entry) bool {
+		return key.domain == 0 && key.v&bit == 0
+	})
+}
+
+// clearWhere deletes the mappings for which match returns true, closing them
+// in teardown order.  match is called with the write lock held.
+func (mapper *Mapper) clearWhere(match func(key Key, e entry) bool) {
+	var matched []Key
+	var closing []entry
+	mapper.mux.Lock()
+	mapper.eachLocked(func(key Key, e entry) bool {
+		if match(key, e) {
+			matched = append(matched, key)
+		}
+		return true
+	})
+	for _, key := range matched {
+		if e, _ := mapper.deleteLocked(key); e.release != nil {
+			closing = append(closing, e)
+		}
+	}
+	mapper.mux.Unlock()
+
+	sortTeardown(closing)
+	for _, e := range closing {
+		e.close()
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"runtime"
+	"time"
+)
+
+// maxCallers limits the C callers recorded for each mapping.
+const maxCallers = 4
+
+// Caller describes a retrieval of a mapping by Go code called back from C, as
+// recorded in debug mode.
+type Caller struct {
+	// Thread is the ID of the OS thread that made the callback.  It is zero
+	// where thread IDs are not supported.
+	Thread int `json:"thread,omitempty"`
+
+	// Foreign reports whether the thread was created by C, rather than by
+	// the Go runtime.
+	Foreign bool `json:"foreign,omitempty"`
+
+	// Time is when the mapping was retrieved.
+	Time time.Time `json:"time"`
+}
+
+// cCaller returns the Caller describing the calling goroutine if it is
+// running a callback from C, and false otherwise.
+func cCaller() (Caller, bool) {
+	var pc [64]uintptr
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc[:])])
+	callback := false
+	for {
+		f, more := frames.Next()
+		switch f.Function {
+		case "runtime.cgocallback":
+			callback = true
+		case "runtime.cgocall":
+			// The callback was made by C code called from Go.
+			if callback {
+				return Caller{Thread: threadID(), Time: time.Now()}, true
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	if !callback {
+		return Caller{}, false
+	}
+	// The stack of a callback on a thread created by C ends at the callback.
+	return Caller{Thread: threadID(), Foreign: true, Time: time.Now()}, true
+}
+
+// recentCallers returns the C callers recorded by d, most recent first.
+func (d *diagnostics) recentCallers() []Caller {
+	if d == nil {
+		return nil
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if len(d.callers) == 0 {
+		return nil
+	}
+	callers := make([]Caller, len(d.callers))
+	for i, c := range d.callers {
+		callers[len(callers)-1-i] = c
+	}
+	return callers
+}
+
+// called records a retrieval by a C callback, forgetting the oldest once
+// maxCallers are recorded.
+func (d *diagnostics) called(c Caller) {
+	d.mux.Lock()
+	if len(d.callers) == maxCallers {
+		copy(d.callers, d.callers[1:])
+		d.callers = d.callers[:maxCallers-1]
+	}
+	d.callers = append(d.callers, c)
+	d.mux.Unlock()
+}
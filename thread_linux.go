@@ -0,0 +1,12 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "syscall"
+
+// threadID returns the ID of the calling OS thread.
+func threadID() int {
+	return syscall.Gettid()
+}
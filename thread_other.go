@@ -0,0 +1,13 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package mapper
+
+// threadID returns zero, as thread IDs are not supported.
+func threadID() int {
+	return 0
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import "unsafe"
+
+// Domain distinguishes between kinds of integer tokens used as keys, such as
+// timer IDs and session IDs, so that equal tokens from different kinds never
+// collide.  Package users choose their own domains; see KeyFromUint.
+type Domain uint16
+
+// KeyFromUint converts an integer token from a C API, such as a timer or
+// session ID, to a Key in the given domain.
+//
+// The returned key never collides with a key in another domain, with a key
+// returned by MapValue, or with a key made from a pointer or handle, so
+// tokens can be mapped without worrying about the values C chooses.  Token
+// keys are not subject to the handle restrictions of options such as
+// WithReservedBits.
+//
+// Token keys cannot be passed to C as handles.  A token key's Handle is the
+// token itself, truncated to a uintptr, which KeyFromHandle, GetHandle, and
+// the other handle functions convert to a different key; C should instead
+// pass back the token, for the Go side to convert using KeyFromUint.
+func KeyFromUint(token uint64, domain Domain) Key {
+	key := Key{v: uintptr(token), domain: uint32(domain) + 1}
+	if unsafe.Sizeof(key.v) < 8 {
+		key.hi = uint32(token >> 32)
+	}
+	return key
+}
+
+// Token returns the token and domain of a key made by KeyFromUint.  The
+// result ok is false for other keys.
+func (k Key) Token() (token uint64, domain Domain, ok bool) {
+	if k.domain == 0 || k.domain == fdDomain {
+		return 0, 0, false
+	}
+	token = uint64(k.v)
+	if unsafe.Sizeof(k.v) < 8 {
+		token |= uint64(k.hi) << 32
+	}
+	return token, Domain(k.domain - 1), true
+}
@@ -0,0 +1,245 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Txn is a set of operations on one or more Mappers that Commit applies
+// atomically: either all succeed, or none is applied, and no other goroutine
+// observes a Mapper part way through.  This suits moving an object from a
+// session Mapper to a global Mapper while C callbacks race to look it up.
+//
+// The zero Txn is empty and ready to use.  A Txn must not be used
+// concurrently.
+type Txn struct {
+	ops []txnOp
+}
+
+// txnOp is an operation of a Txn: a mapping of key to e in mapper, a
+// deletion of key if del is set, or a move of key from mapper to the key to
+// in the Mapper dest if dest is set.
+type txnOp struct {
+	mapper *Mapper
+	key    Key
+	e      entry
+	del    bool
+	dest   *Mapper
+	to     Key
+}
+
+// isMap reports whether op maps a key, rather than deleting or moving one.
+func (op txnOp) isMap() bool {
+	return !op.del && op.dest == nil
+}
+
+// MapPair adds an operation that maps key to goValue in mapper, as
+// Mapper.MapPair does.
+func (tx *Txn) MapPair(mapper *Mapper, key Key, goValue interface{}) {
+	mapper.checkPair(key)
+	tx.ops = append(tx.ops, txnOp{mapper: mapper, key: key, e: entry{value: mapper.stored(goValue)}})
+}
+
+// MapValue adds an operation that maps goValue to a new key in mapper, as
+// Mapper.MapValue does, returning the key.  The key is allocated at once, but
+// is only mapped by Commit.
+func (tx *Txn) MapValue(mapper *Mapper, goValue interface{}) Key {
+	key := mapper.ReserveKeys(1).Key(0)
+	tx.ops = append(tx.ops, txnOp{mapper: mapper, key: key, e: entry{value: mapper.stored(goValue)}})
+	return key
+}
+
+// Delete adds an operation that deletes the mapping of key in mapper.  The
+// transaction fails if key is not mapped.
+func (tx *Txn) Delete(mapper *Mapper, key Key) {
+	tx.ops = append(tx.ops, txnOp{mapper: mapper, key: mapper.canonical(key), del: true})
+}
+
+// Move adds an operation that moves the mapping of key in the Mapper from to
+// a new key in the Mapper dest, returning the new key.  Functions registered
+// by OnDelete, remaining uses, indexes, borrows, and the teardown priority
+// move with the mapping, which joins the namespace of dest with the same name,
+// if any, and is torn down by dest if it is created using WithAutoClose.  The
+// transaction fails if key is not mapped, or the namespace of dest is for
+// another type.
+func (tx *Txn) Move(from *Mapper, key Key, dest *Mapper) Key {
+	to := dest.ReserveKeys(1).Key(0)
+	tx.ops = append(tx.ops, txnOp{mapper: from, key: from.canonical(key), dest: dest, to: to})
+	return to
+}
+
+// Commit applies the operations of the transaction atomically, and empties
+// it.  It returns an error, without applying any operation, if a key to be
+// deleted or moved is not mapped when Commit is called, or if a mapping is
+// rejected by the RateLimit of its Mapper, wrapping ErrRateLimited.
+func (tx *Txn) Commit() error {
+	ops := tx.ops
+	tx.ops = nil
+
+	// Take the tokens of the mappings before locking, as admit may wait for
+	// them, and return them if the transaction is aborted.
+	refund := func(ops []txnOp) {
+		for _, op := range ops {
+			if op.isMap() {
+				op.mapper.limit.refund(1)
+			}
+		}
+	}
+	for i, op := range ops {
+		if op.isMap() {
+			if err := op.mapper.admit(nil); err != nil {
+				refund(ops[:i])
+				return fmt.Errorf("transaction aborted: %w", err)
+			}
+		}
+	}
+
+	// Lock the Mappers in order of address, so that concurrent transactions
+	// never deadlock.
+	var mappers []*Mapper
+	seen := make(map[*Mapper]bool)
+	for _, op := range ops {
+		for _, m := range []*Mapper{op.mapper, op.dest} {
+			if m != nil && !seen[m] {
+				seen[m] = true
+				mappers = append(mappers, m)
+			}
+		}
+	}
+	sort.Slice(mappers, func(i, j int) bool {
+		return uintptr(unsafe.Pointer(mappers[i])) < uintptr(unsafe.Pointer(mappers[j]))
+	})
+	for i := range ops {
+		if ops[i].isMap() {
+			ops[i].mapper.sized(&ops[i].e)
+		}
+	}
+	for _, m := range mappers {
+		m.mux.Lock()
+	}
+	unlock := func() {
+		for i := len(mappers) - 1; i >= 0; i-- {
+			mappers[i].mux.Unlock()
+		}
+	}
+
+	// Validate against the state each operation will see, as earlier
+	// operations may map or delete the same keys.
+	type mapperKey struct {
+		mapper *Mapper
+		key    Key
+	}
+	mapped := make(map[mapperKey]bool)
+	isMapped := func(m *Mapper, key Key) bool {
+		if ok, known := mapped[mapperKey{m, key}]; known {
+			return ok
+		}
+		_, ok := m.loadLocked(key)
+		return ok
+	}
+	for _, op := range ops {
+		if op.del || op.dest != nil {
+			if !isMapped(op.mapper, op.key) {
+				unlock()
+				refund(ops)
+				return fmt.Errorf("transaction aborted: key not mapped: 0x%x", op.key.v)
+			}
+			mapped[mapperKey{op.mapper, op.key}] = false
+		} else {
+			mapped[mapperKey{op.mapper, op.key}] = true
+		}
+		if op.dest != nil {
+			mapped[mapperKey{op.dest, op.to}] = true
+			if e, ok := op.mapper.loadLocked(op.key); ok && e.ns() != nil && op.dest != op.mapper {
+				src := e.ns()
+				if ns, ok := op.dest.namespaces[src.name]; ok && ns.typ != src.typ {
+					unlock()
+					refund(ops)
+					return fmt.Errorf("transaction aborted: namespace %q of the destination is for %v, not %v", ns.name, ns.typ, src.typ)
+				}
+			}
+		}
+	}
+
+	// Lookups that skip the Mappers' locks must not observe them part way
+	// through.
+	for _, m := range mappers {
+		m.committing()
+	}
+	var closing []entry
+	for _, op := range ops {
+		switch {
+		case op.dest != nil:
+			e, _ := op.mapper.deleteLocked(op.key)
+			op.dest.mapLocked(op.to, op.mapper.movedLocked(e, op.dest, op.to))
+		case op.del:
+			if e, _ := op.mapper.deleteLocked(op.key); e.release != nil {
+				closing = append(closing, e)
+			}
+		default:
+			if old, replaced := op.mapper.mapLocked(op.key, op.e); replaced && old.release != nil {
+				closing = append(closing, old)
+			}
+		}
+	}
+	for _, m := range mappers {
+		m.committing()
+	}
+	unlock()
+
+	for _, e := range closing {
+		e.close()
+	}
+	for _, m := range mappers {
+		m.checkRetained()
+	}
+	return nil
+}
+
+// movedLocked returns the entry e, deleted from mapper, as it is to be mapped
+// by key in dest.  The fields tied to its mapping in mapper are cleared, for
+// mapLocked to set, and its namespace, size, and teardown become those of
+// dest.  The caller must hold the write locks of both Mappers.
+func (mapper *Mapper) movedLocked(e entry, dest *Mapper, key Key) entry {
+	e.created = time.Time{}
+	e.seq = 0
+	if e.diag() != nil {
+		e.writableExtra().diag = nil
+	}
+	if dest.sizer == nil {
+		e.size = 0
+	}
+	if ns := e.ns(); ns != nil && dest != mapper {
+		e.writableExtra().ns = dest.namespaceLocked(ns.name, ns.typ)
+	}
+	switch {
+	case e.closer() != nil:
+		c := e.closer()
+		c.mapper, c.key = dest, key
+	case e.release != nil && dest.teardown != nil:
+		// Tear down the value after the functions registered by OnDelete,
+		// as mapLocked only sets up a teardown for entries without them.
+		onDelete := e.release
+		dest.autoClose(key, &e)
+		teardown := e.release
+		e.release = func() {
+			onDelete()
+			teardown()
+		}
+	}
+	return e
+}
+
+// committing marks the start, or the end, of a Commit that modifies the
+// mapper, advancing its commit sequence number, which is odd part way
+// through.  The caller must hold the write lock.  See load.
+func (mapper *Mapper) committing() {
+	atomic.AddUint32(&mapper.commitSeq, 1)
+}
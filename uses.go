@@ -0,0 +1,53 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// MapValueUses is like MapValue, but the mapping is deleted by the nth
+// successful Get or Lookup of the key, or any of their variants.  Thereafter,
+// Get panics, and Lookup returns false, as for any unmapped key.
+//
+// This suits C APIs that call back a known number of times with the same
+// user pointer, such as once for each plane of a video frame, and then forget
+// it.  MapValueUses panics if n is less than one.
+func (mapper *Mapper) MapValueUses(goValue interface{}, n int) Key {
+	if n < 1 {
+		panic(fmt.Errorf("invalid number of uses: %d", n))
+	}
+	uses := int64(n)
+	key, err := mapper.mapCounting(entry{value: mapper.stored(goValue), uses: &uses})
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// use consumes one use of the entry e mapped by key, deleting the mapping on
+// its last use.  It returns false if no uses remain.
+func (mapper *Mapper) use(key Key, e entry) bool {
+	n := atomic.AddInt64(e.uses, -1)
+	if n < 0 {
+		return false
+	}
+	if n == 0 {
+		mapper.mux.Lock()
+		// The key may have been deleted, or mapped again, meanwhile.
+		cur, ok := mapper.loadLocked(key)
+		if ok && cur.uses == e.uses {
+			cur, _ = mapper.deleteLocked(key)
+		} else {
+			ok = false
+		}
+		mapper.mux.Unlock()
+		if ok {
+			cur.close()
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// versionBits is the number of handle bits holding the version of a Mapper
+// created using WithHandleVersion.
+const versionBits = 4
+
+// ErrHandleVersion is wrapped by the error that Get panics with when given a
+// counting-pointer handle of another version; see WithHandleVersion.
+var ErrHandleVersion = errors.New("handle version mismatch")
+
+// WithHandleVersion embeds version, from 1 to 15, in the top four bits of the
+// handles of keys returned by MapValue, and its variants.  Give each
+// incompatible version of a binding its own version, so that when a host and
+// a plugin linking different versions exchange handles, Get of a handle of
+// the other version fails fast, panicking with an error wrapping
+// ErrHandleVersion, rather than resolving to an unrelated value.
+//
+// The version bits are taken from the top of the handle space, as limited by
+// With32BitHandles or WithCompactHandles, leaving fewer keys for MapValue.
+func WithHandleVersion(version int) Option {
+	if version < 1 || version >= 1<<versionBits {
+		panic(fmt.Errorf("handle version out of range [1, %d]: %d", 1<<versionBits-1, version))
+	}
+	return func(mapper *Mapper) {
+		mapper.version = uint8(version)
+	}
+}
+
+// countingMax returns the largest counting-pointer handle, before its version
+// bits are set.
+func (mapper *Mapper) countingMax() uintptr {
+	max := mapper.handleMax()
+	if mapper.highBit {
+		max >>= 1
+	}
+	if mapper.version != 0 {
+		max >>= versionBits
+	}
+	if mapper.id != 0 {
+		max >>= idBits
+	}
+	return max >> mapper.generationBits
+}
+
+// handleMax returns the largest handle the Mapper may use.
+func (mapper *Mapper) handleMax() uintptr {
+	if mapper.maxHandle != 0 {
+		return mapper.maxHandle
+	}
+	return ^uintptr(0)
+}
+
+// countingHandle returns the handle of the plain counting-pointer handle v,
+// obfuscated and with its version and generation bits set.
+func (mapper *Mapper) countingHandle(v uintptr) uintptr {
+	tag, _ := mapper.handleTag()
+	return mapper.obfuscation().handle(v) | tag
+}
+
+// versionTag returns the version bits set in counting-pointer handles, and
+// the mask of the bits holding them.
+func (mapper *Mapper) versionTag() (tag, mask uintptr) {
+	if mapper.version == 0 {
+		return 0, 0
+	}
+	shift := uint(bits.Len(uint(mapper.countingMax()))) + mapper.generationBits
+	if mapper.id != 0 {
+		shift += idBits
+	}
+	return uintptr(mapper.version) << shift, (1<<versionBits - 1) << shift
+}
+
+// versionError returns an error if key is a counting-pointer key of another
+// version, and nil otherwise.
+func (mapper *Mapper) versionError(key Key) error {
+	tag, mask := mapper.versionTag()
+	if mask == 0 || key.domain != 0 || key.v&mapper.countingBit() == 0 || key.v&mask == tag {
+		return nil
+	}
+	shift := uint(bits.TrailingZeros(uint(mask)))
+	return fmt.Errorf("key not mapped: 0x%x has version %d, not %d; it may come from a "+
+		"plugin linking another version: %w", key.v, key.v&mask>>shift, mapper.version, ErrHandleVersion)
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 John Papandriopoulos.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mapper
+
+// EventKind is the kind of change to a mapping reported by Watch.
+type EventKind int
+
+const (
+	// Replaced reports that the key was mapped to a new value.
+	Replaced EventKind = iota + 1
+
+	// Deleted reports that the mapping was deleted, or cleared.
+	Deleted
+)
+
+// String returns the name of the kind.
+func (k EventKind) String() string {
+	switch k {
+	case Replaced:
+		return "replaced"
+	case Deleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// Event is a change to a watched mapping.
+type Event struct {
+	Key  Key
+	Kind EventKind
+}
+
+// watchBuffer is the number of events buffered for each watcher.
+const watchBuffer = 8
+
+// watcher receives the events of a watched key.
+type watcher struct {
+	ch     chan Event
+	closed bool
+}
+
+// Watch returns a channel that receives an Event each time the mapping for
+// key is replaced, and when it is deleted, after which the channel is
+// closed.  This lets supervisory goroutines react when the Go state of a C
+// object is torn down, without polling.  If key is not mapped, the channel
+// is closed at once.
+//
+// Events are sent without blocking the Mapper: if the watcher falls more
+// than a few events behind, Replaced events are dropped.  The closing of the
+// channel always reports deletion.  Call cancel to stop watching, and close
+// the channel, before the mapping is deleted.
+func (mapper *Mapper) Watch(key Key) (events <-chan Event, cancel func()) {
+	key = mapper.canonical(key)
+	w := &watcher{ch: make(chan Event, watchBuffer)}
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	if _, ok := mapper.loadLocked(key); !ok {
+		close(w.ch)
+		return w.ch, func() {}
+	}
+	if mapper.watchers == nil {
+		mapper.watchers = make(map[Key][]*watcher)
+	}
+	mapper.watchers[key] = append(mapper.watchers[key], w)
+	return w.ch, func() {
+		mapper.mux.Lock()
+		defer mapper.mux.Unlock()
+		if w.closed {
+			return
+		}
+		ws := mapper.watchers[key]
+		for i, other := range ws {
+			if other == w {
+				ws = append(ws[:i:i], ws[i+1:]...)
+				break
+			}
+		}
+		if len(ws) == 0 {
+			delete(mapper.watchers, key)
+		} else {
+			mapper.watchers[key] = ws
+		}
+		w.close()
+	}
+}
+
+// notifyLocked sends an event of the given kind to the watchers of key,
+// which stop watching once it is deleted.  The caller must hold the write
+// lock.
+func (mapper *Mapper) notifyLocked(key Key, kind EventKind) {
+	ws, ok := mapper.watchers[key]
+	if !ok {
+		return
+	}
+	for _, w := range ws {
+		select {
+		case w.ch <- Event{key, kind}:
+		default:
+		}
+		if kind == Deleted {
+			w.close()
+		}
+	}
+	if kind == Deleted {
+		delete(mapper.watchers, key)
+	}
+}
+
+// close closes the channel of w.  The caller must hold the write lock.
+func (w *watcher) close() {
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+}
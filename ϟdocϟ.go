@@ -51,6 +51,17 @@
 // mappings, instead of the global map `G`.
 //
 //
+// Typed Values
+//
+// Values are retrieved from a `Mapper` as `interface{}`, and each call site
+// must assert their type.  Where a mapper holds values of a single type, use
+// a `MapperOf[T]` instead: its `Get` returns a `T`, and it stores values
+// without boxing them in an interface.  To retrieve typed values from a
+// `Mapper`, which supports many more features, use `GetAs` and `LookupAs`,
+// whose panics name the expected and actual types, and `NamespaceOf` to group
+// the values of one type.
+//
+//
 // Relation to Go 1.17 and Up
 //
 // Go 1.17 introduced a new Handle type that is similar to the functionality